@@ -0,0 +1,67 @@
+package consul
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// ACL restricts the client subnets which may resolve the names of services.
+type ACL struct {
+	// Prefixes of the names of services that the ACL applies to, an empty
+	// list means that it applies to all services.
+	Prefixes []string
+
+	// Rules are matched in order against the address of clients, the first
+	// matching rule decides whether the query is allowed. Clients that match
+	// no rules are denied if the ACL has allow rules, and allowed otherwise.
+	Rules []ACLRule
+}
+
+// ACLRule allows or denies queries from clients in a subnet.
+type ACLRule struct {
+	Allow bool
+	Net   *net.IPNet
+}
+
+var (
+	errACLDenied = errors.New("denied by ACL")
+)
+
+// appliesTo returns true if the ACL applies to the service name.
+func (acl *ACL) appliesTo(name string) bool {
+	if len(acl.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range acl.Prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns true if the ACL allows queries from ip.
+func (acl *ACL) allows(ip net.IP) bool {
+	hasAllow := false
+
+	for _, rule := range acl.Rules {
+		if ip != nil && rule.Net.Contains(ip) {
+			return rule.Allow
+		}
+		hasAllow = hasAllow || rule.Allow
+	}
+
+	return !hasAllow
+}
+
+// allowed returns true if the client at ip may resolve the service name, which
+// requires all the ACLs that apply to the service to allow it.
+func (c *Consul) allowed(name string, ip net.IP) bool {
+	for i := range c.ACLs {
+		if acl := &c.ACLs[i]; acl.appliesTo(name) && !acl.allows(ip) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package consul
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// adminHandler returns the handler of the admin API of the plugin, requests
+// must be authenticated with token as bearer token.
+//
+// The API supports the following operations:
+//
+//	PURGE /cache
+//		flush the cache
+//	PURGE /cache/NAME[?tag=TAG&dc=DC&peer=PEER]
+//		invalidate the cached entries of a service
+//
+// DELETE is accepted as an alternative to the PURGE method.
+func (c *Consul) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache", c.servePurge)
+	mux.HandleFunc("/cache/", c.servePurge)
+	return authenticate(token, mux)
+}
+
+func authenticate(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[7:]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// startServer starts serving handler on addr, and returns the server so it
+// can be closed when the plugin shuts down.
+func startServer(addr string, handler http.Handler) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{Handler: handler}
+
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("[ERROR] consul http server on %s: %s", addr, err)
+		}
+	}()
+
+	return server, nil
+}
+
+func (c *Consul) servePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PURGE" && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "PURGE, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/cache"), "/"))
+	query := r.URL.Query()
+
+	match := func(k key) bool {
+		return (len(name) == 0 || k.name == name) &&
+			matchParam(query, "tag", k.tag) &&
+			matchParam(query, "id", k.id) &&
+			matchParam(query, "dc", k.dc) &&
+			matchParam(query, "peer", k.peer)
+	}
+
+	c.mutex.RLock()
+	cache := c.cache
+	c.mutex.RUnlock()
+
+	n := 0
+	if cache != nil {
+		n = cache.purge(match)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Purged int `json:"purged"`
+	}{n})
+}
+
+func matchParam(query map[string][]string, param string, value string) bool {
+	values, ok := query[param]
+	return !ok || (len(values) != 0 && strings.EqualFold(values[0], value))
+}
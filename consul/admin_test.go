@@ -0,0 +1,130 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminPurge(t *testing.T) {
+	now := time.Now()
+
+	keys := []key{
+		{name: "service-1", tag: "zone-1", dc: "dc1"},
+		{name: "service-1", tag: "zone-2", dc: "dc1"},
+		{name: "service-1", dc: "dc2"},
+		{name: "service-2", dc: "dc1"},
+	}
+
+	tests := []struct {
+		scenario string
+		method   string
+		path     string
+		token    string
+		status   int
+		purged   int
+	}{
+		{
+			scenario: "missing token",
+			method:   "PURGE",
+			path:     "/cache",
+			status:   http.StatusUnauthorized,
+		},
+
+		{
+			scenario: "invalid token",
+			method:   "PURGE",
+			path:     "/cache",
+			token:    "whatever",
+			status:   http.StatusUnauthorized,
+		},
+
+		{
+			scenario: "invalid method",
+			method:   http.MethodGet,
+			path:     "/cache",
+			token:    "secret",
+			status:   http.StatusMethodNotAllowed,
+		},
+
+		{
+			scenario: "flush",
+			method:   "PURGE",
+			path:     "/cache",
+			token:    "secret",
+			status:   http.StatusOK,
+			purged:   4,
+		},
+
+		{
+			scenario: "purge service",
+			method:   "PURGE",
+			path:     "/cache/service-1",
+			token:    "secret",
+			status:   http.StatusOK,
+			purged:   3,
+		},
+
+		{
+			scenario: "purge service with tag",
+			method:   http.MethodDelete,
+			path:     "/cache/service-1?tag=zone-1",
+			token:    "secret",
+			status:   http.StatusOK,
+			purged:   1,
+		},
+
+		{
+			scenario: "purge service in datacenter",
+			method:   "PURGE",
+			path:     "/cache/service-1?dc=dc1",
+			token:    "secret",
+			status:   http.StatusOK,
+			purged:   2,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.scenario, func(t *testing.T) {
+			cache := &cache{ttl: 1 * time.Minute}
+
+			for _, k := range keys {
+				e := cache.grab(k, now)
+				e.srv = []service{{port: 10001, node: "host-1"}}
+				close(e.ready)
+			}
+
+			consul := New()
+			consul.cache = cache
+
+			req := httptest.NewRequest(test.method, test.path, nil)
+			if len(test.token) != 0 {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			rec := httptest.NewRecorder()
+
+			consul.adminHandler("secret").ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Fatalf("Expected status %d but found: %d", test.status, rec.Code)
+			}
+
+			if test.status == http.StatusOK {
+				var res struct{ Purged int }
+				if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+					t.Fatal(err)
+				}
+				if res.Purged != test.purged {
+					t.Errorf("Expected %d entries to be purged but found: %d", test.purged, res.Purged)
+				}
+			}
+
+			if n := cache.len(); n != len(keys)-test.purged {
+				t.Errorf("Expected %d entries to remain in the cache but found: %d", len(keys)-test.purged, n)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package consul
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// breaker is a circuit breaker tracking the health of a single consul agent.
+//
+// The breaker opens after a configurable number of consecutive failures, at
+// which point requests to the agent are short-circuited until the cool-down
+// period expires. The breaker then becomes half-open and lets a single probe
+// request through, closing again if it succeeds or re-opening if it fails.
+type breaker struct {
+	mutex    sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	default:
+		return "half_open"
+	}
+}
+
+var breakerStates = [...]breakerState{breakerClosed, breakerOpen, breakerHalfOpen}
+
+var (
+	errCircuitOpen = errors.New("circuit breaker is open")
+)
+
+// allow returns true if a request may be sent to the agent at the given time,
+// the second return value is the state of the breaker after the call.
+func (b *breaker) allow(now time.Time, cooldown time.Duration) (bool, breakerState) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < cooldown {
+			return false, b.state
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true, b.state
+
+	case breakerHalfOpen:
+		if b.probing {
+			return false, b.state
+		}
+		b.probing = true
+		return true, b.state
+	}
+
+	return true, b.state
+}
+
+// isOpen returns true if the breaker is open.
+func (b *breaker) isOpen() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state == breakerOpen
+}
+
+// success records a successful request and closes the breaker.
+func (b *breaker) success() breakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+	return b.state
+}
+
+// failure records a failed request, opening the breaker if the probe of a
+// half-open breaker failed or if the threshold of consecutive failures was
+// reached.
+func (b *breaker) failure(now time.Time, threshold int) breakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	b.probing = false
+
+	if b.state == breakerHalfOpen || b.failures >= threshold {
+		b.state = breakerOpen
+		b.openedAt = now
+	}
+
+	return b.state
+}
@@ -2,115 +2,268 @@ package consul
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/miekg/dns"
 )
 
 type cache struct {
-	addr               string
+	client             *client
 	ttl                time.Duration
+	ttlNegative        time.Duration
+	ttlAdaptiveMin     time.Duration
+	ttlAdaptiveMax     time.Duration
+	timeout            time.Duration
 	prefetchAmount     int
 	prefetchPercentage int
 	prefetchDuration   time.Duration
-	transport          http.RoundTripper
-
-	mutex    sync.RWMutex
-	entries  map[key]*entry
-	lookups  atomicIndex
+	watch              bool
+	near               string
+	sequential         bool
+	sticky             bool
+	filter             string
+	health             string
+	nodeMeta           map[string]string
+	retry              retryPolicy
+	maxStale           time.Duration
+	maxMemory          int64
+	aggregate          bool
+	fetches            chan struct{} // bounds the number of concurrent fetches
+	signer             *signer       // signs responses when DNSSEC is enabled
+	invalidAddrLog     time.Duration // minimum interval between invalid address logs
+	packed             *packedCache  // responses of popular names, nil if disabled
+
+	// Requests to consul are bound to ctx, which is canceled when the cache
+	// is closed, and tracked by wg so closing waits for them to complete.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	shards   [cacheShards]cacheShard
+	flights  flightGroup  // fetches of services in flight, by key
+	mutex    sync.RWMutex // protects watches
+	watches  map[key]struct{}
 	cleanups atomicLock
+	bytes    int64
+
+	// Time in unix nanoseconds of the last log of instances dropped for their
+	// invalid addresses, see invalidAddrLog.
+	invalidAddrLogged int64
+}
+
+// The cache entries are spread across shards, each protected by its own mutex,
+// so concurrent lookups of different keys don't contend on a single lock.
+const cacheShards = 64
+
+type cacheShard struct {
+	mutex   sync.RWMutex
+	entries map[key]*entry
+}
+
+func (c *cache) shardOf(k key) *cacheShard {
+	return &c.shards[k.hash()%cacheShards]
+}
+
+// get returns the cache entry for k, or nil if there are none.
+func (c *cache) get(k key) *entry {
+	s := c.shardOf(k)
+	s.mutex.RLock()
+	e := s.entries[k]
+	s.mutex.RUnlock()
+	return e
+}
+
+// each calls f with all the entries of the cache, while holding a read lock on
+// the shard of each entry. f must not modify the cache.
+func (c *cache) each(f func(key, *entry)) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mutex.RLock()
+		for k, e := range s.entries {
+			f(k, e)
+		}
+		s.mutex.RUnlock()
+	}
+}
+
+// len returns the number of entries in the cache.
+func (c *cache) len() (n int) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mutex.RLock()
+		n += len(s.entries)
+		s.mutex.RUnlock()
+	}
+	return
 }
 
 func (c *cache) prefetchDeadlineOf(e *entry) time.Time {
-	d := float64(c.ttl) * (float64(c.prefetchPercentage) / 1000)
+	if e.negative {
+		// Negative entries have a short TTL, they are only refreshed when
+		// they expire.
+		return e.exp
+	}
+	d := float64(e.ttl) * (float64(c.prefetchPercentage) / 1000)
 	return e.exp.Add(-time.Duration(d))
 }
 
-func (c *cache) expirationTimeFrom(now time.Time) time.Time {
-	return now.Add(c.ttl + time.Duration(rand.Int63n(int64(c.ttl/2))))
+// staleDeadlineOf returns the time until which e may be served after it
+// expired, in case it could not be refreshed. Only entries holding services
+// are served stale, errors expire normally.
+func (c *cache) staleDeadlineOf(e *entry) time.Time {
+	if e.err != nil {
+		return e.exp
+	}
+	return e.exp.Add(c.maxStale)
+}
+
+func (c *cache) expirationTimeFrom(now time.Time, ttl time.Duration) time.Time {
+	return now.Add(ttl + time.Duration(rand.Int63n(int64(ttl/2)+1)))
+}
+
+// isNegative returns true if srv and err are the result of a lookup which
+// should be cached for the negative TTL.
+func (c *cache) isNegative(srv []service, err error) bool {
+	return c.ttlNegative > 0 && (err != nil || len(srv) == 0)
+}
+
+// ttlOf returns the TTL of the cache entry replacing e with the result of a
+// lookup. When the adaptive TTL is enabled, the TTL of services that changed
+// since the previous lookup is shortened, while the TTL of services which
+// did not change is extended.
+func (c *cache) ttlOf(e *entry, srv []service, index uint64, err error) time.Duration {
+	if c.isNegative(srv, err) {
+		return c.ttlNegative
+	}
+
+	if c.ttlAdaptiveMax == 0 || e.negative || e.err != nil || e.consulIndex == 0 {
+		return c.ttl
+	}
+
+	ttl := e.ttl
+	if index != e.consulIndex {
+		ttl /= 2
+	} else {
+		ttl *= 2
+	}
+
+	if ttl < c.ttlAdaptiveMin {
+		ttl = c.ttlAdaptiveMin
+	}
+	if ttl > c.ttlAdaptiveMax {
+		ttl = c.ttlAdaptiveMax
+	}
+	return ttl
+}
+
+// lookupStats carries information about how a lookup was served.
+type lookupStats struct {
+	cache   string        // "hit", "miss" or "prefetch_wait"
+	fetch   time.Duration // duration of the request to consul, if any
+	popular bool          // the entry is popular enough to be prefetched
 }
 
 func (c *cache) lookup(ctx context.Context, k key, now time.Time) (srv service, ttl time.Duration, err error) {
+	srv, ttl, _, err = c.lookupStats(ctx, k, now, nil)
+	return
+}
+
+// lookupStats is like lookup but also returns statistics about the lookup. The
+// client is the identity used to select the service with the sticky policy,
+// services are selected by round robin when it is empty.
+func (c *cache) lookupStats(ctx context.Context, k key, now time.Time, client []byte) (srv service, ttl time.Duration, stats lookupStats, err error) {
 	hit := true
-	m := k.metrics()
+	m := c.metricsOf(k)
 	e := c.grab(k, now)
 	i := e.index.incr() - 1
 
-	// Note: the implementation of this check should be changed to take prefetchAmount
-	// into account, but it requires maintaining more state to implement it right, which
-	// is not immediately needed since consul service names looked up in production are
-	// all very popular.
-	if i == 0 || (i >= uint32(c.prefetchAmount)) && now.After(c.prefetchDeadlineOf(e)) {
-		if e.lock.tryLock() {
-			t0 := time.Now()
-			srv, err := c.load(k)
-			t1 := time.Now()
-			e.lock.unlock()
-
-			if e.once.tryLock() {
-				e.srv = srv
-				e.err = err
-				close(e.ready)
-
-				if err == nil {
-					m.cacheSizeAddSuccess(1)
-				} else {
-					m.cacheSizeAddDenial(1)
-				}
-
-				hit = false
-				m.cacheMissesInc()
-				m.cacheServicesAdd(len(srv))
-
-			} else if err == nil {
-				c.update(k, &entry{
-					srv:   srv,
-					exp:   c.expirationTimeFrom(now),
-					ready: e.ready, // already closed
-					index: 1,       // can't be zero to avoid refetching on next lookup
-					once:  1,       // can't be zero to avoid closing the channel twice
-				})
-				m.cachePrefetchesInc()
-			}
+	// Only popular entries are prefetched, others are refreshed when a lookup
+	// happens after they expired.
+	popular := e.freq.update(c.prefetchDuration, now) >= c.prefetchAmount
+	stats.popular = popular
+
+	refresh := i == 0 || (popular && now.After(c.prefetchDeadlineOf(e))) || now.After(e.exp)
 
-			m.cacheFetchSizesObserve(len(srv))
-			m.cacheFetchDurationsObserve(t1.Sub(t0))
+	// Entries which could not be refreshed are served right away while they
+	// may be served stale, and only refreshed in the background once their
+	// retry time passed, so lookups don't wait for consul while it fails.
+	if retry := atomic.LoadInt64(&e.retry); refresh && retry != 0 && !now.After(c.staleDeadlineOf(e)) {
+		if now.UnixNano() >= retry {
+			c.flights.start(k, func() { c.refreshEntry(k, e, now) })
 		}
+		refresh = false
 	}
 
-	// Every 1000 lookups the cache removes expired entries.
-	if (c.lookups.incr() % 1000) == 0 {
-		if c.cleanups.tryLock() {
-			c.cleanup(now)
-			c.cleanups.unlock()
+	// Hits which waited for a request to consul, because they refreshed the
+	// entry or it was being fetched by another lookup, are reported apart.
+	waited := false
+
+	// Lookups wait for the fetches that they start, and for the fetches of
+	// entries which are not ready yet. When the fetch in flight was started
+	// for an entry which has since been replaced, the lookup starts its own.
+	for refresh || !e.isReady() {
+		var r *entry
+		var miss bool
+		var fetch time.Duration
+
+		done, started := c.flights.start(k, func() {
+			r, miss, fetch = c.refreshEntry(k, e, now)
+		})
+
+		if started || !e.isReady() {
+			waited = true
+
+			select {
+			case <-done:
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
 		}
-	}
 
-	if !e.isReady() {
-		select {
-		case <-e.ready:
-		case <-ctx.Done():
-			err = ctx.Err()
-			return
+		if started {
+			e, hit, stats.fetch = r, !miss, fetch
 		}
+
+		refresh = false
 	}
 
 	if n := len(e.srv); n != 0 {
-		srv = e.srv[i%uint32(n)]
+		switch {
+		case c.sequential:
+			srv = e.srv[0]
+		case c.sticky && len(client) != 0:
+			srv = sticky(e.srv, client)
+		default:
+			srv = weighted(e.srv, i)
+		}
 	}
 
 	ttl = e.exp.Sub(now)
 	err = e.err
 
+	if ttl < 0 {
+		ttl = 0
+		if err == nil {
+			m.cacheStaleInc()
+		}
+	}
+
 	if hit {
 		if err == nil {
 			m.cacheHitsIncSuccess()
@@ -119,75 +272,284 @@ func (c *cache) lookup(ctx context.Context, k key, now time.Time) (srv service,
 		}
 	}
 
+	switch {
+	case !hit:
+		stats.cache = "miss"
+	case waited:
+		stats.cache = "prefetch_wait"
+	default:
+		stats.cache = "hit"
+	}
+	return
+}
+
+// refreshEntry fetches the services of k and updates e with them, returning the
+// entry which holds the result, e itself or its replacement. miss is true if e
+// was filled for the first time. The entry is always ready when the method
+// returns, even if the fetch failed.
+func (c *cache) refreshEntry(k key, e *entry, now time.Time) (r *entry, miss bool, fetch time.Duration) {
+	m := c.metricsOf(k)
+	r = e
+
+	t0 := time.Now()
+	srv, index, err := c.loadSafe(k)
+	t1 := time.Now()
+
+	if c.watch && err == nil {
+		c.startWatch(k, index)
+	}
+
+	// Entries are only filled by flights, and there is a single flight per
+	// key, so the entry cannot get ready concurrently.
+	if !e.isReady() {
+		e.srv = srv
+		e.err = err
+		e.consulIndex = index
+		close(e.ready)
+
+		if err == nil {
+			m.cacheSizeAddSuccess(1)
+		} else {
+			m.cacheSizeAddDenial(1)
+		}
+
+		miss = true
+		m.cacheMissesInc()
+		m.cacheServicesAdd(len(srv))
+		c.bytesAdd(sizeOfServices(srv))
+
+		if c.isNegative(srv, err) {
+			// The expiration time of the entry was set for a positive
+			// result, replace it to expire sooner.
+			r = c.replace(k, e, srv, index, err, now)
+		}
+
+	} else if err == nil {
+		r = c.replace(k, e, srv, index, nil, now)
+		m.cachePrefetchesInc()
+
+	} else if now.After(c.staleDeadlineOf(e)) {
+		// The entry expired and could not be refreshed, errors are now
+		// reported instead of serving the last known services.
+		r = c.replace(k, e, nil, 0, err, now)
+
+	} else {
+		atomic.StoreInt64(&e.retry, now.Add(staleRetryBackoff).UnixNano())
+	}
+
+	fetch = t1.Sub(t0)
+	m.cacheFetchSizesObserve(len(srv))
+	m.cacheFetchDurationsObserve(fetch)
+
+	if c.maxMemory > 0 && atomic.LoadInt64(&c.bytes) > c.maxMemory {
+		if c.cleanups.tryLock() {
+			c.evict(now)
+			c.cleanups.unlock()
+		}
+	}
+
 	return
 }
 
 func (c *cache) grab(k key, now time.Time) (e *entry) {
-	c.mutex.RLock()
-	e = c.entries[k]
-	c.mutex.RUnlock()
+	s := c.shardOf(k)
+	s.mutex.RLock()
+	e = s.entries[k]
+	s.mutex.RUnlock()
 
 	if e == nil {
-		c.mutex.Lock()
+		s.mutex.Lock()
 
-		if e = c.entries[k]; e == nil {
-			if c.entries == nil {
-				c.entries = make(map[key]*entry)
+		if e = s.entries[k]; e == nil {
+			if s.entries == nil {
+				s.entries = make(map[key]*entry)
 			}
 
 			e = &entry{
-				exp:   c.expirationTimeFrom(now),
-				ready: make(chan struct{}),
+				exp:     c.expirationTimeFrom(now, c.ttl),
+				ttl:     c.ttl,
+				updated: now,
+				freq:    &frequency{},
+				ready:   make(chan struct{}),
 			}
 
-			c.entries[k] = e
+			s.entries[k] = e
+			c.bytesAdd(sizeOfEntry(k))
 		}
 
-		c.mutex.Unlock()
+		s.mutex.Unlock()
 	}
 
 	return e
 }
 
 func (c *cache) update(k key, e *entry) {
-	c.mutex.Lock()
-	c.entries[k] = e
-	c.mutex.Unlock()
+	s := c.shardOf(k)
+	s.mutex.Lock()
+	s.entries[k] = e
+	s.mutex.Unlock()
 }
 
-func (c *cache) load(k key) ([]service, error) {
-	u := c.addr + "/v1/health/service/" + url.QueryEscape(k.name) + "?passing"
-	if len(k.tag) != 0 {
-		u += "&tag=" + url.QueryEscape(k.tag)
+// insert adds e to the cache unless there is already an entry for k, and
+// returns whether e was added.
+func (c *cache) insert(k key, e *entry) bool {
+	s := c.shardOf(k)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.entries[k] != nil {
+		return false
+	}
+	if s.entries == nil {
+		s.entries = make(map[key]*entry)
+	}
+	s.entries[k] = e
+	return true
+}
+
+// replace updates the cache entry for k with the result of refreshing e,
+// returning the new entry.
+func (c *cache) replace(k key, e *entry, srv []service, index uint64, err error, now time.Time) *entry {
+	// The entry may still be getting filled by the goroutine which created it.
+	<-e.ready
+
+	ttl := c.ttlOf(e, srv, index, err)
+	r := &entry{
+		srv:         srv,
+		err:         err,
+		exp:         c.expirationTimeFrom(now, ttl),
+		ttl:         ttl,
+		updated:     now,
+		freq:        e.freq,
+		negative:    c.isNegative(srv, err),
+		consulIndex: index,
+		ready:       e.ready, // already closed
+		index:       1,       // can't be zero to avoid refetching on next lookup
+	}
+	c.update(k, r)
+
+	m := c.metricsOf(k)
+	if (e.err == nil) != (err == nil) {
+		if err == nil {
+			m.cacheSizeAddDenial(-1)
+			m.cacheSizeAddSuccess(1)
+		} else {
+			m.cacheSizeAddSuccess(-1)
+			m.cacheSizeAddDenial(1)
+		}
+	}
+	m.cacheServicesAdd(len(srv) - len(e.srv))
+	c.bytesAdd(sizeOfServices(srv) - sizeOfServices(e.srv))
+	return r
+}
+
+// load fetches the list of healthy services for k, retrying on failures as
+// configured by the retry policy of the cache.
+func (c *cache) load(k key) (srv []service, index uint64, err error) {
+	for attempt := 1; ; attempt++ {
+		srv, index, err = c.fetch(k, 0, 0)
+
+		if err == nil || attempt >= c.retry.attempts || !c.retry.retryable(err) {
+			return
+		}
+
+		c.metricsOf(k).cacheRetriesInc()
+		time.Sleep(c.retry.delay(attempt))
+	}
+}
+
+// loadSafe is like load but reports panics as errors, a crashed fetch must not
+// leave lookups waiting for entries which never get filled.
+func (c *cache) loadSafe(k key) (srv []service, index uint64, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			srv, index, err = nil, 0, fmt.Errorf("panic fetching %s: %v", k, p)
+			log.Printf("[ERROR] %s\n%s", err, debug.Stack())
+		}
+	}()
+	return c.load(k)
+}
+
+// fetch queries the list of healthy services for k. When index is not zero the
+// request is sent as a consul blocking query which returns when the state of
+// the service changes, or after the wait duration elapsed.
+func (c *cache) fetch(k key, index uint64, wait time.Duration) ([]service, uint64, error) {
+	q := url.Values{}
+	if c.health == healthPassing {
+		q.Set("passing", "")
+	}
+	tag := k.tag
+	if len(c.filter) != 0 {
+		filter := c.filter
+		if strings.Contains(filter, filterTag) {
+			// Names without a tag match all the instances of the service
+			// which satisfy the clauses of the filter that don't use the
+			// tag, an expression comparing to an empty tag would be rejected
+			// by consul.
+			if len(tag) == 0 {
+				filter, _ = untaggedFilter(filter)
+			}
+			filter, tag = strings.Replace(filter, filterTag, tag, -1), ""
+		}
+		if len(filter) != 0 {
+			q.Set("filter", filter)
+		}
+	}
+	if len(tag) != 0 {
+		q.Set("tag", tag)
 	}
 	if len(k.dc) != 0 {
-		u += "&dc=" + url.QueryEscape(k.dc)
+		q.Set("dc", k.dc)
+	}
+	if len(k.peer) != 0 {
+		q.Set("peer", k.peer)
+	}
+	if len(c.near) != 0 {
+		q.Set("near", c.near)
+	}
+	for k, v := range c.nodeMeta {
+		q.Add("node-meta", k+":"+v)
 	}
 
-	req, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return nil, err
+	timeout := c.timeout
+	if index != 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", wait.String())
+		// Consul adds a random jitter of up to wait/16 to blocking queries.
+		timeout += wait + wait/16
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), c.ttl)
+	c.wg.Add(1)
+	defer c.wg.Done()
+
+	ctx, cancel := context.WithTimeout(c.context(), timeout)
 	defer cancel()
 
-	res, err := c.transport.RoundTrip(req.WithContext(ctx))
+	if index == 0 {
+		if c.fetches != nil {
+			if !c.acquireFetch(ctx) {
+				return nil, 0, errTooManyRequests
+			}
+			defer func() { <-c.fetches }()
+		}
+		cacheInflightFetchesAdd(1)
+		defer cacheInflightFetchesAdd(-1)
+	}
+
+	res, err := c.client.get(ctx, "/v1/health/service/"+url.QueryEscape(k.name)+"?"+q.Encode())
 	if err != nil {
-		return nil, err
+		fetchErrorsInc(errorCause(err), "")
+		return nil, 0, err
 	}
 	if res.StatusCode != http.StatusOK {
 		res.Body.Close()
-		return nil, httpError(res)
+		err = httpError(res)
+		fetchErrorsInc(errorCause(err), strconv.Itoa(res.StatusCode))
+		return nil, 0, err
 	}
 
-	var endpoints = make([]consulHealthService, 0, 100)
-	if err := json.NewDecoder(res.Body).Decode(&endpoints); err != nil {
-		return nil, err
-	}
-	if err := res.Body.Close(); err != nil {
-		return nil, err
-	}
+	index, _ = strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	c.observeConsulHeaders(k, res.Header, index)
 
 	var isOK = isIP
 	switch k.qtype {
@@ -197,66 +559,468 @@ func (c *cache) load(k key) ([]service, error) {
 		isOK = isIPv6
 	}
 
-	var services = make([]service, 0, len(endpoints))
-	for _, endpoint := range endpoints {
-		if ip := net.ParseIP(endpoint.Service.Address); isOK(ip) {
+	var services []service
+	var invalid []consulHealthService
+
+	// Instances are converted to services as they are decoded, the response
+	// of services with many instances is never held in memory.
+	err = decodeHealthServices(res.Body, func(endpoint *consulHealthService) {
+		if c.health == healthWarning && endpoint.isCritical() {
+			return
+		}
+		// Names are looked up in lower case, so IDs are matched regardless
+		// of their case.
+		if len(k.id) != 0 && !strings.EqualFold(endpoint.Service.ID, k.id) {
+			return
+		}
+		address, port := endpoint.Service.Address, endpoint.Service.Port
+		if tagged, ok := endpoint.Service.TaggedAddresses[k.addr]; ok && len(k.addr) != 0 {
+			address, port = tagged.Address, tagged.Port
+		}
+		ip := net.ParseIP(address)
+		if ip == nil {
+			// The memory of endpoint is reused, only the fields which are
+			// reported are copied.
+			invalid = append(invalid, consulHealthService{
+				Node:    consulNode{Node: endpoint.Node.Node},
+				Service: consulService{ID: endpoint.Service.ID, Address: address},
+			})
+			return
+		}
+		if isOK(ip) {
 			services = append(services, service{
-				addr: ip,
-				port: endpoint.Service.Port,
-				node: dns.Fqdn(join(endpoint.Node.Node, "node", endpoint.Node.Datacenter, "consul")),
+				addr:   ip,
+				port:   port,
+				node:   dns.Fqdn(join(endpoint.Node.Node, "node", endpoint.Node.Datacenter, "consul")),
+				weight: endpoint.weight(),
 			})
 		}
+	})
+	if err != nil {
+		res.Body.Close()
+		fetchErrorsInc(causeDecode, "")
+		return nil, 0, err
+	}
+	if err := res.Body.Close(); err != nil {
+		fetchErrorsInc(errorCause(err), "")
+		return nil, 0, err
+	}
+
+	if len(invalid) != 0 {
+		c.reportInvalidAddrs(k, invalid, time.Now())
+	}
+	// When services are sorted by proximity the order must be preserved,
+	// otherwise they are shuffled to spread the load across instances.
+	if len(c.near) == 0 {
+		for i := range services {
+			j := rand.Intn(len(services))
+			services[i], services[j] = services[j], services[i]
+		}
+	}
+	return services, index, nil
+}
+
+// reportInvalidAddrs counts the instances of k which were dropped because their
+// address could not be parsed, and logs them at most once per invalidAddrLog.
+func (c *cache) reportInvalidAddrs(k key, invalid []consulHealthService, now time.Time) {
+	c.metricsOf(k).cacheInvalidAddrsAdd(len(invalid))
+
+	if c.invalidAddrLog <= 0 {
+		return
+	}
+
+	last := atomic.LoadInt64(&c.invalidAddrLogged)
+	if last != 0 && now.Sub(time.Unix(0, last)) < c.invalidAddrLog {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&c.invalidAddrLogged, last, now.UnixNano()) {
+		return // another fetch is logging
+	}
+
+	for _, endpoint := range invalid {
+		log.Printf("[WARN] dropped instance %q of consul service %s on node %s with invalid address %q",
+			endpoint.Service.ID, k.name, endpoint.Node.Node, endpoint.Service.Address)
+	}
+}
+
+// observeConsulHeaders exports the state of the consul servers reported in
+// the headers of a response fetching the services of k.
+func (c *cache) observeConsulHeaders(k key, h http.Header, index uint64) {
+	m := c.metricsOf(k)
+
+	if index != 0 {
+		m.cacheConsulIndexSet(index)
 	}
-	for i := range services {
-		j := rand.Intn(len(services))
-		services[i], services[j] = services[j], services[i]
+
+	if knownLeader, err := strconv.ParseBool(h.Get("X-Consul-KnownLeader")); err == nil {
+		m.cacheKnownLeaderSet(knownLeader)
+	}
+
+	// The last contact is reported in milliseconds.
+	if lastContact, err := strconv.ParseUint(h.Get("X-Consul-LastContact"), 10, 64); err == nil {
+		m.cacheLastContactSet(time.Duration(lastContact) * time.Millisecond)
 	}
-	return services, nil
+}
+
+// context returns the context that requests to consul are bound to.
+func (c *cache) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// close cancels the requests to consul and the watches of the cache, waits
+// for them to return, then releases the idle connections of the client.
+func (c *cache) close() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.wg.Wait()
+	c.client.closeIdleConnections()
+}
+
+// acquireFetch waits for a slot to send a request to consul when the number of
+// concurrent fetches is limited, and returns false if ctx expired first.
+func (c *cache) acquireFetch(ctx context.Context) bool {
+	cacheFetchQueueAdd(1)
+	defer cacheFetchQueueAdd(-1)
+
+	select {
+	case c.fetches <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// startWatch launches a goroutine maintaining a blocking query on k, unless
+// one is already running for this key.
+func (c *cache) startWatch(k key, index uint64) {
+	if index == 0 {
+		return // the agent did not return X-Consul-Index, blocking is not supported
+	}
+
+	c.mutex.Lock()
+	_, running := c.watches[k]
+	if !running {
+		if c.watches == nil {
+			c.watches = make(map[key]struct{})
+		}
+		c.watches[k] = struct{}{}
+	}
+	c.mutex.Unlock()
+
+	if !running {
+		c.wg.Add(1)
+		go c.runWatch(k, index)
+	}
+}
+
+// runWatch keeps the cache entry of k up to date by issuing blocking queries
+// to consul and replacing the cached services as soon as a change is reported.
+// The watch stops when the entry expires or gets removed from the cache, so
+// only keys that are still being looked up are watched.
+func (c *cache) runWatch(k key, index uint64) {
+	defer c.wg.Done()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.watches, k)
+		c.mutex.Unlock()
+	}()
+
+	backoff := time.Duration(0)
+	ctx := c.context()
+
+	for {
+		srv, next, err := c.fetch(k, index, watchWait)
+		if err != nil {
+			if backoff = 2*backoff + watchBackoff; backoff > c.ttl {
+				backoff = c.ttl
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if !c.isWatched(k, time.Now()) {
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		switch {
+		case next == 0:
+			return
+		case next == index:
+			// The wait duration expired without any changes.
+			if !c.isWatched(k, time.Now()) {
+				return
+			}
+			continue
+		}
+
+		if !c.refresh(k, srv, time.Now()) {
+			return
+		}
+
+		// When the index goes backward the consul documentation recommends
+		// resetting it, which issues a non-blocking query on the next round.
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+func (c *cache) isWatched(k key, now time.Time) bool {
+	e := c.get(k)
+	return e != nil && e.isReady() && now.Before(e.exp)
+}
+
+// refresh replaces the services of the cache entry for k, preserving its
+// expiration time. The method returns false if the entry has expired or was
+// removed from the cache.
+func (c *cache) refresh(k key, srv []service, now time.Time) bool {
+	s := c.shardOf(k)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	e := s.entries[k]
+	if e == nil || !e.isReady() || !now.Before(e.exp) {
+		return false
+	}
+
+	s.entries[k] = &entry{
+		srv:         srv,
+		exp:         e.exp,
+		ttl:         e.ttl,
+		updated:     now,
+		freq:        e.freq,
+		negative:    e.negative,
+		consulIndex: e.consulIndex,
+		ready:       e.ready, // already closed
+		index:       1,       // can't be zero to avoid refetching on next lookup
+	}
+
+	m := c.metricsOf(k)
+	m.cacheServicesAdd(len(srv) - len(e.srv))
+	m.cacheWatchUpdatesInc()
+	c.bytesAdd(sizeOfServices(srv) - sizeOfServices(e.srv))
+	return true
 }
 
 // cleanup removes all expired cache entries. The implementation optimizes for
 // creating opportunities for other goroutines to get scheduled by frequently
-// releasing and reacquiring locks on the cache mutex.
+// releasing and reacquiring locks on the cache shards.
 func (c *cache) cleanup(now time.Time) {
-	c.mutex.RLock()
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mutex.RLock()
 
-	for k, e := range c.entries {
-		c.mutex.RUnlock()
+		for k, e := range s.entries {
+			s.mutex.RUnlock()
 
-		if now.After(e.exp) && e.isReady() {
-			removed := false
-
-			c.mutex.Lock()
-			// In case the entries map was modified concurrently, we make
-			// sure that the e we've seen is still the one in the cache.
-			if c.entries[k] == e {
-				delete(c.entries, k)
-				removed = true
-			}
-			c.mutex.Unlock()
-
-			if removed {
-				m := k.metrics()
-				if e.err == nil {
-					m.cacheSizeAddDenial(-1)
-				} else {
-					m.cacheSizeAddSuccess(-1)
-				}
-				m.cacheServicesAdd(-len(e.srv))
+			if now.After(c.staleDeadlineOf(e)) && e.isReady() {
+				c.remove(k, e, expired)
 			}
+
+			s.mutex.RLock()
+		}
+
+		s.mutex.RUnlock()
+	}
+
+	if c.signer != nil {
+		c.signer.cleanup(now)
+	}
+}
+
+// evict removes cache entries until the memory used by the cache goes below
+// the configured limit. Entries are evicted by order of expiration, so the
+// ones which are about to be refreshed are evicted first.
+func (c *cache) evict(now time.Time) {
+	type evictable struct {
+		k key
+		e *entry
+	}
+
+	var entries []evictable
+	c.each(func(k key, e *entry) {
+		if e.isReady() {
+			entries = append(entries, evictable{k, e})
+		}
+	})
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].e.exp.Before(entries[j].e.exp)
+	})
+
+	for _, x := range entries {
+		if atomic.LoadInt64(&c.bytes) <= c.maxMemory {
+			break
+		}
+
+		c.remove(x.k, x.e, memory)
+	}
+}
+
+// purge removes all the cache entries for which match returns true, and
+// returns the number of entries removed.
+func (c *cache) purge(match func(key) bool) (n int) {
+	type purgeable struct {
+		k key
+		e *entry
+	}
+
+	var entries []purgeable
+	c.each(func(k key, e *entry) {
+		if e.isReady() && match(k) {
+			entries = append(entries, purgeable{k, e})
 		}
+	})
 
-		c.mutex.RLock()
+	for _, x := range entries {
+		if c.remove(x.k, x.e, purged) {
+			n++
+		}
 	}
 
-	c.mutex.RUnlock()
+	return
+}
+
+// remove deletes the entry e for k from the cache, unless it was replaced
+// concurrently, and records the reason of the eviction. The method returns
+// true if the entry was removed.
+func (c *cache) remove(k key, e *entry, reason string) bool {
+	s := c.shardOf(k)
+	s.mutex.Lock()
+	removed := s.entries[k] == e
+	if removed {
+		delete(s.entries, k)
+	}
+	s.mutex.Unlock()
+
+	if removed {
+		m := c.metricsOf(k)
+		if e.err == nil {
+			m.cacheSizeAddSuccess(-1)
+		} else {
+			m.cacheSizeAddDenial(-1)
+		}
+		m.cacheServicesAdd(-len(e.srv))
+		m.cacheEvictionsInc(reason)
+		c.bytesAdd(-(sizeOfEntry(k) + sizeOfServices(e.srv)))
+	}
+
+	return removed
+}
+
+func (c *cache) bytesAdd(n int) {
+	atomic.AddInt64(&c.bytes, int64(n))
+	cacheBytesAdd(n)
+}
+
+// sizeOfEntry returns the approximate number of bytes used by an empty cache
+// entry for k, including the key.
+func sizeOfEntry(k key) int {
+	return int(unsafe.Sizeof(k)+unsafe.Sizeof(entry{})) + len(k.name) + len(k.tag) + len(k.dc) + len(k.peer)
+}
+
+// weighted returns the service of srv selected by the i-th lookup, services are
+// selected in proportion to their weight, or in turn when they all have the
+// same weight.
+func weighted(srv []service, i uint32) service {
+	total, uniform := 0, true
+	for _, s := range srv {
+		total += s.weight
+		uniform = uniform && s.weight == srv[0].weight
+	}
+
+	if uniform || total <= 0 {
+		return srv[i%uint32(len(srv))]
+	}
+
+	// The lookup index is scrambled so consecutive lookups are spread across
+	// the services instead of hitting each one weight times in a row.
+	n := int(mix64(uint64(i)) % uint64(total))
+	for _, s := range srv {
+		if n < s.weight {
+			return s
+		}
+		n -= s.weight
+	}
+	return srv[len(srv)-1]
+}
+
+// sizeOfServices returns the approximate number of bytes used by srv.
+func sizeOfServices(srv []service) (n int) {
+	for _, s := range srv {
+		n += int(unsafe.Sizeof(s)) + len(s.addr) + len(s.node)
+	}
+	return
 }
 
 func httpError(res *http.Response) error {
 	req := res.Request
-	return fmt.Errorf("%s %s: %s", req.Method, req.URL, res.Status)
+	return &statusError{
+		msg:  fmt.Sprintf("%s %s: %s", req.Method, req.URL, res.Status),
+		code: res.StatusCode,
+	}
+}
+
+// Causes of failed requests to consul, reported by the fetch errors metric.
+const (
+	causeTimeout           = "timeout"
+	causeConnectionRefused = "connection_refused"
+	causeCircuitOpen       = "circuit_open"
+	causeCanceled          = "canceled"
+	causeClientError       = "4xx"
+	causeServerError       = "5xx"
+	causeStatus            = "status"
+	causeDecode            = "decode"
+	causeOther             = "other"
+)
+
+// errorCause classifies errors returned by requests to consul.
+func errorCause(err error) string {
+	if e, ok := err.(*statusError); ok {
+		switch {
+		case e.code >= 500:
+			return causeServerError
+		case e.code >= 400:
+			return causeClientError
+		default:
+			return causeStatus
+		}
+	}
+
+	switch {
+	case err == errCircuitOpen:
+		return causeCircuitOpen
+	case errors.Is(err, context.Canceled):
+		return causeCanceled
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return causeConnectionRefused
+	}
+
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return causeTimeout
+	}
+
+	return causeOther
 }
 
+// statusError is the type of errors returned when consul responds with an
+// unexpected status code.
+type statusError struct {
+	msg  string
+	code int
+}
+
+func (e *statusError) Error() string { return e.msg }
+
 func join(parts ...string) string {
 	b := make([]byte, 0, 10*len(parts))
 
@@ -275,12 +1039,45 @@ func join(parts ...string) string {
 type key struct {
 	name  string
 	tag   string
+	id    string // ID of a single service instance
+	addr  string // tagged address used instead of the service address
 	dc    string
+	peer  string
 	qtype uint16
 }
 
+// hash returns the FNV-1a hash of k.
+func (k key) hash() uint32 {
+	const prime = 16777619
+	h := uint32(2166136261)
+
+	for _, s := range [...]string{k.name, k.tag, k.id, k.addr, k.dc, k.peer} {
+		for i := 0; i < len(s); i++ {
+			h = (h ^ uint32(s[i])) * prime
+		}
+		h *= prime // separates the strings, so ("ab", "") and ("a", "b") differ
+	}
+
+	h = (h ^ uint32(k.qtype&0xFF)) * prime
+	h = (h ^ uint32(k.qtype>>8)) * prime
+	return h
+}
+
+// metricsOf returns the metrics of k, which are not labeled by dc, tag and
+// name when the cache is configured to aggregate its metrics.
+func (c *cache) metricsOf(k key) metrics {
+	if c.aggregate {
+		return metrics{}
+	}
+	return k.metrics()
+}
+
 func (k key) metrics() metrics {
-	return metrics{name: k.name, tag: k.tag, dc: k.dc}
+	dc := k.dc
+	if len(k.peer) != 0 {
+		dc = k.peer + ".peer"
+	}
+	return metrics{name: k.name, tag: k.tag, dc: dc}
 }
 
 func (k key) String() string {
@@ -293,6 +1090,11 @@ func (k key) String() string {
 		b = append(b, '.')
 	}
 
+	if len(k.id) != 0 {
+		b = append(b, k.id...)
+		b = append(b, ".instance."...)
+	}
+
 	b = append(b, k.name...)
 	b = append(b, ".service"...)
 
@@ -301,14 +1103,21 @@ func (k key) String() string {
 		b = append(b, k.dc...)
 	}
 
+	if len(k.peer) != 0 {
+		b = append(b, '.')
+		b = append(b, k.peer...)
+		b = append(b, ".peer"...)
+	}
+
 	b = append(b, ".consul"...)
 	return string(b)
 }
 
 type service struct {
-	addr net.IP
-	port int
-	node string
+	addr   net.IP
+	port   int
+	node   string
+	weight int
 }
 
 func (s service) header(name string, rrtype uint16, ttl time.Duration) dns.RR_Header {
@@ -316,10 +1125,16 @@ func (s service) header(name string, rrtype uint16, ttl time.Duration) dns.RR_He
 		Name:   name,
 		Rrtype: rrtype,
 		Class:  dns.ClassINET,
-		Ttl:    1 + uint32(ttl.Truncate(time.Second)/time.Second),
+		Ttl:    ttlSeconds(ttl),
 	}
 }
 
+// ttlSeconds returns the TTL of records valid for ttl, rounded up to the next
+// second.
+func ttlSeconds(ttl time.Duration) uint32 {
+	return 1 + uint32(ttl.Truncate(time.Second)/time.Second)
+}
+
 func (s service) A(name string, ttl time.Duration) *dns.A {
 	return &dns.A{
 		Hdr: s.header(name, dns.TypeA, ttl),
@@ -352,13 +1167,48 @@ func (s service) ANY(name string, ttl time.Duration) dns.RR {
 }
 
 type entry struct {
-	srv   []service
-	err   error
-	exp   time.Time
-	ready chan struct{}
-	index atomicIndex
-	lock  atomicLock
-	once  atomicLock
+	srv         []service
+	err         error
+	exp         time.Time
+	ttl         time.Duration
+	updated     time.Time
+	freq        *frequency
+	negative    bool
+	consulIndex uint64
+	ready       chan struct{}
+	index       atomicIndex
+	// Time in nanoseconds since the epoch before which the entry is not
+	// refreshed again after a refresh failed, zero if it never failed.
+	retry int64
+}
+
+// frequency tracks the popularity of cache entries, counting the number of
+// lookups seen with no gaps longer than a given duration between them.
+type frequency struct {
+	mutex sync.Mutex
+	last  time.Time
+	hits  int
+}
+
+// update records a lookup at the given time, and returns the number of hits.
+func (f *frequency) update(gap time.Duration, now time.Time) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if now.Sub(f.last) >= gap {
+		f.hits = 0
+	}
+
+	f.last = now
+	f.hits++
+	return f.hits
+}
+
+// lastUpdate returns the time of the last lookup recorded.
+func (f *frequency) lastUpdate() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.last
 }
 
 func (e *entry) isReady() bool {
@@ -374,6 +1224,38 @@ func (e *entry) isReady() bool {
 type consulHealthService struct {
 	Node    consulNode
 	Service consulService
+	Checks  []consulCheck
+}
+
+func (s *consulHealthService) isCritical() bool {
+	for _, check := range s.Checks {
+		if check.Status == healthCritical {
+			return true
+		}
+	}
+	return false
+}
+
+// weight returns the weight of the service in the current state of its health
+// checks, services registered without weights have a weight of 1.
+func (s *consulHealthService) weight() (w int) {
+	weights := s.Service.Weights
+	if weights == (consulServiceWeights{}) {
+		return 1
+	}
+
+	w = weights.Passing
+	for _, check := range s.Checks {
+		if check.Status == healthWarning {
+			w = weights.Warning
+			break
+		}
+	}
+
+	if w < 0 {
+		w = 0
+	}
+	return
 }
 
 type consulNode struct {
@@ -382,10 +1264,38 @@ type consulNode struct {
 }
 
 type consulService struct {
+	ID              string
+	Address         string
+	Port            int
+	TaggedAddresses map[string]consulServiceAddress
+	Weights         consulServiceWeights
+}
+
+type consulServiceWeights struct {
+	Passing int
+	Warning int
+}
+
+type consulServiceAddress struct {
 	Address string
 	Port    int
 }
 
+type consulCheck struct {
+	Status string
+}
+
+const (
+	// Maximum duration of blocking queries issued by watches.
+	watchWait = 5 * time.Minute
+	// Initial delay before retrying a failed blocking query.
+	watchBackoff = 1 * time.Second
+	// Delay before retrying to refresh an entry which could not be refreshed.
+	staleRetryBackoff = 1 * time.Second
+	// Placeholder replaced by the queried tag in filter expressions.
+	filterTag = "{tag}"
+)
+
 var (
 	errTooManyRequests = errors.New("too many requests")
 )
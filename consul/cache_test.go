@@ -2,13 +2,1192 @@ package consul
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
+func TestCacheFilter(t *testing.T) {
+	tests := []struct {
+		filter         string
+		tag            string
+		expectedFilter string
+		expectedTag    string
+	}{
+		{
+			filter:         "",
+			tag:            "zone-1",
+			expectedFilter: "",
+			expectedTag:    "zone-1",
+		},
+
+		{
+			filter:         "Service.Meta.env == prod",
+			tag:            "zone-1",
+			expectedFilter: "Service.Meta.env == prod",
+			expectedTag:    "zone-1",
+		},
+
+		{
+			filter:         "Service.Meta.zone == {tag}",
+			tag:            "zone-1",
+			expectedFilter: "Service.Meta.zone == zone-1",
+			expectedTag:    "",
+		},
+
+		{
+			filter:         "Service.Meta.zone == {tag}",
+			tag:            "",
+			expectedFilter: "",
+			expectedTag:    "",
+		},
+
+		{
+			filter:         "Service.Meta.env == prod and {tag} in Service.Tags",
+			tag:            "zone-1",
+			expectedFilter: "Service.Meta.env == prod and zone-1 in Service.Tags",
+			expectedTag:    "",
+		},
+
+		{
+			filter:         "Service.Meta.env == prod and {tag} in Service.Tags",
+			tag:            "",
+			expectedFilter: "Service.Meta.env == prod",
+			expectedTag:    "",
+		},
+
+		{
+			filter:         `(Service.Meta.env == prod or Service.Meta.env == "a and b") and not {tag} in Service.Tags and Node.Meta.rack != r1`,
+			tag:            "",
+			expectedFilter: `(Service.Meta.env == prod or Service.Meta.env == "a and b") and Node.Meta.rack != r1`,
+			expectedTag:    "",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.filter+"/"+test.tag, func(t *testing.T) {
+			var query atomic.Value
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query.Store(r.URL.Query())
+				w.Write([]byte("[]"))
+			}))
+			defer server.Close()
+
+			cache := cache{
+				client:  newClient([]string{server.URL}, http.DefaultTransport),
+				ttl:     1 * time.Second,
+				timeout: 1 * time.Second,
+				filter:  test.filter,
+			}
+
+			if _, _, err := cache.load(key{name: "service-1", tag: test.tag}); err != nil {
+				t.Fatal(err)
+			}
+
+			q := query.Load().(url.Values)
+
+			if filter := q.Get("filter"); filter != test.expectedFilter {
+				t.Errorf("Expected filter to be %q but found: %q", test.expectedFilter, filter)
+			}
+
+			if tag := q.Get("tag"); tag != test.expectedTag {
+				t.Errorf("Expected tag to be %q but found: %q", test.expectedTag, tag)
+			}
+		})
+	}
+}
+
+func TestCacheRetry(t *testing.T) {
+	tests := []struct {
+		scenario  string
+		failures  int
+		status    int
+		attempts  int
+		expectErr bool
+		expectReq int
+	}{
+		{
+			scenario:  "no retries",
+			failures:  1,
+			status:    http.StatusServiceUnavailable,
+			attempts:  1,
+			expectErr: true,
+			expectReq: 1,
+		},
+
+		{
+			scenario:  "retry until success",
+			failures:  2,
+			status:    http.StatusServiceUnavailable,
+			attempts:  3,
+			expectErr: false,
+			expectReq: 3,
+		},
+
+		{
+			scenario:  "retry until exhausted",
+			failures:  5,
+			status:    http.StatusTooManyRequests,
+			attempts:  3,
+			expectErr: true,
+			expectReq: 3,
+		},
+
+		{
+			scenario:  "non-retryable status",
+			failures:  1,
+			status:    http.StatusForbidden,
+			attempts:  3,
+			expectErr: true,
+			expectReq: 1,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.scenario, func(t *testing.T) {
+			var requests int32
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if int(atomic.AddInt32(&requests, 1)) <= test.failures {
+					w.WriteHeader(test.status)
+					return
+				}
+				w.Write([]byte("[]"))
+			}))
+			defer server.Close()
+
+			cache := cache{
+				client:  newClient([]string{server.URL}, http.DefaultTransport),
+				ttl:     1 * time.Second,
+				timeout: 1 * time.Second,
+				retry: retryPolicy{
+					attempts:    test.attempts,
+					backoff:     1 * time.Millisecond,
+					maxBackoff:  10 * time.Millisecond,
+					statusCodes: defaultRetryStatusCodes,
+				},
+			}
+
+			_, _, err := cache.load(key{name: "service-1"})
+
+			if test.expectErr && err == nil {
+				t.Error("Expected an error but found <nil>")
+			}
+
+			if !test.expectErr && err != nil {
+				t.Error(err)
+			}
+
+			if n := int(atomic.LoadInt32(&requests)); n != test.expectReq {
+				t.Errorf("Expected %d requests to consul but found: %d", test.expectReq, n)
+			}
+		})
+	}
+}
+
+func TestCacheTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	cache := cache{
+		client:  newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:     1 * time.Minute,
+		timeout: 50 * time.Millisecond,
+	}
+
+	t0 := time.Now()
+
+	if _, _, err := cache.load(key{name: "service-1"}); err == nil {
+		t.Error("Expected an error but found <nil>")
+	}
+
+	if d := time.Since(t0); d > 1*time.Second {
+		t.Error("the request to consul did not time out after", d)
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	tests := []struct {
+		scenario  string
+		maxStale  time.Duration
+		after     time.Duration
+		expectErr bool
+	}{
+		{
+			scenario:  "serve stale disabled",
+			maxStale:  0,
+			after:     2 * time.Minute,
+			expectErr: true,
+		},
+
+		{
+			scenario:  "serve stale within max_stale",
+			maxStale:  5 * time.Minute,
+			after:     2 * time.Minute,
+			expectErr: false,
+		},
+
+		{
+			scenario:  "serve stale past max_stale",
+			maxStale:  5 * time.Minute,
+			after:     10 * time.Minute,
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.scenario, func(t *testing.T) {
+			var down int32
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.LoadInt32(&down) != 0 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				json.NewEncoder(w).Encode([]consulHealthService{{
+					Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+					Service: consulService{Address: "192.168.0.1", Port: 10001},
+				}})
+			}))
+			defer server.Close()
+
+			cache := cache{
+				client:             newClient([]string{server.URL}, http.DefaultTransport),
+				ttl:                1 * time.Minute,
+				timeout:            1 * time.Second,
+				prefetchAmount:     10,
+				prefetchPercentage: 10,
+				prefetchDuration:   1 * time.Minute,
+				maxStale:           test.maxStale,
+			}
+
+			ctx := context.Background()
+			now := time.Now()
+			k := key{name: "service-1"}
+
+			if _, _, err := cache.lookup(ctx, k, now); err != nil {
+				t.Fatal(err)
+			}
+
+			atomic.StoreInt32(&down, 1)
+
+			srv, ttl, err := cache.lookup(ctx, k, now.Add(test.after))
+
+			if test.expectErr {
+				if err == nil {
+					t.Error("Expected an error but found <nil>")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := srv.addr.String(); s != "192.168.0.1" {
+				t.Error("unexpected service address:", s)
+			}
+			if ttl != 0 {
+				t.Error("unexpected TTL of stale service:", ttl)
+			}
+		})
+	}
+}
+
+func TestCacheStaleRetry(t *testing.T) {
+	var down, requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&down) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode([]consulHealthService{{
+			Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+			Service: consulService{Address: "192.168.0.1", Port: 10001},
+		}})
+	}))
+	defer server.Close()
+
+	cache := cache{
+		client:             newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:                1 * time.Minute,
+		timeout:            1 * time.Second,
+		prefetchAmount:     10,
+		prefetchPercentage: 10,
+		prefetchDuration:   1 * time.Minute,
+		maxStale:           5 * time.Minute,
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	k := key{name: "service-1"}
+
+	if _, _, err := cache.lookup(ctx, k, now); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&down, 1)
+
+	// The first lookup after the entry expired waits for the refresh, which
+	// fails and sets the time of the next attempt.
+	now = now.Add(2 * time.Minute)
+	if _, _, err := cache.lookup(ctx, k, now); err != nil {
+		t.Fatal(err)
+	}
+	n := atomic.LoadInt32(&requests)
+
+	// Lookups before the retry time are served stale without requests.
+	if _, _, err := cache.lookup(ctx, k, now.Add(staleRetryBackoff/2)); err != nil {
+		t.Fatal(err)
+	}
+	if r := atomic.LoadInt32(&requests); r != n {
+		t.Errorf("Expected no requests before the retry time but found: %d", r-n)
+	}
+
+	// Lookups after the retry time are served stale and refresh the entry in
+	// the background.
+	atomic.StoreInt32(&down, 0)
+
+	srv, ttl, err := cache.lookup(ctx, k, now.Add(2*staleRetryBackoff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := srv.addr.String(); s != "192.168.0.1" {
+		t.Error("unexpected service address:", s)
+	}
+	if ttl != 0 {
+		t.Error("unexpected TTL of stale service:", ttl)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if e := cache.get(k); e != nil && atomic.LoadInt64(&e.retry) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the entry was not refreshed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCacheMaxMemory(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]consulHealthService{{
+			Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+			Service: consulService{Address: "192.168.0.1", Port: 10001},
+		}})
+	}))
+	defer server.Close()
+
+	cache := cache{
+		client:             newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:                1 * time.Minute,
+		timeout:            1 * time.Second,
+		prefetchAmount:     10,
+		prefetchPercentage: 10,
+		prefetchDuration:   1 * time.Minute,
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+
+	if _, _, err := cache.lookup(ctx, key{name: "service-0"}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// All entries have the same size, limit the cache to 5 of them.
+	cache.maxMemory = 5 * atomic.LoadInt64(&cache.bytes)
+
+	for i := 1; i != 10; i++ {
+		k := key{name: "service-" + strconv.Itoa(i)}
+
+		if _, _, err := cache.lookup(ctx, k, now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := atomic.LoadInt64(&cache.bytes); n > cache.maxMemory {
+			t.Errorf("the cache uses %d bytes which is more than the limit of %d", n, cache.maxMemory)
+		}
+	}
+
+	n := cache.len()
+
+	if n != 5 {
+		t.Errorf("Expected 5 entries in the cache but found: %d", n)
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	var empty int32 = 1
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results := []consulHealthService{}
+		if atomic.LoadInt32(&empty) == 0 {
+			results = append(results, consulHealthService{
+				Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+				Service: consulService{Address: "192.168.0.1", Port: 10001},
+			})
+		}
+		json.NewEncoder(w).Encode(results)
+	}))
+	defer server.Close()
+
+	cache := cache{
+		client:             newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:                10 * time.Minute,
+		ttlNegative:        5 * time.Second,
+		timeout:            1 * time.Second,
+		prefetchAmount:     10,
+		prefetchPercentage: 10,
+		prefetchDuration:   1 * time.Minute,
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	k := key{name: "service-1"}
+
+	srv, ttl, err := cache.lookup(ctx, k, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.addr != nil {
+		t.Fatal("unexpected service address:", srv.addr)
+	}
+	if ttl > 10*time.Second {
+		t.Error("the negative entry was cached with a long TTL:", ttl)
+	}
+
+	atomic.StoreInt32(&empty, 0)
+
+	srv, ttl, err = cache.lookup(ctx, k, now.Add(10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := srv.addr.String(); s != "192.168.0.1" {
+		t.Error("unexpected service address:", s)
+	}
+	if ttl < 10*time.Minute {
+		t.Error("the positive entry was cached with a short TTL:", ttl)
+	}
+}
+
+func TestCacheAdaptiveTTL(t *testing.T) {
+	var index int32 = 1
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", strconv.Itoa(int(atomic.LoadInt32(&index))))
+		json.NewEncoder(w).Encode([]consulHealthService{{
+			Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+			Service: consulService{Address: "192.168.0.1", Port: 10001},
+		}})
+	}))
+	defer server.Close()
+
+	cache := cache{
+		client:             newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:                1 * time.Minute,
+		ttlAdaptiveMin:     15 * time.Second,
+		ttlAdaptiveMax:     4 * time.Minute,
+		timeout:            1 * time.Second,
+		prefetchAmount:     10,
+		prefetchPercentage: 10,
+		prefetchDuration:   1 * time.Minute,
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	k := key{name: "service-1"}
+
+	// Lookups after the entries expired force a refresh, then return the TTL
+	// of the new entry.
+	lookup := func() time.Duration {
+		_, ttl, err := cache.lookup(ctx, k, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(ttl + ttl/2 + time.Second)
+		return ttl
+	}
+
+	lookup()
+
+	for _, max := range []time.Duration{2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		if ttl := lookup(); ttl < max/2 || ttl > max+max/2 {
+			t.Errorf("Expected the TTL of a stable service to be around %s but found: %s", max, ttl)
+		}
+	}
+
+	for _, min := range []time.Duration{2 * time.Minute, 1 * time.Minute, 30 * time.Second, 15 * time.Second, 15 * time.Second} {
+		atomic.AddInt32(&index, 1)
+		if ttl := lookup(); ttl < min || ttl > min+min/2 {
+			t.Errorf("Expected the TTL of a changing service to be around %s but found: %s", min, ttl)
+		}
+	}
+}
+
+func TestCachePrefetchAmount(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		json.NewEncoder(w).Encode([]consulHealthService{{
+			Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+			Service: consulService{Address: "192.168.0.1", Port: 10001},
+		}})
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		scenario string
+		lookups  []time.Duration
+		requests int32
+	}{
+		{
+			scenario: "entries looked up less than the prefetch amount are not prefetched",
+			lookups:  []time.Duration{0, 20 * time.Second, 39 * time.Second},
+			requests: 1,
+		},
+		{
+			scenario: "entries looked up more than the prefetch amount are prefetched",
+			lookups:  []time.Duration{0, 1 * time.Second, 2 * time.Second, 3 * time.Second, 39 * time.Second},
+			requests: 2,
+		},
+		{
+			scenario: "entries looked up with gaps longer than the prefetch duration are not prefetched",
+			lookups:  []time.Duration{0, 1 * time.Second, 2 * time.Second, 3 * time.Second, 50 * time.Second},
+			requests: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+
+			// With a TTL of 1 minute and a prefetch percentage of 90%, the
+			// entry expires after 60s at the earliest, and is prefetched
+			// after 36s at the latest.
+			cache := cache{
+				client:             newClient([]string{server.URL}, http.DefaultTransport),
+				ttl:                1 * time.Minute,
+				timeout:            1 * time.Second,
+				prefetchAmount:     4,
+				prefetchPercentage: 900,
+				prefetchDuration:   40 * time.Second,
+			}
+
+			ctx := context.Background()
+			now := time.Now()
+
+			for _, d := range test.lookups {
+				if _, _, err := cache.lookup(ctx, key{name: "service-1"}, now.Add(d)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if n := atomic.LoadInt32(&requests); n != test.requests {
+				t.Errorf("Expected %d requests to consul but found: %d", test.requests, n)
+			}
+		})
+	}
+}
+
+func TestCacheRefreshAll(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			w.Write([]byte("[]"))
+			return
+		}
+		json.NewEncoder(w).Encode([]consulHealthService{{
+			Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+			Service: consulService{Address: "192.168.0.1", Port: 10001},
+		}})
+	}))
+	defer server.Close()
+
+	cache := cache{
+		client:             newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:                1 * time.Minute,
+		timeout:            1 * time.Second,
+		prefetchAmount:     10,
+		prefetchPercentage: 10,
+		prefetchDuration:   1 * time.Minute,
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+
+	for _, name := range []string{"service-1", "service-2", "idle", "missing"} {
+		if _, _, err := cache.lookup(ctx, key{name: name}, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"service-1", "service-2", "missing"} {
+		if _, _, err := cache.lookup(ctx, key{name: name}, now.Add(30*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Refreshed entries expire a full TTL after the refresh, lookups are
+	// then answered without sending requests to consul. Entries without
+	// services, or which were not looked up recently, are not refreshed.
+	now = now.Add(50 * time.Second)
+	cache.refreshAll(now, 40*time.Second)
+
+	if n := atomic.LoadInt32(&requests); n != 6 {
+		t.Errorf("Expected 6 requests to consul but found: %d", n)
+	}
+
+	if _, ttl, err := cache.lookup(ctx, key{name: "idle"}, now); err != nil {
+		t.Fatal(err)
+	} else if ttl >= 1*time.Minute {
+		t.Errorf("Expected the idle entry not to be refreshed but its TTL is: %s", ttl)
+	}
+
+	for _, name := range []string{"service-1", "service-2"} {
+		_, ttl, err := cache.lookup(ctx, key{name: name}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl < 1*time.Minute {
+			t.Errorf("Expected the refreshed entry of %s to be live but its TTL is: %s", name, ttl)
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 6 {
+		t.Errorf("Expected no more requests to consul after the refresh but found: %d", n-6)
+	}
+}
+
+func TestCacheEvictions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]consulHealthService{{
+			Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+			Service: consulService{Address: "192.168.0.1", Port: 10001},
+		}})
+	}))
+	defer server.Close()
+
+	cache := cache{
+		client:             newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:                1 * time.Minute,
+		timeout:            1 * time.Second,
+		prefetchAmount:     10,
+		prefetchPercentage: 10,
+		prefetchDuration:   1 * time.Minute,
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+
+	// The metrics are global, the keys are unique to this test to not be
+	// affected by other tests.
+	found := key{name: "evictions-found"}
+	missing := key{name: "missing"}
+	dropped := key{name: "evictions-purged"}
+
+	for _, k := range []key{found, missing, dropped} {
+		cache.lookup(ctx, k, now)
+	}
+
+	cache.purge(func(k key) bool { return k == dropped })
+	cache.cleanup(now.Add(2 * time.Minute))
+
+	tests := []struct {
+		metric prometheus.Metric
+		value  float64
+	}{
+		{cacheEvictions.WithLabelValues("", "", found.name, expired), 1},
+		{cacheEvictions.WithLabelValues("", "", missing.name, expired), 1},
+		{cacheEvictions.WithLabelValues("", "", dropped.name, purged), 1},
+		{cacheSize.WithLabelValues("", "", found.name, success), 0},
+		{cacheSize.WithLabelValues("", "", missing.name, denial), 0},
+		{cacheSize.WithLabelValues("", "", dropped.name, success), 0},
+		{cacheServices.WithLabelValues("", "", found.name), 0},
+	}
+
+	for _, test := range tests {
+		if value := metricValue(test.metric); value != test.value {
+			t.Errorf("Expected %s to be %g but found: %g", test.metric.Desc(), test.value, value)
+		}
+	}
+
+	if n := atomic.LoadInt64(&cache.bytes); n != 0 {
+		t.Errorf("Expected the cache to use no bytes after removing all entries but found: %d", n)
+	}
+}
+
+func TestCacheAggregateMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]consulHealthService{{
+			Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+			Service: consulService{Address: "192.168.0.1", Port: 10001},
+		}})
+	}))
+	defer server.Close()
+
+	cache := cache{
+		client:             newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:                1 * time.Minute,
+		timeout:            1 * time.Second,
+		prefetchAmount:     10,
+		prefetchPercentage: 10,
+		prefetchDuration:   1 * time.Minute,
+		aggregate:          true,
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+
+	misses := cacheMisses.WithLabelValues("", "", "")
+	hits := cacheHits.WithLabelValues("", "", "", success)
+	misses0, hits0 := metricValue(misses), metricValue(hits)
+
+	for _, name := range []string{"aggregate-1", "aggregate-2", "aggregate-1"} {
+		if _, _, err := cache.lookup(ctx, key{name: name, dc: "dc1"}, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := metricValue(misses) - misses0; n != 2 {
+		t.Errorf("Expected 2 aggregated cache misses but found: %g", n)
+	}
+
+	if n := metricValue(hits) - hits0; n != 1 {
+		t.Errorf("Expected 1 aggregated cache hit but found: %g", n)
+	}
+
+	if n := metricValue(cacheMisses.WithLabelValues("dc1", "", "aggregate-1")); n != 0 {
+		t.Errorf("Expected no cache misses labeled with the service name but found: %g", n)
+	}
+}
+
+func TestCacheConsulHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "42")
+		w.Header().Set("X-Consul-KnownLeader", "true")
+		w.Header().Set("X-Consul-LastContact", "1500")
+		json.NewEncoder(w).Encode([]consulHealthService{{
+			Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+			Service: consulService{Address: "192.168.0.1", Port: 10001},
+		}})
+	}))
+	defer server.Close()
+
+	cache := cache{
+		client:             newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:                1 * time.Minute,
+		timeout:            1 * time.Second,
+		prefetchAmount:     10,
+		prefetchPercentage: 10,
+		prefetchDuration:   1 * time.Minute,
+	}
+
+	if _, _, err := cache.lookup(context.Background(), key{name: "headers-1", dc: "dc1"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := metricValue(cacheConsulIndex.WithLabelValues("dc1", "", "headers-1")); v != 42 {
+		t.Errorf("Expected the consul index to be 42 but found: %g", v)
+	}
+
+	if v := metricValue(cacheKnownLeader.WithLabelValues("dc1", "", "headers-1")); v != 1 {
+		t.Errorf("Expected the known leader gauge to be 1 but found: %g", v)
+	}
+
+	if v := metricValue(cacheLastContact.WithLabelValues("dc1", "", "headers-1")); v != 1.5 {
+		t.Errorf("Expected the last contact to be 1.5s but found: %g", v)
+	}
+}
+
+func TestCacheInvalidAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]consulHealthService{
+			{
+				Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+				Service: consulService{ID: "invalid-1", Address: "192.168.0.1", Port: 10001},
+			},
+			{
+				Node:    consulNode{Node: "host-2", Datacenter: "dc1"},
+				Service: consulService{ID: "invalid-2", Address: "not-an-ip", Port: 10002},
+			},
+			{
+				Node:    consulNode{Node: "host-3", Datacenter: "dc1"},
+				Service: consulService{ID: "invalid-3", Address: "", Port: 10003},
+			},
+		})
+	}))
+	defer server.Close()
+
+	cache := cache{
+		client:             newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:                1 * time.Minute,
+		timeout:            1 * time.Second,
+		prefetchAmount:     10,
+		prefetchPercentage: 10,
+		prefetchDuration:   1 * time.Minute,
+		invalidAddrLog:     1 * time.Minute,
+	}
+
+	srv, _, err := cache.lookup(context.Background(), key{name: "invalid", dc: "dc1"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !srv.addr.Equal(net.ParseIP("192.168.0.1")) {
+		t.Errorf("Expected the service with a valid address but found: %s", srv.addr)
+	}
+
+	if n := metricValue(cacheInvalidAddrs.WithLabelValues("dc1", "", "invalid")); n != 2 {
+		t.Errorf("Expected 2 instances dropped for their invalid address but found: %g", n)
+	}
+
+	if atomic.LoadInt64(&cache.invalidAddrLogged) == 0 {
+		t.Error("Expected the instances with invalid addresses to be logged")
+	}
+}
+
+func TestCacheLookupStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]consulHealthService{{
+			Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+			Service: consulService{Address: "192.168.0.1", Port: 10001},
+		}})
+	}))
+	defer server.Close()
+
+	cache := cache{
+		client:             newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:                1 * time.Minute,
+		timeout:            1 * time.Second,
+		prefetchAmount:     1,
+		prefetchPercentage: 10,
+		prefetchDuration:   1 * time.Minute,
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+
+	for _, test := range []struct {
+		now   time.Time
+		cache string
+	}{
+		{now: now, cache: "miss"},
+		{now: now.Add(1 * time.Second), cache: "hit"},
+		// Once the entry expired, the lookup refreshes it before answering.
+		{now: now.Add(90 * time.Second), cache: "prefetch_wait"},
+	} {
+		_, _, stats, err := cache.lookupStats(ctx, key{name: "service-1", dc: "dc1"}, test.now, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.cache != test.cache {
+			t.Errorf("Expected the lookup to be a %q but found: %q", test.cache, stats.cache)
+		}
+	}
+}
+
+func TestCacheHitRatio(t *testing.T) {
+	hits, misses := atomic.LoadUint64(&cacheLookupHits), atomic.LoadUint64(&cacheLookupMisses)
+	defer func() {
+		atomic.StoreUint64(&cacheLookupHits, hits)
+		atomic.StoreUint64(&cacheLookupMisses, misses)
+	}()
+
+	atomic.StoreUint64(&cacheLookupHits, 0)
+	atomic.StoreUint64(&cacheLookupMisses, 0)
+
+	if ratio := metricValue(cacheHitRatio); ratio != 0 {
+		t.Errorf("Expected the hit ratio to be 0 without lookups but found: %g", ratio)
+	}
+
+	m := metrics{}
+	m.cacheMissesInc()
+	m.cacheHitsIncSuccess()
+	m.cacheHitsIncSuccess()
+	m.cacheHitsIncDenial()
+
+	if ratio := metricValue(cacheHitRatio); ratio != 0.75 {
+		t.Errorf("Expected the hit ratio to be 0.75 but found: %g", ratio)
+	}
+}
+
+func metricValue(m prometheus.Metric) float64 {
+	var v dto.Metric
+	m.Write(&v)
+	switch {
+	case v.Counter != nil:
+		return v.Counter.GetValue()
+	case v.Gauge != nil:
+		return v.Gauge.GetValue()
+	case v.Histogram != nil:
+		return float64(v.Histogram.GetSampleCount())
+	}
+	return 0
+}
+
+func TestCacheMaxConcurrentFetches(t *testing.T) {
+	var inflight, peak, queued int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+
+		if metricValue(cacheFetchQueue) > 0 {
+			atomic.StoreInt32(&queued, 1)
+		}
+
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		json.NewEncoder(w).Encode([]consulHealthService{{
+			Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+			Service: consulService{Address: "192.168.0.1", Port: 10001},
+		}})
+	}))
+	defer server.Close()
+
+	cache := cache{
+		client:             newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:                1 * time.Minute,
+		timeout:            1 * time.Second,
+		prefetchAmount:     10,
+		prefetchPercentage: 10,
+		prefetchDuration:   1 * time.Minute,
+		fetches:            make(chan struct{}, 2),
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	wg := sync.WaitGroup{}
+
+	for i := 0; i != 10; i++ {
+		wg.Add(1)
+		go func(k key) {
+			defer wg.Done()
+			if _, _, err := cache.lookup(ctx, k, now); err != nil {
+				t.Error(err)
+			}
+		}(key{name: "service-" + strconv.Itoa(i)})
+	}
+
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&peak); n > 2 {
+		t.Errorf("Expected at most 2 concurrent fetches but found: %d", n)
+	}
+
+	if atomic.LoadInt32(&queued) == 0 {
+		t.Error("Expected lookups to be queued while fetches were in flight")
+	}
+
+	if n := metricValue(cacheFetchQueue); n != 0 {
+		t.Errorf("Expected no lookups to be queued after they completed but found: %g", n)
+	}
+
+	if n := metricValue(endpointInflightRequests.WithLabelValues(server.URL)); n != 0 {
+		t.Errorf("Expected no requests in flight after the lookups completed but found: %g", n)
+	}
+}
+
+func TestErrorCause(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	_, refused := http.Get(closed.URL)
+
+	timeout := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer timeout.Close()
+
+	_, timedOut := (&http.Client{Timeout: 10 * time.Millisecond}).Get(timeout.URL)
+
+	tests := []struct {
+		err   error
+		cause string
+	}{
+		{err: &statusError{code: http.StatusServiceUnavailable}, cause: causeServerError},
+		{err: &statusError{code: http.StatusForbidden}, cause: causeClientError},
+		{err: &statusError{code: http.StatusNotModified}, cause: causeStatus},
+		{err: errCircuitOpen, cause: causeCircuitOpen},
+		{err: &url.Error{Op: "Get", URL: "http://localhost", Err: context.Canceled}, cause: causeCanceled},
+		{err: refused, cause: causeConnectionRefused},
+		{err: timedOut, cause: causeTimeout},
+		{err: errors.New("whatever"), cause: causeOther},
+	}
+
+	for _, test := range tests {
+		if cause := errorCause(test.err); cause != test.cause {
+			t.Errorf("Expected the cause of %v to be %q but found: %q", test.err, test.cause, cause)
+		}
+	}
+}
+
+func TestCacheWatch(t *testing.T) {
+	var (
+		mutex   sync.Mutex
+		index   = 1
+		addr    = "192.168.0.1"
+		changed = make(chan struct{})
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		current, change := index, changed
+		mutex.Unlock()
+
+		if r.URL.Query().Get("index") == strconv.Itoa(current) {
+			select {
+			case <-change:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		mutex.Lock()
+		w.Header().Set("X-Consul-Index", strconv.Itoa(index))
+		results := []consulHealthService{{
+			Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+			Service: consulService{Address: addr, Port: 10001},
+		}}
+		mutex.Unlock()
+
+		json.NewEncoder(w).Encode(results)
+	}))
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	cache := cache{
+		client:             newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:                1 * time.Minute,
+		timeout:            1 * time.Second,
+		prefetchAmount:     10,
+		prefetchPercentage: 10,
+		prefetchDuration:   1 * time.Minute,
+		watch:              true,
+	}
+
+	ctx := context.Background()
+	k := key{name: "service-1"}
+
+	srv, _, err := cache.lookup(ctx, k, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := srv.addr.String(); s != "192.168.0.1" {
+		t.Fatal("unexpected service address:", s)
+	}
+
+	mutex.Lock()
+	index, addr = 2, "192.168.0.2"
+	close(changed)
+	changed = make(chan struct{})
+	mutex.Unlock()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		srv, _, err := cache.lookup(ctx, k, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := srv.addr.String(); s == "192.168.0.2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the cache entry was not updated by the watch")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCacheClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") != "" {
+			<-r.Context().Done() // blocking queries never return
+			return
+		}
+		w.Header().Set("X-Consul-Index", "1")
+		json.NewEncoder(w).Encode([]consulHealthService{{
+			Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+			Service: consulService{Address: "192.168.0.1", Port: 10001},
+		}})
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cache := cache{
+		client:             newClient([]string{server.URL}, &http.Transport{}),
+		ttl:                1 * time.Minute,
+		timeout:            1 * time.Second,
+		prefetchAmount:     10,
+		prefetchPercentage: 10,
+		prefetchDuration:   1 * time.Minute,
+		watch:              true,
+		ctx:                ctx,
+		cancel:             cancel,
+	}
+
+	if _, _, err := cache.lookup(context.Background(), key{name: "service-1"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cache.close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the cache did not stop its watches")
+	}
+
+	cache.mutex.RLock()
+	n := len(cache.watches)
+	cache.mutex.RUnlock()
+
+	if n != 0 {
+		t.Errorf("Expected no watches after closing the cache but found: %d", n)
+	}
+}
+
 func BenchmarkCache(b *testing.B) {
 	handler := consulHandler("dc1", []consulServerService{
 		// host 1
@@ -35,12 +1214,12 @@ func BenchmarkCache(b *testing.B) {
 	defer server.Close()
 
 	cache := cache{
-		addr:               server.URL,
+		client:             newClient([]string{server.URL}, http.DefaultTransport),
 		ttl:                1 * time.Second,
+		timeout:            1 * time.Second,
 		prefetchAmount:     10,
 		prefetchPercentage: 10,
 		prefetchDuration:   1 * time.Second,
-		transport:          http.DefaultTransport,
 	}
 
 	keys := []key{
@@ -0,0 +1,49 @@
+package consul
+
+import (
+	"os"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// serveChaos answers the CHAOS TXT queries for version.bind with the version
+// of the server, and for hostname.bind and id.server with its identity and the
+// consul agent that it uses. The answer is nil if state is not one of them.
+func (c *Consul) serveChaos(ctx context.Context, state request.Request) []dns.RR {
+	if state.QClass() != dns.ClassCHAOS || state.QType() != dns.TypeTXT {
+		return nil
+	}
+
+	var txt []string
+
+	switch qname := state.Name(); qname {
+	case "version.bind.":
+		txt = []string{c.ChaosVersion}
+
+	case "hostname.bind.", "id.server.":
+		identity := c.ChaosIdentity
+		if len(identity) == 0 {
+			identity, _ = os.Hostname()
+		}
+		txt = []string{identity}
+
+		// The identity is still reported when consul cannot be reached, only
+		// the agent is missing.
+		if _, agent, err := c.grabCache(ctx); err == nil {
+			txt = append(txt,
+				"consul-agent="+agent.Config.NodeName,
+				"consul-dc="+agent.Config.Datacenter,
+			)
+		}
+
+	default:
+		return nil
+	}
+
+	return []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: txt,
+	}}
+}
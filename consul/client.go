@@ -0,0 +1,210 @@
+package consul
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"math/bits"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// client sends requests to the consul agents that the plugin is configured
+// with. Requests are always sent to the same agent until it fails with a
+// connection or server error, at which point the client fails over to the next
+// address in the list.
+//
+// When breakerThreshold is set, each agent is guarded by a circuit breaker
+// which short-circuits requests to agents that failed repeatedly.
+type client struct {
+	addrs     []string
+	transport http.RoundTripper
+	header    http.Header // set on all requests
+	current   uint32
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	breakers         []breaker
+
+	// Outcomes of the last 64 requests, where bits set to 1 represent
+	// failures. The most recent outcome is in the lowest bit.
+	outcomes uint64
+}
+
+func newClient(addrs []string, transport http.RoundTripper) *client {
+	return &client{
+		addrs:     addrs,
+		transport: transport,
+		breakers:  make([]breaker, len(addrs)),
+	}
+}
+
+// closeIdleConnections releases the idle connections of the client transport,
+// if it supports it.
+func (c *client) closeIdleConnections() {
+	if t, ok := c.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// get sends a GET request for path to consul, the path may include a query
+// string. The caller is expected to close the body of the returned response.
+func (c *client) get(ctx context.Context, path string) (res *http.Response, err error) {
+	res, err = c.send(ctx, path)
+	c.record(err != nil)
+	return
+}
+
+func (c *client) send(ctx context.Context, path string) (res *http.Response, err error) {
+	for attempt := 0; attempt != len(c.addrs); attempt++ {
+		i := atomic.LoadUint32(&c.current)
+		n := i % uint32(len(c.addrs))
+		addr := c.addrs[n]
+		m := endpointMetrics{addr: addr}
+
+		if !c.allow(n, m) {
+			if err == nil {
+				err = errCircuitOpen
+			}
+			m.endpointShortCircuitsInc()
+			atomic.CompareAndSwapUint32(&c.current, i, i+1)
+			continue
+		}
+
+		var req *http.Request
+		if req, err = http.NewRequest(http.MethodGet, addr+path, nil); err != nil {
+			return
+		}
+		for name, values := range c.header {
+			req.Header[name] = values
+		}
+		// Compression is requested explicitly since the transport may not be
+		// a *http.Transport, which would negotiate it transparently.
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		m.endpointInflightRequestsAdd(1)
+		res, err = c.transport.RoundTrip(req.WithContext(ctx))
+		m.endpointInflightRequestsAdd(-1)
+
+		if err == nil {
+			decompress(res)
+
+			if res.StatusCode < 500 {
+				m.endpointHealthySet(true)
+				c.success(n, m)
+				return
+			}
+			err = httpError(res)
+			res.Body.Close()
+			res = nil
+		}
+
+		m.endpointHealthySet(false)
+		m.endpointFailuresInc()
+		c.failure(n, m)
+
+		// Only the first goroutine observing the failure moves the client to
+		// the next address, others will retry on the address it selected.
+		if atomic.CompareAndSwapUint32(&c.current, i, i+1) {
+			m.endpointFailoversInc()
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *client) allow(n uint32, m endpointMetrics) bool {
+	if c.breakerThreshold <= 0 {
+		return true
+	}
+	ok, state := c.breakers[n].allow(time.Now(), c.breakerCooldown)
+	m.endpointBreakerStateSet(state)
+	return ok
+}
+
+func (c *client) success(n uint32, m endpointMetrics) {
+	if c.breakerThreshold > 0 {
+		m.endpointBreakerStateSet(c.breakers[n].success())
+	}
+}
+
+func (c *client) failure(n uint32, m endpointMetrics) {
+	if c.breakerThreshold > 0 {
+		m.endpointBreakerStateSet(c.breakers[n].failure(time.Now(), c.breakerThreshold))
+	}
+}
+
+func (c *client) record(failed bool) {
+	for {
+		old := atomic.LoadUint64(&c.outcomes)
+		next := old << 1
+		if failed {
+			next |= 1
+		}
+		if atomic.CompareAndSwapUint64(&c.outcomes, old, next) {
+			break
+		}
+	}
+	healthySet(c.healthy())
+}
+
+// healthy returns false if most of the recent requests to consul failed, or
+// if the circuit breakers of all consul agents are open.
+func (c *client) healthy() bool {
+	if bits.OnesCount64(atomic.LoadUint64(&c.outcomes)) > 32 {
+		return false
+	}
+	if c.breakerThreshold <= 0 {
+		return true
+	}
+	for i := range c.breakers {
+		if !c.breakers[i].isOpen() {
+			return true
+		}
+	}
+	return false
+}
+
+// addr returns the address of the consul agent currently in use.
+func (c *client) addr() string {
+	return c.addrs[atomic.LoadUint32(&c.current)%uint32(len(c.addrs))]
+}
+
+// decompress replaces the body of res with a reader decompressing it when the
+// response is gzip encoded.
+func decompress(res *http.Response) {
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		return
+	}
+	res.Body = &gzipBody{body: res.Body}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+}
+
+// gzipBody decompresses a response body, the gzip header is only read on the
+// first call to Read so errors are reported when decoding the response.
+type gzipBody struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.zr == nil && b.err == nil {
+		b.zr, b.err = gzip.NewReader(b.body)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.zr.Read(p)
+}
+
+func (b *gzipBody) Close() error {
+	return b.body.Close()
+}
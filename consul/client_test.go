@@ -0,0 +1,190 @@
+package consul
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientFailover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+
+	// Reserve an address that nothing listens on to trigger connection errors.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	client := newClient([]string{closed.URL, down.URL, up.URL}, http.DefaultTransport)
+
+	for i := 0; i != 3; i++ {
+		res, err := client.get(context.Background(), "/v1/agent/self")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Expected status %d but got %d", http.StatusOK, res.StatusCode)
+		}
+
+		if addr := client.addr(); addr != up.URL {
+			t.Errorf("Expected the client to use %s but it uses %s", up.URL, addr)
+		}
+	}
+}
+
+func TestClientAllDown(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	client := newClient([]string{down.URL, down.URL}, http.DefaultTransport)
+
+	if _, err := client.get(context.Background(), "/v1/agent/self"); err == nil {
+		t.Error("Expected an error but found <nil>")
+	}
+}
+
+func TestClientBreaker(t *testing.T) {
+	var requests int32
+	var healthy int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	client := newClient([]string{server.URL}, http.DefaultTransport)
+	client.breakerThreshold = 3
+	client.breakerCooldown = 50 * time.Millisecond
+
+	for i := 0; i != 10; i++ {
+		if _, err := client.get(context.Background(), "/v1/agent/self"); err == nil {
+			t.Fatal("Expected an error but found <nil>")
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Expected the breaker to open after 3 requests but %d were sent", n)
+	}
+
+	if _, err := client.get(context.Background(), "/v1/agent/self"); err != errCircuitOpen {
+		t.Errorf("Expected %v but found: %v", errCircuitOpen, err)
+	}
+
+	// Once the cool-down period expired the breaker lets a probe through and
+	// closes when it succeeds.
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(client.breakerCooldown)
+
+	for i := 0; i != 3; i++ {
+		res, err := client.get(context.Background(), "/v1/agent/self")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 6 {
+		t.Errorf("Expected 6 requests to be sent but found: %d", n)
+	}
+}
+
+func TestClientHealthy(t *testing.T) {
+	var down int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	client := newClient([]string{server.URL}, http.DefaultTransport)
+
+	get := func(n int) {
+		for i := 0; i != n; i++ {
+			if res, err := client.get(context.Background(), "/v1/agent/self"); err == nil {
+				res.Body.Close()
+			}
+		}
+	}
+
+	get(10)
+	if !client.healthy() {
+		t.Error("the client is unhealthy after successful requests")
+	}
+
+	atomic.StoreInt32(&down, 1)
+	get(64)
+	if client.healthy() {
+		t.Error("the client is healthy after failed requests")
+	}
+
+	atomic.StoreInt32(&down, 0)
+	get(64)
+	if !client.healthy() {
+		t.Error("the client did not recover after successful requests")
+	}
+
+	// When all circuit breakers are open the client is unhealthy regardless
+	// of the outcome of past requests.
+	client.breakerThreshold = 1
+	client.breakerCooldown = 1 * time.Minute
+	client.breakers[0].failure(time.Now(), client.breakerThreshold)
+
+	if client.healthy() {
+		t.Error("the client is healthy while all circuit breakers are open")
+	}
+}
+
+func TestClientCompression(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write([]byte(`"uncompressed"`))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		z := gzip.NewWriter(w)
+		z.Write([]byte(`"compressed"`))
+		z.Close()
+	}))
+	defer server.Close()
+
+	// A transport which does not negotiate compression on its own.
+	transport := &http.Transport{DisableCompression: true}
+	defer transport.CloseIdleConnections()
+
+	client := newClient([]string{server.URL}, transport)
+
+	res, err := client.get(context.Background(), "/v1/agent/self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var body string
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body != "compressed" {
+		t.Errorf("Expected a compressed response but got: %q", body)
+	}
+}
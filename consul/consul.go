@@ -1,15 +1,19 @@
 package consul
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/fall"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 	"golang.org/x/net/context"
@@ -24,32 +28,335 @@ import (
 type Consul struct {
 	Next plugin.Handler // Next handler in the list of plugins.
 
+	// Zones are the origins that the plugin is authoritative for, queries for
+	// names outside of these zones are passed to the next plugin. An empty
+	// list means the plugin handles all queries.
+	Zones []string
+
+	// Fall controls which queries are passed to the next plugin when they are
+	// for names outside of the consul domain or not found in consul.
+	Fall fall.F
+
 	// Addr is the address of the consul agent used by this plugin, it must be
 	// be in the scheme://host:port format.
 	Addr string
 
+	// FailoverAddrs is a list of addresses of consul agents that the plugin
+	// fails over to when the agent it is using becomes unavailable.
+	FailoverAddrs []string
+
 	// Maximum age of cached service entries.
 	TTL time.Duration
 
+	// Maximum age of cached errors and lookups which found no services, zero
+	// means that they are cached for TTL.
+	TTLNegative time.Duration
+
+	// Bounds of the adaptive TTL of cached services. When set, the TTL of
+	// each cached entry is shortened when consul reports changes to the
+	// service and extended when the service is stable.
+	TTLAdaptiveMin time.Duration
+	TTLAdaptiveMax time.Duration
+
+	// Bounds of the TTL of records in responses, which are otherwise set to
+	// the remaining time until cached services expire. Zero values disable
+	// the bounds.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// Timeout of requests sent to consul, blocking queries are given this
+	// timeout on top of their wait time.
+	Timeout time.Duration
+
 	// Configuration of the cache prefetcher.
 	PrefetchAmount     int
 	PrefetchPercentage int
 	PrefetchDuration   time.Duration
 
+	// When Watch is true, the cache maintains a blocking query to consul for
+	// each cached entry and updates it as soon as consul reports a change.
+	Watch bool
+
+	// Backend selects how the plugin receives service updates from consul,
+	// either "http" (the default) or "streaming".
+	Backend string
+
+	// Near is passed to consul to sort the services by estimated round trip
+	// time from a node, the special value "_agent" uses the agent's node.
+	Near string
+
+	// Policy controls which service is returned when multiple are available,
+	// either "round_robin" (the default), "sequential", which always returns
+	// the first service in the order reported by consul, or "sticky", which
+	// consistently returns the same service to a client while it is healthy.
+	Policy string
+
+	// Filter is a consul filter expression applied to health requests. The
+	// "{tag}" placeholder is replaced with the tag of the queried name, in
+	// which case the tag is not used to filter services by consul tags, and
+	// the clauses using it are removed from the filter of names without a tag.
+	Filter string
+
+	// Health selects the services returned by the plugin based on the state of
+	// their health checks, either "passing" (the default), "warning" which
+	// also includes services with warning checks, or "any".
+	Health string
+
+	// NodeMeta restricts the services to those running on nodes with matching
+	// metadata.
+	NodeMeta map[string]string
+
+	// Interval at which the plugin refreshes the information it has about the
+	// consul agent, such as the datacenter it belongs to.
+	AgentRefresh time.Duration
+
+	// Interval at which the plugin refreshes the list of datacenters of the
+	// consul catalog. When set, queries for services in datacenters missing
+	// from the list are answered with NXDOMAIN without requests to consul.
+	// Zero disables the validation of datacenters.
+	DatacenterRefresh time.Duration
+
+	// Retry policy of requests to consul. The first attempt is included in
+	// RetryAttempts, so a value of 1 disables retries. Network errors and
+	// responses with one of the RetryStatusCodes are retried.
+	RetryAttempts    int
+	RetryBackoff     time.Duration
+	RetryMaxBackoff  time.Duration
+	RetryStatusCodes []int
+
+	// Circuit breaker of requests to each consul agent, which opens after
+	// BreakerThreshold consecutive failures and short-circuits requests for
+	// BreakerCooldown. A zero threshold disables the breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// Maximum duration for which expired services are still served when they
+	// cannot be refreshed from consul. Zero disables serving stale services.
+	MaxStale time.Duration
+
+	// Names of services that must be successfully looked up before the plugin
+	// reports being ready.
+	Warmup []string
+
+	// Approximate maximum number of bytes used by the cache, entries are
+	// evicted when the limit is exceeded. Zero means no limit.
+	MaxMemory int64
+
+	// Path of the file where the cache is periodically saved, and restored
+	// from when the plugin starts. An empty path disables persistence. The
+	// services which expired are only restored within MaxStale.
+	Persist         string
+	PersistInterval time.Duration
+
+	// Interval at which expired entries are removed from the cache.
+	CleanupInterval time.Duration
+
+	// Interval at which all the services in the cache are refreshed in the
+	// background, whether they are looked up or not. Zero disables it.
+	RefreshAll time.Duration
+
+	// Address of the admin API of the plugin, which is disabled when empty,
+	// and the token that requests to the API must be authenticated with.
+	AdminAddr  string
+	AdminToken string
+
+	// Address of the debug endpoint of the plugin, which must be a loopback
+	// address. The endpoint is disabled when empty.
+	DebugAddr string
+
+	// Address of the health endpoint of the plugin, which reports whether the
+	// plugin is able to reach consul. The endpoint is disabled when empty.
+	HealthAddr string
+
+	// Maximum number of DNS requests served concurrently by the plugin, the
+	// requests beyond the limit are refused. Zero means no limit.
+	MaxRequests int
+
+	// Maximum number of concurrent requests sent to consul to fetch services,
+	// blocking queries issued by watches are not counted. Zero means no limit.
+	MaxConcurrentFetches int
+
+	// Fraction of queries that are logged, between 0 and 1, and the duration
+	// above which queries are always logged. Zero values disable logging.
+	QueryLog float64
+	SlowLog  time.Duration
+
+	// Minimum interval between logs of service instances dropped because their
+	// address could not be parsed, they are always counted in the metrics.
+	// Zero disables logging.
+	InvalidAddrLog time.Duration
+
+	// Metrics controls the labels of the cache metrics, either "detailed" (the
+	// default) which labels them with the dc, tag and name of services, or
+	// "aggregate" which drops those labels to keep the cardinality low.
+	Metrics string
+
+	// Paths of the keys that responses are signed with when clients request
+	// DNSSEC records, without the .key and .private extensions of the files
+	// generated by dnssec-keygen. All keys must belong to the same zone, which
+	// should be the consul domain. An empty list disables DNSSEC.
+	DNSSEC []string
+
+	// GatewayMode controls how services which are only reachable through a
+	// mesh gateway are resolved, either "none" (the default) which returns the
+	// addresses of service instances, "local" which returns the LAN address of
+	// the Gateway service in the local datacenter, or "remote" which returns
+	// the WAN address of the Gateway service in the datacenter of the service.
+	// Services imported from cluster peers always use the local gateway.
+	GatewayMode string
+	Gateway     string
+
+	// Response codes of queries which the plugin does not resolve, for names
+	// outside of the consul domain (REFUSED by default), for unsupported query
+	// types and names like prepared queries (NOTIMP by default), and for names
+	// which cannot be parsed (NXDOMAIN by default). Some stub resolvers stop
+	// using servers which answer with REFUSED.
+	RcodeForeign     int
+	RcodeUnsupported int
+	RcodeMalformed   int
+
+	// When NoClientCache is true, the records of responses have a TTL of zero
+	// so clients query the plugin every time, services are still cached by
+	// the plugin for TTL.
+	NoClientCache bool
+
+	// Maximum number of packed responses kept for the names of popular cache
+	// entries, which answer queries without building and packing messages.
+	// The responses are written to clients as raw bytes, plugins chained
+	// before this one which rewrite responses don't see them. Zero disables
+	// packed responses.
+	PackedResponses int
+
+	// When LegacyNXDomain is true, queries for services which have no records
+	// of the requested type are answered with NXDOMAIN, instead of NOERROR and
+	// an empty answer.
+	LegacyNXDomain bool
+
+	// When Chaos is true, CHAOS TXT queries for version.bind are answered with
+	// ChaosVersion, and queries for hostname.bind and id.server are answered
+	// with ChaosIdentity, the hostname by default, followed by the node name
+	// and datacenter of the consul agent used by the plugin.
+	Chaos         bool
+	ChaosVersion  string
+	ChaosIdentity string
+
+	// ACLs restrict the clients which may resolve the names of services,
+	// queries that they deny are refused.
+	ACLs []ACL
+
+	// Views change the tag and datacenter that the queries of clients resolve
+	// services in, based on the subnet of the clients. The first view matching
+	// a client applies.
+	Views []View
+
 	// HTTP transport used to send requests to consul.
 	Transport http.RoundTripper
 
-	mutex sync.RWMutex
-	cache *cache
-	agent consulAgent
+	// UserAgent and Headers are set on all the requests sent to consul, for
+	// example to authenticate with a proxy in front of the agents. The Go
+	// default User-Agent is used when it is empty.
+	UserAgent string
+	Headers   http.Header
+
+	mutex    sync.RWMutex
+	cache    *cache
+	agent    consulAgent
+	agentExp time.Time
+
+	// Controls the background refresh of the agent information, and counts
+	// the consecutive lookup failures which trigger an early refresh.
+	agentLock atomicLock
+	failures  uint32
+
+	// Datacenters of the consul catalog, nil until they are first fetched,
+	// see DatacenterRefresh.
+	datacenters     map[string]struct{}
+	datacentersExp  time.Time
+	datacentersLock atomicLock
+
+	// Set to 1 once the plugin is ready to serve queries, see Ready.
+	ready uint32
+	// Set to 1 when the last attempt to initialize the plugin failed.
+	initFailed uint32
+	// Number of DNS requests currently being served, see MaxRequests.
+	requests int64
+	// Number of queried names which could not be parsed, by reason.
+	nameErrors [len(nameErrorReasons)]uint64
 }
 
 const (
 	defaultAddr               = "http://localhost:8500"
 	defaultTTL                = 1 * time.Minute
+	defaultTimeout            = 5 * time.Second
 	defaultPrefetchAmount     = 2
 	defaultPrefetchPercentage = 10
 	defaultPrefetchDuration   = 1 * time.Minute
+	defaultBackend            = backendHTTP
+	defaultPolicy             = policyRoundRobin
+	defaultMetrics            = metricsDetailed
+	defaultHealth             = healthPassing
+	defaultGatewayMode        = gatewayNone
+	defaultGateway            = "mesh-gateway"
+	defaultRcodeForeign       = dns.RcodeRefused
+	defaultChaosVersion       = "coredns-consul"
+	defaultRcodeUnsupported   = dns.RcodeNotImplemented
+	defaultRcodeMalformed     = dns.RcodeNameError
+	defaultAgentRefresh       = 1 * time.Minute
+	defaultRetryAttempts      = 1
+	defaultRetryBackoff       = 100 * time.Millisecond
+	defaultRetryMaxBackoff    = 1 * time.Second
+	defaultBreakerThreshold   = 5
+	defaultBreakerCooldown    = 10 * time.Second
+	defaultPersistInterval    = 1 * time.Minute
+	defaultCleanupInterval    = 1 * time.Minute
+)
+
+var defaultRetryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+const (
+	// Number of consecutive lookup failures after which the agent information
+	// is refreshed, regardless of the configured refresh interval.
+	agentRefreshFailures = 3
+)
+
+const (
+	// The http backend polls the health endpoint of the consul agent.
+	backendHTTP = "http"
+	// The streaming backend relies on the agent being configured with
+	// use_streaming_backend, in which case blocking queries on the health
+	// endpoint are served from a gRPC subscription to the consul servers
+	// instead of polling them. Watches are always enabled with this backend.
+	backendStreaming = "streaming"
+)
+
+const (
+	policyRoundRobin = "round_robin"
+	policySequential = "sequential"
+	policySticky     = "sticky"
+)
+
+const (
+	metricsDetailed  = "detailed"
+	metricsAggregate = "aggregate"
+)
+
+const (
+	gatewayNone   = "none"
+	gatewayLocal  = "local"
+	gatewayRemote = "remote"
+)
+
+const (
+	healthPassing  = "passing"
+	healthWarning  = "warning"
+	healthCritical = "critical"
+	healthAny      = "any"
 )
 
 // New constructs a new instance of a consul plugin.
@@ -57,21 +364,114 @@ func New() *Consul {
 	return &Consul{
 		Addr:               defaultAddr,
 		TTL:                defaultTTL,
+		Timeout:            defaultTimeout,
 		PrefetchAmount:     defaultPrefetchAmount,
 		PrefetchPercentage: defaultPrefetchPercentage,
 		PrefetchDuration:   defaultPrefetchDuration,
+		Backend:            defaultBackend,
+		Policy:             defaultPolicy,
+		Metrics:            defaultMetrics,
+		Health:             defaultHealth,
+		GatewayMode:        defaultGatewayMode,
+		Gateway:            defaultGateway,
+		RcodeForeign:       defaultRcodeForeign,
+		RcodeUnsupported:   defaultRcodeUnsupported,
+		RcodeMalformed:     defaultRcodeMalformed,
+		ChaosVersion:       defaultChaosVersion,
+		AgentRefresh:       defaultAgentRefresh,
+		RetryAttempts:      defaultRetryAttempts,
+		RetryBackoff:       defaultRetryBackoff,
+		RetryMaxBackoff:    defaultRetryMaxBackoff,
+		RetryStatusCodes:   defaultRetryStatusCodes,
+		BreakerThreshold:   defaultBreakerThreshold,
+		BreakerCooldown:    defaultBreakerCooldown,
+		PersistInterval:    defaultPersistInterval,
+		CleanupInterval:    defaultCleanupInterval,
 	}
 }
 
 // Name of the plugin, returns "consul".
 func (*Consul) Name() string { return "consul" }
 
+// Healthy returns false when the plugin is unable to reach consul, either
+// because most recent requests failed or because the circuit breakers of all
+// the consul agents are open.
+func (c *Consul) Healthy() bool {
+	c.mutex.RLock()
+	cache := c.cache
+	c.mutex.RUnlock()
+
+	if cache == nil {
+		return atomic.LoadUint32(&c.initFailed) == 0
+	}
+	return cache.client.healthy()
+}
+
+// Close stops the watches of the plugin, waits for the requests in flight to
+// consul to complete, and releases the connections to consul. The plugin must
+// not be used after being closed.
+func (c *Consul) Close() error {
+	c.mutex.RLock()
+	cache := c.cache
+	c.mutex.RUnlock()
+
+	if cache != nil {
+		cache.close()
+	}
+	return nil
+}
+
 // ServeDNS satisfies the plugin.Handler interface.
 func (c *Consul) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
-	rcode, answer, extra, err := c.serveDNS(ctx, state)
 
-	if err != nil {
+	if c.Chaos {
+		if answer := c.serveChaos(ctx, state); answer != nil {
+			a := &dns.Msg{}
+			a.SetReply(r)
+			a.Authoritative = true
+			a.Answer = answer
+			w.WriteMsg(a)
+			responsesInc(a.Rcode)
+			return a.Rcode, nil
+		}
+	}
+
+	if len(c.Zones) != 0 && plugin.Zones(c.Zones).Matches(state.Name()) == "" {
+		return plugin.NextOrFailure(c.Name(), c.Next, ctx, w, r)
+	}
+
+	t0 := time.Now()
+	stats := lookupStats{}
+	packed := packedReply{}
+	rcode, answer, extra, outOfScope, err := c.serveDNS(ctx, state, &stats, &packed)
+
+	switch {
+	case rcode == dns.RcodeServerFailure:
+		requestDurationsObserve("error", time.Since(t0))
+	case len(stats.cache) != 0:
+		requestDurationsObserve(stats.cache, time.Since(t0))
+	}
+
+	if packed.msg != nil {
+		w.Write(packed.msg)
+		packedHitsInc()
+		responsesInc(dns.RcodeSuccess)
+		c.logQuery(state, dns.RcodeSuccess, stats, time.Since(t0))
+		return dns.RcodeSuccess, nil
+	}
+
+	if err == nil && (rcode == dns.RcodeNameError || rcode == dns.RcodeRefused) && c.Fall.Through(state.Name()) {
+		return plugin.NextOrFailure(c.Name(), c.Next, ctx, w, r)
+	}
+
+	if outOfScope {
+		rcode = c.outOfScopeRcode(rcode)
+	}
+
+	// Requests rejected by ACLs or limits are counted by the metrics, logging
+	// them would flood the logs under load.
+	if err != nil && err != errACLDenied && err != errTooManyRequests {
 		log.Printf("[ERROR] %s: %s", state.Name(), err)
 	}
 
@@ -81,93 +481,329 @@ func (c *Consul) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 	a.Compress = true
 	a.Authoritative = true
 
-	if answer != nil {
-		a.Answer = append(a.Answer, answer)
+	if c.NoClientCache {
+		zeroTTL(answer)
+		zeroTTL(extra)
 	}
 
-	if extra != nil {
-		a.Extra = append(a.Extra, extra)
+	a.Answer = append(a.Answer, answer...)
+	a.Extra = append(a.Extra, extra...)
+
+	if state.Do() {
+		if signer := c.signer(); signer != nil {
+			signer.signMsg(a, state.Name(), nodataTypes(state.Name(), state.QType()), time.Now())
+		}
 	}
 
 	state.SizeAndDo(a)
 	a = state.Scrub(a)
+
+	if packed.cache != nil {
+		packed.cache.put(packed.key, a)
+	}
+
 	w.WriteMsg(a)
-	return rcode, err
+
+	responsesInc(a.Rcode)
+	c.logQuery(state, a.Rcode, stats, time.Since(t0))
+	return a.Rcode, err
 }
 
-func (c *Consul) serveDNS(ctx context.Context, state request.Request) (rcode int, answer dns.RR, extra dns.RR, err error) {
+// signer returns the signer of DNSSEC records, or nil if DNSSEC is disabled or
+// the plugin is not initialized.
+func (c *Consul) signer() *signer {
+	c.mutex.RLock()
+	cache := c.cache
+	c.mutex.RUnlock()
+
+	if cache == nil {
+		return nil
+	}
+	return cache.signer
+}
+
+// packedReply carries the packed response answering a query, or where the
+// response must be cached once it is built.
+type packedReply struct {
+	msg   []byte
+	cache *packedCache
+	key   packedKey
+}
+
+// serveDNS answers the query in state, stats is filled when the query is looked
+// up in the cache. outOfScope is true when the plugin does not resolve the name
+// or type of the query, see outOfScopeRcode. When the answer is served from a
+// packed response, it is set in packed instead of the records.
+func (c *Consul) serveDNS(ctx context.Context, state request.Request, stats *lookupStats, packed *packedReply) (rcode int, answer []dns.RR, extra []dns.RR, outOfScope bool, err error) {
 	var cache *cache
 	var agent consulAgent
 
+	n := atomic.AddInt64(&c.requests, 1)
+	inflightRequestsAdd(1)
+	defer func() {
+		atomic.AddInt64(&c.requests, -1)
+		inflightRequestsAdd(-1)
+	}()
+
+	if c.MaxRequests > 0 && n > int64(c.MaxRequests) {
+		rcode, err = dns.RcodeRefused, errTooManyRequests
+		return
+	}
+
 	if cache, agent, err = c.grabCache(ctx); err != nil {
 		rcode = dns.RcodeServerFailure
 		return
 	}
 
+	// Names are parsed and looked up in lower case, but answers are owned by
+	// the name as it was queried, since resolvers randomizing the case of the
+	// names they query (0x20) may reject answers which don't match it.
 	qname := state.Name()
 	qtype := state.QType()
+	owner := state.QName()
 
-	name, tag, typ, dc, domain := splitName(qname)
-	if len(name) == 0 {
-		rcode = dns.RcodeNameError
+	if cache.signer != nil && qtype == dns.TypeDNSKEY && qname == cache.signer.zone {
+		answer = cache.signer.dnskeys()
 		return
 	}
-	if domain != "consul" {
-		rcode = dns.RcodeRefused
+
+	if ip, ok := splitAddr(qname); ok {
+		rcode, answer = c.serveAddr(owner, qtype, ip)
+		outOfScope = rcode == dns.RcodeNotImplemented
 		return
 	}
-	if typ != "service" {
-		rcode = dns.RcodeNotImplemented
+
+	clientIP := net.ParseIP(state.IP())
+
+	var key key
+	if key, rcode = c.parseViewKey(qname, qtype, agent, clientIP); rcode != dns.RcodeSuccess {
+		if reason, ok := nameErrorOf(qname, rcode); ok {
+			atomic.AddUint64(&c.nameErrors[reason], 1)
+			nameErrorsInc(nameErrorReasons[reason])
+		}
+		outOfScope = true
 		return
 	}
-	if len(dc) == 0 {
-		dc = agent.Config.Datacenter
+
+	if len(c.ACLs) != 0 && !c.allowed(key.name, clientIP) {
+		rcode, err = dns.RcodeRefused, errACLDenied
+		return
 	}
 
-	key := key{name: name, tag: tag, dc: dc, qtype: qtype}
-	switch key.qtype {
-	case dns.TypeA, dns.TypeAAAA, dns.TypeANY:
-	case dns.TypeSRV:
-		key.qtype = dns.TypeANY
-	default:
-		rcode = dns.RcodeNotImplemented
+	// Services imported from peers are not in the datacenters of the catalog.
+	if c.DatacenterRefresh > 0 && len(key.peer) == 0 && !c.knownDatacenter(cache.client, key.dc) {
+		rcode = dns.RcodeNameError
 		return
 	}
 
+	var client []byte
+	if cache.sticky {
+		client = clientOf(state)
+	}
+
 	var srv service
 	var ttl time.Duration
-
-	if srv, ttl, err = cache.lookup(ctx, key, time.Now()); err != nil {
+	if srv, ttl, *stats, err = cache.lookupStats(ctx, key, time.Now(), client); err != nil {
+		if atomic.AddUint32(&c.failures, 1) >= agentRefreshFailures {
+			atomic.StoreUint32(&c.failures, 0)
+			c.refreshAgent(cache.client)
+		}
 		rcode = dns.RcodeServerFailure
 		return
 	}
 
+	if atomic.LoadUint32(&c.failures) != 0 {
+		atomic.StoreUint32(&c.failures, 0)
+	}
+
 	if srv.addr == nil {
 		rcode = dns.RcodeNameError
+		if !c.LegacyNXDomain && c.hasOtherAddrs(ctx, cache, key) {
+			rcode = dns.RcodeSuccess
+		}
 		return
 	}
 
+	if gateway, ok := c.gatewayOf(key, agent); ok {
+		var gatewayTTL time.Duration
+		if srv, gatewayTTL, err = cache.lookup(ctx, gateway, time.Now()); err == nil && srv.addr == nil {
+			err = fmt.Errorf("no %s addresses for %s", gateway.addr, gateway)
+		}
+		if err != nil {
+			rcode = dns.RcodeServerFailure
+			return
+		}
+		if gatewayTTL < ttl {
+			ttl = gatewayTTL
+		}
+	}
+
+	ttl = c.clampTTL(ttl)
+
+	// Signed responses are not packed, signatures are cached by the signer.
+	if cache.packed != nil && stats.popular && (cache.signer == nil || !state.Do()) {
+		if k, ok := packedKeyOf(state, srv); ok {
+			if r := cache.packed.get(k); r != nil {
+				var recordTTL uint32
+				if !c.NoClientCache {
+					recordTTL = ttlSeconds(ttl)
+				}
+				packed.msg = r.reply(state.Req, recordTTL)
+				return
+			}
+			packed.cache, packed.key = cache.packed, k
+		}
+	}
+
 	switch qtype {
 	case dns.TypeA:
-		answer = srv.A(qname, ttl)
+		answer = []dns.RR{srv.A(owner, ttl)}
 	case dns.TypeAAAA:
-		answer = srv.AAAA(qname, ttl)
+		answer = []dns.RR{srv.AAAA(owner, ttl)}
 	case dns.TypeANY:
-		answer = srv.ANY(qname, ttl)
+		answer = []dns.RR{srv.ANY(owner, ttl)}
 	case dns.TypeSRV:
-		rr := srv.SRV(qname, ttl)
-		answer = rr
-		extra = srv.ANY(rr.Target, ttl)
+		rr := srv.SRV(owner, ttl)
+		answer = []dns.RR{rr}
+		extra = []dns.RR{srv.ANY(rr.Target, ttl)}
 	}
 	return
 }
 
+// outOfScopeRcode returns the response code configured to answer queries which
+// the plugin does not resolve, given the response code chosen by serveDNS:
+// REFUSED for names outside of the consul domain, NOTIMP for unsupported query
+// types and names, and NXDOMAIN for malformed names.
+func (c *Consul) outOfScopeRcode(rcode int) int {
+	switch rcode {
+	case dns.RcodeRefused:
+		return c.RcodeForeign
+	case dns.RcodeNotImplemented:
+		return c.RcodeUnsupported
+	case dns.RcodeNameError:
+		return c.RcodeMalformed
+	}
+	return rcode
+}
+
+// serveAddr answers queries for the <hex-ip>.addr[.<dc>].consul names which
+// consul uses as targets of SRV records, the address is decoded from the name.
+func (c *Consul) serveAddr(qname string, qtype uint16, ip net.IP) (rcode int, answer []dns.RR) {
+	if ip == nil {
+		rcode = dns.RcodeNameError
+		return
+	}
+
+	srv := service{addr: ip}
+	ttl := c.clampTTL(c.TTL - time.Second)
+
+	switch {
+	case qtype == dns.TypeANY:
+		answer = []dns.RR{srv.ANY(qname, ttl)}
+	case qtype == dns.TypeA && isIPv4(ip):
+		answer = []dns.RR{srv.A(qname, ttl)}
+	case qtype == dns.TypeAAAA && isIPv6(ip):
+		answer = []dns.RR{srv.AAAA(qname, ttl)}
+	case qtype != dns.TypeA && qtype != dns.TypeAAAA:
+		rcode = dns.RcodeNotImplemented
+	case c.LegacyNXDomain:
+		rcode = dns.RcodeNameError
+	}
+	return
+}
+
+// gatewayOf returns the key of the mesh gateway that the service of k must be
+// reached through, ok is false if the service is directly reachable.
+func (c *Consul) gatewayOf(k key, agent consulAgent) (gateway key, ok bool) {
+	remote := len(k.peer) != 0 || (len(k.dc) != 0 && k.dc != agent.Config.Datacenter)
+
+	if !remote || c.GatewayMode == gatewayNone || len(c.GatewayMode) == 0 {
+		return
+	}
+
+	gateway = key{name: c.Gateway, dc: agent.Config.Datacenter, addr: "lan", qtype: k.qtype}
+	if c.GatewayMode == gatewayRemote && len(k.peer) == 0 {
+		gateway.dc, gateway.addr = k.dc, "wan"
+	}
+	return gateway, true
+}
+
+// hasOtherAddrs returns true if the service of an A or AAAA query has addresses
+// of the other family, in which case the name exists and the query is answered
+// with NODATA instead of NXDOMAIN.
+func (c *Consul) hasOtherAddrs(ctx context.Context, cache *cache, k key) bool {
+	if k.qtype != dns.TypeA && k.qtype != dns.TypeAAAA {
+		return false
+	}
+	k.qtype = dns.TypeANY
+	srv, _, err := cache.lookup(ctx, k, time.Now())
+	return err == nil && srv.addr != nil
+}
+
+// nodataTypes returns the types of the records that qname has when a query for
+// qtype is answered with NODATA, which only happens for the address family
+// that a service or an addr name does not have.
+func nodataTypes(qname string, qtype uint16) []uint16 {
+	if ip, ok := splitAddr(qname); ok {
+		switch {
+		case isIPv4(ip):
+			return []uint16{dns.TypeA}
+		case isIPv6(ip):
+			return []uint16{dns.TypeAAAA}
+		}
+		return nil
+	}
+
+	switch qtype {
+	case dns.TypeA:
+		return []uint16{dns.TypeAAAA, dns.TypeSRV}
+	case dns.TypeAAAA:
+		return []uint16{dns.TypeA, dns.TypeSRV}
+	}
+	return nil
+}
+
+// maxRecordTTL returns the maximum TTL of records in responses.
+func (c *Consul) maxRecordTTL() time.Duration {
+	ttl := c.TTL
+	if ttl < c.TTLAdaptiveMax {
+		ttl = c.TTLAdaptiveMax
+	}
+	if ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+	if ttl += time.Second; c.MaxTTL > 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	return ttl
+}
+
+// zeroTTL sets the TTL of all the records of rrs to zero.
+func zeroTTL(rrs []dns.RR) {
+	for _, rr := range rrs {
+		rr.Header().Ttl = 0
+	}
+}
+
+// clampTTL returns ttl adjusted so the TTL of records in responses is within
+// the configured bounds. Record TTLs are rounded up to the next second.
+func (c *Consul) clampTTL(ttl time.Duration) time.Duration {
+	if c.MinTTL > 0 && ttl < c.MinTTL-time.Second {
+		ttl = c.MinTTL - time.Second
+	}
+	if c.MaxTTL > 0 && ttl >= c.MaxTTL {
+		ttl = c.MaxTTL - time.Second
+	}
+	return ttl
+}
+
 func (c *Consul) grabCache(ctx context.Context) (*cache, consulAgent, error) {
 	var err error
 
 	c.mutex.RLock()
 	cache := c.cache
 	agent := c.agent
+	agentExp := c.agentExp
 	c.mutex.RUnlock()
 
 	if cache == nil {
@@ -177,17 +813,58 @@ func (c *Consul) grabCache(ctx context.Context) (*cache, consulAgent, error) {
 			if err == nil {
 				c.cache = cache
 				c.agent = agent
+				c.agentExp = time.Now().Add(c.AgentRefresh)
+				atomic.StoreUint32(&c.initFailed, 0)
+			} else {
+				atomic.StoreUint32(&c.initFailed, 1)
 			}
+			healthySet(err == nil)
+		} else {
+			agent = c.agent
 		}
 		c.mutex.Unlock()
+	} else if time.Now().After(agentExp) {
+		c.refreshAgent(cache.client)
 	}
 
 	return cache, agent, err
 }
 
+// refreshAgent fetches the agent information in the background, unless a
+// refresh is already in progress. Lookups keep using the current information
+// until the refresh completes.
+func (c *Consul) refreshAgent(client *client) {
+	if !c.agentLock.tryLock() {
+		return
+	}
+
+	go func() {
+		defer c.agentLock.unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		agent, err := c.fetchAgentInfo(ctx, client)
+		cancel()
+
+		c.mutex.Lock()
+		if err == nil {
+			c.agent = agent
+		}
+		// The expiration is pushed back on errors as well, so a failing agent
+		// doesn't get a refresh request on every lookup.
+		c.agentExp = time.Now().Add(c.AgentRefresh)
+		c.mutex.Unlock()
+
+		if err != nil {
+			log.Printf("[ERROR] refreshing consul agent information: %s", err)
+		}
+	}()
+}
+
 func (c *Consul) init(ctx context.Context) (*cache, consulAgent, error) {
-	log.Printf("[INFO] consul %s { ttl %s; prefetch %d %s %d%% }",
-		c.Addr, c.TTL, c.PrefetchAmount, c.PrefetchDuration, c.PrefetchPercentage)
+	addrs := append([]string{c.Addr}, c.FailoverAddrs...)
+
+	log.Printf("[INFO] consul %s { ttl %s; timeout %s; prefetch %d %s %d%%; watch %t; backend %s; near %q; policy %s; filter %q; health %s; node_meta %v }",
+		strings.Join(addrs, " "), c.TTL, c.Timeout, c.PrefetchAmount, c.PrefetchDuration, c.PrefetchPercentage, c.Watch, c.Backend, c.Near, c.Policy, c.Filter, c.Health, c.NodeMeta)
 
 	var transport http.RoundTripper
 	if transport = c.Transport; transport == nil {
@@ -204,31 +881,121 @@ func (c *Consul) init(ctx context.Context) (*cache, consulAgent, error) {
 		}
 	}
 
-	agent, err := c.fetchAgentInfo(ctx, transport)
+	client := newClient(addrs, transport)
+	client.breakerThreshold = c.BreakerThreshold
+	client.breakerCooldown = c.BreakerCooldown
+	client.header = c.Headers.Clone()
+
+	if len(c.UserAgent) != 0 {
+		if client.header == nil {
+			client.header = make(http.Header)
+		}
+		client.header.Set("User-Agent", c.UserAgent)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	agent, err := c.fetchAgentInfo(ctx, client)
+
+	var snap *snapshot
+	if len(c.Persist) != 0 {
+		var snapErr error
+		if snap, snapErr = readSnapshot(c.Persist); snapErr != nil {
+			log.Printf("[ERROR] reading consul cache snapshot from %s: %s", c.Persist, snapErr)
+		}
+	}
+
 	if err != nil {
-		return nil, consulAgent{}, err
+		if snap == nil {
+			return nil, consulAgent{}, err
+		}
+		// Use the agent information from the snapshot so the plugin can
+		// start when consul is unavailable, it is refreshed after a few
+		// lookup failures or when the refresh interval expires.
+		log.Printf("[WARN] using consul agent information from %s: %s", c.Persist, err)
+		agent = snap.Agent
 	}
 
 	cache := &cache{
-		addr:               c.Addr,
+		client:             client,
 		ttl:                c.TTL,
+		ttlNegative:        c.TTLNegative,
+		ttlAdaptiveMin:     c.TTLAdaptiveMin,
+		ttlAdaptiveMax:     c.TTLAdaptiveMax,
+		timeout:            c.Timeout,
 		prefetchAmount:     c.PrefetchAmount,
 		prefetchPercentage: c.PrefetchPercentage,
 		prefetchDuration:   c.PrefetchDuration,
-		transport:          transport,
+		watch:              c.Watch || c.Backend == backendStreaming,
+		near:               c.Near,
+		sequential:         c.Policy == policySequential,
+		sticky:             c.Policy == policySticky,
+		filter:             c.Filter,
+		health:             c.Health,
+		nodeMeta:           c.NodeMeta,
+		retry: retryPolicy{
+			attempts:    c.RetryAttempts,
+			backoff:     c.RetryBackoff,
+			maxBackoff:  c.RetryMaxBackoff,
+			statusCodes: c.RetryStatusCodes,
+		},
+		maxStale:  c.MaxStale,
+		maxMemory: c.MaxMemory,
+		aggregate: c.Metrics == metricsAggregate,
+
+		invalidAddrLog: c.InvalidAddrLog,
+	}
+
+	if c.MaxConcurrentFetches > 0 {
+		cache.fetches = make(chan struct{}, c.MaxConcurrentFetches)
+	}
+
+	if c.PackedResponses > 0 {
+		cache.packed = newPackedCache(c.PackedResponses)
+	}
+
+	if c.DatacenterRefresh > 0 {
+		c.refreshDatacenters(client)
+	}
+
+	if len(c.DNSSEC) != 0 {
+		if cache.signer, err = c.newSigner(); err != nil {
+			return nil, consulAgent{}, err
+		}
+	}
+
+	cache.ctx, cache.cancel = context.WithCancel(context.Background())
+
+	// Without max_stale, the services which expired while CoreDNS was down
+	// cannot be served until consul is reachable again.
+	if snap != nil {
+		if n := cache.restore(snap.Entries, time.Now()); n != 0 && c.MaxStale == 0 {
+			log.Printf("[WARN] %d expired services from %s were not restored, set max_stale to serve them while consul is unavailable", n, c.Persist)
+		}
 	}
 
 	return cache, agent, nil
 }
 
-func (c *Consul) fetchAgentInfo(ctx context.Context, transport http.RoundTripper) (agent consulAgent, err error) {
-	var req *http.Request
-	var res *http.Response
+func (c *Consul) newSigner() (*signer, error) {
+	keys := make([]dnssecKey, len(c.DNSSEC))
 
-	if req, err = http.NewRequest(http.MethodGet, c.Addr+"/v1/agent/self", nil); err != nil {
-		return
+	for i, path := range c.DNSSEC {
+		k, err := readDNSSECKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = k
 	}
-	if res, err = transport.RoundTrip(req.WithContext(ctx)); err != nil {
+
+	return newSigner(keys, c.maxRecordTTL())
+}
+
+func (c *Consul) fetchAgentInfo(ctx context.Context, client *client) (agent consulAgent, err error) {
+	var res *http.Response
+
+	if res, err = client.get(ctx, "/v1/agent/self"); err != nil {
 		return
 	}
 	defer res.Body.Close()
@@ -249,6 +1016,94 @@ type consulAgent struct {
 
 type consulAgentConfig struct {
 	Datacenter string
+	NodeName   string
+}
+
+// parseKey returns the cache key for a query of the given name and type,
+// or the response code to answer with if the query is not supported.
+func parseKey(qname string, qtype uint16, agent consulAgent) (k key, rcode int) {
+	name, tag, typ, dc, domain := splitName(qname)
+	if len(name) == 0 {
+		rcode = dns.RcodeNameError
+		return
+	}
+	if domain != "consul" {
+		rcode = dns.RcodeRefused
+		return
+	}
+	if typ != "service" {
+		rcode = dns.RcodeNotImplemented
+		return
+	}
+	peer, dc := splitPeer(dc)
+	if len(dc) == 0 && len(peer) == 0 {
+		dc = agent.Config.Datacenter
+	}
+	id, tag := splitInstance(tag)
+
+	k = key{name: name, tag: tag, id: id, dc: dc, peer: peer, qtype: qtype}
+	switch k.qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeANY:
+	case dns.TypeSRV:
+		k.qtype = dns.TypeANY
+	default:
+		rcode = dns.RcodeNotImplemented
+	}
+	return
+}
+
+// Reasons why queried names could not be parsed, see nameErrorOf.
+const (
+	nameErrorRFC2782 = iota
+	nameErrorNoService
+	nameErrorSuffix
+)
+
+var nameErrorReasons = [...]string{
+	nameErrorRFC2782:   "bad_rfc2782",
+	nameErrorNoService: "missing_service_label",
+	nameErrorSuffix:    "unknown_suffix",
+}
+
+// nameErrorOf returns the reason why qname could not be parsed, given the
+// response code returned by parseKey. ok is false if the name was parsed, or
+// if it is well formed but not supported by the plugin.
+func nameErrorOf(qname string, rcode int) (reason int, ok bool) {
+	switch {
+	case rcode != dns.RcodeNameError && rcode != dns.RcodeRefused:
+		return
+	case !dns.IsSubDomain("consul.", qname):
+		reason = nameErrorSuffix
+	case strings.HasPrefix(qname, "_"):
+		reason = nameErrorRFC2782
+	default:
+		reason = nameErrorNoService
+	}
+	return reason, true
+}
+
+// isEmptyNonTerminal returns true if qname is in the consul domain and has no
+// records, but is the parent of names of services or addresses, like
+// service.consul., dc1.consul. or service.dc1.consul.
+func isEmptyNonTerminal(qname string) bool {
+	if !dns.IsSubDomain("consul.", qname) || qname == "consul." {
+		return false
+	}
+
+	labels := dns.SplitDomainName(strings.TrimSuffix(qname, "consul."))
+
+	// The datacenter part of the names is either empty, a datacenter, or a
+	// cluster peer in the <peer>.peer form.
+	for _, n := range []int{0, 1, 2} {
+		if n > len(labels) || (n == 2 && labels[len(labels)-1] != "peer") {
+			break
+		}
+		switch strings.Join(labels[:len(labels)-n], ".") {
+		case "", "service", "addr", "_tcp.service":
+			return true
+		}
+	}
+	return false
 }
 
 func splitName(s string) (name, tag, typ, dc, domain string) {
@@ -273,6 +1128,51 @@ func splitNameDefault(s string) (name, tag, typ, dc, domain string) {
 	return
 }
 
+// splitAddr decodes the IP address of a name in the <hex-ip>.addr[.<dc>].consul
+// form, ok is false if the name is not in this form and ip is nil if the name
+// does not hold a valid address.
+func splitAddr(s string) (ip net.IP, ok bool) {
+	s = strings.TrimSuffix(s, ".")
+
+	i := strings.Index(s, ".addr.")
+	if i < 0 {
+		return
+	}
+
+	if domain, _ := splitLast(s[i+len(".addr."):]); domain != "consul" {
+		return
+	}
+
+	ok = true
+	b, err := hex.DecodeString(s[:i])
+	if err == nil && (len(b) == net.IPv4len || len(b) == net.IPv6len) {
+		ip = net.IP(b).To16()
+	}
+	return
+}
+
+// splitInstance extracts the ID of a service instance from the tag part of a
+// name in the <id>.instance.<service>.service.consul form.
+func splitInstance(s string) (id, tag string) {
+	if strings.HasSuffix(s, ".instance") {
+		id = strings.TrimSuffix(s, ".instance")
+	} else {
+		tag = s
+	}
+	return
+}
+
+// splitPeer extracts the name of a cluster peer from the datacenter part of a
+// name in the service.<peer>.peer.consul form.
+func splitPeer(s string) (peer, dc string) {
+	if strings.HasSuffix(s, ".peer") {
+		peer = strings.TrimSuffix(s, ".peer")
+	} else {
+		dc = s
+	}
+	return
+}
+
 func splitNameRFC2782(s string) (name, tag, typ, dc, domain string) {
 	name, s = split(s)
 	tag, s = split(s)
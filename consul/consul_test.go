@@ -1,6 +1,7 @@
 package consul
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -9,13 +10,21 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	corednstest "github.com/coredns/coredns/plugin/test"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/coredns-plugins/consul/consultest"
 )
 
 func init() {
@@ -31,11 +40,14 @@ func TestConsul(t *testing.T) {
 		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10004, pass: true, tags: []string{"zone-1"}},
 
 		// host 2
-		{node: "host-2", name: "service-1", addr: "192.168.0.2", port: 10011, pass: true, tags: []string{"zone-2"}},
+		{node: "host-2", name: "service-1", addr: "192.168.0.2", port: 10011, pass: true, tags: []string{"zone-2"}, id: "service-1-host-2"},
 		{node: "host-2", name: "service-2", addr: "192.168.0.2", port: 10012, pass: true, tags: []string{"zone-2"}},
 
 		// host 3
 		{node: "host-3", name: "service-1", addr: "2001:db8:85a3::8a2e:370:7334", port: 10021, pass: true, tags: []string{"zone-1"}},
+
+		// host 4 (imported from the cluster peer "cluster-2")
+		{node: "host-4", name: "service-1", addr: "192.168.1.4", port: 10031, pass: true, tags: []string{"zone-1"}, peer: "cluster-2"},
 	}
 
 	tests := []struct {
@@ -178,6 +190,89 @@ func TestConsul(t *testing.T) {
 			},
 		},
 
+		{
+			scenario: "sending a A query for a service imported from a cluster peer returns the correct addresses",
+			qname:    "service-1.service.cluster-2.peer.consul.",
+			qtype:    dns.TypeA,
+			replies: []*dns.Msg{
+				{Answer: []dns.RR{rrA("service-1.service.cluster-2.peer.consul.", "192.168.1.4")}},
+			},
+		},
+
+		{
+			scenario: "sending a A query for a service of a cluster peer that the server does not know about returns a NXDOMAIN error",
+			qname:    "service-1.service.cluster-3.peer.consul.",
+			qtype:    dns.TypeA,
+			rcode:    dns.RcodeNameError,
+		},
+
+		{
+			scenario: "sending a AAAA query for a service with only IPv4 addresses returns an empty answer",
+			qname:    "service-2.service.consul.",
+			qtype:    dns.TypeAAAA,
+			rcode:    dns.RcodeSuccess,
+			replies: []*dns.Msg{
+				{},
+			},
+		},
+
+		{
+			scenario: "sending a SRV query for a service instance returns the instance with this ID",
+			qname:    "service-1-host-2.instance.service-1.service.consul.",
+			qtype:    dns.TypeSRV,
+			replies: []*dns.Msg{
+				{Answer: []dns.RR{rrSRV("service-1-host-2.instance.service-1.service.consul.", "host-2.node.dc1.consul.", 10011)}, Extra: []dns.RR{rrA("host-2.node.dc1.consul.", "192.168.0.2")}},
+			},
+		},
+
+		{
+			scenario: "sending a A query for a service instance that does not exist returns a NXDOMAIN error",
+			qname:    "service-1-host-9.instance.service-1.service.consul.",
+			qtype:    dns.TypeA,
+			rcode:    dns.RcodeNameError,
+		},
+
+		{
+			scenario: "sending a A query for an address name returns the address encoded in the name",
+			qname:    "c0a8000a.addr.dc1.consul.",
+			qtype:    dns.TypeA,
+			replies: []*dns.Msg{
+				{Answer: []dns.RR{rrA("c0a8000a.addr.dc1.consul.", "192.168.0.10")}},
+			},
+		},
+
+		{
+			scenario: "sending a AAAA query for an address name without a datacenter returns the address encoded in the name",
+			qname:    "20010db885a3000000008a2e03707334.addr.consul.",
+			qtype:    dns.TypeAAAA,
+			replies: []*dns.Msg{
+				{Answer: []dns.RR{rrAAAA("20010db885a3000000008a2e03707334.addr.consul.", "2001:db8:85a3::8a2e:370:7334")}},
+			},
+		},
+
+		{
+			scenario: "sending a AAAA query for an IPv4 address name returns an empty answer",
+			qname:    "c0a8000a.addr.dc1.consul.",
+			qtype:    dns.TypeAAAA,
+			replies: []*dns.Msg{
+				{},
+			},
+		},
+
+		{
+			scenario: "sending a A query for an invalid address name returns a NXDOMAIN error",
+			qname:    "c0a8000z.addr.dc1.consul.",
+			qtype:    dns.TypeA,
+			rcode:    dns.RcodeNameError,
+		},
+
+		{
+			scenario: "sending a AAAA query for a service that does not exist returns a NXDOMAIN error",
+			qname:    "service-4.service.consul.",
+			qtype:    dns.TypeAAAA,
+			rcode:    dns.RcodeNameError,
+		},
+
 		{
 			scenario: "sending a SRV query in RFC 2782 format for a datacenter of that the server does not know about returns a NSDOMAIN error",
 			qname:    "_service-1._tcp.service.dc2.consul.",
@@ -228,77 +323,1569 @@ func TestConsul(t *testing.T) {
 	}
 }
 
-func consulServer(serverDC string, serverServices []consulServerService) *httptest.Server {
-	return httptest.NewServer(consulHandler(serverDC, serverServices))
+func TestConsulMixedCase(t *testing.T) {
+	var fetches int32
+
+	handler := consulHandler("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", id: "Service-1-A", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/health/service/") {
+			atomic.AddInt32(&fetches, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		reply *dns.Msg
+	}{
+		{
+			qname: "Service-1.SERVICE.consul.",
+			qtype: dns.TypeA,
+			reply: &dns.Msg{Answer: []dns.RR{rrA("Service-1.SERVICE.consul.", "192.168.0.1")}},
+		},
+		{
+			qname: "sErViCe-1.service.CoNsUl.",
+			qtype: dns.TypeA,
+			reply: &dns.Msg{Answer: []dns.RR{rrA("sErViCe-1.service.CoNsUl.", "192.168.0.1")}},
+		},
+		{
+			qname: "SERVICE-1-A.instance.service-1.service.consul.",
+			qtype: dns.TypeA,
+			reply: &dns.Msg{Answer: []dns.RR{rrA("SERVICE-1-A.instance.service-1.service.consul.", "192.168.0.1")}},
+		},
+		{
+			qname: "C0A80001.ADDR.consul.",
+			qtype: dns.TypeA,
+			reply: &dns.Msg{Answer: []dns.RR{rrA("C0A80001.ADDR.consul.", "192.168.0.1")}},
+		},
+	}
+
+	for _, test := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(test.qname, test.qtype)
+		rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+		if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+
+		if !replyEqual(test.reply, rec.Msg) {
+			t.Errorf("%s: Unexpected reply: %v", test.qname, rec.Msg)
+		}
+	}
+
+	// One fetch for the service, and one for the instance.
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("Expected names differing by case to share cache entries, but consul was queried %d times", n)
+	}
 }
 
-func consulHandler(serverDC string, serverServices []consulServerService) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		const (
-			v1AgentSelf     = "/v1/agent/self"
-			v1HealthService = "/v1/health/service/"
-		)
-
-		switch {
-		case r.URL.Path == v1AgentSelf:
-			json.NewEncoder(w).Encode(consulAgent{
-				Config: consulAgentConfig{
-					Datacenter: serverDC,
-				},
-			})
+func TestConsulRequestDurations(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+	defer server.Close()
 
-		case strings.HasPrefix(r.URL.Path, v1HealthService):
-			var (
-				service = strings.TrimPrefix(r.URL.Path, v1HealthService)
-				query   = r.URL.Query()
-				tag     = query.Get("tag")
-				dc      = query.Get("dc")
-				pass    = query.Get("passing")
-				results = make([]consulHealthService, 0, len(serverServices))
-			)
-
-			if len(dc) == 0 || dc == serverDC {
-				for _, srv := range serverServices {
-					if srv.name != service {
-						continue
-					}
-					if len(tag) != 0 && !srv.hasTag(tag) {
-						continue
-					}
-					if len(pass) != 0 && !srv.pass {
-						continue
-					}
-					results = append(results, consulHealthService{
-						Node:    consulNode{Node: srv.node, Datacenter: serverDC},
-						Service: consulService{Address: srv.addr, Port: srv.port},
-					})
-				}
+	consul := New()
+	consul.Addr = server.URL
+
+	observations := func() (counts map[string]float64) {
+		counts = map[string]float64{}
+		for _, outcome := range []string{"hit", "miss", "prefetch_wait", "error"} {
+			counts[outcome] = metricValue(requestDurations.WithLabelValues(outcome).(prometheus.Metric))
+		}
+		return
+	}
+
+	before := observations()
+
+	for i := 0; i != 3; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("service-1.service.consul.", dns.TypeA)
+		rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+		if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after := observations()
+
+	if n := after["miss"] - before["miss"]; n != 1 {
+		t.Errorf("Expected 1 query observed as a miss but found: %g", n)
+	}
+
+	if n := after["hit"] - before["hit"]; n != 2 {
+		t.Errorf("Expected 2 queries observed as hits but found: %g", n)
+	}
+}
+
+func TestConsulNear(t *testing.T) {
+	var near atomic.Value
+
+	handler := consulHandler("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+		{node: "host-2", name: "service-1", addr: "192.168.0.2", port: 10011, pass: true},
+		{node: "host-3", name: "service-1", addr: "192.168.0.3", port: 10021, pass: true},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/health/service/") {
+			near.Store(r.URL.Query().Get("near"))
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.Near = "_agent"
+	consul.Policy = policySequential
+
+	for i := 0; i != 10; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("service-1.service.consul.", dns.TypeA)
+		rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+		if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+
+		reply := &dns.Msg{Answer: []dns.RR{rrA("service-1.service.consul.", "192.168.0.1")}}
+		if !replyEqual(reply, rec.Msg) {
+			t.Fatalf("Unexpected reply: %v", rec.Msg)
+		}
+	}
+
+	if v, _ := near.Load().(string); v != "_agent" {
+		t.Errorf("Expected the near parameter to be %q but found: %q", "_agent", v)
+	}
+}
+
+func TestConsulSticky(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+		{node: "host-2", name: "service-1", addr: "192.168.0.2", port: 10011, pass: true},
+		{node: "host-3", name: "service-1", addr: "192.168.0.3", port: 10021, pass: true},
+	})
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.Policy = policySticky
+
+	resolve := func(clientIP string, subnet *dns.EDNS0_SUBNET) string {
+		req := &dns.Msg{}
+		req.SetQuestion("service-1.service.consul.", dns.TypeA)
+		if subnet != nil {
+			req.SetEdns0(4096, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, subnet)
+		}
+		rec := dnstest.NewRecorder(&corednstest.ResponseWriter{RemoteIP: clientIP})
+
+		if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.Msg.Answer) != 1 {
+			t.Fatalf("Unexpected reply: %v", rec.Msg)
+		}
+		return rec.Msg.Answer[0].(*dns.A).A.String()
+	}
+
+	found := map[string]bool{}
+
+	for i := 0; i != 50; i++ {
+		clientIP := fmt.Sprintf("10.0.%d.%d", i/10, i%10+1)
+		addr := resolve(clientIP, nil)
+		found[addr] = true
+
+		for j := 0; j != 5; j++ {
+			if a := resolve(clientIP, nil); a != addr {
+				t.Fatalf("Expected client %s to always receive %s but found: %s", clientIP, addr, a)
+			}
+		}
+	}
+
+	if len(found) != 3 {
+		t.Errorf("Expected clients to be spread across 3 services but found: %v", found)
+	}
+
+	for i := 0; i != 10; i++ {
+		subnet := func(ip string) *dns.EDNS0_SUBNET {
+			return &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				Address:       net.ParseIP(ip).To4(),
 			}
+		}
 
-			json.NewEncoder(w).Encode(results)
-		default:
-			w.WriteHeader(http.StatusNotFound)
+		a := resolve("127.0.0.1", subnet(fmt.Sprintf("172.16.%d.1", i)))
+		b := resolve("127.0.0.2", subnet(fmt.Sprintf("172.16.%d.200", i)))
+
+		if a != b {
+			t.Errorf("Expected clients of the subnet 172.16.%d.0/24 to receive the same service but found: %s and %s", i, a, b)
 		}
+	}
+}
 
+func TestConsulWeights(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true, weights: consulServiceWeights{Passing: 9, Warning: 1}},
+		{node: "host-2", name: "service-1", addr: "192.168.0.2", port: 10011, pass: true, weights: consulServiceWeights{Passing: 1, Warning: 1}},
+		{node: "host-3", name: "service-1", addr: "192.168.0.3", port: 10021, warn: true, weights: consulServiceWeights{Passing: 9, Warning: 0}},
 	})
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.Health = healthWarning
+
+	counts := map[string]int{}
+
+	for i := 0; i != 1000; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("service-1.service.consul.", dns.TypeA)
+		rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+		if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.Msg.Answer) != 1 {
+			t.Fatalf("Unexpected reply: %v", rec.Msg)
+		}
+		counts[rec.Msg.Answer[0].(*dns.A).A.String()]++
+	}
+
+	if n := counts["192.168.0.1"]; n < 850 || n > 950 {
+		t.Errorf("Expected about 900 answers with the service of weight 9 but found: %d", n)
+	}
+
+	if n := counts["192.168.0.2"]; n < 50 || n > 150 {
+		t.Errorf("Expected about 100 answers with the service of weight 1 but found: %d", n)
+	}
+
+	if n := counts["192.168.0.3"]; n != 0 {
+		t.Errorf("Expected no answers with the warning service of weight 0 but found: %d", n)
+	}
 }
 
-type consulServerService struct {
-	node string
-	name string
-	addr string
-	port int
-	pass bool
-	tags []string
+func TestConsulHealth(t *testing.T) {
+	services := []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+		{node: "host-2", name: "service-1", addr: "192.168.0.2", port: 10011, warn: true},
+		{node: "host-3", name: "service-1", addr: "192.168.0.3", port: 10021},
+	}
+
+	tests := []struct {
+		health string
+		addrs  []string
+	}{
+		{health: healthPassing, addrs: []string{"192.168.0.1"}},
+		{health: healthWarning, addrs: []string{"192.168.0.1", "192.168.0.2"}},
+		{health: healthAny, addrs: []string{"192.168.0.1", "192.168.0.2", "192.168.0.3"}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.health, func(t *testing.T) {
+			t.Parallel()
+
+			server := consulServer("dc1", services)
+			defer server.Close()
+
+			consul := New()
+			consul.Addr = server.URL
+			consul.Health = test.health
+
+			found := map[string]bool{}
+
+			for i := 0; i != 30; i++ {
+				req := &dns.Msg{}
+				req.SetQuestion("service-1.service.consul.", dns.TypeA)
+				rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+				if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+					t.Fatal(err)
+				}
+
+				for _, rr := range rec.Msg.Answer {
+					found[rr.(*dns.A).A.String()] = true
+				}
+			}
+
+			if len(found) != len(test.addrs) {
+				t.Errorf("Expected %d addresses but found %d: %v", len(test.addrs), len(found), found)
+			}
+
+			for _, addr := range test.addrs {
+				if !found[addr] {
+					t.Errorf("Expected %s to be returned", addr)
+				}
+			}
+		})
+	}
+}
+
+func TestConsulNodeMeta(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true, meta: map[string]string{"storage": "hdd"}},
+		{node: "host-2", name: "service-1", addr: "192.168.0.2", port: 10011, pass: true, meta: map[string]string{"storage": "ssd"}},
+	})
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.NodeMeta = map[string]string{"storage": "ssd"}
+
+	for i := 0; i != 10; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("service-1.service.consul.", dns.TypeA)
+		rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+		if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+
+		reply := &dns.Msg{Answer: []dns.RR{rrA("service-1.service.consul.", "192.168.0.2")}}
+		if !replyEqual(reply, rec.Msg) {
+			t.Fatalf("Unexpected reply: %v", rec.Msg)
+		}
+	}
 }
 
-func (srv *consulServerService) hasTag(tag string) bool {
-	for _, srvTag := range srv.tags {
-		if srvTag == tag {
-			return true
+func TestConsulAgentRefresh(t *testing.T) {
+	var dc2 int32
+
+	handler1 := consulHandler("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+	handler2 := consulHandler("dc2", []consulServerService{
+		{node: "host-2", name: "service-1", addr: "192.168.0.2", port: 10011, pass: true},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&dc2) == 0 {
+			handler1.ServeHTTP(w, r)
+		} else {
+			handler2.ServeHTTP(w, r)
+		}
+	}))
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.AgentRefresh = 10 * time.Millisecond
+
+	lookup := func() *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion("service-1.service.consul.", dns.TypeA)
+		rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+		if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Msg
+	}
+
+	if msg := lookup(); !replyEqual(&dns.Msg{Answer: []dns.RR{rrA("service-1.service.consul.", "192.168.0.1")}}, msg) {
+		t.Fatalf("Unexpected reply: %v", msg)
+	}
+
+	// The agent restarted in a different datacenter.
+	atomic.StoreInt32(&dc2, 1)
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if msg := lookup(); replyEqual(&dns.Msg{Answer: []dns.RR{rrA("service-1.service.consul.", "192.168.0.2")}}, msg) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the agent information was not refreshed")
 		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConsulTTLBounds(t *testing.T) {
+	tests := []struct {
+		scenario string
+		ttl      time.Duration
+		minTTL   time.Duration
+		maxTTL   time.Duration
+		noCache  bool
+		expect   uint32
+	}{
+		{
+			scenario: "max_ttl",
+			ttl:      10 * time.Minute,
+			maxTTL:   30 * time.Second,
+			expect:   30,
+		},
+
+		{
+			scenario: "min_ttl",
+			ttl:      1 * time.Minute,
+			minTTL:   5 * time.Minute,
+			expect:   300,
+		},
+
+		{
+			scenario: "no_client_cache",
+			ttl:      1 * time.Minute,
+			minTTL:   5 * time.Minute,
+			noCache:  true,
+			expect:   0,
+		},
+	}
+
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+	defer server.Close()
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.scenario, func(t *testing.T) {
+			consul := New()
+			consul.Addr = server.URL
+			consul.TTL = test.ttl
+			consul.MinTTL = test.minTTL
+			consul.MaxTTL = test.maxTTL
+			consul.NoClientCache = test.noCache
+
+			req := &dns.Msg{}
+			req.SetQuestion("service-1.service.consul.", dns.TypeSRV)
+			rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+			if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, rr := range append(rec.Msg.Answer, rec.Msg.Extra...) {
+				if ttl := rr.Header().Ttl; ttl != test.expect {
+					t.Errorf("Expected the TTL to be %d but found: %d", test.expect, ttl)
+				}
+			}
+		})
+	}
+}
+
+func TestConsulPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul")
+	if err != nil {
+		t.Fatal(err)
 	}
-	return false
+	defer os.RemoveAll(dir)
+
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+
+	lookup := func(consul *Consul) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion("service-1.service.consul.", dns.TypeA)
+		rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+		consul.ServeDNS(context.Background(), rec, req)
+		return rec.Msg
+	}
+
+	reply := &dns.Msg{Answer: []dns.RR{rrA("service-1.service.consul.", "192.168.0.1")}}
+
+	consul1 := New()
+	consul1.Addr = server.URL
+	consul1.Persist = filepath.Join(dir, "snapshot.json")
+
+	if msg := lookup(consul1); !replyEqual(reply, msg) {
+		t.Fatalf("Unexpected reply: %v", msg)
+	}
+
+	if err := consul1.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Consul becomes unavailable, the plugin restarts and restores its cache.
+	server.Close()
+
+	consul2 := New()
+	consul2.Addr = server.URL
+	consul2.Persist = consul1.Persist
+
+	if msg := lookup(consul2); !replyEqual(reply, msg) {
+		t.Fatalf("Unexpected reply: %v", msg)
+	}
+}
+
+func TestConsulPersistExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+
+	lookup := func(consul *Consul) int {
+		req := &dns.Msg{}
+		req.SetQuestion("service-1.service.consul.", dns.TypeA)
+		rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+		consul.ServeDNS(context.Background(), rec, req)
+		return rec.Rcode
+	}
+
+	consul1 := New()
+	consul1.Addr = server.URL
+	consul1.TTL = 10 * time.Millisecond
+	consul1.Persist = filepath.Join(dir, "snapshot.json")
+
+	if rcode := lookup(consul1); rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected NOERROR but got: %s", dns.RcodeToString[rcode])
+	}
+
+	if err := consul1.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Consul becomes unavailable and the plugin restarts after the services
+	// expired.
+	server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(ioutil.Discard)
+
+	consul2 := New()
+	consul2.Addr = server.URL
+	consul2.Persist = consul1.Persist
+
+	if rcode := lookup(consul2); rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected the expired services not to be restored but got: %s", dns.RcodeToString[rcode])
+	}
+	if !strings.Contains(buf.String(), "set max_stale") {
+		t.Errorf("Expected a warning about the expired services: %s", buf.String())
+	}
+
+	// They are restored and served stale within max_stale.
+	consul3 := New()
+	consul3.Addr = server.URL
+	consul3.Persist = consul1.Persist
+	consul3.MaxStale = 1 * time.Minute
+
+	if rcode := lookup(consul3); rcode != dns.RcodeSuccess {
+		t.Errorf("Expected the services to be served stale but got: %s", dns.RcodeToString[rcode])
+	}
+}
+
+func TestConsulBackendStreaming(t *testing.T) {
+	blocking := make(chan struct{}, 1)
+
+	handler := consulHandler("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/health/") && r.URL.Query().Get("index") != "" {
+			select {
+			case blocking <- struct{}{}:
+			default:
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.Backend = backendStreaming
+	defer consul.Close()
+
+	req := &dns.Msg{}
+	req.SetQuestion("service-1.service.consul.", dns.TypeA)
+	rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+	if rcode, _ := consul.ServeDNS(context.Background(), rec, req); rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected NOERROR but got: %s", dns.RcodeToString[rcode])
+	}
+
+	// The streaming backend implies watches, the service is watched with
+	// blocking queries without enabling watch.
+	select {
+	case <-blocking:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the service was not watched with blocking queries")
+	}
+}
+
+func TestConsulJanitor(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.TTL = 10 * time.Millisecond
+	consul.CleanupInterval = 10 * time.Millisecond
+
+	req := &dns.Msg{}
+	req.SetQuestion("service-1.service.consul.", dns.TypeA)
+	rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+	consul.ServeDNS(context.Background(), rec, req)
+
+	if n := consul.cache.len(); n != 1 {
+		t.Fatalf("Expected 1 entry in the cache but found: %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consul.janitor(ctx)
+
+	// The janitor removes the entry once it expired, without lookups.
+	for deadline := time.Now().Add(5 * time.Second); consul.cache.len() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("The expired entry was not removed from the cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConsulZones(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.Zones = []string{"consul."}
+
+	next := false
+	consul.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		next = true
+		m := &dns.Msg{}
+		m.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(m)
+		return dns.RcodeNameError, nil
+	})
+
+	tests := []struct {
+		qname string
+		rcode int
+		next  bool
+	}{
+		{qname: "service-1.service.consul.", rcode: dns.RcodeSuccess},
+		{qname: "www.example.com.", rcode: dns.RcodeNameError, next: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.qname, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(test.qname, dns.TypeA)
+			rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+			next = false
+
+			rcode, _ := consul.ServeDNS(context.Background(), rec, req)
+			if rcode != test.rcode {
+				t.Errorf("Expected %s but got: %s", dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+			}
+
+			if next != test.next {
+				t.Errorf("Expected the query to be passed to the next plugin: %t", test.next)
+			}
+		})
+	}
+}
+
+func TestConsulFallthrough(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+	defer server.Close()
+
+	tests := []struct {
+		fall  []string
+		qname string
+		rcode int
+		next  bool
+	}{
+		{qname: "www.example.com.", rcode: dns.RcodeNameError},
+		{qname: "service-2.service.consul.", rcode: dns.RcodeNameError},
+		{fall: []string{}, qname: "www.example.com.", rcode: dns.RcodeSuccess, next: true},
+		{fall: []string{}, qname: "service-2.service.consul.", rcode: dns.RcodeSuccess, next: true},
+		{fall: []string{}, qname: "service-1.service.consul.", rcode: dns.RcodeSuccess},
+		{fall: []string{"example.com"}, qname: "www.example.com.", rcode: dns.RcodeSuccess, next: true},
+		{fall: []string{"example.com"}, qname: "service-2.service.consul.", rcode: dns.RcodeNameError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.qname, func(t *testing.T) {
+			consul := New()
+			consul.Addr = server.URL
+
+			if test.fall != nil {
+				consul.Fall.SetZonesFromArgs(test.fall)
+			}
+
+			next := false
+			consul.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+				next = true
+				m := &dns.Msg{}
+				m.SetReply(r)
+				w.WriteMsg(m)
+				return dns.RcodeSuccess, nil
+			})
+
+			req := &dns.Msg{}
+			req.SetQuestion(test.qname, dns.TypeA)
+			rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+			rcode, _ := consul.ServeDNS(context.Background(), rec, req)
+			if rcode != test.rcode {
+				t.Errorf("Expected %s but got: %s", dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+			}
+
+			if next != test.next {
+				t.Errorf("Expected the query to be passed to the next plugin: %t", test.next)
+			}
+		})
+	}
+}
+
+func TestConsulResponses(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+
+	noerror := responses.WithLabelValues("NOERROR")
+	nxdomain := responses.WithLabelValues("NXDOMAIN")
+	noerror0, nxdomain0 := metricValue(noerror), metricValue(nxdomain)
+
+	for _, qname := range []string{"service-1.service.consul.", "service-1.service.consul.", "service-2.service.consul."} {
+		req := &dns.Msg{}
+		req.SetQuestion(qname, dns.TypeA)
+		consul.ServeDNS(context.Background(), dnstest.NewRecorder(&corednstest.ResponseWriter{}), req)
+	}
+
+	if n := metricValue(noerror) - noerror0; n != 2 {
+		t.Errorf("Expected 2 NOERROR responses but found: %g", n)
+	}
+
+	if n := metricValue(nxdomain) - nxdomain0; n != 1 {
+		t.Errorf("Expected 1 NXDOMAIN response but found: %g", n)
+	}
+}
+
+func TestConsulLargeServiceSet(t *testing.T) {
+	services := make([]consulServerService, 500)
+	for i := range services {
+		services[i] = consulServerService{
+			node: fmt.Sprintf("host-%d", i),
+			name: "service-1",
+			addr: fmt.Sprintf("10.0.%d.%d", i/256, i%256),
+			port: 10000 + i,
+			pass: true,
+		}
+	}
+
+	server := consulServer("dc1", services)
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+
+	// Answers carry a single record however many instances are registered,
+	// so they always fit in the smallest UDP message and are never truncated.
+	for _, tcp := range []bool{false, true} {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeSRV} {
+			req := &dns.Msg{}
+			req.SetQuestion("service-1.service.consul.", qtype)
+			rec := dnstest.NewRecorder(&corednstest.ResponseWriter{TCP: tcp})
+
+			if rcode, err := consul.ServeDNS(context.Background(), rec, req); rcode != dns.RcodeSuccess {
+				t.Fatalf("Unexpected response code: %s (%v)", dns.RcodeToString[rcode], err)
+			}
+
+			msg := rec.Msg
+			if msg.Truncated {
+				t.Errorf("Unexpected truncated %s response (tcp=%t)", dns.TypeToString[qtype], tcp)
+			}
+			if len(msg.Answer) != 1 {
+				t.Errorf("Expected 1 answer in the %s response but found: %d", dns.TypeToString[qtype], len(msg.Answer))
+			}
+			if n := msg.Len(); n > dns.MinMsgSize {
+				t.Errorf("The %s response of %d bytes does not fit in a UDP message", dns.TypeToString[qtype], n)
+			}
+		}
+	}
+}
+
+func TestConsulDNSSEC(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.DNSSEC = []string{"testdata/Kconsul.+013+10202", "testdata/Kconsul.+013+35954"}
+
+	tests := []struct {
+		qname  string
+		qtype  uint16
+		do     bool
+		rcode  int
+		answer int
+		ns     int
+		extra  int
+		nsec   []uint16
+		next   string
+	}{
+		{qname: "service-1.service.consul.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answer: 1},
+		{qname: "service-1.service.consul.", qtype: dns.TypeA, do: true, rcode: dns.RcodeSuccess, answer: 2},
+		{qname: "service-1.service.consul.", qtype: dns.TypeSRV, do: true, rcode: dns.RcodeSuccess, answer: 2, extra: 2},
+		{qname: "service-2.service.consul.", qtype: dns.TypeA, do: true, rcode: dns.RcodeNameError, ns: 6},
+		{qname: "consul.", qtype: dns.TypeDNSKEY, do: true, rcode: dns.RcodeSuccess, answer: 3},
+		{qname: "consul.", qtype: dns.TypeA, do: true, rcode: dns.RcodeSuccess, ns: 4},
+		{qname: "service-1.service.consul.", qtype: dns.TypeAAAA, do: true, rcode: dns.RcodeSuccess, ns: 4, nsec: []uint16{dns.TypeA, dns.TypeSRV, dns.TypeRRSIG, dns.TypeNSEC}},
+		{qname: "c0a80001.addr.dc1.consul.", qtype: dns.TypeAAAA, do: true, rcode: dns.RcodeSuccess, ns: 4, nsec: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}},
+		{qname: "service.consul.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{qname: "service.consul.", qtype: dns.TypeA, do: true, rcode: dns.RcodeSuccess, ns: 4, nsec: []uint16{dns.TypeRRSIG, dns.TypeNSEC}, next: `\000.service.consul.`},
+		{qname: "dc1.consul.", qtype: dns.TypeA, do: true, rcode: dns.RcodeSuccess, ns: 4, nsec: []uint16{dns.TypeRRSIG, dns.TypeNSEC}, next: `\000.dc1.consul.`},
+		{qname: "service.dc1.consul.", qtype: dns.TypeA, do: true, rcode: dns.RcodeSuccess, ns: 4, nsec: []uint16{dns.TypeRRSIG, dns.TypeNSEC}, next: `\000.service.dc1.consul.`},
+		{qname: "x.y.consul.", qtype: dns.TypeA, do: true, rcode: dns.RcodeNameError, ns: 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.qname+" "+dns.TypeToString[test.qtype], func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(test.qname, test.qtype)
+			req.SetEdns0(4096, test.do)
+			rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+			rcode, _ := consul.ServeDNS(context.Background(), rec, req)
+			if rcode != test.rcode {
+				t.Errorf("Expected %s but got: %s", dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+			}
+
+			msg := rec.Msg
+			if len(msg.Answer) != test.answer {
+				t.Errorf("Expected %d records in the answer section but found: %v", test.answer, msg.Answer)
+			}
+			if len(msg.Ns) != test.ns {
+				t.Errorf("Expected %d records in the authority section but found: %v", test.ns, msg.Ns)
+			}
+			// The OPT record is always in the additional section.
+			if len(msg.Extra) != test.extra+1 {
+				t.Errorf("Expected %d records in the additional section but found: %v", test.extra, msg.Extra)
+			}
+
+			if test.nsec != nil {
+				var nsec *dns.NSEC
+				for _, rr := range msg.Ns {
+					if rr, ok := rr.(*dns.NSEC); ok {
+						nsec = rr
+					}
+				}
+				if nsec == nil {
+					t.Fatalf("Expected a NSEC record in the authority section but found: %v", msg.Ns)
+				}
+				if !reflect.DeepEqual(nsec.TypeBitMap, test.nsec) {
+					t.Errorf("Expected the NSEC record to list %v but found: %v", test.nsec, nsec.TypeBitMap)
+				}
+				if len(test.next) != 0 && nsec.NextDomain != test.next {
+					t.Errorf("Expected the next name of the NSEC record to be %q but found: %q", test.next, nsec.NextDomain)
+				}
+			}
+		})
+	}
+}
+
+func TestConsulACL(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+		{node: "host-2", name: "internal-1", addr: "192.168.0.2", port: 10002, pass: true},
+	})
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.ACLs = []ACL{
+		{
+			Rules: []ACLRule{
+				{Allow: false, Net: cidr("10.0.1.0/24")},
+				{Allow: true, Net: cidr("10.0.0.0/16")},
+			},
+		},
+		{
+			Prefixes: []string{"internal-"},
+			Rules: []ACLRule{
+				{Allow: true, Net: cidr("10.0.2.0/24")},
+			},
+		},
+	}
+
+	tests := []struct {
+		qname    string
+		remoteIP string
+		rcode    int
+	}{
+		{qname: "service-1.service.consul.", remoteIP: "10.0.0.1", rcode: dns.RcodeSuccess},
+		{qname: "service-1.service.consul.", remoteIP: "10.0.1.1", rcode: dns.RcodeRefused},
+		{qname: "service-1.service.consul.", remoteIP: "172.16.0.1", rcode: dns.RcodeRefused},
+		{qname: "internal-1.service.consul.", remoteIP: "10.0.2.1", rcode: dns.RcodeSuccess},
+		{qname: "internal-1.service.consul.", remoteIP: "10.0.0.1", rcode: dns.RcodeRefused},
+	}
+
+	for _, test := range tests {
+		t.Run(test.qname+" from "+test.remoteIP, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(test.qname, dns.TypeA)
+			rec := dnstest.NewRecorder(&corednstest.ResponseWriter{RemoteIP: test.remoteIP})
+
+			rcode, _ := consul.ServeDNS(context.Background(), rec, req)
+			if rcode != test.rcode {
+				t.Errorf("Expected %s but got: %s", dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+			}
+
+			if test.rcode == dns.RcodeRefused && len(rec.Msg.Answer) != 0 {
+				t.Errorf("Expected no answers in refused responses but found: %v", rec.Msg.Answer)
+			}
+		})
+	}
+}
+
+func TestConsulViews(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true, tags: []string{"internal"}},
+		{node: "host-2", name: "service-1", addr: "192.168.0.2", port: 10002, pass: true, tags: []string{"edge"}},
+		{node: "host-3", name: "service-1", addr: "192.168.0.3", port: 10003, pass: true, tags: []string{"edge"}, dc: "dc2"},
+	})
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.Views = []View{
+		{Nets: []*net.IPNet{cidr("10.0.0.0/8")}, Tag: "internal"},
+		{Nets: []*net.IPNet{cidr("172.16.0.0/12")}, Tag: "edge", DC: "dc2"},
+	}
+
+	tests := []struct {
+		qname    string
+		remoteIP string
+		addr     string
+	}{
+		{qname: "service-1.service.consul.", remoteIP: "10.0.0.1", addr: "192.168.0.1"},
+		{qname: "service-1.service.consul.", remoteIP: "172.16.0.1", addr: "192.168.0.3"},
+		{qname: "edge.service-1.service.consul.", remoteIP: "10.0.0.1", addr: "192.168.0.2"},
+		{qname: "service-1.service.dc1.consul.", remoteIP: "172.16.0.1", addr: "192.168.0.2"},
+		{qname: "internal.service-1.service.consul.", remoteIP: "192.168.1.1", addr: "192.168.0.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.qname+" from "+test.remoteIP, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(test.qname, dns.TypeA)
+			rec := dnstest.NewRecorder(&corednstest.ResponseWriter{RemoteIP: test.remoteIP})
+
+			if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatal(err)
+			}
+
+			reply := &dns.Msg{Answer: []dns.RR{rrA(test.qname, test.addr)}}
+			if !replyEqual(reply, rec.Msg) {
+				t.Errorf("Unexpected reply: %v", rec.Msg)
+			}
+		})
+	}
+}
+
+func TestConsulDatacenters(t *testing.T) {
+	var fetches int32
+
+	handler := consulHandler("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+		{node: "host-2", name: "service-1", addr: "192.168.1.1", port: 10001, pass: true, dc: "dc2"},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/health/service/") {
+			atomic.AddInt32(&fetches, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.DatacenterRefresh = 1 * time.Minute
+
+	// The plugin starts fetching the datacenters when it is initialized.
+	if _, _, err := consul.grabCache(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); consul.knownDatacenters() == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("The datacenters were not fetched")
+		}
+	}
+
+	tests := []struct {
+		qname string
+		rcode int
+	}{
+		{qname: "service-1.service.consul.", rcode: dns.RcodeSuccess},
+		{qname: "service-1.service.dc2.consul.", rcode: dns.RcodeSuccess},
+		{qname: "service-1.service.dc3.consul.", rcode: dns.RcodeNameError},
+		{qname: "service-1.service.peer-1.peer.consul.", rcode: dns.RcodeNameError},
+	}
+
+	for _, test := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(test.qname, dns.TypeA)
+		rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+		if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+
+		if rec.Rcode != test.rcode {
+			t.Errorf("%s: expected rcode %s but found: %s", test.qname, dns.RcodeToString[test.rcode], dns.RcodeToString[rec.Rcode])
+		}
+	}
+
+	// The unknown datacenter is answered without a request to consul, while
+	// the peer is not validated, and looked up for addresses of any family
+	// when it has no IPv4 addresses.
+	if n := atomic.LoadInt32(&fetches); n != 4 {
+		t.Errorf("Expected 4 requests for services but found: %d", n)
+	}
+
+	if v := metricValue(datacenterKnown.WithLabelValues("dc2")); v != 1 {
+		t.Errorf("Expected dc2 to be known but found: %g", v)
+	}
+
+	rec := httptest.NewRecorder()
+	consul.debugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/datacenters", nil))
+
+	var res struct{ Datacenters []string }
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Datacenters, []string{"dc1", "dc2"}) {
+		t.Errorf("Unexpected datacenters: %v", res.Datacenters)
+	}
+}
+
+func TestConsulHeaders(t *testing.T) {
+	handler := consulHandler("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+
+	var mutex sync.Mutex
+	var paths []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.UserAgent() != "resolver/1.0" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("%s: unexpected headers: %v", r.URL.Path, r.Header)
+		}
+		mutex.Lock()
+		paths = append(paths, r.URL.Path)
+		mutex.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.UserAgent = "resolver/1.0"
+	consul.Headers = http.Header{"Authorization": {"Bearer secret"}}
+
+	req := &dns.Msg{}
+	req.SetQuestion("service-1.service.consul.", dns.TypeA)
+	rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+	if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !reflect.DeepEqual(paths, []string{"/v1/agent/self", "/v1/health/service/service-1"}) {
+		t.Errorf("Unexpected requests to consul: %v", paths)
+	}
+}
+
+func TestConsulRcodes(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.RcodeForeign = dns.RcodeNameError
+	consul.RcodeUnsupported = dns.RcodeSuccess
+	consul.RcodeMalformed = dns.RcodeServerFailure
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+	}{
+		{qname: "service-1.service.example.com.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{qname: "service-1.query.consul.", qtype: dns.TypeA, rcode: dns.RcodeSuccess},
+		{qname: "service-1.service.consul.", qtype: dns.TypeMX, rcode: dns.RcodeSuccess},
+		{qname: "c0a80001.addr.consul.", qtype: dns.TypeMX, rcode: dns.RcodeSuccess},
+		{qname: "_service-1.tcp.service.consul.", qtype: dns.TypeSRV, rcode: dns.RcodeServerFailure},
+		{qname: "service-2.service.consul.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{qname: "service-1.service.consul.", qtype: dns.TypeA, rcode: dns.RcodeSuccess},
+	}
+
+	for _, test := range tests {
+		t.Run(test.qname+" "+dns.TypeToString[test.qtype], func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(test.qname, test.qtype)
+			rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+			if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatal(err)
+			}
+
+			if rec.Msg.Rcode != test.rcode {
+				t.Errorf("Expected %s but got: %s", dns.RcodeToString[test.rcode], dns.RcodeToString[rec.Msg.Rcode])
+			}
+		})
+	}
+}
+
+func TestConsulChaos(t *testing.T) {
+	server := consulServer("dc1", nil)
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.Zones = []string{"consul."}
+	consul.Chaos = true
+	consul.ChaosIdentity = "resolver-1"
+
+	tests := []struct {
+		qname string
+		txt   []string
+	}{
+		{qname: "version.bind.", txt: []string{defaultChaosVersion}},
+		{qname: "hostname.bind.", txt: []string{"resolver-1", "consul-agent=agent-1", "consul-dc=dc1"}},
+		{qname: "ID.Server.", txt: []string{"resolver-1", "consul-agent=agent-1", "consul-dc=dc1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.qname, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(test.qname, dns.TypeTXT)
+			req.Question[0].Qclass = dns.ClassCHAOS
+			rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+			if _, err := consul.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(rec.Msg.Answer) != 1 {
+				t.Fatalf("Unexpected reply: %v", rec.Msg)
+			}
+
+			txt, ok := rec.Msg.Answer[0].(*dns.TXT)
+			if !ok || txt.Hdr.Name != test.qname || txt.Hdr.Class != dns.ClassCHAOS {
+				t.Fatalf("Unexpected answer: %v", rec.Msg.Answer[0])
+			}
+
+			if !reflect.DeepEqual(txt.Txt, test.txt) {
+				t.Errorf("Expected %q but found: %q", test.txt, txt.Txt)
+			}
+		})
+	}
+
+	// CHAOS queries for other names are passed to the next plugin since they
+	// are outside of the zones of the plugin.
+	req := &dns.Msg{}
+	req.SetQuestion("authors.bind.", dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+	if rcode, _ := consul.ServeDNS(context.Background(), rec, req); rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL without a next plugin but found: %s", dns.RcodeToString[rcode])
+	}
+}
+
+func TestConsulLegacyNXDomain(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+	defer server.Close()
+
+	for _, legacy := range []bool{false, true} {
+		consul := New()
+		consul.Addr = server.URL
+		consul.LegacyNXDomain = legacy
+
+		req := &dns.Msg{}
+		req.SetQuestion("service-1.service.consul.", dns.TypeAAAA)
+		rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+		expected := dns.RcodeSuccess
+		if legacy {
+			expected = dns.RcodeNameError
+		}
+
+		if rcode, _ := consul.ServeDNS(context.Background(), rec, req); rcode != expected {
+			t.Errorf("Expected %s with legacy_nxdomain=%t but got: %s", dns.RcodeToString[expected], legacy, dns.RcodeToString[rcode])
+		}
+
+		if len(rec.Msg.Answer) != 0 {
+			t.Errorf("Expected an empty answer but found: %v", rec.Msg.Answer)
+		}
+	}
+}
+
+func TestConsulGatewayMode(t *testing.T) {
+	gateway := func(dc, lan, wan string) consulServerService {
+		return consulServerService{
+			node: "gateway-" + dc,
+			name: "mesh-gateway",
+			addr: "172.16.0.1",
+			port: 8443,
+			pass: true,
+			dc:   dc,
+			tagged: map[string]consulServiceAddress{
+				"lan": {Address: lan, Port: 8443},
+				"wan": {Address: wan, Port: 443},
+			},
+		}
+	}
+
+	server := consulServer("dc1", []consulServerService{
+		gateway("dc1", "10.1.0.1", "203.0.113.1"),
+		gateway("dc2", "10.2.0.1", "203.0.113.2"),
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+		{node: "host-2", name: "service-1", addr: "192.168.0.2", port: 10001, pass: true, dc: "dc2"},
+		{node: "host-3", name: "service-1", addr: "192.168.0.3", port: 10001, pass: true, peer: "cluster-2"},
+	})
+	defer server.Close()
+
+	tests := []struct {
+		mode  string
+		qname string
+		addr  string
+		port  uint16
+		rcode int
+	}{
+		{mode: gatewayNone, qname: "service-1.service.dc2.consul.", addr: "192.168.0.2", port: 10001},
+		{mode: gatewayLocal, qname: "service-1.service.consul.", addr: "192.168.0.1", port: 10001},
+		{mode: gatewayLocal, qname: "service-1.service.dc2.consul.", addr: "10.1.0.1", port: 8443},
+		{mode: gatewayLocal, qname: "service-1.service.cluster-2.peer.consul.", addr: "10.1.0.1", port: 8443},
+		{mode: gatewayRemote, qname: "service-1.service.dc2.consul.", addr: "203.0.113.2", port: 443},
+		{mode: gatewayRemote, qname: "service-1.service.cluster-2.peer.consul.", addr: "10.1.0.1", port: 8443},
+		{mode: gatewayRemote, qname: "service-2.service.dc2.consul.", rcode: dns.RcodeNameError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode+" "+test.qname, func(t *testing.T) {
+			consul := New()
+			consul.Addr = server.URL
+			consul.GatewayMode = test.mode
+
+			req := &dns.Msg{}
+			req.SetQuestion(test.qname, dns.TypeSRV)
+			rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+
+			rcode, _ := consul.ServeDNS(context.Background(), rec, req)
+			if rcode != test.rcode {
+				t.Fatalf("Expected %s but got: %s", dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+			}
+			if rcode != dns.RcodeSuccess {
+				return
+			}
+
+			if srv, ok := rec.Msg.Answer[0].(*dns.SRV); !ok || srv.Port != test.port {
+				t.Errorf("Expected a SRV record with port %d but found: %v", test.port, rec.Msg.Answer)
+			}
+			if a, ok := rec.Msg.Extra[0].(*dns.A); !ok || a.A.String() != test.addr {
+				t.Errorf("Expected a A record with address %s but found: %v", test.addr, rec.Msg.Extra)
+			}
+		})
+	}
+}
+
+func TestConsulQueryLog(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+	defer server.Close()
+
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(ioutil.Discard)
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.QueryLog = 1
+
+	for i := 0; i != 2; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("service-1.service.consul.", dns.TypeA)
+		consul.ServeDNS(context.Background(), dnstest.NewRecorder(&corednstest.ResponseWriter{}), req)
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, "consul query:") {
+			lines = append(lines, line)
+		}
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 queries to be logged but found: %q", lines)
+	}
+
+	for i, cache := range []string{"cache=miss", "cache=hit"} {
+		for _, field := range []string{"qname=service-1.service.consul.", "qtype=A", "rcode=NOERROR", cache} {
+			if !strings.Contains(lines[i], field) {
+				t.Errorf("Expected the log line to contain %q: %s", field, lines[i])
+			}
+		}
+	}
+}
+
+func TestConsulMaxRequests(t *testing.T) {
+	release := make(chan struct{})
+
+	handler := consulHandler("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/health/") {
+			<-release
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(ioutil.Discard)
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.MaxRequests = 1
+
+	lookup := func() int {
+		req := &dns.Msg{}
+		req.SetQuestion("service-1.service.consul.", dns.TypeA)
+		rec := dnstest.NewRecorder(&corednstest.ResponseWriter{})
+		consul.ServeDNS(context.Background(), rec, req)
+		return rec.Rcode
+	}
+
+	done := make(chan int)
+	go func() { done <- lookup() }()
+
+	// Wait for the first request to be in flight before sending the second.
+	for atomic.LoadInt64(&consul.requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if rcode := lookup(); rcode != dns.RcodeRefused {
+		t.Errorf("Expected the request beyond the limit to be refused but got: %s", dns.RcodeToString[rcode])
+	}
+
+	close(release)
+
+	if rcode := <-done; rcode != dns.RcodeSuccess {
+		t.Errorf("Expected the first request to succeed but got: %s", dns.RcodeToString[rcode])
+	}
+
+	if strings.Contains(buf.String(), "[ERROR]") {
+		t.Errorf("Expected refused requests not to be logged as errors: %s", buf.String())
+	}
+}
+
+func TestConsulReady(t *testing.T) {
+	var up int32
+
+	handler := consulHandler("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.Warmup = []string{"service-1.service.consul"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		consul.warmup(ctx)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	if consul.Ready() {
+		t.Fatal("the plugin reported being ready while consul was unavailable")
+	}
+
+	atomic.StoreInt32(&up, 1)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the plugin did not become ready")
+	}
+
+	if !consul.Ready() {
+		t.Error("the plugin did not report being ready")
+	}
+}
+
+func TestConsulReadyAfterLookupFailure(t *testing.T) {
+	var up int32
+
+	handler := consulHandler("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+
+	// Only the lookups of services fail, the agent information is available.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/health/service/") && atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.Warmup = []string{"service-1.service.consul"}
+	defer consul.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		consul.warmup(ctx)
+		close(done)
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+
+	if consul.Ready() {
+		t.Fatal("the plugin reported being ready while the lookups failed")
+	}
+
+	atomic.StoreInt32(&up, 1)
+
+	// The failed lookup is cached for the TTL of the entry, which is much
+	// longer than the backoff of the warmup.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the plugin did not become ready")
+	}
+
+	if !consul.Ready() {
+		t.Error("the plugin did not report being ready")
+	}
+}
+
+func consulServer(serverDC string, serverServices []consulServerService) *httptest.Server {
+	return httptest.NewServer(consulHandler(serverDC, serverServices))
+}
+
+func consulHandler(serverDC string, serverServices []consulServerService) http.Handler {
+	services := make([]consultest.Service, len(serverServices))
+	for i, srv := range serverServices {
+		services[i] = srv.service()
+	}
+	return consultest.NewServer(serverDC, services...)
+}
+
+// consulServerService is a shorthand for the consultest services registered in
+// the consul servers of tests.
+type consulServerService struct {
+	node string
+	name string
+	id   string
+	addr string
+	port int
+	pass bool
+	warn bool // critical when neither pass nor warn are set
+	tags []string
+	meta map[string]string // node metadata
+	peer string
+	dc   string // defaults to the datacenter of the server
+
+	tagged  map[string]consulServiceAddress
+	weights consulServiceWeights
+}
+
+func (srv *consulServerService) service() consultest.Service {
+	s := consultest.Service{
+		Node:       srv.node,
+		Name:       srv.name,
+		ID:         srv.id,
+		Address:    srv.addr,
+		Port:       srv.port,
+		Tags:       srv.tags,
+		Health:     consultest.Critical,
+		NodeMeta:   srv.meta,
+		Peer:       srv.peer,
+		Datacenter: srv.dc,
+		Weights:    consultest.Weights(srv.weights),
+	}
+
+	switch {
+	case srv.pass:
+		s.Health = consultest.Passing
+	case srv.warn:
+		s.Health = consultest.Warning
+	}
+
+	if srv.tagged != nil {
+		s.TaggedAddresses = make(map[string]consultest.Address, len(srv.tagged))
+		for k, addr := range srv.tagged {
+			s.TaggedAddresses[k] = consultest.Address(addr)
+		}
+	}
+
+	return s
 }
 
 func replyEqual(r1, r2 *dns.Msg) bool {
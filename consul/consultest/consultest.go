@@ -0,0 +1,367 @@
+// Package consultest implements a mock of the consul agent HTTP API, for the
+// integration tests of programs embedding the consul plugin.
+//
+// The mock serves the endpoints used by the plugin: /v1/agent/self,
+// /v1/health/service/<name>, /v1/catalog/services and
+// /v1/catalog/datacenters.
+//
+//	server := httptest.NewServer(consultest.NewServer("dc1",
+//		consultest.Service{Node: "host-1", Name: "service-1", Address: "192.168.0.1", Port: 10001},
+//	))
+//	defer server.Close()
+//
+//	plugin := consul.New()
+//	plugin.Addr = server.URL
+package consultest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Health states of services, see Service.Health.
+const (
+	Passing  = "passing"
+	Warning  = "warning"
+	Critical = "critical"
+)
+
+// Service is a service instance registered in the mock consul agent.
+type Service struct {
+	Node    string
+	Name    string
+	ID      string
+	Address string
+	Port    int
+	Tags    []string
+
+	// Health is the state of the health checks of the service, Passing when
+	// empty.
+	Health string
+
+	// NodeMeta is the metadata of the node, matched by node-meta filters.
+	NodeMeta map[string]string
+
+	// Peer is the name of the cluster peer that the service is imported from,
+	// and Datacenter the datacenter of the service, the datacenter of the
+	// server when empty.
+	Peer       string
+	Datacenter string
+
+	TaggedAddresses map[string]Address
+	Weights         Weights
+}
+
+// Address is a tagged address of a service.
+type Address struct {
+	Address string
+	Port    int
+}
+
+// Weights are the weights of a service when its health checks are passing, or
+// when some are in the warning state.
+type Weights struct {
+	Passing int
+	Warning int
+}
+
+// Server is a mock consul agent, it implements http.Handler.
+//
+// The fields of Server must be set before it serves requests, the services can
+// be changed at any time with SetServices.
+type Server struct {
+	// Datacenter and node name of the agent.
+	Datacenter string
+	NodeName   string
+
+	// Token is the ACL token that requests must carry in the X-Consul-Token
+	// header or the token query parameter, requests are not authenticated
+	// when empty. Other requests are answered with 403 Forbidden.
+	Token string
+
+	// Delay is the time waited before answering each request.
+	Delay time.Duration
+
+	mutex    sync.Mutex
+	services []Service
+	index    uint64
+	changed  chan struct{} // closed when the services change
+}
+
+// NewServer returns a mock consul agent of datacenter, with services.
+//
+// The consul index starts at the number of services, as if they were
+// registered one by one, and is incremented by every call to SetServices.
+func NewServer(datacenter string, services ...Service) *Server {
+	index := uint64(len(services))
+	if index == 0 {
+		index = 1
+	}
+	return &Server{
+		Datacenter: datacenter,
+		NodeName:   "agent-1",
+		services:   services,
+		index:      index,
+		changed:    make(chan struct{}),
+	}
+}
+
+// SetServices replaces the services of s, and unblocks the blocking queries
+// waiting for a change.
+func (s *Server) SetServices(services ...Service) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.services = services
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Index returns the current consul index of s.
+func (s *Server) Index() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.index
+}
+
+func (s *Server) state() ([]Service, uint64, <-chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.services, s.index, s.changed
+}
+
+// ServeHTTP satisfies the http.Handler interface.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const (
+		v1AgentSelf       = "/v1/agent/self"
+		v1HealthService   = "/v1/health/service/"
+		v1CatalogServices = "/v1/catalog/services"
+		v1CatalogDCs      = "/v1/catalog/datacenters"
+	)
+
+	if s.Delay > 0 {
+		select {
+		case <-time.After(s.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if len(s.Token) != 0 && !s.authorized(r) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.URL.Path == v1AgentSelf:
+		writeJSON(w, agent{Config: agentConfig{Datacenter: s.Datacenter, NodeName: s.NodeName}})
+
+	case strings.HasPrefix(r.URL.Path, v1HealthService):
+		services, index := s.wait(r)
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		writeJSON(w, s.health(strings.TrimPrefix(r.URL.Path, v1HealthService), services, r))
+
+	case r.URL.Path == v1CatalogServices:
+		services, index := s.wait(r)
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		writeJSON(w, s.catalog(services, r))
+
+	case r.URL.Path == v1CatalogDCs:
+		services, _, _ := s.state()
+		writeJSON(w, s.datacenters(services))
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if token := r.Header.Get("X-Consul-Token"); len(token) != 0 {
+		return token == s.Token
+	}
+	return r.URL.Query().Get("token") == s.Token
+}
+
+// wait implements blocking queries, it returns when the consul index of s is
+// greater than the index parameter of r, or when the wait parameter elapsed.
+func (s *Server) wait(r *http.Request) ([]Service, uint64) {
+	services, index, changed := s.state()
+	query := r.URL.Query()
+
+	min, err := strconv.ParseUint(query.Get("index"), 10, 64)
+	if err != nil || min < index {
+		return services, index
+	}
+
+	wait, err := time.ParseDuration(query.Get("wait"))
+	if err != nil || wait <= 0 {
+		wait = 5 * time.Minute // default of consul
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+
+	services, index, _ = s.state()
+	return services, index
+}
+
+func (s *Server) health(name string, services []Service, r *http.Request) []healthService {
+	query := r.URL.Query()
+	tag := query.Get("tag")
+	dc := query.Get("dc")
+	peer := query.Get("peer")
+	_, passing := query["passing"]
+	nodeMeta := query["node-meta"]
+	results := make([]healthService, 0, len(services))
+
+	if len(dc) == 0 {
+		dc = s.Datacenter
+	}
+
+	for _, srv := range services {
+		if srv.Name != name || srv.Peer != peer || s.datacenterOf(srv) != dc {
+			continue
+		}
+		if len(tag) != 0 && !srv.hasTag(tag) {
+			continue
+		}
+		if passing && srv.health() != Passing {
+			continue
+		}
+		if !srv.hasNodeMeta(nodeMeta) {
+			continue
+		}
+		results = append(results, healthService{
+			Node: node{Node: srv.Node, Datacenter: dc, Meta: srv.NodeMeta},
+			Service: service{
+				ID:              srv.ID,
+				Service:         srv.Name,
+				Tags:            srv.Tags,
+				Address:         srv.Address,
+				Port:            srv.Port,
+				TaggedAddresses: srv.TaggedAddresses,
+				Weights:         srv.Weights,
+			},
+			Checks: []check{{Status: srv.health()}},
+		})
+	}
+
+	return results
+}
+
+func (s *Server) catalog(services []Service, r *http.Request) map[string][]string {
+	dc := r.URL.Query().Get("dc")
+	results := make(map[string][]string)
+
+	if len(dc) == 0 {
+		dc = s.Datacenter
+	}
+
+	for _, srv := range services {
+		if len(srv.Peer) == 0 && s.datacenterOf(srv) == dc {
+			results[srv.Name] = append(results[srv.Name], srv.Tags...)
+		}
+	}
+
+	return results
+}
+
+// datacenters returns the datacenter of s and the datacenters of services.
+func (s *Server) datacenters(services []Service) []string {
+	datacenters := []string{s.Datacenter}
+	seen := map[string]bool{s.Datacenter: true}
+
+	for _, srv := range services {
+		if dc := s.datacenterOf(srv); len(srv.Peer) == 0 && !seen[dc] {
+			datacenters = append(datacenters, dc)
+			seen[dc] = true
+		}
+	}
+
+	return datacenters
+}
+
+func (s *Server) datacenterOf(srv Service) string {
+	if len(srv.Datacenter) != 0 {
+		return srv.Datacenter
+	}
+	return s.Datacenter
+}
+
+func (srv *Service) health() string {
+	if len(srv.Health) == 0 {
+		return Passing
+	}
+	return srv.Health
+}
+
+func (srv *Service) hasTag(tag string) bool {
+	for _, srvTag := range srv.Tags {
+		if srvTag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Service) hasNodeMeta(nodeMeta []string) bool {
+	for _, kv := range nodeMeta {
+		i := strings.IndexByte(kv, ':')
+		if i < 0 || srv.NodeMeta[kv[:i]] != kv[i+1:] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// The types below mirror the responses of the consul API.
+
+type agent struct {
+	Config agentConfig
+}
+
+type agentConfig struct {
+	Datacenter string
+	NodeName   string
+}
+
+type healthService struct {
+	Node    node
+	Service service
+	Checks  []check
+}
+
+type node struct {
+	Node       string
+	Datacenter string
+	Meta       map[string]string
+}
+
+type service struct {
+	ID              string
+	Service         string
+	Tags            []string
+	Address         string
+	Port            int
+	TaggedAddresses map[string]Address
+	Weights         Weights
+}
+
+type check struct {
+	Status string
+}
@@ -0,0 +1,150 @@
+package consultest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, url string, header http.Header, v interface{}) (*http.Response, time.Duration) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, values := range header {
+		req.Header[k] = values
+	}
+
+	t0 := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if v != nil && res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res, time.Since(t0)
+}
+
+func TestServerHealth(t *testing.T) {
+	server := httptest.NewServer(NewServer("dc1",
+		Service{Node: "host-1", Name: "service-1", Address: "192.168.0.1", Port: 10001, Tags: []string{"primary"}},
+		Service{Node: "host-2", Name: "service-1", Address: "192.168.0.2", Port: 10001, Health: Warning},
+		Service{Node: "host-3", Name: "service-1", Address: "192.168.0.3", Port: 10001, Health: Critical},
+		Service{Node: "host-4", Name: "service-1", Address: "192.168.1.1", Port: 10001, Datacenter: "dc2"},
+		Service{Node: "host-5", Name: "service-2", Address: "192.168.0.5", Port: 10002},
+	))
+	defer server.Close()
+
+	tests := []struct {
+		query string
+		nodes []string
+	}{
+		{query: "", nodes: []string{"host-1", "host-2", "host-3"}},
+		{query: "?passing", nodes: []string{"host-1"}},
+		{query: "?tag=primary", nodes: []string{"host-1"}},
+		{query: "?dc=dc2", nodes: []string{"host-4"}},
+	}
+
+	for _, test := range tests {
+		var results []healthService
+		if res, _ := get(t, server.URL+"/v1/health/service/service-1"+test.query, nil, &results); res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: unexpected status: %s", test.query, res.Status)
+		}
+
+		var nodes []string
+		for _, r := range results {
+			nodes = append(nodes, r.Node.Node)
+		}
+
+		if len(nodes) != len(test.nodes) {
+			t.Errorf("%s: expected nodes %v but found: %v", test.query, test.nodes, nodes)
+			continue
+		}
+		for i := range nodes {
+			if nodes[i] != test.nodes[i] {
+				t.Errorf("%s: expected nodes %v but found: %v", test.query, test.nodes, nodes)
+				break
+			}
+		}
+	}
+}
+
+func TestServerBlockingQuery(t *testing.T) {
+	s := NewServer("dc1", Service{Node: "host-1", Name: "service-1", Address: "192.168.0.1", Port: 10001})
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	index := strconv.FormatUint(s.Index(), 10)
+
+	// Without changes, the query returns when the wait time elapsed.
+	res, d := get(t, server.URL+"/v1/health/service/service-1?index="+index+"&wait=100ms", nil, nil)
+	if d < 100*time.Millisecond {
+		t.Errorf("Expected the blocking query to wait for 100ms but it returned after %s", d)
+	}
+	if res.Header.Get("X-Consul-Index") != index {
+		t.Errorf("Expected the consul index to be %s but found: %s", index, res.Header.Get("X-Consul-Index"))
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.SetServices(Service{Node: "host-2", Name: "service-1", Address: "192.168.0.2", Port: 10001})
+	}()
+
+	var results []healthService
+	res, d = get(t, server.URL+"/v1/health/service/service-1?index="+index+"&wait=5s", nil, &results)
+	if d >= 5*time.Second {
+		t.Error("Expected the blocking query to return when the services changed")
+	}
+	if len(results) != 1 || results[0].Node.Node != "host-2" {
+		t.Errorf("Expected the changed services but found: %+v", results)
+	}
+	if n, _ := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64); n != s.Index() || n <= 1 {
+		t.Errorf("Expected the consul index to be incremented but found: %d", n)
+	}
+}
+
+func TestServerToken(t *testing.T) {
+	s := NewServer("dc1")
+	s.Token = "secret"
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	tests := []struct {
+		url    string
+		header http.Header
+		status int
+	}{
+		{url: "/v1/agent/self", status: http.StatusForbidden},
+		{url: "/v1/agent/self", header: http.Header{"X-Consul-Token": {"wrong"}}, status: http.StatusForbidden},
+		{url: "/v1/agent/self", header: http.Header{"X-Consul-Token": {"secret"}}, status: http.StatusOK},
+		{url: "/v1/agent/self?token=secret", status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		var a agent
+		if res, _ := get(t, server.URL+test.url, test.header, &a); res.StatusCode != test.status {
+			t.Errorf("%s %v: expected status %d but found: %d", test.url, test.header, test.status, res.StatusCode)
+		} else if res.StatusCode == http.StatusOK && a.Config.Datacenter != "dc1" {
+			t.Errorf("Expected the datacenter of the agent to be dc1 but found: %q", a.Config.Datacenter)
+		}
+	}
+}
+
+func TestServerDelay(t *testing.T) {
+	s := NewServer("dc1")
+	s.Delay = 50 * time.Millisecond
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	if _, d := get(t, server.URL+"/v1/catalog/services", nil, nil); d < s.Delay {
+		t.Errorf("Expected the response to be delayed by %s but it took %s", s.Delay, d)
+	}
+}
@@ -0,0 +1,100 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// knownDatacenter returns false if dc is not in the list of datacenters of the
+// consul catalog. The list is refreshed in the background once it expired, and
+// all datacenters are considered known until it was fetched successfully.
+func (c *Consul) knownDatacenter(client *client, dc string) bool {
+	c.mutex.RLock()
+	datacenters := c.datacenters
+	datacentersExp := c.datacentersExp
+	c.mutex.RUnlock()
+
+	if time.Now().After(datacentersExp) {
+		c.refreshDatacenters(client)
+	}
+
+	if datacenters == nil {
+		return true
+	}
+
+	_, ok := datacenters[dc]
+	return ok
+}
+
+// refreshDatacenters fetches the list of datacenters in the background, unless
+// a refresh is already in progress.
+func (c *Consul) refreshDatacenters(client *client) {
+	if !c.datacentersLock.tryLock() {
+		return
+	}
+
+	go func() {
+		defer c.datacentersLock.unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		datacenters, err := c.fetchDatacenters(ctx, client)
+		cancel()
+
+		c.mutex.Lock()
+		if err == nil {
+			datacentersSet(c.datacenters, datacenters)
+			c.datacenters = datacenters
+		}
+		// The last known list is kept on errors, and the expiration pushed
+		// back so a failing agent doesn't get a request on every lookup.
+		c.datacentersExp = time.Now().Add(c.DatacenterRefresh)
+		c.mutex.Unlock()
+	}()
+}
+
+// https://www.consul.io/api/catalog.html#list-datacenters
+func (c *Consul) fetchDatacenters(ctx context.Context, client *client) (map[string]struct{}, error) {
+	res, err := client.get(ctx, "/v1/catalog/datacenters")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, httpError(res)
+	}
+
+	var list []string
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	datacenters := make(map[string]struct{}, len(list))
+	for _, dc := range list {
+		// Names are looked up in lower case.
+		datacenters[strings.ToLower(dc)] = struct{}{}
+	}
+	return datacenters, nil
+}
+
+// knownDatacenters returns the sorted list of datacenters known to the plugin,
+// which is nil if it was never fetched.
+func (c *Consul) knownDatacenters() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.datacenters == nil {
+		return nil
+	}
+
+	list := make([]string, 0, len(c.datacenters))
+	for dc := range c.datacenters {
+		list = append(list, dc)
+	}
+	sort.Strings(list)
+	return list
+}
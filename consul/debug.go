@@ -0,0 +1,157 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// debugEntry is the representation of cache entries returned by the debug
+// endpoint of the plugin.
+type debugEntry struct {
+	Name       string `json:"name"`
+	Tag        string `json:"tag,omitempty"`
+	ID         string `json:"id,omitempty"`
+	DC         string `json:"dc,omitempty"`
+	Peer       string `json:"peer,omitempty"`
+	Type       string `json:"type"`
+	Ready      bool   `json:"ready"`
+	Error      string `json:"error,omitempty"`
+	Services   int    `json:"services"`
+	Age        string `json:"age"`
+	TTL        string `json:"ttl"`
+	ExpiresIn  string `json:"expires_in"`
+	PrefetchIn string `json:"prefetch_in"`
+	Stale      bool   `json:"stale"`
+	Watched    bool   `json:"watched"`
+}
+
+// debugHandler returns the handler of the debug endpoint of the plugin, which
+// responds to GET /cache with the list of cache entries, to GET /names with
+// the number of queried names which could not be parsed, by reason, and to
+// GET /datacenters with the datacenters known to the plugin.
+func (c *Consul) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache", c.serveCacheDump)
+	mux.HandleFunc("/names", c.serveNameErrors)
+	mux.HandleFunc("/datacenters", c.serveDatacenters)
+	return mux
+}
+
+func (c *Consul) serveDatacenters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	datacenters := c.knownDatacenters()
+	if datacenters == nil {
+		datacenters = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Datacenters []string `json:"datacenters"`
+	}{datacenters})
+}
+
+func (c *Consul) serveNameErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	errors := make(map[string]uint64, len(nameErrorReasons))
+	for i, reason := range nameErrorReasons {
+		errors[reason] = atomic.LoadUint64(&c.nameErrors[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Errors map[string]uint64 `json:"errors"`
+	}{errors})
+}
+
+func (c *Consul) serveCacheDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mutex.RLock()
+	cache := c.cache
+	c.mutex.RUnlock()
+
+	entries := []debugEntry{}
+	if cache != nil {
+		entries = cache.dump(time.Now())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Entries []debugEntry `json:"entries"`
+	}{entries})
+}
+
+// dump returns the list of cache entries, sorted by name.
+func (c *cache) dump(now time.Time) []debugEntry {
+	entries := make([]debugEntry, 0, c.len())
+
+	c.mutex.RLock()
+	c.each(func(k key, e *entry) {
+		d := debugEntry{
+			Name:       k.name,
+			Tag:        k.tag,
+			ID:         k.id,
+			DC:         k.dc,
+			Peer:       k.peer,
+			Type:       dns.TypeToString[k.qtype],
+			Ready:      e.isReady(),
+			Age:        now.Sub(e.updated).String(),
+			TTL:        e.ttl.String(),
+			ExpiresIn:  e.exp.Sub(now).String(),
+			PrefetchIn: c.prefetchDeadlineOf(e).Sub(now).String(),
+			Stale:      now.After(e.exp),
+		}
+
+		if d.Ready {
+			d.Services = len(e.srv)
+			if e.err != nil {
+				d.Error = e.err.Error()
+			}
+		}
+
+		_, d.Watched = c.watches[k]
+		entries = append(entries, d)
+	})
+	c.mutex.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		e1, e2 := &entries[i], &entries[j]
+		if e1.Name != e2.Name {
+			return e1.Name < e2.Name
+		}
+		if e1.Tag != e2.Tag {
+			return e1.Tag < e2.Tag
+		}
+		if e1.ID != e2.ID {
+			return e1.ID < e2.ID
+		}
+		if e1.DC != e2.DC {
+			return e1.DC < e2.DC
+		}
+		if e1.Peer != e2.Peer {
+			return e1.Peer < e2.Peer
+		}
+		return e1.Type < e2.Type
+	})
+
+	return entries
+}
@@ -0,0 +1,110 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	corednstest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestDebugCacheDump(t *testing.T) {
+	now := time.Now()
+	cache := &cache{ttl: 1 * time.Minute, prefetchPercentage: 10}
+
+	e1 := cache.grab(key{name: "service-1", tag: "zone-1", dc: "dc1", qtype: dns.TypeA}, now)
+	e1.srv = []service{{port: 10001, node: "host-1"}, {port: 10002, node: "host-2"}}
+	close(e1.ready)
+
+	e2 := cache.grab(key{name: "service-2", dc: "dc1", qtype: dns.TypeANY}, now)
+	e2.err = errors.New("consul is down")
+	close(e2.ready)
+
+	consul := New()
+	consul.cache = cache
+
+	rec := httptest.NewRecorder()
+	consul.debugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cache", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but found: %d", http.StatusOK, rec.Code)
+	}
+
+	var res struct{ Entries []debugEntry }
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	type summary struct {
+		name, tag, dc, typ string
+		services           int
+		err                string
+	}
+
+	var found []summary
+	for _, e := range res.Entries {
+		found = append(found, summary{e.Name, e.Tag, e.DC, e.Type, e.Services, e.Error})
+
+		if _, err := time.ParseDuration(e.ExpiresIn); err != nil {
+			t.Error(err)
+		}
+	}
+
+	expected := []summary{
+		{"service-1", "zone-1", "dc1", "A", 2, ""},
+		{"service-2", "", "dc1", "ANY", 0, "consul is down"},
+	}
+
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Unexpected cache dump:\n%+v\n%+v", expected, found)
+	}
+}
+
+func TestDebugNameErrors(t *testing.T) {
+	server := consulServer("dc1", nil)
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+
+	for _, qname := range []string{
+		"_service-1.tcp.service.consul.",
+		"service-1.consul.",
+		"service-1.node.consul.",
+		"service-1.service.example.com.",
+		"service-1.query.consul.",
+	} {
+		req := &dns.Msg{}
+		req.SetQuestion(qname, dns.TypeA)
+		consul.ServeDNS(context.Background(), dnstest.NewRecorder(&corednstest.ResponseWriter{}), req)
+	}
+
+	rec := httptest.NewRecorder()
+	consul.debugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/names", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but found: %d", http.StatusOK, rec.Code)
+	}
+
+	var res struct{ Errors map[string]uint64 }
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]uint64{
+		"bad_rfc2782":           1,
+		"missing_service_label": 2,
+		"unknown_suffix":        1,
+	}
+
+	if !reflect.DeepEqual(res.Errors, expected) {
+		t.Errorf("Unexpected name errors:\n%+v\n%+v", expected, res.Errors)
+	}
+}
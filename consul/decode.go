@@ -0,0 +1,65 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// healthDecoder holds the instance that responses of the health endpoint are
+// decoded into. Instances are decoded one at a time into the same memory, so
+// decoding services with thousands of instances does not allocate the whole
+// list, and the slices and maps of instances are reused across refreshes.
+type healthDecoder struct {
+	endpoint consulHealthService
+}
+
+var healthDecoders = sync.Pool{
+	New: func() interface{} { return &healthDecoder{} },
+}
+
+// decodeHealthServices decodes the list of instances read from r, and calls f
+// with each of them. The instance passed to f is only valid until f returns.
+func decodeHealthServices(r io.Reader, f func(*consulHealthService)) error {
+	d := healthDecoders.Get().(*healthDecoder)
+	defer healthDecoders.Put(d)
+
+	dec := json.NewDecoder(r)
+
+	switch tok, err := dec.Token(); {
+	case err != nil:
+		return err
+	case tok == nil:
+		return nil // null
+	case tok != json.Delim('['):
+		return &json.UnmarshalTypeError{Value: fmt.Sprint(tok), Type: reflect.TypeOf([]consulHealthService(nil))}
+	}
+
+	for dec.More() {
+		d.reset()
+		if err := dec.Decode(&d.endpoint); err != nil {
+			return err
+		}
+		f(&d.endpoint)
+	}
+
+	_, err := dec.Token() // ]
+	return err
+}
+
+// reset clears the instance of d while keeping the memory of its checks and
+// tagged addresses, encoding/json decodes arrays into the slice capacity and
+// objects into existing maps.
+func (d *healthDecoder) reset() {
+	checks := d.endpoint.Checks[:0]
+	addrs := d.endpoint.Service.TaggedAddresses
+
+	for k := range addrs {
+		delete(addrs, k)
+	}
+
+	d.endpoint = consulHealthService{Checks: checks}
+	d.endpoint.Service.TaggedAddresses = addrs
+}
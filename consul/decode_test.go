@@ -0,0 +1,98 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeHealthServices(t *testing.T) {
+	const input = `[
+		{
+			"Node": {"Node": "host-1", "Datacenter": "dc1", "Meta": {"rack": "a"}},
+			"Service": {
+				"ID": "service-1-a",
+				"Address": "192.168.0.1",
+				"Port": 10001,
+				"Tags": ["primary"],
+				"TaggedAddresses": {"wan": {"Address": "10.0.0.1", "Port": 20001}},
+				"Weights": {"Passing": 3, "Warning": 1}
+			},
+			"Checks": [{"Status": "passing", "Output": "ok"}, {"Status": "warning"}]
+		},
+		{
+			"Node": {"Node": "host-2", "Datacenter": "dc1"},
+			"Service": {"ID": "service-1-b", "Address": "192.168.0.2", "Port": 10001},
+			"Checks": [{"Status": "critical"}]
+		}
+	]`
+
+	var decoded []consulHealthService
+	if err := decodeHealthServices(strings.NewReader(input), func(s *consulHealthService) {
+		// The instance is reused, copy what the test compares.
+		c := *s
+		c.Checks = append([]consulCheck(nil), s.Checks...)
+		if s.Service.TaggedAddresses != nil {
+			c.Service.TaggedAddresses = map[string]consulServiceAddress{}
+			for k, v := range s.Service.TaggedAddresses {
+				c.Service.TaggedAddresses[k] = v
+			}
+		}
+		decoded = append(decoded, c)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []consulHealthService
+	if err := json.Unmarshal([]byte(input), &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	// Decoding into a reused instance leaves empty maps where encoding/json
+	// leaves nil ones.
+	if len(decoded) == 2 && len(decoded[1].Service.TaggedAddresses) == 0 {
+		decoded[1].Service.TaggedAddresses = nil
+	}
+
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("Unexpected decoded services:\n%+v\n%+v", expected, decoded)
+	}
+
+	for _, input := range []string{`null`, `[]`} {
+		n := 0
+		if err := decodeHealthServices(strings.NewReader(input), func(*consulHealthService) { n++ }); err != nil || n != 0 {
+			t.Errorf("%s: expected no services but found %d (%v)", input, n, err)
+		}
+	}
+
+	for _, input := range []string{`{}`, `[{"Node": 1}]`, `[{}`} {
+		if err := decodeHealthServices(strings.NewReader(input), func(*consulHealthService) {}); err == nil {
+			t.Errorf("%s: expected an error", input)
+		}
+	}
+}
+
+func BenchmarkDecodeHealthServices(b *testing.B) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i := 0; i < 5000; i++ {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `{"Node":{"Node":"host-%d","Datacenter":"dc1"},"Service":{"ID":"service-1-%d","Address":"10.0.%d.%d","Port":10001},"Checks":[{"Status":"passing"},{"Status":"passing"}]}`,
+			i, i, i/256, i%256)
+	}
+	buf.WriteByte(']')
+
+	b.ReportAllocs()
+	b.SetBytes(int64(buf.Len()))
+
+	for i := 0; i < b.N; i++ {
+		if err := decodeHealthServices(bytes.NewReader(buf.Bytes()), func(*consulHealthService) {}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
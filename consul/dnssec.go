@@ -0,0 +1,410 @@
+package consul
+
+import (
+	"crypto"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Signatures are valid from a bit before they are generated, to account
+	// for clock skew between the plugin and validating resolvers, and are
+	// regenerated well before they expire.
+	signatureInception  = 1 * time.Hour
+	signatureValidity   = 7 * 24 * time.Hour
+	signatureRefresh    = 24 * time.Hour
+	signatureMinimumTTL = 60
+)
+
+// Maximum lengths of labels and of names in their wire format.
+const (
+	maxLabelLen = 63
+	maxNameLen  = 255
+)
+
+// dnssecKey is a key that the plugin signs responses with, read from the pair
+// of files generated by dnssec-keygen.
+type dnssecKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+	tag    uint16
+}
+
+// readDNSSECKey reads the key at path, which is the name of the key files
+// without their .key and .private extensions.
+func readDNSSECKey(path string) (key dnssecKey, err error) {
+	path = strings.TrimSuffix(strings.TrimSuffix(path, ".key"), ".private")
+
+	var pub, priv *os.File
+	if pub, err = os.Open(path + ".key"); err != nil {
+		return
+	}
+	defer pub.Close()
+
+	if priv, err = os.Open(path + ".private"); err != nil {
+		return
+	}
+	defer priv.Close()
+
+	var rr dns.RR
+	if rr, err = dns.ReadRR(pub, pub.Name()); err != nil {
+		return
+	}
+
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		err = fmt.Errorf("%s: not a DNSKEY record", pub.Name())
+		return
+	}
+
+	var pk crypto.PrivateKey
+	if pk, err = dnskey.ReadPrivateKey(priv, priv.Name()); err != nil {
+		return
+	}
+
+	signer, ok := pk.(crypto.Signer)
+	if !ok {
+		err = fmt.Errorf("%s: unsupported private key", priv.Name())
+		return
+	}
+
+	key = dnssecKey{dnskey: dnskey, signer: signer, tag: dnskey.KeyTag()}
+	return
+}
+
+// signer produces the DNSSEC records of responses in the zone of its keys.
+//
+// Signatures are cached so the records of the cached services are not signed
+// again on every query, the cache is cleaned up with the service cache.
+type signer struct {
+	zone string
+	ksk  []dnssecKey // signs the DNSKEY records
+	zsk  []dnssecKey // signs all other records
+	ttl  uint32      // original TTL of signed records
+
+	mutex sync.Mutex
+	sigs  map[string]signature
+}
+
+type signature struct {
+	rrsig *dns.RRSIG
+	exp   time.Time
+}
+
+// newSigner returns a signer for keys, which must all belong to the same zone.
+// Records are signed with an original TTL of ttl, which must be greater than
+// or equal to the TTL of all the records in responses.
+func newSigner(keys []dnssecKey, ttl time.Duration) (*signer, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no DNSSEC keys")
+	}
+
+	s := &signer{
+		zone: dns.Fqdn(strings.ToLower(keys[0].dnskey.Hdr.Name)),
+		ttl:  uint32(ttl / time.Second),
+		sigs: make(map[string]signature),
+	}
+
+	if s.ttl < signatureMinimumTTL {
+		s.ttl = signatureMinimumTTL
+	}
+
+	for _, k := range keys {
+		if zone := dns.Fqdn(strings.ToLower(k.dnskey.Hdr.Name)); zone != s.zone {
+			return nil, fmt.Errorf("DNSSEC keys must belong to the same zone: %s != %s", zone, s.zone)
+		}
+		if k.dnskey.Flags&dns.SEP != 0 {
+			s.ksk = append(s.ksk, k)
+		} else {
+			s.zsk = append(s.zsk, k)
+		}
+	}
+
+	// Without separate key signing and zone signing keys, all keys are used
+	// to sign all records.
+	if len(s.ksk) == 0 {
+		s.ksk = s.zsk
+	}
+	if len(s.zsk) == 0 {
+		s.zsk = s.ksk
+	}
+
+	return s, nil
+}
+
+// dnskeys returns the DNSKEY records of the zone.
+func (s *signer) dnskeys() []dns.RR {
+	rrs := make([]dns.RR, 0, len(s.ksk)+len(s.zsk))
+	seen := make(map[uint16]bool)
+
+	for _, keys := range [][]dnssecKey{s.ksk, s.zsk} {
+		for _, k := range keys {
+			if !seen[k.tag] {
+				seen[k.tag] = true
+				rr := *k.dnskey
+				rr.Hdr = dns.RR_Header{Name: s.zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: s.ttl}
+				rrs = append(rrs, &rr)
+			}
+		}
+	}
+
+	return rrs
+}
+
+// soa returns the SOA record of the zone, which negative responses carry in
+// their authority section.
+func (s *signer) soa(ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: s.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "ns." + s.zone,
+		Mbox:    "hostmaster." + s.zone,
+		Serial:  1,
+		Refresh: s.ttl,
+		Retry:   s.ttl,
+		Expire:  s.ttl,
+		Minttl:  ttl,
+	}
+}
+
+// signMsg adds the DNSSEC records to m, which answers a query for qname. The
+// message is left unsigned if qname is not in the zone of the signer. types
+// are the types of the records that qname has, which are listed by the NSEC
+// record proving a NODATA answer.
+//
+// Negative answers are proven with NSEC white lies (RFC 4470), which cover the
+// smallest possible range of names around qname instead of revealing the
+// actual names of the zone.
+func (s *signer) signMsg(m *dns.Msg, qname string, types []uint16, now time.Time) {
+	if !dns.IsSubDomain(s.zone, qname) {
+		return
+	}
+
+	ttl := s.ttl
+	if len(m.Answer) != 0 {
+		ttl = m.Answer[0].Header().Ttl
+	}
+
+	switch {
+	case m.Rcode == dns.RcodeNameError && qname == s.zone:
+		// The apex exists since it holds the DNSKEY records, so queries for
+		// other types get a NODATA response.
+		m.Rcode = dns.RcodeSuccess
+		m.Ns = []dns.RR{s.soa(ttl), s.nsec(qname, `\000.`+qname, ttl, dns.TypeSOA, dns.TypeDNSKEY, dns.TypeRRSIG, dns.TypeNSEC)}
+
+	case m.Rcode == dns.RcodeNameError && isEmptyNonTerminal(qname):
+		// Names like service.consul. have no records but the names of services
+		// sit below them, denying their existence would deny all the services
+		// to validating resolvers (RFC 8020), so they get a NODATA response
+		// which only covers the name itself.
+		m.Rcode = dns.RcodeSuccess
+		m.Ns = []dns.RR{s.soa(ttl), s.nsec(qname, `\000.`+qname, ttl, dns.TypeRRSIG, dns.TypeNSEC)}
+
+	case m.Rcode == dns.RcodeNameError:
+		parent, _ := dns.NextLabel(qname, 0)
+		wildcard := "*." + qname[parent:]
+		m.Ns = []dns.RR{
+			s.soa(ttl),
+			s.nsec(predecessor(qname), successor(qname), ttl, dns.TypeRRSIG, dns.TypeNSEC),
+			s.nsec(predecessor(wildcard), successor(wildcard), ttl, dns.TypeRRSIG, dns.TypeNSEC),
+		}
+
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0:
+		types = append(append([]uint16{}, types...), dns.TypeRRSIG, dns.TypeNSEC)
+		m.Ns = []dns.RR{s.soa(ttl), s.nsec(qname, successor(qname), ttl, types...)}
+
+	case m.Rcode != dns.RcodeSuccess:
+		return
+	}
+
+	m.Answer = s.sign(m.Answer, now)
+	m.Ns = s.sign(m.Ns, now)
+	m.Extra = s.sign(m.Extra, now)
+}
+
+// nsec returns a NSEC record which covers the names between owner and next.
+func (s *signer) nsec(owner string, next string, ttl uint32, types ...uint16) *dns.NSEC {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// sign returns rrs with the signatures of each of their RRsets appended.
+// Records outside of the zone, like the OPT record, are not signed.
+func (s *signer) sign(rrs []dns.RR, now time.Time) []dns.RR {
+	type rrset struct {
+		name  string
+		rtype uint16
+	}
+
+	var order []rrset
+	var sets = make(map[rrset][]dns.RR)
+
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT || h.Rrtype == dns.TypeRRSIG || !dns.IsSubDomain(s.zone, h.Name) {
+			continue
+		}
+		k := rrset{name: strings.ToLower(h.Name), rtype: h.Rrtype}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+
+	for _, k := range order {
+		keys := s.zsk
+		if k.rtype == dns.TypeDNSKEY {
+			keys = s.ksk
+		}
+		for _, key := range keys {
+			if sig := s.signature(key, sets[k], now); sig != nil {
+				rrs = append(rrs, sig)
+			}
+		}
+	}
+
+	return rrs
+}
+
+// signature returns the signature of rrset by key. Records of the set are
+// signed with the original TTL of the signer, so a signature is reused for the
+// same records as their TTL decreases.
+func (s *signer) signature(key dnssecKey, rrset []dns.RR, now time.Time) *dns.RRSIG {
+	ttl := rrset[0].Header().Ttl
+	signed := make([]dns.RR, len(rrset))
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%d", key.tag)
+
+	// Signatures do not depend on the case of names, so the variants of a name
+	// queried with a randomized case share the same cached signature.
+	for i, rr := range rrset {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = s.ttl
+		signed[i] = rr
+		b.WriteByte('\n')
+		b.WriteString(strings.ToLower(rr.String()))
+	}
+
+	k := b.String()
+
+	s.mutex.Lock()
+	sig, ok := s.sigs[k]
+	s.mutex.Unlock()
+
+	if !ok || now.After(sig.exp) {
+		rrsig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET},
+			Algorithm:  key.dnskey.Algorithm,
+			KeyTag:     key.tag,
+			SignerName: s.zone,
+			Inception:  uint32(now.Add(-signatureInception).Unix()),
+			Expiration: uint32(now.Add(signatureValidity).Unix()),
+		}
+
+		if err := rrsig.Sign(key.signer, signed); err != nil {
+			log.Printf("[ERROR] signing %s records of %s: %s", dns.TypeToString[rrset[0].Header().Rrtype], rrsig.Hdr.Name, err)
+			return nil
+		}
+
+		sig = signature{rrsig: rrsig, exp: now.Add(signatureRefresh)}
+		s.mutex.Lock()
+		s.sigs[k] = sig
+		s.mutex.Unlock()
+	}
+
+	rrsig := *sig.rrsig
+	rrsig.Hdr.Name = rrset[0].Header().Name
+	rrsig.Hdr.Ttl = ttl
+	return &rrsig
+}
+
+// cleanup removes the signatures which are due to be regenerated.
+func (s *signer) cleanup(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for k, sig := range s.sigs {
+		if now.After(sig.exp) {
+			delete(s.sigs, k)
+		}
+	}
+}
+
+// predecessor returns a name which sorts right before name in the canonical
+// order of DNS names, by decrementing the last byte of its first label and
+// padding the label with \255 bytes up to its maximum length (RFC 4470), so no
+// sibling of the name sorts between the two. A trailing zero byte is removed
+// instead, which gives the parent of the name when the label is "\000".
+func predecessor(name string) string {
+	return mapFirstLabel(name, func(label []byte, max int) []byte {
+		last := len(label) - 1
+		if label[last] == 0 {
+			return label[:last]
+		}
+		label[last]--
+		// Names are compared in lower case, so upper case letters would sort
+		// after the name.
+		if label[last] >= 'A' && label[last] <= 'Z' {
+			label[last] = 'A' - 1
+		}
+		for len(label) < max {
+			label = append(label, 255)
+		}
+		return label
+	})
+}
+
+// successor returns a name which sorts right after name and all of its
+// descendants in the canonical order of DNS names, by appending a zero byte to
+// its first label.
+func successor(name string) string {
+	return mapFirstLabel(name, func(label []byte, max int) []byte {
+		if len(label) < max {
+			return append(label, 0)
+		}
+		label[len(label)-1]++
+		return label
+	})
+}
+
+// mapFirstLabel returns name with its first label replaced by the result of f,
+// which is given the unescaped bytes of the label and the maximum length of a
+// label which keeps the name within the limits of DNS names.
+func mapFirstLabel(name string, f func(label []byte, max int) []byte) string {
+	b := make([]byte, 256)
+
+	n, err := dns.PackDomainName(name, b, 0, nil, false)
+	if err != nil || n <= 1 {
+		return name
+	}
+
+	max := maxLabelLen
+	if rest := n - 1 - int(b[0]); max > maxNameLen-1-rest {
+		max = maxNameLen - 1 - rest
+	}
+
+	label := f(append([]byte{}, b[1:1+b[0]]...), max)
+	if len(label) == 0 {
+		parent, _ := dns.NextLabel(name, 0)
+		return name[parent:]
+	}
+
+	w := append([]byte{byte(len(label))}, label...)
+	w = append(w, b[1+b[0]:n]...)
+
+	s, _, err := dns.UnpackDomainName(w, 0)
+	if err != nil {
+		return name
+	}
+	return s
+}
@@ -0,0 +1,203 @@
+package consul
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCanonicalNeighbors(t *testing.T) {
+	// pad appends n \255 bytes to label.
+	pad := func(label string, n int) string {
+		return label + strings.Repeat("\\255", n)
+	}
+	long := strings.Repeat(strings.Repeat("a", 63)+".", 3)
+
+	tests := []struct {
+		name        string
+		predecessor string
+		successor   string
+	}{
+		{name: "service-1.service.consul.", predecessor: pad("service-0", 54) + ".service.consul.", successor: "service-1\\000.service.consul."},
+		{name: "a.consul.", predecessor: pad("`", 62) + ".consul.", successor: "a\\000.consul."},
+		{name: "\\[.consul.", predecessor: pad("\\@", 62) + ".consul.", successor: "[\\000.consul."},
+		{name: "\\000.consul.", predecessor: "consul.", successor: "\\000\\000.consul."},
+		{name: "*.service.consul.", predecessor: pad("\\)", 62) + ".service.consul.", successor: "*\\000.service.consul."},
+		{name: "b." + long + "consul.", predecessor: pad("a", 53) + "." + long + "consul.", successor: "b\\000." + long + "consul."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if name := predecessor(test.name); name != test.predecessor {
+				t.Errorf("Expected the predecessor to be %q but found: %q", test.predecessor, name)
+			} else if compareNames(name, test.name) >= 0 {
+				t.Errorf("Expected the predecessor to sort before the name")
+			}
+
+			if name := successor(test.name); name != test.successor {
+				t.Errorf("Expected the successor to be %q but found: %q", test.successor, name)
+			}
+		})
+	}
+}
+
+func TestSigner(t *testing.T) {
+	var keys []dnssecKey
+
+	for _, path := range []string{"testdata/Kconsul.+013+10202", "testdata/Kconsul.+013+35954"} {
+		k, err := readDNSSECKey(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+
+	s, err := newSigner(keys, 1*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.zone != "consul." {
+		t.Errorf("Expected the zone to be consul. but found: %s", s.zone)
+	}
+	if len(s.ksk) != 1 || s.ksk[0].tag != 10202 {
+		t.Errorf("Expected key 10202 to be the key signing key")
+	}
+	if len(s.zsk) != 1 || s.zsk[0].tag != 35954 {
+		t.Errorf("Expected key 35954 to be the zone signing key")
+	}
+
+	now := time.Now()
+	sign := func(ttl uint32) *dns.RRSIG {
+		m := &dns.Msg{}
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "service-1.service.consul.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.ParseIP("192.168.0.1"),
+		}}
+		s.signMsg(m, "service-1.service.consul.", nil, now)
+
+		if len(m.Answer) != 2 {
+			t.Fatalf("Expected the answer to be signed: %v", m.Answer)
+		}
+
+		rrsig := m.Answer[1].(*dns.RRSIG)
+		if rrsig.Hdr.Ttl != ttl {
+			t.Errorf("Expected the signature TTL to be %d but found: %d", ttl, rrsig.Hdr.Ttl)
+		}
+		if rrsig.OrigTtl != 60 {
+			t.Errorf("Expected the original TTL to be 60 but found: %d", rrsig.OrigTtl)
+		}
+		if err := rrsig.Verify(s.zsk[0].dnskey, m.Answer[:1]); err != nil {
+			t.Errorf("Invalid signature: %s", err)
+		}
+		return rrsig
+	}
+
+	sig1, sig2 := sign(60), sign(30)
+	if sig1.Signature != sig2.Signature {
+		t.Error("Expected the signature to be reused for records with a lower TTL")
+	}
+
+	s.cleanup(now.Add(signatureRefresh + time.Second))
+	if len(s.sigs) != 0 {
+		t.Errorf("Expected the signatures to be removed from the cache but found %d", len(s.sigs))
+	}
+
+	m := &dns.Msg{}
+	m.Answer = s.dnskeys()
+	s.signMsg(m, "consul.", nil, now)
+
+	if len(m.Answer) != 3 {
+		t.Fatalf("Expected the DNSKEY records to be signed: %v", m.Answer)
+	}
+	if err := m.Answer[2].(*dns.RRSIG).Verify(s.ksk[0].dnskey, m.Answer[:2]); err != nil {
+		t.Errorf("Invalid signature of the DNSKEY records: %s", err)
+	}
+}
+
+func TestSignerNameError(t *testing.T) {
+	k, err := readDNSSECKey("testdata/Kconsul.+013+35954")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newSigner([]dnssecKey{k}, 1*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &dns.Msg{}
+	m.Rcode = dns.RcodeNameError
+	s.signMsg(m, "service-2.service.consul.", nil, time.Now())
+
+	var nsec []*dns.NSEC
+	for _, rr := range m.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsec = append(nsec, rr)
+		case *dns.RRSIG:
+			if err := rr.Verify(k.dnskey, rrsetOf(m.Ns, rr)); err != nil {
+				t.Errorf("Invalid signature of the %s records: %s", dns.TypeToString[rr.TypeCovered], err)
+			}
+		}
+	}
+
+	if len(nsec) != 2 {
+		t.Fatalf("Expected 2 NSEC records but found: %v", nsec)
+	}
+
+	for i, name := range []string{"service-2.service.consul.", "*.service.consul."} {
+		if !covers(nsec[i], name) {
+			t.Errorf("Expected %s to cover %s", nsec[i], name)
+		}
+	}
+
+	if covers(nsec[0], "service-1.service.consul.") {
+		t.Errorf("Expected %s not to cover service-1.service.consul.", nsec[0])
+	}
+}
+
+func rrsetOf(rrs []dns.RR, rrsig *dns.RRSIG) (rrset []dns.RR) {
+	for _, rr := range rrs {
+		if h := rr.Header(); h.Rrtype == rrsig.TypeCovered && h.Name == rrsig.Hdr.Name {
+			rrset = append(rrset, rr)
+		}
+	}
+	return
+}
+
+// covers reports whether name is between the owner and next name of nsec in
+// the canonical order of DNS names.
+func covers(nsec *dns.NSEC, name string) bool {
+	return compareNames(nsec.Hdr.Name, name) < 0 && compareNames(name, nsec.NextDomain) < 0
+}
+
+func compareNames(a, b string) int {
+	la, lb := labelsOf(a), labelsOf(b)
+
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := la[len(la)-i], lb[len(lb)-i]
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return +1
+		}
+	}
+
+	return len(la) - len(lb)
+}
+
+func labelsOf(name string) (labels []string) {
+	b := make([]byte, 256)
+	n, _ := dns.PackDomainName(dns.CanonicalName(name), b, 0, nil, false)
+
+	for i := 0; i < n && b[i] != 0; i += 1 + int(b[i]) {
+		labels = append(labels, string(b[i+1:i+1+int(b[i])]))
+	}
+
+	return
+}
@@ -0,0 +1,72 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+)
+
+// untaggedFilter returns the filter expression applied to names without a tag,
+// which is made of the clauses of the top-level conjunction of expr that do
+// not use the {tag} placeholder. An error is returned if the placeholder is
+// used in a top-level disjunction, since the clause using it cannot be removed
+// without matching other services.
+func untaggedFilter(expr string) (string, error) {
+	if !strings.Contains(expr, filterTag) {
+		return expr, nil
+	}
+
+	if len(splitFilter(expr, "or")) > 1 {
+		return "", fmt.Errorf("the %s placeholder must not be used in a top-level 'or' of the filter: %q", filterTag, expr)
+	}
+
+	clauses := splitFilter(expr, "and")
+	untagged := clauses[:0]
+
+	for _, clause := range clauses {
+		if !strings.Contains(clause, filterTag) {
+			untagged = append(untagged, clause)
+		}
+	}
+
+	return strings.Join(untagged, " and "), nil
+}
+
+// splitFilter splits a consul filter expression on the op logical operator,
+// ignoring the operators within parentheses and quoted values.
+func splitFilter(expr string, op string) []string {
+	var clauses []string
+	var quote byte
+	var depth, start int
+
+	for i := 0; i < len(expr); i++ {
+		switch b := expr[i]; {
+		case quote != 0:
+			if b == '\\' && quote == '"' {
+				i++
+			} else if b == quote {
+				quote = 0
+			}
+		case b == '"' || b == '`':
+			quote = b
+		case b == '(':
+			depth++
+		case b == ')':
+			depth--
+		case depth == 0 && isFilterOperator(expr, i, op):
+			clauses = append(clauses, strings.TrimSpace(expr[start:i]))
+			start = i + len(op)
+			i = start - 1
+		}
+	}
+
+	return append(clauses, strings.TrimSpace(expr[start:]))
+}
+
+// isFilterOperator returns true if the op operator is at offset i of expr,
+// delimited by spaces or parentheses.
+func isFilterOperator(expr string, i int, op string) bool {
+	j := i + len(op)
+	return i > 0 && j < len(expr) && expr[i:j] == op &&
+		strings.IndexByte(" \t\n)", expr[i-1]) >= 0 &&
+		strings.IndexByte(" \t\n(", expr[j]) >= 0
+}
@@ -0,0 +1,50 @@
+package consul
+
+import (
+	"sync"
+)
+
+// flightGroup coalesces the concurrent fetches of services for the same key,
+// at most one fetch of each key is in flight at any time.
+//
+// Fetches run in their own goroutine, so the lookups waiting for them can give
+// up when their context is canceled without canceling the fetch, which still
+// updates the cache for the other lookups.
+type flightGroup struct {
+	mutex   sync.Mutex
+	flights map[key]chan struct{}
+}
+
+// start runs fn in a new goroutine unless a fetch of k is already in flight,
+// and returns a channel closed when the fetch of k completes. started is true
+// if fn was run by this call.
+//
+// The results of fn must be passed through variables captured by fn, which
+// may only be read after done is closed.
+func (g *flightGroup) start(k key, fn func()) (done <-chan struct{}, started bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if ch, ok := g.flights[k]; ok {
+		return ch, false
+	}
+
+	if g.flights == nil {
+		g.flights = make(map[key]chan struct{})
+	}
+
+	ch := make(chan struct{})
+	g.flights[k] = ch
+
+	go func() {
+		defer func() {
+			g.mutex.Lock()
+			delete(g.flights, k)
+			g.mutex.Unlock()
+			close(ch)
+		}()
+		fn()
+	}()
+
+	return ch, true
+}
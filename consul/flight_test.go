@@ -0,0 +1,92 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheFlightWaiterTimeout(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		json.NewEncoder(w).Encode([]consulHealthService{{
+			Node:    consulNode{Node: "host-1", Datacenter: "dc1"},
+			Service: consulService{Address: "192.168.0.1", Port: 10001},
+		}})
+	}))
+	defer server.Close()
+
+	cache := cache{
+		client:  newClient([]string{server.URL}, http.DefaultTransport),
+		ttl:     1 * time.Minute,
+		timeout: 5 * time.Second,
+	}
+
+	k := key{name: "service-1", dc: "dc1"}
+	now := time.Now()
+
+	// The lookup which started the fetch gives up, but the fetch continues.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, _, err := cache.lookup(ctx, k, now); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the lookup to time out but got: %v", err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		srv, _, err := cache.lookup(context.Background(), k, now)
+		if err == nil && srv.addr.String() != "192.168.0.1" {
+			t.Errorf("Unexpected service: %+v", srv)
+		}
+		result <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The lookup waiting for the fetch in flight did not return")
+	}
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("Expected the lookups to share a single fetch but found: %d", n)
+	}
+}
+
+type panicTransport struct{}
+
+func (panicTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	panic("crashed")
+}
+
+func TestCacheFlightPanic(t *testing.T) {
+	cache := cache{
+		client:  newClient([]string{"http://localhost:8500"}, panicTransport{}),
+		ttl:     1 * time.Minute,
+		timeout: 1 * time.Second,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The crash is reported to the lookup instead of leaving it waiting.
+	_, _, err := cache.lookup(ctx, key{name: "service-1", dc: "dc1"}, time.Now())
+	if err == nil || !strings.Contains(err.Error(), "crashed") {
+		t.Errorf("Expected the lookup to fail with the panic of the fetch but got: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package consul
+
+import (
+	"net/http"
+)
+
+// healthHandler returns the handler of the health endpoint of the plugin,
+// which responds to GET /health with 200 when the plugin is able to reach
+// consul, and 503 when it is not.
+func (c *Consul) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", c.serveHealth)
+	return mux
+}
+
+func (c *Consul) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := http.StatusOK
+	if !c.Healthy() {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(http.StatusText(status) + "\n"))
+}
@@ -0,0 +1,80 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	corednstest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestHealthEndpoint(t *testing.T) {
+	var up int32 = 1
+
+	handler := consulHandler("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.Warmup = []string{"service-1.service.consul"}
+	defer consul.Close()
+
+	consul.warmup(context.Background())
+
+	health := httptest.NewServer(consul.healthHandler())
+	defer health.Close()
+
+	check := func(status int) {
+		t.Helper()
+		res, err := http.Get(health.URL + "/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Errorf("Expected status %d but found: %d", status, res.StatusCode)
+		}
+	}
+
+	check(http.StatusOK)
+
+	atomic.StoreInt32(&up, 0)
+
+	// Each query is for a different name so it is not answered from the
+	// cache, and fails to reach consul.
+	for i := 0; i < 64 && consul.Healthy(); i++ {
+		req := &dns.Msg{}
+		req.SetQuestion(fmt.Sprintf("service-%d.service.consul.", i+2), dns.TypeA)
+		consul.ServeDNS(context.Background(), dnstest.NewRecorder(&corednstest.ResponseWriter{}), req)
+	}
+
+	check(http.StatusServiceUnavailable)
+
+	if !consul.Ready() {
+		t.Error("the plugin stopped being ready while consul was unavailable")
+	}
+
+	res, err := http.Post(health.URL+"/health", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d but found: %d", http.StatusMethodNotAllowed, res.StatusCode)
+	}
+}
@@ -0,0 +1,29 @@
+package consul
+
+import (
+	"context"
+	"time"
+)
+
+// janitor periodically removes expired entries from the cache until ctx is
+// canceled.
+func (c *Consul) janitor(ctx context.Context) {
+	ticker := time.NewTicker(c.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			c.mutex.RLock()
+			cache := c.cache
+			c.mutex.RUnlock()
+
+			if cache != nil && cache.cleanups.tryLock() {
+				cache.cleanup(now)
+				cache.cleanups.unlock()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -3,19 +3,34 @@ package consul
 import (
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	metricsPlugin "github.com/coredns/coredns/plugin/metrics"
 	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
 	consulSubsystem = "consul_cache"
+	agentSubsystem  = "consul"
 	success         = "success"
 	denial          = "denial"
+
+	// Reasons for removing entries from the cache.
+	expired = "expired"
+	memory  = "memory"
+	purged  = "purged"
+)
+
+// Counts of cache hits and misses of all cache entries, used to compute the
+// hit ratio of the cache.
+var (
+	cacheLookupHits   uint64
+	cacheLookupMisses uint64
 )
 
 var (
@@ -28,6 +43,13 @@ var (
 		Help:      "The number of elements in the cache.",
 	}, []string{"dc", "tag", "name", "type"})
 
+	cacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: consulSubsystem,
+		Name:      "bytes",
+		Help:      "The approximate number of bytes used by the cache.",
+	})
+
 	cacheServices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: consulSubsystem,
@@ -49,12 +71,19 @@ var (
 		Help:      "The count of cache misses.",
 	}, []string{"dc", "tag", "name"})
 
+	cacheHitRatio = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: consulSubsystem,
+		Name:      "hit_ratio",
+		Help:      "The ratio of cache lookups that were hits.",
+	}, cacheHitRatioValue)
+
 	cacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: consulSubsystem,
 		Name:      "evictions_total",
-		Help:      "The count of cache evictions.",
-	}, []string{"dc", "tag", "name"})
+		Help:      "The count of cache evictions by reason.",
+	}, []string{"dc", "tag", "name", "reason"})
 
 	cachePrefetches = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
@@ -63,6 +92,34 @@ var (
 		Help:      "The number of time the cache has prefetched a cached item.",
 	}, []string{"dc", "tag", "name"})
 
+	cacheRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: consulSubsystem,
+		Name:      "refreshes_total",
+		Help:      "The number of time the cache has refreshed a cached item in the background.",
+	}, []string{"dc", "tag", "name"})
+
+	cacheStale = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: consulSubsystem,
+		Name:      "stale_total",
+		Help:      "The count of lookups answered with expired services because they could not be refreshed.",
+	}, []string{"dc", "tag", "name"})
+
+	cacheRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: consulSubsystem,
+		Name:      "retries_total",
+		Help:      "The number of time a failed request to consul was retried.",
+	}, []string{"dc", "tag", "name"})
+
+	cacheWatchUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: consulSubsystem,
+		Name:      "watch_updates_total",
+		Help:      "The number of time a cached item was updated by a blocking query.",
+	}, []string{"dc", "tag", "name"})
+
 	cacheFetchSizes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: consulSubsystem,
@@ -78,6 +135,147 @@ var (
 		Help:      "The distribution of response time to Consul requests.",
 		Buckets:   []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60},
 	}, []string{"dc", "tag", "name"})
+
+	cacheInvalidAddrs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: consulSubsystem,
+		Name:      "invalid_addresses_total",
+		Help:      "The count of service instances dropped because their address could not be parsed.",
+	}, []string{"dc", "tag", "name"})
+
+	cacheConsulIndex = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: consulSubsystem,
+		Name:      "consul_index",
+		Help:      "The consul index of the last response to a request fetching services.",
+	}, []string{"dc", "tag", "name"})
+
+	cacheKnownLeader = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: consulSubsystem,
+		Name:      "known_leader",
+		Help:      "Whether the consul server answering the last request fetching services knew the cluster leader (1) or not (0).",
+	}, []string{"dc", "tag", "name"})
+
+	cacheLastContact = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: consulSubsystem,
+		Name:      "last_contact_seconds",
+		Help:      "The time since the consul server answering the last request fetching services was in contact with the leader.",
+	}, []string{"dc", "tag", "name"})
+
+	cacheInflightFetches = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: consulSubsystem,
+		Name:      "inflight_fetches",
+		Help:      "The number of requests to consul currently fetching services.",
+	})
+
+	cacheFetchQueue = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: consulSubsystem,
+		Name:      "fetch_queue_depth",
+		Help:      "The number of lookups waiting for the limit of concurrent fetches to let their request to consul through.",
+	})
+
+	cachePackedHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: consulSubsystem,
+		Name:      "packed_hits_total",
+		Help:      "The count of responses served from packed messages of popular names.",
+	})
+
+	responses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: agentSubsystem,
+		Name:      "responses_total",
+		Help:      "The count of responses sent by the plugin, by response code.",
+	}, []string{"rcode"})
+
+	requestDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: agentSubsystem,
+		Name:      "request_duration_seconds",
+		Help:      "The distribution of the time to serve queries for services, by outcome of the cache lookup.",
+		Buckets:   []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5},
+	}, []string{"outcome"})
+
+	nameErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: agentSubsystem,
+		Name:      "name_errors_total",
+		Help:      "The count of queries for names which could not be parsed, by reason.",
+	}, []string{"reason"})
+
+	datacenterKnown = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: agentSubsystem,
+		Name:      "datacenter_known",
+		Help:      "Whether a datacenter is in the list of datacenters of the consul catalog (1).",
+	}, []string{"dc"})
+
+	inflightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: agentSubsystem,
+		Name:      "inflight_requests",
+		Help:      "The number of DNS requests currently served by the plugin.",
+	})
+
+	healthy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: agentSubsystem,
+		Name:      "healthy",
+		Help:      "Whether the plugin is able to reach consul (1) or not (0).",
+	})
+
+	endpointHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: agentSubsystem,
+		Name:      "endpoint_healthy",
+		Help:      "Whether the last request to a consul agent succeeded (1) or failed (0).",
+	}, []string{"addr"})
+
+	endpointInflightRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: agentSubsystem,
+		Name:      "endpoint_inflight_requests",
+		Help:      "The number of HTTP requests to a consul agent waiting for a response.",
+	}, []string{"addr"})
+
+	endpointFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: agentSubsystem,
+		Name:      "endpoint_failures_total",
+		Help:      "The count of failed requests to a consul agent.",
+	}, []string{"addr"})
+
+	fetchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: agentSubsystem,
+		Name:      "fetch_errors_total",
+		Help:      "The count of failed requests to consul fetching services, by cause and status code.",
+	}, []string{"cause", "code"})
+
+	endpointFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: agentSubsystem,
+		Name:      "endpoint_failovers_total",
+		Help:      "The number of time the plugin failed over from a consul agent to the next one.",
+	}, []string{"addr"})
+
+	endpointBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: agentSubsystem,
+		Name:      "endpoint_breaker_state",
+		Help:      "Whether the circuit breaker of a consul agent is in the given state (1) or not (0).",
+	}, []string{"addr", "state"})
+
+	endpointShortCircuits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: agentSubsystem,
+		Name:      "endpoint_short_circuits_total",
+		Help:      "The count of requests to a consul agent rejected by its open circuit breaker.",
+	}, []string{"addr"})
 )
 
 type metrics struct {
@@ -100,24 +298,54 @@ func (m metrics) cacheServicesAdd(n int) {
 
 func (m metrics) cacheHitsIncSuccess() {
 	cacheHits.WithLabelValues(m.dc, m.tag, m.name, success).Inc()
+	atomic.AddUint64(&cacheLookupHits, 1)
 }
 
 func (m metrics) cacheHitsIncDenial() {
 	cacheHits.WithLabelValues(m.dc, m.tag, m.name, denial).Inc()
+	atomic.AddUint64(&cacheLookupHits, 1)
 }
 
 func (m metrics) cacheMissesInc() {
 	cacheMisses.WithLabelValues(m.dc, m.tag, m.name).Inc()
+	atomic.AddUint64(&cacheLookupMisses, 1)
 }
 
-func (m metrics) cacheEvictionsInc() {
-	cacheEvictions.WithLabelValues(m.dc, m.tag, m.name).Inc()
+// cacheHitRatioValue returns the ratio of cache lookups that were hits since
+// the program started.
+func cacheHitRatioValue() float64 {
+	hits := atomic.LoadUint64(&cacheLookupHits)
+	misses := atomic.LoadUint64(&cacheLookupMisses)
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+func (m metrics) cacheEvictionsInc(reason string) {
+	cacheEvictions.WithLabelValues(m.dc, m.tag, m.name, reason).Inc()
 }
 
 func (m metrics) cachePrefetchesInc() {
 	cachePrefetches.WithLabelValues(m.dc, m.tag, m.name).Inc()
 }
 
+func (m metrics) cacheRefreshesInc() {
+	cacheRefreshes.WithLabelValues(m.dc, m.tag, m.name).Inc()
+}
+
+func (m metrics) cacheStaleInc() {
+	cacheStale.WithLabelValues(m.dc, m.tag, m.name).Inc()
+}
+
+func (m metrics) cacheRetriesInc() {
+	cacheRetries.WithLabelValues(m.dc, m.tag, m.name).Inc()
+}
+
+func (m metrics) cacheWatchUpdatesInc() {
+	cacheWatchUpdates.WithLabelValues(m.dc, m.tag, m.name).Inc()
+}
+
 func (m metrics) cacheFetchSizesObserve(n int) {
 	cacheFetchSizes.WithLabelValues(m.dc, m.tag, m.name).Observe(float64(n))
 }
@@ -126,6 +354,121 @@ func (m metrics) cacheFetchDurationsObserve(d time.Duration) {
 	cacheFetchDurations.WithLabelValues(m.dc, m.tag, m.name).Observe(float64(d) / float64(time.Second))
 }
 
+func (m metrics) cacheInvalidAddrsAdd(n int) {
+	cacheInvalidAddrs.WithLabelValues(m.dc, m.tag, m.name).Add(float64(n))
+}
+
+func (m metrics) cacheConsulIndexSet(index uint64) {
+	cacheConsulIndex.WithLabelValues(m.dc, m.tag, m.name).Set(float64(index))
+}
+
+func (m metrics) cacheKnownLeaderSet(known bool) {
+	v := 0.0
+	if known {
+		v = 1.0
+	}
+	cacheKnownLeader.WithLabelValues(m.dc, m.tag, m.name).Set(v)
+}
+
+func (m metrics) cacheLastContactSet(d time.Duration) {
+	cacheLastContact.WithLabelValues(m.dc, m.tag, m.name).Set(float64(d) / float64(time.Second))
+}
+
+func cacheBytesAdd(n int) {
+	cacheBytes.Add(float64(n))
+}
+
+func cacheInflightFetchesAdd(n int) {
+	cacheInflightFetches.Add(float64(n))
+}
+
+func cacheFetchQueueAdd(n int) {
+	cacheFetchQueue.Add(float64(n))
+}
+
+func packedHitsInc() {
+	cachePackedHits.Inc()
+}
+
+func responsesInc(rcode int) {
+	responses.WithLabelValues(dns.RcodeToString[rcode]).Inc()
+}
+
+func requestDurationsObserve(outcome string, d time.Duration) {
+	requestDurations.WithLabelValues(outcome).Observe(float64(d) / float64(time.Second))
+}
+
+func nameErrorsInc(reason string) {
+	nameErrors.WithLabelValues(reason).Inc()
+}
+
+// datacentersSet updates the known datacenters from the previous list to the
+// next one.
+func datacentersSet(prev, next map[string]struct{}) {
+	for dc := range prev {
+		if _, ok := next[dc]; !ok {
+			datacenterKnown.DeleteLabelValues(dc)
+		}
+	}
+	for dc := range next {
+		datacenterKnown.WithLabelValues(dc).Set(1)
+	}
+}
+
+func inflightRequestsAdd(n int) {
+	inflightRequests.Add(float64(n))
+}
+
+func fetchErrorsInc(cause, code string) {
+	fetchErrors.WithLabelValues(cause, code).Inc()
+}
+
+func healthySet(ok bool) {
+	v := 0.0
+	if ok {
+		v = 1.0
+	}
+	healthy.Set(v)
+}
+
+type endpointMetrics struct {
+	addr string
+}
+
+func (m endpointMetrics) endpointHealthySet(healthy bool) {
+	v := 0.0
+	if healthy {
+		v = 1.0
+	}
+	endpointHealthy.WithLabelValues(m.addr).Set(v)
+}
+
+func (m endpointMetrics) endpointInflightRequestsAdd(n int) {
+	endpointInflightRequests.WithLabelValues(m.addr).Add(float64(n))
+}
+
+func (m endpointMetrics) endpointFailuresInc() {
+	endpointFailures.WithLabelValues(m.addr).Inc()
+}
+
+func (m endpointMetrics) endpointFailoversInc() {
+	endpointFailovers.WithLabelValues(m.addr).Inc()
+}
+
+func (m endpointMetrics) endpointBreakerStateSet(state breakerState) {
+	for _, s := range breakerStates {
+		v := 0.0
+		if s == state {
+			v = 1.0
+		}
+		endpointBreakerState.WithLabelValues(m.addr, s.String()).Set(v)
+	}
+}
+
+func (m endpointMetrics) endpointShortCircuitsInc() {
+	endpointShortCircuits.WithLabelValues(m.addr).Inc()
+}
+
 func registerMetrics(c *caddy.Controller) error {
 	once.Do(func() {
 		if m := dnsserver.GetConfig(c).Handler("prometheus"); m == nil {
@@ -134,13 +477,39 @@ func registerMetrics(c *caddy.Controller) error {
 			log.Printf("[WARN] the registered metrics plugin is of an unexpected %T type", m)
 		} else {
 			r.MustRegister(cacheSize)
+			r.MustRegister(cacheBytes)
 			r.MustRegister(cacheServices)
 			r.MustRegister(cacheHits)
 			r.MustRegister(cacheMisses)
+			r.MustRegister(cacheHitRatio)
 			r.MustRegister(cacheEvictions)
 			r.MustRegister(cachePrefetches)
+			r.MustRegister(cacheRefreshes)
+			r.MustRegister(cacheStale)
+			r.MustRegister(cacheRetries)
+			r.MustRegister(cacheWatchUpdates)
 			r.MustRegister(cacheFetchSizes)
 			r.MustRegister(cacheFetchDurations)
+			r.MustRegister(cacheInvalidAddrs)
+			r.MustRegister(cacheConsulIndex)
+			r.MustRegister(cacheKnownLeader)
+			r.MustRegister(cacheLastContact)
+			r.MustRegister(cacheInflightFetches)
+			r.MustRegister(cacheFetchQueue)
+			r.MustRegister(cachePackedHits)
+			r.MustRegister(responses)
+			r.MustRegister(nameErrors)
+			r.MustRegister(datacenterKnown)
+			r.MustRegister(requestDurations)
+			r.MustRegister(inflightRequests)
+			r.MustRegister(healthy)
+			r.MustRegister(endpointHealthy)
+			r.MustRegister(fetchErrors)
+			r.MustRegister(endpointInflightRequests)
+			r.MustRegister(endpointFailures)
+			r.MustRegister(endpointFailovers)
+			r.MustRegister(endpointBreakerState)
+			r.MustRegister(endpointShortCircuits)
 		}
 	})
 	return nil
@@ -0,0 +1,210 @@
+package consul
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// packedCache holds the packed responses of popular names, queries for these
+// names are answered with a copy of the packed message patched with the ID,
+// flags and question of the query and the TTL of the records, instead of
+// building and packing a new message.
+//
+// The responses are keyed by the service that they return, so they never
+// become invalid and are only evicted to bound the size of the cache.
+type packedCache struct {
+	mutex     sync.RWMutex
+	responses map[packedKey]*packedResponse
+	limit     int
+}
+
+type packedKey struct {
+	qname string
+	qtype uint16
+	addr  [16]byte
+	port  int
+	node  string
+	size  int    // maximum size of the response, see request.Size
+	edns  uint16 // UDP size of the EDNS0 record of the query, zero if none
+	do    bool
+}
+
+type packedResponse struct {
+	msg  []byte
+	ttls []int // offsets of the TTLs of the records in msg
+}
+
+func newPackedCache(limit int) *packedCache {
+	return &packedCache{
+		responses: make(map[packedKey]*packedResponse),
+		limit:     limit,
+	}
+}
+
+// packedKeyOf returns the key of the response to state answered with srv, ok
+// is false if the response cannot be served from a packed message.
+func packedKeyOf(state request.Request, srv service) (k packedKey, ok bool) {
+	if state.Req.Opcode != dns.OpcodeQuery || len(state.Req.Question) != 1 {
+		return
+	}
+
+	// The case of the question is patched in place, escaped names may not be
+	// encoded with the same length in upper and lower case.
+	qname := state.Name()
+	if strings.IndexByte(qname, '\\') >= 0 {
+		return
+	}
+
+	if o := state.Req.IsEdns0(); o != nil {
+		// EDNS0 options of the query, such as cookies or the client subnet,
+		// may be echoed in the response.
+		if len(o.Option) != 0 {
+			return
+		}
+		k.edns, k.do = o.UDPSize(), o.Do()
+	}
+
+	k.qname = qname
+	k.qtype = state.QType()
+	copy(k.addr[:], srv.addr.To16())
+	k.port = srv.port
+	k.node = srv.node
+	k.size = state.Size()
+	return k, true
+}
+
+// get returns the packed response of k, or nil if there are none.
+func (p *packedCache) get(k packedKey) *packedResponse {
+	p.mutex.RLock()
+	r := p.responses[k]
+	p.mutex.RUnlock()
+	return r
+}
+
+// put packs msg and caches it as the response of k. Messages which cannot be
+// patched to answer other queries are not cached.
+func (p *packedCache) put(k packedKey, msg *dns.Msg) {
+	if msg.Truncated {
+		return
+	}
+
+	// Truncate disables compression of messages which fit in the size of the
+	// response, but the names of records in the answer must point to the
+	// question so its case can be patched.
+	msg.Compress = true
+
+	b, err := msg.Pack()
+	if err != nil {
+		return
+	}
+
+	ttls, ok := packedTTLs(b)
+	if !ok {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, exists := p.responses[k]; !exists && len(p.responses) >= p.limit {
+		// Popular names are cached again on their next query, dropping any
+		// response is simpler than tracking which one was used last.
+		for evicted := range p.responses {
+			delete(p.responses, evicted)
+			break
+		}
+	}
+
+	p.responses[k] = &packedResponse{msg: b, ttls: ttls}
+}
+
+// reply returns a copy of the packed response answering req, with records
+// which have the given TTL.
+func (r *packedResponse) reply(req *dns.Msg, ttl uint32) []byte {
+	b := make([]byte, len(r.msg))
+	copy(b, r.msg)
+
+	binary.BigEndian.PutUint16(b[0:], req.Id)
+	b[2] &^= 0x01 // RD
+	b[3] &^= 0x10 // CD
+
+	if req.RecursionDesired {
+		b[2] |= 0x01
+	}
+	if req.CheckingDisabled {
+		b[3] |= 0x10
+	}
+
+	// The names of records in the answer point to the question, which has
+	// the same labels as the queried name, but maybe not the same case.
+	qname := req.Question[0].Name
+	for off, i := headerSize, 0; b[off] != 0; off += int(b[off]) + 1 {
+		n := int(b[off])
+		i += copy(b[off+1:off+1+n], qname[i:i+n]) + 1
+	}
+
+	for _, off := range r.ttls {
+		binary.BigEndian.PutUint32(b[off:], ttl)
+	}
+
+	return b
+}
+
+// Size of the header of DNS messages.
+const headerSize = 12
+
+// packedTTLs returns the offsets of the TTLs of the records of msg, excluding
+// the OPT pseudo-record, ok is false if msg has more than one question, or if
+// the names of records in the answer do not point to the question.
+func packedTTLs(msg []byte) (ttls []int, ok bool) {
+	if len(msg) < headerSize || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return
+	}
+
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	records := answers +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+
+	off, ok := skipName(msg, headerSize)
+	if off += 4; !ok || off > len(msg) {
+		return nil, false
+	}
+
+	for i := 0; i < records; i++ {
+		if i < answers && (off+2 > len(msg) || msg[off] != 0xC0 || msg[off+1] != headerSize) {
+			return nil, false
+		}
+
+		if off, ok = skipName(msg, off); !ok || off+10 > len(msg) {
+			return nil, false
+		}
+
+		if binary.BigEndian.Uint16(msg[off:]) != dns.TypeOPT {
+			ttls = append(ttls, off+4)
+		}
+
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	}
+
+	return ttls, off == len(msg)
+}
+
+// skipName returns the offset following the domain name at off in msg.
+func skipName(msg []byte, off int) (int, bool) {
+	for off < len(msg) {
+		switch n := int(msg[off]); {
+		case n == 0:
+			return off + 1, true
+		case n&0xC0 == 0xC0:
+			return off + 2, off+2 <= len(msg)
+		default:
+			off += n + 1
+		}
+	}
+	return off, false
+}
@@ -0,0 +1,161 @@
+package consul
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	corednstest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// packedWriter records the responses written to it, and whether they were
+// written as packed messages.
+type packedWriter struct {
+	corednstest.ResponseWriter
+	msg    *dns.Msg
+	packed bool
+}
+
+func (w *packedWriter) WriteMsg(m *dns.Msg) error {
+	w.msg, w.packed = m, false
+	return nil
+}
+
+func (w *packedWriter) Write(b []byte) (int, error) {
+	w.msg, w.packed = &dns.Msg{}, true
+	return len(b), w.msg.Unpack(b)
+}
+
+func TestPackedReply(t *testing.T) {
+	srv := service{addr: net.ParseIP("192.168.0.1"), port: 10001, node: "host-1.node.dc1.consul."}
+
+	req := &dns.Msg{}
+	req.SetQuestion("_service-1._tcp.service.consul.", dns.TypeSRV)
+	req.SetEdns0(4096, false)
+
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Compress = true
+	res.Answer = []dns.RR{srv.SRV(req.Question[0].Name, 10*time.Second)}
+	res.Extra = []dns.RR{srv.A(srv.node, 10*time.Second), req.IsEdns0()}
+
+	b, err := res.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ttls, ok := packedTTLs(b)
+	if !ok {
+		t.Fatal("Expected the response to be packable")
+	}
+	if len(ttls) != 2 {
+		t.Fatalf("Expected the TTLs of the SRV and A records but found %d offsets", len(ttls))
+	}
+
+	query := &dns.Msg{}
+	query.SetQuestion("_Service-1._TCP.service.Consul.", dns.TypeSRV)
+	query.RecursionDesired = false
+	query.CheckingDisabled = true
+
+	reply := &dns.Msg{}
+	if err := reply.Unpack((&packedResponse{msg: b, ttls: ttls}).reply(query, 42)); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Id != query.Id || reply.RecursionDesired || !reply.CheckingDisabled || !reply.Response {
+		t.Errorf("Unexpected header of the reply: %v", reply.MsgHdr)
+	}
+	if name := reply.Question[0].Name; name != query.Question[0].Name {
+		t.Errorf("Expected the question to be %q but found: %q", query.Question[0].Name, name)
+	}
+	if len(reply.Answer) != 1 || reply.Answer[0].Header().Name != query.Question[0].Name {
+		t.Errorf("Expected the answer to be owned by the queried name: %v", reply.Answer)
+	}
+	for _, rr := range append(reply.Answer, reply.Extra[0]) {
+		if rr.Header().Ttl != 42 {
+			t.Errorf("Expected the TTL to be patched: %v", rr)
+		}
+	}
+	if o := reply.IsEdns0(); o == nil || o.UDPSize() != 4096 {
+		t.Errorf("Expected the OPT record to be preserved: %v", reply.Extra)
+	}
+}
+
+func TestConsulPackedResponses(t *testing.T) {
+	server := httptest.NewServer(consulHandler("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+		{node: "host-2", name: "service-1", addr: "192.168.0.2", port: 10001, pass: true},
+	}))
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+	consul.PackedResponses = 10
+
+	hits := metricValue(cachePackedHits)
+	qnames := []string{"service-1.service.consul.", "Service-1.SERVICE.consul."}
+	packed := 0
+	var last string
+
+	for i := 0; i < 8; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion(qnames[i%2], dns.TypeA)
+		req.RecursionDesired = i%3 == 0
+		w := &packedWriter{}
+
+		if _, err := consul.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatal(err)
+		}
+
+		if w.packed {
+			packed++
+		}
+
+		if w.msg.Id != req.Id || w.msg.RecursionDesired != req.RecursionDesired || w.msg.Rcode != dns.RcodeSuccess {
+			t.Fatalf("%d: unexpected header of the reply: %v", i, w.msg.MsgHdr)
+		}
+		if len(w.msg.Answer) != 1 {
+			t.Fatalf("%d: unexpected answer: %v", i, w.msg.Answer)
+		}
+
+		a := w.msg.Answer[0].(*dns.A)
+		if a.Hdr.Name != qnames[i%2] {
+			t.Errorf("%d: expected the answer to be owned by %q but found: %q", i, qnames[i%2], a.Hdr.Name)
+		}
+		if a.Hdr.Ttl == 0 || a.Hdr.Ttl > 91 {
+			t.Errorf("%d: unexpected TTL of the answer: %d", i, a.Hdr.Ttl)
+		}
+		if a.A.String() == last {
+			t.Errorf("%d: expected the services to be returned by round robin but found %s twice", i, last)
+		}
+		last = a.A.String()
+	}
+
+	// The entry is popular from the second query, the responses for each of
+	// the two services are packed and then served from the packed cache.
+	if packed != 5 {
+		t.Errorf("Expected 5 packed responses but found: %d", packed)
+	}
+	if n := metricValue(cachePackedHits) - hits; n != 5 {
+		t.Errorf("Expected the packed hits to increase by 5 but found: %g", n)
+	}
+
+	// Queries with EDNS0 options are never answered with packed responses.
+	req := &dns.Msg{}
+	req.SetQuestion(qnames[0], dns.TypeA)
+	req.SetEdns0(4096, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"})
+
+	for i := 0; i < 3; i++ {
+		w := &packedWriter{}
+		if _, err := consul.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatal(err)
+		}
+		if w.packed {
+			t.Error("Expected the query with EDNS0 options not to be answered with a packed response")
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshot is the representation of the cache state saved on disk, which is
+// restored when the plugin starts so it can answer queries even if consul is
+// not available.
+type snapshot struct {
+	Agent   consulAgent     `json:"agent"`
+	Entries []snapshotEntry `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Name     string            `json:"name"`
+	Tag      string            `json:"tag,omitempty"`
+	ID       string            `json:"id,omitempty"`
+	Tagged   string            `json:"tagged,omitempty"`
+	DC       string            `json:"dc,omitempty"`
+	Peer     string            `json:"peer,omitempty"`
+	Qtype    uint16            `json:"qtype"`
+	Exp      time.Time         `json:"exp"`
+	Updated  time.Time         `json:"updated"`
+	TTL      time.Duration     `json:"ttl"`
+	Index    uint64            `json:"index,omitempty"`
+	Services []snapshotService `json:"services"`
+}
+
+type snapshotService struct {
+	Addr   net.IP `json:"addr"`
+	Port   int    `json:"port"`
+	Node   string `json:"node"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// snapshot returns the list of cache entries holding services.
+func (c *cache) snapshot() (entries []snapshotEntry) {
+	c.each(func(k key, e *entry) {
+		if !e.isReady() || e.err != nil || len(e.srv) == 0 {
+			return
+		}
+
+		services := make([]snapshotService, len(e.srv))
+		for i, s := range e.srv {
+			services[i] = snapshotService{Addr: s.addr, Port: s.port, Node: s.node, Weight: s.weight}
+		}
+
+		entries = append(entries, snapshotEntry{
+			Name:     k.name,
+			Tag:      k.tag,
+			ID:       k.id,
+			Tagged:   k.addr,
+			DC:       k.dc,
+			Peer:     k.peer,
+			Qtype:    k.qtype,
+			Exp:      e.exp,
+			Updated:  e.updated,
+			TTL:      e.ttl,
+			Index:    e.consulIndex,
+			Services: services,
+		})
+	})
+
+	return
+}
+
+// restore adds the entries of a snapshot to the cache, entries that can no
+// longer be served, even stale, are skipped and counted in expired.
+func (c *cache) restore(entries []snapshotEntry, now time.Time) (expired int) {
+	for _, s := range entries {
+		k := key{name: s.Name, tag: s.Tag, id: s.ID, addr: s.Tagged, dc: s.DC, peer: s.Peer, qtype: s.Qtype}
+		e := &entry{
+			exp:         s.Exp,
+			ttl:         s.TTL,
+			updated:     s.Updated,
+			freq:        &frequency{},
+			consulIndex: s.Index,
+			ready:       make(chan struct{}),
+			index:       1, // can't be zero to avoid refetching on next lookup
+		}
+		close(e.ready)
+
+		if e.ttl <= 0 {
+			e.ttl = c.ttl
+		}
+
+		if !now.Before(c.staleDeadlineOf(e)) {
+			expired++
+			continue
+		}
+
+		for _, srv := range s.Services {
+			e.srv = append(e.srv, service{addr: srv.Addr, port: srv.Port, node: srv.Node, weight: srv.Weight})
+		}
+
+		if !c.insert(k, e) {
+			continue
+		}
+
+		m := c.metricsOf(k)
+		m.cacheSizeAddSuccess(1)
+		m.cacheServicesAdd(len(e.srv))
+		c.bytesAdd(sizeOfEntry(k) + sizeOfServices(e.srv))
+	}
+
+	return expired
+}
+
+func readSnapshot(path string) (*snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &snapshot{}
+	if err := json.NewDecoder(f).Decode(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// writeSnapshot atomically replaces the file at path with s.
+func writeSnapshot(path string, s *snapshot) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := json.NewEncoder(f).Encode(s); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// saveSnapshot writes the state of the cache to the configured file. It does
+// nothing if the plugin has not been initialized yet.
+func (c *Consul) saveSnapshot() error {
+	c.mutex.RLock()
+	cache, agent := c.cache, c.agent
+	c.mutex.RUnlock()
+
+	if cache == nil {
+		return nil
+	}
+
+	return writeSnapshot(c.Persist, &snapshot{
+		Agent:   agent,
+		Entries: cache.snapshot(),
+	})
+}
+
+// persist periodically saves the state of the cache until ctx is canceled.
+func (c *Consul) persist(ctx context.Context) {
+	ticker := time.NewTicker(c.PersistInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.saveSnapshot(); err != nil {
+				log.Printf("[ERROR] saving consul cache snapshot to %s: %s", c.Persist, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package consul
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// logQuery logs a query served by the plugin if it was sampled, or if it was
+// slower than the slow log threshold.
+func (c *Consul) logQuery(state request.Request, rcode int, stats lookupStats, duration time.Duration) {
+	slow := c.SlowLog > 0 && duration >= c.SlowLog
+
+	if !slow && (c.QueryLog <= 0 || rand.Float64() >= c.QueryLog) {
+		return
+	}
+
+	cache := stats.cache
+	if len(cache) == 0 {
+		cache = "-"
+	}
+
+	log.Printf("[INFO] consul query: qname=%s qtype=%s rcode=%s cache=%s fetch=%s duration=%s slow=%t",
+		state.Name(), state.Type(), dns.RcodeToString[rcode], cache, stats.fetch, duration, slow)
+}
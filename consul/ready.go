@@ -0,0 +1,73 @@
+package consul
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Initial delay before retrying to warm up the plugin after a failure.
+	warmupBackoff = 1 * time.Second
+	// Maximum delay between attempts to warm up the plugin.
+	warmupMaxBackoff = 30 * time.Second
+)
+
+// Ready satisfies the interface used by the ready plugin. The consul plugin
+// becomes ready after it fetched the agent information and successfully
+// looked up all the warmup services.
+func (c *Consul) Ready() bool { return atomic.LoadUint32(&c.ready) != 0 }
+
+// warmup initializes the plugin, retrying on failures until it becomes ready
+// or ctx is canceled.
+func (c *Consul) warmup(ctx context.Context) {
+	for backoff := warmupBackoff; ; {
+		err := c.warm(ctx)
+		if err == nil {
+			atomic.StoreUint32(&c.ready, 1)
+			return
+		}
+
+		log.Printf("[WARN] consul is not ready: %s", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		if backoff *= 2; backoff > warmupMaxBackoff {
+			backoff = warmupMaxBackoff
+		}
+	}
+}
+
+func (c *Consul) warm(ctx context.Context) error {
+	cache, agent, err := c.grabCache(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Warm up the cache entries used to answer A, AAAA, and SRV queries.
+	for _, name := range c.Warmup {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeSRV} {
+			k, _ := parseKey(dns.Fqdn(strings.ToLower(name)), qtype, agent)
+
+			// Failed lookups of previous attempts are cached, the entries
+			// are removed so the services are fetched again.
+			if e := cache.get(k); e != nil && e.isReady() && e.err != nil {
+				cache.remove(k, e, purged)
+			}
+
+			if _, _, err := cache.lookup(ctx, k, time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package consul
+
+import (
+	"context"
+	"time"
+)
+
+// Number of refresh intervals without lookups after which entries are not
+// refreshed anymore, and expire from the cache.
+const refreshAllIdleIntervals = 3
+
+// refreshAll periodically refreshes all the services in the cache until ctx
+// is canceled.
+func (c *Consul) refreshAll(ctx context.Context) {
+	ticker := time.NewTicker(c.RefreshAll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			c.mutex.RLock()
+			cache := c.cache
+			c.mutex.RUnlock()
+
+			if cache != nil {
+				cache.refreshAll(now, refreshAllIdleIntervals*c.RefreshAll)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshAll fetches the services of all live cache entries from consul,
+// regardless of how often they are looked up. Entries which are watched, or
+// already being refreshed by a lookup, are skipped. So are entries with no
+// services, and entries which were not looked up for longer than idle, which
+// are left to expire.
+func (c *cache) refreshAll(now time.Time, idle time.Duration) {
+	var keys []key
+	c.mutex.RLock()
+	c.each(func(k key, e *entry) {
+		if _, watched := c.watches[k]; watched || !e.isReady() || now.After(c.staleDeadlineOf(e)) {
+			return
+		}
+		if e.negative || len(e.srv) == 0 || now.Sub(e.freq.lastUpdate()) > idle {
+			return
+		}
+		keys = append(keys, k)
+	})
+	c.mutex.RUnlock()
+
+	for _, k := range keys {
+		e := c.get(k)
+		if e == nil {
+			continue
+		}
+
+		done, started := c.flights.start(k, func() {
+			t0 := time.Now()
+			srv, index, err := c.loadSafe(k)
+			t1 := time.Now()
+
+			m := c.metricsOf(k)
+			m.cacheFetchSizesObserve(len(srv))
+			m.cacheFetchDurationsObserve(t1.Sub(t0))
+
+			if err != nil {
+				// Failures are handled by lookups, which either serve the
+				// entry stale or report the error once it expired.
+				return
+			}
+
+			if c.get(k) == e {
+				c.replace(k, e, srv, index, nil, now)
+				m.cacheRefreshesInc()
+			}
+		})
+
+		// Services are refreshed one at a time, entries which are already
+		// being refreshed by lookups are skipped.
+		if started {
+			<-done
+		}
+	}
+}
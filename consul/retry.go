@@ -0,0 +1,63 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// retryPolicy configures how the cache retries failed requests to consul.
+type retryPolicy struct {
+	attempts    int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	statusCodes []int
+}
+
+// retryable returns true if err is worth retrying, which is the case of all
+// network errors and of responses with one of the configured status codes.
+// Requests rejected by open circuit breakers or by the limit of concurrent
+// fetches, requests which were canceled or timed out, and responses which could
+// not be decoded are not retried, retrying them would fail the same way.
+func (p *retryPolicy) retryable(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case err == errCircuitOpen, err == errTooManyRequests:
+		return false
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return false
+	}
+
+	if e, ok := err.(*statusError); ok {
+		for _, code := range p.statusCodes {
+			if e.code == code {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// delay returns the time to wait before the given attempt, which grows
+// exponentially up to the maximum backoff. Delays are randomized between
+// half and the full value so concurrent retries don't happen in lockstep.
+func (p *retryPolicy) delay(attempt int) time.Duration {
+	d := p.backoff
+	for i := 1; i < attempt && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
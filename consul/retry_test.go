@@ -0,0 +1,46 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	p := retryPolicy{statusCodes: defaultRetryStatusCodes}
+
+	decode := func(s string) error {
+		return decodeHealthServices(strings.NewReader(s), func(*consulHealthService) {})
+	}
+
+	tests := []struct {
+		scenario  string
+		err       error
+		retryable bool
+	}{
+		{scenario: "network error", err: errors.New("connection reset by peer"), retryable: true},
+		{scenario: "retryable status", err: &statusError{code: 503}, retryable: true},
+		{scenario: "non-retryable status", err: &statusError{code: 403}, retryable: false},
+		{scenario: "circuit open", err: errCircuitOpen, retryable: false},
+		{scenario: "too many requests", err: errTooManyRequests, retryable: false},
+		{scenario: "canceled", err: &url.Error{Op: "Get", URL: "http://consul", Err: context.Canceled}, retryable: false},
+		{scenario: "deadline exceeded", err: fmt.Errorf("fetching: %w", context.DeadlineExceeded), retryable: false},
+		{scenario: "syntax error", err: decode(`[{"Node": }]`), retryable: false},
+		{scenario: "type error", err: decode(`[{"Node": 42}]`), retryable: false},
+		{scenario: "not a list", err: decode(`{}`), retryable: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			if test.err == nil {
+				t.Fatal("Expected an error but found <nil>")
+			}
+			if retryable := p.retryable(test.err); retryable != test.retryable {
+				t.Errorf("Expected %v to be retryable=%t but found: %t", test.err, test.retryable, retryable)
+			}
+		})
+	}
+}
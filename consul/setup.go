@@ -1,7 +1,11 @@
 package consul
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
@@ -9,6 +13,7 @@ import (
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
 )
 
 
@@ -16,9 +21,60 @@ func init() { plugin.Register("consul", setupConsul) }
 
 // setupConsulPlugin configures the consul plugin, the format is:
 //
-//	consul [ADDR:PORT] {
+//	consul [ADDR:PORT...] {
+//		zones ZONE...
+//		fallthrough [ZONE...]
 //		ttl DURATION
 //		prefetch AMOUNT [DURATION [PERCENTAGE%]]
+//		watch
+//		backend http|streaming
+//		near NODE
+//		policy round_robin|sequential|sticky
+//		filter EXPRESSION
+//		health passing|warning|any
+//		gateway_mode none|local|remote [SERVICE]
+//		node_meta KEY=VALUE...
+//		agent_refresh DURATION
+//		datacenter_refresh DURATION
+//		retry ATTEMPTS [BACKOFF [MAX_BACKOFF]]
+//		retry_status CODE...
+//		breaker FAILURES [COOLDOWN]
+//		max_stale DURATION
+//		timeout DURATION
+//		user_agent VALUE
+//		header NAME VALUE
+//		warmup NAME...
+//		warmup_file PATH
+//		max_memory SIZE
+//		ttl_negative DURATION
+//		min_ttl DURATION
+//		max_ttl DURATION
+//		ttl_adaptive MIN MAX
+//		persist PATH [INTERVAL]
+//		cleanup INTERVAL
+//		refresh_all INTERVAL
+//		admin ADDR TOKEN
+//		debug ADDR
+//		health_addr ADDR
+//		metrics detailed|aggregate
+//		query_log RATE
+//		slow_log DURATION
+//		invalid_addr_log INTERVAL
+//		maxreq LIMIT
+//		max_concurrent_fetches LIMIT
+//		legacy_nxdomain
+//		no_client_cache
+//		packed_responses LIMIT
+//		rcode foreign|unsupported|malformed RCODE
+//		chaos [VERSION [IDENTITY]]
+//		dnssec KEY...
+//		acl [PREFIX...] {
+//			allow|deny CIDR...
+//		}
+//		view CIDR... {
+//			tag TAG
+//			dc DC
+//		}
 //	}
 //
 func setupConsul(c *caddy.Controller) error {
@@ -32,7 +88,69 @@ func setupConsul(c *caddy.Controller) error {
 		return consulPlugin
 	})
 
+	var cancel context.CancelFunc
+	var admin, debug, health *http.Server
+
 	c.OnStartup(func() error { return registerMetrics(c) })
+
+	c.OnStartup(func() error {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		go consulPlugin.warmup(ctx)
+		go consulPlugin.janitor(ctx)
+		if len(consulPlugin.Persist) != 0 {
+			go consulPlugin.persist(ctx)
+		}
+		if consulPlugin.RefreshAll != 0 {
+			go consulPlugin.refreshAll(ctx)
+		}
+		return nil
+	})
+
+	if len(consulPlugin.AdminAddr) != 0 {
+		c.OnStartup(func() (err error) {
+			admin, err = startServer(consulPlugin.AdminAddr, consulPlugin.adminHandler(consulPlugin.AdminToken))
+			return
+		})
+	}
+
+	if len(consulPlugin.DebugAddr) != 0 {
+		c.OnStartup(func() (err error) {
+			debug, err = startServer(consulPlugin.DebugAddr, consulPlugin.debugHandler())
+			return
+		})
+	}
+
+	if len(consulPlugin.HealthAddr) != 0 {
+		c.OnStartup(func() (err error) {
+			health, err = startServer(consulPlugin.HealthAddr, consulPlugin.healthHandler())
+			return
+		})
+	}
+
+	c.OnShutdown(func() error {
+		if cancel != nil {
+			cancel()
+		}
+		if admin != nil {
+			admin.Close()
+		}
+		if debug != nil {
+			debug.Close()
+		}
+		if health != nil {
+			health.Close()
+		}
+		var err error
+		if len(consulPlugin.Persist) != 0 {
+			err = consulPlugin.saveSnapshot()
+		}
+		// Shutdown hooks also run when the configuration is reloaded, closing
+		// the plugin releases its goroutines and connections to consul.
+		consulPlugin.Close()
+		return err
+	})
+
 	return nil
 }
 
@@ -43,19 +161,36 @@ func parseConsul(c *caddy.Controller) (*Consul, error) {
 
 	consulPlugin := New()
 
-	switch args := c.RemainingArgs(); len(args) {
-	case 0:
-	case 1:
-		consulPlugin.Addr = args[0]
-		if strings.Index(consulPlugin.Addr, "://") < 0 {
-			consulPlugin.Addr = "http://" + consulPlugin.Addr
+	for _, z := range c.ServerBlockKeys {
+		consulPlugin.Zones = append(consulPlugin.Zones, plugin.Host(z).Normalize())
+	}
+
+	for i, addr := range c.RemainingArgs() {
+		if strings.Index(addr, "://") < 0 {
+			addr = "http://" + addr
+		}
+		if i == 0 {
+			consulPlugin.Addr = addr
+		} else {
+			consulPlugin.FailoverAddrs = append(consulPlugin.FailoverAddrs, addr)
 		}
-	default:
-		return nil, c.ArgErr()
 	}
 
 	for c.NextBlock() {
 		switch c.Val() {
+		case "zones":
+			zones := c.RemainingArgs()
+			if len(zones) == 0 {
+				return nil, c.ArgErr()
+			}
+			for i, z := range zones {
+				zones[i] = plugin.Host(z).Normalize()
+			}
+			consulPlugin.Zones = zones
+
+		case "fallthrough":
+			consulPlugin.Fall.SetZonesFromArgs(c.RemainingArgs())
+
 		case "prefetch":
 			amount, percentage, duration, err := parsePrefetch(c)
 			if err != nil {
@@ -72,11 +207,309 @@ func parseConsul(c *caddy.Controller) (*Consul, error) {
 			}
 			consulPlugin.TTL = ttl
 
+		case "watch":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			consulPlugin.Watch = true
+
+		case "backend":
+			backend, err := parseBackend(c)
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.Backend = backend
+
+		case "near":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			consulPlugin.Near = args[0]
+
+		case "policy":
+			policy, err := parsePolicy(c)
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.Policy = policy
+
+		case "filter":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			filter := strings.Join(args, " ")
+			if _, err := untaggedFilter(filter); err != nil {
+				return nil, err
+			}
+			consulPlugin.Filter = filter
+
+		case "health":
+			health, err := parseHealth(c)
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.Health = health
+
+		case "gateway_mode":
+			if err := parseGatewayMode(c, consulPlugin); err != nil {
+				return nil, err
+			}
+
+		case "node_meta":
+			if err := parseNodeMeta(c, consulPlugin); err != nil {
+				return nil, err
+			}
+
+		case "agent_refresh":
+			refresh, err := parseDuration(c, "agent refresh interval")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.AgentRefresh = refresh
+
+		case "datacenter_refresh":
+			refresh, err := parseDuration(c, "datacenter refresh interval")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.DatacenterRefresh = refresh
+
+		case "retry":
+			if err := parseRetry(c, consulPlugin); err != nil {
+				return nil, err
+			}
+
+		case "retry_status":
+			codes, err := parseStatusCodes(c)
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.RetryStatusCodes = codes
+
+		case "breaker":
+			if err := parseBreaker(c, consulPlugin); err != nil {
+				return nil, err
+			}
+
+		case "max_stale":
+			maxStale, err := parseDuration(c, "max stale")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.MaxStale = maxStale
+
+		case "timeout":
+			timeout, err := parseDuration(c, "timeout")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.Timeout = timeout
+
+		case "user_agent":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			consulPlugin.UserAgent = args[0]
+
+		case "header":
+			if err := parseHeader(c, consulPlugin); err != nil {
+				return nil, err
+			}
+
+		case "warmup", "warm":
+			names, err := parseWarmup(c)
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.Warmup = append(consulPlugin.Warmup, names...)
+
+		case "warmup_file":
+			names, err := parseWarmupFile(c)
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.Warmup = append(consulPlugin.Warmup, names...)
+
+		case "max_memory":
+			size, err := parseSize(c)
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.MaxMemory = size
+
+		case "ttl_negative":
+			ttl, err := parseDuration(c, "negative TTL")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.TTLNegative = ttl
+
+		case "min_ttl":
+			ttl, err := parseRecordTTL(c, "min TTL")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.MinTTL = ttl
+
+		case "max_ttl":
+			ttl, err := parseRecordTTL(c, "max TTL")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.MaxTTL = ttl
+
+		case "ttl_adaptive":
+			min, max, err := parseTTLAdaptive(c)
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.TTLAdaptiveMin, consulPlugin.TTLAdaptiveMax = min, max
+
+		case "persist":
+			if err := parsePersist(c, consulPlugin); err != nil {
+				return nil, err
+			}
+
+		case "cleanup":
+			interval, err := parseDuration(c, "cleanup interval")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.CleanupInterval = interval
+
+		case "refresh_all":
+			interval, err := parseDuration(c, "refresh interval")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.RefreshAll = interval
+
+		case "admin":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			consulPlugin.AdminAddr, consulPlugin.AdminToken = args[0], args[1]
+
+		case "metrics":
+			metrics, err := parseMetrics(c)
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.Metrics = metrics
+
+		case "query_log":
+			rate, err := parseRate(c)
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.QueryLog = rate
+
+		case "slow_log":
+			threshold, err := parseDuration(c, "slow log threshold")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.SlowLog = threshold
+
+		case "invalid_addr_log":
+			interval, err := parseDuration(c, "invalid address log interval")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.InvalidAddrLog = interval
+
+		case "maxreq":
+			limit, err := parseLimit(c, "max requests")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.MaxRequests = limit
+
+		case "max_concurrent_fetches":
+			limit, err := parseLimit(c, "max concurrent fetches")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.MaxConcurrentFetches = limit
+
+		case "legacy_nxdomain":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			consulPlugin.LegacyNXDomain = true
+
+		case "no_client_cache":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			consulPlugin.NoClientCache = true
+
+		case "packed_responses":
+			limit, err := parseLimit(c, "packed responses")
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.PackedResponses = limit
+
+		case "rcode":
+			if err := parseRcode(c, consulPlugin); err != nil {
+				return nil, err
+			}
+
+		case "chaos":
+			if err := parseChaos(c, consulPlugin); err != nil {
+				return nil, err
+			}
+
+		case "acl":
+			acl, err := parseACL(c)
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.ACLs = append(consulPlugin.ACLs, acl)
+
+		case "view":
+			view, err := parseView(c)
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.Views = append(consulPlugin.Views, view)
+
+		case "dnssec":
+			if err := parseDNSSEC(c, consulPlugin); err != nil {
+				return nil, err
+			}
+
+		case "debug":
+			addr, err := parseDebug(c)
+			if err != nil {
+				return nil, err
+			}
+			consulPlugin.DebugAddr = addr
+
+		case "health_addr":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			if _, _, err := net.SplitHostPort(args[0]); err != nil {
+				return nil, err
+			}
+			consulPlugin.HealthAddr = args[0]
+
 		default:
 			return nil, c.ArgErr()
 		}
 	}
 
+	if consulPlugin.MinTTL > 0 && consulPlugin.MaxTTL > 0 && consulPlugin.MinTTL > consulPlugin.MaxTTL {
+		return nil, fmt.Errorf("min TTL must not be greater than max TTL: %s > %s", consulPlugin.MinTTL, consulPlugin.MaxTTL)
+	}
+
 	return consulPlugin, nil
 }
 
@@ -146,3 +579,640 @@ func parseTTL(c *caddy.Controller) (ttl time.Duration, err error) {
 
 	return
 }
+
+func parseBackend(c *caddy.Controller) (backend string, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	switch backend = args[0]; backend {
+	case backendHTTP, backendStreaming:
+	default:
+		err = fmt.Errorf("backend must be one of %q or %q: %q", backendHTTP, backendStreaming, backend)
+	}
+
+	return
+}
+
+func parsePolicy(c *caddy.Controller) (policy string, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	switch policy = args[0]; policy {
+	case policyRoundRobin, policySequential, policySticky:
+	default:
+		err = fmt.Errorf("policy must be one of %q, %q or %q: %q", policyRoundRobin, policySequential, policySticky, policy)
+	}
+
+	return
+}
+
+func parseMetrics(c *caddy.Controller) (metrics string, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	switch metrics = args[0]; metrics {
+	case metricsDetailed, metricsAggregate:
+	default:
+		err = fmt.Errorf("metrics must be one of %q or %q: %q", metricsDetailed, metricsAggregate, metrics)
+	}
+
+	return
+}
+
+func parseHealth(c *caddy.Controller) (health string, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	switch health = args[0]; health {
+	case healthPassing, healthWarning, healthAny:
+	default:
+		err = fmt.Errorf("health must be one of %q, %q or %q: %q", healthPassing, healthWarning, healthAny, health)
+	}
+
+	return
+}
+
+func parseGatewayMode(c *caddy.Controller, consulPlugin *Consul) (err error) {
+	args := c.RemainingArgs()
+
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+
+	switch mode := args[0]; mode {
+	case gatewayNone, gatewayLocal, gatewayRemote:
+		consulPlugin.GatewayMode = mode
+	default:
+		return fmt.Errorf("gateway mode must be one of %q, %q or %q: %q", gatewayNone, gatewayLocal, gatewayRemote, mode)
+	}
+
+	if len(args) > 1 {
+		consulPlugin.Gateway = args[1]
+	}
+
+	return
+}
+
+func parseRcode(c *caddy.Controller, consulPlugin *Consul) error {
+	args := c.RemainingArgs()
+
+	if len(args) != 2 {
+		return c.ArgErr()
+	}
+
+	var rcode *int
+	switch scope := args[0]; scope {
+	case "foreign":
+		rcode = &consulPlugin.RcodeForeign
+	case "unsupported":
+		rcode = &consulPlugin.RcodeUnsupported
+	case "malformed":
+		rcode = &consulPlugin.RcodeMalformed
+	default:
+		return fmt.Errorf("rcode scope must be one of %q, %q or %q: %q", "foreign", "unsupported", "malformed", scope)
+	}
+
+	switch value := strings.ToUpper(args[1]); value {
+	case "NOERROR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED":
+		*rcode = dns.StringToRcode[value]
+	default:
+		return fmt.Errorf("rcode must be one of NOERROR, SERVFAIL, NXDOMAIN, NOTIMP or REFUSED: %q", args[1])
+	}
+
+	return nil
+}
+
+func parseChaos(c *caddy.Controller, consulPlugin *Consul) error {
+	args := c.RemainingArgs()
+
+	if len(args) > 2 {
+		return c.ArgErr()
+	}
+
+	consulPlugin.Chaos = true
+
+	if len(args) > 0 {
+		consulPlugin.ChaosVersion = args[0]
+	}
+
+	if len(args) > 1 {
+		consulPlugin.ChaosIdentity = args[1]
+	}
+
+	return nil
+}
+
+func parseNodeMeta(c *caddy.Controller, consulPlugin *Consul) error {
+	args := c.RemainingArgs()
+
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+
+	for _, arg := range args {
+		i := strings.IndexByte(arg, '=')
+		if i <= 0 {
+			return fmt.Errorf("node metadata must be in the KEY=VALUE format: %q", arg)
+		}
+		if consulPlugin.NodeMeta == nil {
+			consulPlugin.NodeMeta = make(map[string]string)
+		}
+		consulPlugin.NodeMeta[arg[:i]] = arg[i+1:]
+	}
+
+	return nil
+}
+
+func parseHeader(c *caddy.Controller, consulPlugin *Consul) error {
+	args := c.RemainingArgs()
+
+	if len(args) != 2 {
+		return c.ArgErr()
+	}
+
+	name, value := args[0], args[1]
+	if len(name) == 0 || strings.ContainsAny(name, ": \t\r\n") {
+		return fmt.Errorf("header name must be a valid HTTP header name: %q", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("header value must not contain line breaks: %q", value)
+	}
+
+	if consulPlugin.Headers == nil {
+		consulPlugin.Headers = make(http.Header)
+	}
+	consulPlugin.Headers.Add(name, value)
+	return nil
+}
+
+func parseRate(c *caddy.Controller) (rate float64, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	if rate, err = strconv.ParseFloat(args[0], 64); err != nil {
+		return
+	}
+
+	if rate <= 0 || rate > 1 {
+		err = fmt.Errorf("query log rate must fall in range (0, 1]: %g", rate)
+	}
+
+	return
+}
+
+func parseLimit(c *caddy.Controller, what string) (limit int, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	if limit, err = strconv.Atoi(args[0]); err != nil {
+		return
+	}
+
+	if limit <= 0 {
+		err = fmt.Errorf("%s must be positive: %d", what, limit)
+	}
+
+	return
+}
+
+func parseDuration(c *caddy.Controller, what string) (d time.Duration, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	if d, err = time.ParseDuration(args[0]); err != nil {
+		return
+	}
+
+	if d <= 0 {
+		err = fmt.Errorf("%s must be positive: %s", what, d)
+	}
+
+	return
+}
+
+func parseRecordTTL(c *caddy.Controller, what string) (ttl time.Duration, err error) {
+	if ttl, err = parseDuration(c, what); err != nil {
+		return
+	}
+
+	if ttl%time.Second != 0 {
+		err = fmt.Errorf("%s must be a whole number of seconds: %s", what, ttl)
+	}
+
+	return
+}
+
+func parseTTLAdaptive(c *caddy.Controller) (min time.Duration, max time.Duration, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 2 {
+		err = c.ArgErr()
+		return
+	}
+
+	if min, err = time.ParseDuration(args[0]); err != nil {
+		return
+	}
+
+	if max, err = time.ParseDuration(args[1]); err != nil {
+		return
+	}
+
+	if min <= 0 {
+		err = fmt.Errorf("adaptive TTL bounds must be positive: %s", min)
+		return
+	}
+
+	if min > max {
+		err = fmt.Errorf("adaptive TTL min must not be greater than max: %s > %s", min, max)
+	}
+
+	return
+}
+
+func parsePersist(c *caddy.Controller, consulPlugin *Consul) (err error) {
+	args := c.RemainingArgs()
+
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+
+	consulPlugin.Persist = args[0]
+
+	if len(args) > 1 {
+		if consulPlugin.PersistInterval, err = time.ParseDuration(args[1]); err != nil {
+			return
+		}
+		if consulPlugin.PersistInterval <= 0 {
+			return fmt.Errorf("persist interval must be positive: %s", consulPlugin.PersistInterval)
+		}
+	}
+
+	return
+}
+
+// parseDNSSEC configures the DNSSEC keys of the plugin, which are read once to
+// report invalid keys when the configuration is loaded.
+func parseDNSSEC(c *caddy.Controller, consulPlugin *Consul) (err error) {
+	args := c.RemainingArgs()
+
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+
+	consulPlugin.DNSSEC = append(consulPlugin.DNSSEC, args...)
+	_, err = consulPlugin.newSigner()
+	return
+}
+
+// parseACL parses an acl block, which holds one allow or deny rule per line.
+func parseACL(c *caddy.Controller) (acl ACL, err error) {
+	acl.Prefixes = c.RemainingArgs()
+
+	if !c.Next() || c.Val() != "{" {
+		err = c.SyntaxErr("{")
+		return
+	}
+
+	for c.Next() {
+		var rule ACLRule
+
+		switch c.Val() {
+		case "}":
+			if len(acl.Rules) == 0 {
+				err = c.Err("acl must have at least one rule")
+			}
+			return
+		case "allow":
+			rule.Allow = true
+		case "deny":
+		default:
+			err = c.SyntaxErr("allow|deny")
+			return
+		}
+
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			err = c.ArgErr()
+			return
+		}
+
+		for _, arg := range args {
+			if rule.Net, err = parseCIDR(arg); err != nil {
+				return
+			}
+			acl.Rules = append(acl.Rules, rule)
+		}
+	}
+
+	err = c.EOFErr()
+	return
+}
+
+// parseView parses a view block, which holds the tag and datacenter that the
+// view applies to the queries of its clients.
+func parseView(c *caddy.Controller) (view View, err error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		err = c.ArgErr()
+		return
+	}
+
+	for _, arg := range args {
+		var n *net.IPNet
+		if n, err = parseCIDR(arg); err != nil {
+			return
+		}
+		view.Nets = append(view.Nets, n)
+	}
+
+	if !c.Next() || c.Val() != "{" {
+		err = c.SyntaxErr("{")
+		return
+	}
+
+	for c.Next() {
+		var value *string
+
+		switch c.Val() {
+		case "}":
+			if len(view.Tag) == 0 && len(view.DC) == 0 {
+				err = c.Err("view must have a tag or a dc")
+			}
+			return
+		case "tag":
+			value = &view.Tag
+		case "dc":
+			value = &view.DC
+		default:
+			err = c.SyntaxErr("tag|dc")
+			return
+		}
+
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			err = c.ArgErr()
+			return
+		}
+		*value = args[0]
+	}
+
+	err = c.EOFErr()
+	return
+}
+
+// parseCIDR parses a subnet in the CIDR notation, or a single IP address.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if strings.IndexByte(s, '/') < 0 {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+func parseDebug(c *caddy.Controller) (addr string, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	var host string
+	if host, _, err = net.SplitHostPort(args[0]); err != nil {
+		return
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		err = fmt.Errorf("debug address must be a loopback address: %q", args[0])
+		return
+	}
+
+	addr = args[0]
+	return
+}
+
+func parseRetry(c *caddy.Controller, consulPlugin *Consul) (err error) {
+	args := c.RemainingArgs()
+
+	if len(args) == 0 || len(args) > 3 {
+		return c.ArgErr()
+	}
+
+	if consulPlugin.RetryAttempts, err = strconv.Atoi(args[0]); err != nil {
+		return
+	}
+	if consulPlugin.RetryAttempts <= 0 {
+		return fmt.Errorf("retry attempts must be positive: %d", consulPlugin.RetryAttempts)
+	}
+
+	if len(args) > 1 {
+		if consulPlugin.RetryBackoff, err = time.ParseDuration(args[1]); err != nil {
+			return
+		}
+		if consulPlugin.RetryBackoff <= 0 {
+			return fmt.Errorf("retry backoff must be positive: %s", consulPlugin.RetryBackoff)
+		}
+		if consulPlugin.RetryMaxBackoff < consulPlugin.RetryBackoff {
+			consulPlugin.RetryMaxBackoff = consulPlugin.RetryBackoff
+		}
+	}
+
+	if len(args) > 2 {
+		if consulPlugin.RetryMaxBackoff, err = time.ParseDuration(args[2]); err != nil {
+			return
+		}
+		if consulPlugin.RetryMaxBackoff < consulPlugin.RetryBackoff {
+			return fmt.Errorf("retry max backoff must be greater than the backoff: %s < %s", consulPlugin.RetryMaxBackoff, consulPlugin.RetryBackoff)
+		}
+	}
+
+	return
+}
+
+func parseStatusCodes(c *caddy.Controller) (codes []int, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) == 0 {
+		err = c.ArgErr()
+		return
+	}
+
+	for _, arg := range args {
+		var code int
+		if code, err = strconv.Atoi(arg); err != nil {
+			return
+		}
+		if code < 100 || code > 599 {
+			err = fmt.Errorf("invalid HTTP status code: %d", code)
+			return
+		}
+		codes = append(codes, code)
+	}
+
+	return
+}
+
+func parseBreaker(c *caddy.Controller, consulPlugin *Consul) (err error) {
+	args := c.RemainingArgs()
+
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+
+	if consulPlugin.BreakerThreshold, err = strconv.Atoi(args[0]); err != nil {
+		return
+	}
+	if consulPlugin.BreakerThreshold < 0 {
+		return fmt.Errorf("breaker failures must not be negative: %d", consulPlugin.BreakerThreshold)
+	}
+
+	if len(args) > 1 {
+		if consulPlugin.BreakerCooldown, err = time.ParseDuration(args[1]); err != nil {
+			return
+		}
+		if consulPlugin.BreakerCooldown <= 0 {
+			return fmt.Errorf("breaker cool-down must be positive: %s", consulPlugin.BreakerCooldown)
+		}
+	}
+
+	return
+}
+
+func parseWarmup(c *caddy.Controller) (names []string, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) == 0 {
+		err = c.ArgErr()
+		return
+	}
+
+	return parseWarmupNames(args)
+}
+
+func parseWarmupFile(c *caddy.Controller) (names []string, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	var b []byte
+	if b, err = ioutil.ReadFile(args[0]); err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		var lineNames []string
+		if lineNames, err = parseWarmupNames(strings.Fields(line)); err != nil {
+			return
+		}
+		names = append(names, lineNames...)
+	}
+
+	return
+}
+
+// parseWarmupNames converts a list of services to the DNS names that are
+// looked up to warm up the cache. Services are either DNS names in the
+// consul domain, or in the short NAME[@TAG][.DC] form.
+func parseWarmupNames(args []string) (names []string, err error) {
+	for _, arg := range args {
+		name := arg
+
+		if !strings.HasSuffix(strings.TrimSuffix(name, "."), ".consul") {
+			service, dc := split(name)
+			if strings.IndexByte(dc, '.') >= 0 {
+				err = fmt.Errorf("warmup name must be a consul service name: %q", arg)
+				return
+			}
+			if i := strings.IndexByte(service, '@'); i >= 0 {
+				service = service[i+1:] + "." + service[:i]
+			}
+			if name = service + ".service."; len(dc) != 0 {
+				name += dc + "."
+			}
+			name += "consul"
+		}
+
+		if _, rcode := parseKey(dns.Fqdn(name), dns.TypeA, consulAgent{}); rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("warmup name must be a consul service name: %q", arg)
+			return
+		}
+
+		names = append(names, name)
+	}
+
+	return
+}
+
+func parseSize(c *caddy.Controller) (size int64, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	s, unit := args[0], int64(1)
+
+	for suffix, n := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(strings.ToUpper(s), suffix) {
+			s, unit = s[:len(s)-len(suffix)], n
+			break
+		}
+	}
+
+	if size, err = strconv.ParseInt(s, 10, 64); err != nil {
+		return
+	}
+
+	if size <= 0 {
+		err = fmt.Errorf("memory size must be positive: %d", size)
+		return
+	}
+
+	size *= unit
+	return
+}
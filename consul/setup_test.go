@@ -1,20 +1,80 @@
 package consul
 
 import (
+	"net"
+	"net/http"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
 )
 
 func TestSetupSuccess(t *testing.T) {
 	tests := []struct {
 		input              string
+		keys               []string
+		zones              []string
+		fall               []string
 		addr               string
+		failoverAddrs      []string
 		ttl                time.Duration
 		prefetchAmount     int
 		prefetchPercentage int
 		prefetchDuration   time.Duration
+		watch              bool
+		backend            string
+		near               string
+		policy             string
+		filter             string
+		health             string
+		nodeMeta           map[string]string
+		agentRefresh       time.Duration
+		dcRefresh          time.Duration
+		retryAttempts      int
+		retryBackoff       time.Duration
+		retryMaxBackoff    time.Duration
+		retryStatusCodes   []int
+		breakerThreshold   int
+		breakerCooldown    time.Duration
+		maxStale           time.Duration
+		timeout            time.Duration
+		userAgent          string
+		headers            http.Header
+		warmup             []string
+		maxMemory          int64
+		ttlNegative        time.Duration
+		minTTL             time.Duration
+		maxTTL             time.Duration
+		ttlAdaptiveMin     time.Duration
+		ttlAdaptiveMax     time.Duration
+		persist            string
+		persistInterval    time.Duration
+		cleanupInterval    time.Duration
+		refreshAll         time.Duration
+		adminAddr          string
+		adminToken         string
+		debugAddr          string
+		healthAddr         string
+		metrics            string
+		maxRequests        int
+		maxFetches         int
+		queryLog           float64
+		slowLog            time.Duration
+		invalidAddrLog     time.Duration
+		dnssec             []string
+		acls               []ACL
+		views              []View
+		legacyNXDomain     bool
+		noClientCache      bool
+		packedResponses    int
+		chaos              bool
+		chaosVersion       string
+		chaosIdentity      string
+		rcodes             []int // foreign, unsupported and malformed
+		gatewayMode        string
+		gateway            string
 	}{
 		// valid inputs
 		{
@@ -90,6 +150,680 @@ func TestSetupSuccess(t *testing.T) {
 			prefetchPercentage: 50,
 			prefetchDuration:   30 * time.Second,
 		},
+
+		{
+			input:              `consul 1.2.3.4:1234 http://1.2.3.5:1234 1.2.3.6:1234`,
+			addr:               "http://1.2.3.4:1234",
+			failoverAddrs:      []string{"http://1.2.3.5:1234", "http://1.2.3.6:1234"},
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+		},
+
+		{
+			input: `consul {
+				watch
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			watch:              true,
+		},
+
+		{
+			input: `consul {
+				backend streaming
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			backend:            backendStreaming,
+		},
+
+		{
+			input: `consul {
+				near _agent
+				policy sequential
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			near:               "_agent",
+			policy:             policySequential,
+		},
+
+		{
+			input: `consul {
+				policy sticky
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			policy:             policySticky,
+		},
+
+		{
+			input: `consul {
+				filter Service.Meta.zone == {tag}
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			filter:             "Service.Meta.zone == {tag}",
+		},
+
+		{
+			input: `consul {
+				health warning
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			health:             healthWarning,
+		},
+
+		{
+			input: `consul {
+				node_meta storage=ssd
+				node_meta rack=a1 zone=
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			nodeMeta:           map[string]string{"storage": "ssd", "rack": "a1", "zone": ""},
+		},
+
+		{
+			input: `consul {
+				agent_refresh 10s
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			agentRefresh:       10 * time.Second,
+		},
+
+		{
+			input: `consul {
+				datacenter_refresh 5m
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			dcRefresh:          5 * time.Minute,
+		},
+
+		{
+			input: `consul {
+				retry 3
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			retryAttempts:      3,
+		},
+
+		{
+			input: `consul {
+				retry 5 2s
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			retryAttempts:      5,
+			retryBackoff:       2 * time.Second,
+			retryMaxBackoff:    2 * time.Second,
+		},
+
+		{
+			input: `consul {
+				retry 5 10ms 500ms
+				retry_status 429 503
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			retryAttempts:      5,
+			retryBackoff:       10 * time.Millisecond,
+			retryMaxBackoff:    500 * time.Millisecond,
+			retryStatusCodes:   []int{429, 503},
+		},
+
+		{
+			input: `consul {
+				breaker 10 1m
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			breakerThreshold:   10,
+			breakerCooldown:    1 * time.Minute,
+		},
+
+		{
+			input: `consul {
+				breaker 0
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			breakerThreshold:   -1,
+		},
+
+		{
+			input: `consul {
+				max_stale 1h
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			maxStale:           1 * time.Hour,
+		},
+
+		{
+			input: `consul {
+				timeout 2s
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			timeout:            2 * time.Second,
+		},
+
+		{
+			input: `consul {
+				user_agent resolver/1.0
+				header Authorization "Bearer secret"
+				header X-Forwarded-For 10.0.0.1
+				header x-forwarded-for 10.0.0.2
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			userAgent:          "resolver/1.0",
+			headers: http.Header{
+				"Authorization":   {"Bearer secret"},
+				"X-Forwarded-For": {"10.0.0.1", "10.0.0.2"},
+			},
+		},
+
+		{
+			input: `consul {
+				warmup web.service.consul
+				warmup primary.db.service.dc1.consul
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			warmup:             []string{"web.service.consul", "primary.db.service.dc1.consul"},
+		},
+
+		{
+			input: `consul {
+				warm web db@primary.dc1 api.dc2
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			warmup:             []string{"web.service.consul", "primary.db.service.dc1.consul", "api.service.dc2.consul"},
+		},
+
+		{
+			input: `consul {
+				warmup_file testdata/warmup
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			warmup:             []string{"web.service.consul", "primary.db.service.dc1.consul"},
+		},
+
+		{
+			input: `consul {
+				max_memory 64MB
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			maxMemory:          64 << 20,
+		},
+
+		{
+			input: `consul {
+				max_memory 100000
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			maxMemory:          100000,
+		},
+
+		{
+			input: `consul {
+				ttl 10m
+				ttl_negative 5s
+			}`,
+			addr:               defaultAddr,
+			ttl:                10 * time.Minute,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			ttlNegative:        5 * time.Second,
+		},
+
+		{
+			input: `consul {
+				min_ttl 5s
+				max_ttl 1m
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			minTTL:             5 * time.Second,
+			maxTTL:             1 * time.Minute,
+		},
+
+		{
+			input: `consul {
+				ttl_adaptive 10s 10m
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			ttlAdaptiveMin:     10 * time.Second,
+			ttlAdaptiveMax:     10 * time.Minute,
+		},
+
+		{
+			input: `consul {
+				persist /var/lib/coredns/consul.json
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			persist:            "/var/lib/coredns/consul.json",
+		},
+
+		{
+			input: `consul {
+				persist /var/lib/coredns/consul.json 10s
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			persist:            "/var/lib/coredns/consul.json",
+			persistInterval:    10 * time.Second,
+		},
+
+		{
+			input: `consul {
+				cleanup 10s
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			cleanupInterval:    10 * time.Second,
+		},
+
+		{
+			input: `consul {
+				refresh_all 30s
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			refreshAll:         30 * time.Second,
+		},
+
+		{
+			input: `consul {
+				admin localhost:8600 secret
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			adminAddr:          "localhost:8600",
+			adminToken:         "secret",
+		},
+
+		{
+			input: `consul {
+				debug 127.0.0.1:8601
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			debugAddr:          "127.0.0.1:8601",
+		},
+
+		{
+			input: `consul {
+				health_addr :8602
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			healthAddr:         ":8602",
+		},
+
+		{
+			input: `consul {
+				metrics aggregate
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			metrics:            metricsAggregate,
+		},
+
+		{
+			input: `consul {
+				maxreq 100
+				max_concurrent_fetches 10
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			maxRequests:        100,
+			maxFetches:         10,
+		},
+
+		{
+			input: `consul {
+				query_log 0.01
+				slow_log 100ms
+				invalid_addr_log 1m
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			queryLog:           0.01,
+			slowLog:            100 * time.Millisecond,
+			invalidAddrLog:     1 * time.Minute,
+		},
+
+		{
+			input: `consul {
+				dnssec testdata/Kconsul.+013+10202 testdata/Kconsul.+013+35954.key
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			dnssec:             []string{"testdata/Kconsul.+013+10202", "testdata/Kconsul.+013+35954.key"},
+		},
+
+		{
+			input: `consul {
+				gateway_mode local
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			gatewayMode:        gatewayLocal,
+		},
+
+		{
+			input: `consul {
+				gateway_mode remote mgw
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			gatewayMode:        gatewayRemote,
+			gateway:            "mgw",
+		},
+
+		{
+			input: `consul {
+				legacy_nxdomain
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			legacyNXDomain:     true,
+		},
+
+		{
+			input: `consul {
+				rcode foreign NXDOMAIN
+				rcode unsupported noerror
+				rcode malformed SERVFAIL
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			rcodes:             []int{dns.RcodeNameError, dns.RcodeSuccess, dns.RcodeServerFailure},
+		},
+
+		{
+			input: `consul {
+				no_client_cache
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			noClientCache:      true,
+		},
+
+		{
+			input: `consul {
+				packed_responses 1000
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			packedResponses:    1000,
+		},
+
+		{
+			input: `consul {
+				chaos
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			chaos:              true,
+		},
+
+		{
+			input: `consul {
+				chaos resolver-v1.2.3 resolver-1
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			chaos:              true,
+			chaosVersion:       "resolver-v1.2.3",
+			chaosIdentity:      "resolver-1",
+		},
+
+		{
+			input: `consul {
+				acl {
+					deny 10.0.1.0/24
+					allow 10.0.0.0/16 fd00::/8
+				}
+				acl internal- admin {
+					allow 10.0.2.1
+				}
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			acls: []ACL{
+				{
+					Rules: []ACLRule{
+						{Allow: false, Net: cidr("10.0.1.0/24")},
+						{Allow: true, Net: cidr("10.0.0.0/16")},
+						{Allow: true, Net: cidr("fd00::/8")},
+					},
+				},
+				{
+					Prefixes: []string{"internal-", "admin"},
+					Rules: []ACLRule{
+						{Allow: true, Net: cidr("10.0.2.1/32")},
+					},
+				},
+			},
+		},
+
+		{
+			input: `consul {
+				view 10.0.0.0/16 10.1.0.0/16 {
+					tag internal
+				}
+				view 172.16.0.0/12 {
+					tag edge
+					dc dc2
+				}
+			}`,
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+			views: []View{
+				{Nets: []*net.IPNet{cidr("10.0.0.0/16"), cidr("10.1.0.0/16")}, Tag: "internal"},
+				{Nets: []*net.IPNet{cidr("172.16.0.0/12")}, Tag: "edge", DC: "dc2"},
+			},
+		},
+
+		{
+			input:              `consul`,
+			keys:               []string{"consul.:53", "dns://example.com:53"},
+			zones:              []string{"consul.", "example.com."},
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+		},
+
+		{
+			input: `consul {
+				zones service.consul DC1.Consul.
+			}`,
+			keys:               []string{".:53"},
+			zones:              []string{"service.consul.", "dc1.consul."},
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+		},
+
+		{
+			input: `consul {
+				fallthrough
+			}`,
+			fall:               []string{"."},
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+		},
+
+		{
+			input: `consul {
+				fallthrough example.com consul
+			}`,
+			fall:               []string{"example.com.", "consul."},
+			addr:               defaultAddr,
+			ttl:                defaultTTL,
+			prefetchAmount:     defaultPrefetchAmount,
+			prefetchPercentage: defaultPrefetchPercentage,
+			prefetchDuration:   defaultPrefetchDuration,
+		},
 	}
 
 	for _, test := range tests {
@@ -97,6 +831,7 @@ func TestSetupSuccess(t *testing.T) {
 			t.Log(test.input)
 
 			c := caddy.NewTestController("dns", test.input)
+			c.ServerBlockKeys = test.keys
 			consulPlugin, err := parseConsul(c)
 
 			if err != nil {
@@ -104,10 +839,22 @@ func TestSetupSuccess(t *testing.T) {
 				return
 			}
 
+			if !reflect.DeepEqual(consulPlugin.Fall.Zones, test.fall) {
+				t.Errorf("Expected fallthrough zones to be %v but found: %v", test.fall, consulPlugin.Fall.Zones)
+			}
+
+			if !reflect.DeepEqual(consulPlugin.Zones, test.zones) {
+				t.Errorf("Expected zones to be %v but found: %v", test.zones, consulPlugin.Zones)
+			}
+
 			if consulPlugin.Addr != test.addr {
 				t.Errorf("Expected consul address to be %v but found: %v", test.addr, consulPlugin.Addr)
 			}
 
+			if !reflect.DeepEqual(consulPlugin.FailoverAddrs, test.failoverAddrs) {
+				t.Errorf("Expected consul failover addresses to be %v but found: %v", test.failoverAddrs, consulPlugin.FailoverAddrs)
+			}
+
 			if consulPlugin.TTL != test.ttl {
 				t.Errorf("Expected TTL to be %v but found: %v", test.ttl, consulPlugin.TTL)
 			}
@@ -123,6 +870,286 @@ func TestSetupSuccess(t *testing.T) {
 			if consulPlugin.PrefetchDuration != test.prefetchDuration {
 				t.Errorf("Expectedprefetch duration to be %v but found: %v", test.prefetchDuration, consulPlugin.PrefetchDuration)
 			}
+
+			if consulPlugin.Watch != test.watch {
+				t.Errorf("Expected watch to be %t but found: %t", test.watch, consulPlugin.Watch)
+			}
+
+			if backend := test.backend; backend == "" {
+				if consulPlugin.Backend != defaultBackend {
+					t.Errorf("Expected backend to be %v but found: %v", defaultBackend, consulPlugin.Backend)
+				}
+			} else if consulPlugin.Backend != backend {
+				t.Errorf("Expected backend to be %v but found: %v", backend, consulPlugin.Backend)
+			}
+
+			if consulPlugin.Near != test.near {
+				t.Errorf("Expected near to be %q but found: %q", test.near, consulPlugin.Near)
+			}
+
+			if policy := test.policy; policy == "" {
+				if consulPlugin.Policy != defaultPolicy {
+					t.Errorf("Expected policy to be %v but found: %v", defaultPolicy, consulPlugin.Policy)
+				}
+			} else if consulPlugin.Policy != policy {
+				t.Errorf("Expected policy to be %v but found: %v", policy, consulPlugin.Policy)
+			}
+
+			if consulPlugin.Filter != test.filter {
+				t.Errorf("Expected filter to be %q but found: %q", test.filter, consulPlugin.Filter)
+			}
+
+			if health := test.health; health == "" {
+				if consulPlugin.Health != defaultHealth {
+					t.Errorf("Expected health to be %v but found: %v", defaultHealth, consulPlugin.Health)
+				}
+			} else if consulPlugin.Health != health {
+				t.Errorf("Expected health to be %v but found: %v", health, consulPlugin.Health)
+			}
+
+			if !reflect.DeepEqual(consulPlugin.NodeMeta, test.nodeMeta) {
+				t.Errorf("Expected node metadata to be %v but found: %v", test.nodeMeta, consulPlugin.NodeMeta)
+			}
+
+			if agentRefresh := test.agentRefresh; agentRefresh == 0 {
+				if consulPlugin.AgentRefresh != defaultAgentRefresh {
+					t.Errorf("Expected agent refresh to be %v but found: %v", defaultAgentRefresh, consulPlugin.AgentRefresh)
+				}
+			} else if consulPlugin.AgentRefresh != agentRefresh {
+				t.Errorf("Expected agent refresh to be %v but found: %v", agentRefresh, consulPlugin.AgentRefresh)
+			}
+
+			if consulPlugin.DatacenterRefresh != test.dcRefresh {
+				t.Errorf("Expected datacenter refresh to be %v but found: %v", test.dcRefresh, consulPlugin.DatacenterRefresh)
+			}
+
+			if retryAttempts := test.retryAttempts; retryAttempts == 0 {
+				if consulPlugin.RetryAttempts != defaultRetryAttempts {
+					t.Errorf("Expected retry attempts to be %v but found: %v", defaultRetryAttempts, consulPlugin.RetryAttempts)
+				}
+			} else if consulPlugin.RetryAttempts != retryAttempts {
+				t.Errorf("Expected retry attempts to be %v but found: %v", retryAttempts, consulPlugin.RetryAttempts)
+			}
+
+			if retryBackoff := test.retryBackoff; retryBackoff == 0 {
+				if consulPlugin.RetryBackoff != defaultRetryBackoff {
+					t.Errorf("Expected retry backoff to be %v but found: %v", defaultRetryBackoff, consulPlugin.RetryBackoff)
+				}
+			} else if consulPlugin.RetryBackoff != retryBackoff {
+				t.Errorf("Expected retry backoff to be %v but found: %v", retryBackoff, consulPlugin.RetryBackoff)
+			}
+
+			if retryMaxBackoff := test.retryMaxBackoff; retryMaxBackoff == 0 {
+				if consulPlugin.RetryMaxBackoff != defaultRetryMaxBackoff {
+					t.Errorf("Expected retry max backoff to be %v but found: %v", defaultRetryMaxBackoff, consulPlugin.RetryMaxBackoff)
+				}
+			} else if consulPlugin.RetryMaxBackoff != retryMaxBackoff {
+				t.Errorf("Expected retry max backoff to be %v but found: %v", retryMaxBackoff, consulPlugin.RetryMaxBackoff)
+			}
+
+			if retryStatusCodes := test.retryStatusCodes; retryStatusCodes == nil {
+				if !reflect.DeepEqual(consulPlugin.RetryStatusCodes, defaultRetryStatusCodes) {
+					t.Errorf("Expected retry status codes to be %v but found: %v", defaultRetryStatusCodes, consulPlugin.RetryStatusCodes)
+				}
+			} else if !reflect.DeepEqual(consulPlugin.RetryStatusCodes, retryStatusCodes) {
+				t.Errorf("Expected retry status codes to be %v but found: %v", retryStatusCodes, consulPlugin.RetryStatusCodes)
+			}
+
+			switch breakerThreshold := test.breakerThreshold; breakerThreshold {
+			case 0:
+				if consulPlugin.BreakerThreshold != defaultBreakerThreshold {
+					t.Errorf("Expected breaker threshold to be %v but found: %v", defaultBreakerThreshold, consulPlugin.BreakerThreshold)
+				}
+			case -1: // disabled
+				if consulPlugin.BreakerThreshold != 0 {
+					t.Errorf("Expected breaker to be disabled but found a threshold of %v", consulPlugin.BreakerThreshold)
+				}
+			default:
+				if consulPlugin.BreakerThreshold != breakerThreshold {
+					t.Errorf("Expected breaker threshold to be %v but found: %v", breakerThreshold, consulPlugin.BreakerThreshold)
+				}
+			}
+
+			if breakerCooldown := test.breakerCooldown; breakerCooldown == 0 {
+				if consulPlugin.BreakerCooldown != defaultBreakerCooldown {
+					t.Errorf("Expected breaker cool-down to be %v but found: %v", defaultBreakerCooldown, consulPlugin.BreakerCooldown)
+				}
+			} else if consulPlugin.BreakerCooldown != breakerCooldown {
+				t.Errorf("Expected breaker cool-down to be %v but found: %v", breakerCooldown, consulPlugin.BreakerCooldown)
+			}
+
+			if consulPlugin.MaxStale != test.maxStale {
+				t.Errorf("Expected max stale to be %v but found: %v", test.maxStale, consulPlugin.MaxStale)
+			}
+
+			if timeout := test.timeout; timeout == 0 {
+				if consulPlugin.Timeout != defaultTimeout {
+					t.Errorf("Expected timeout to be %v but found: %v", defaultTimeout, consulPlugin.Timeout)
+				}
+			} else if consulPlugin.Timeout != timeout {
+				t.Errorf("Expected timeout to be %v but found: %v", timeout, consulPlugin.Timeout)
+			}
+
+			if consulPlugin.UserAgent != test.userAgent {
+				t.Errorf("Expected user agent to be %q but found: %q", test.userAgent, consulPlugin.UserAgent)
+			}
+
+			if !reflect.DeepEqual(consulPlugin.Headers, test.headers) {
+				t.Errorf("Expected headers to be %v but found: %v", test.headers, consulPlugin.Headers)
+			}
+
+			if !reflect.DeepEqual(consulPlugin.Warmup, test.warmup) {
+				t.Errorf("Expected warmup names to be %v but found: %v", test.warmup, consulPlugin.Warmup)
+			}
+
+			if consulPlugin.MaxMemory != test.maxMemory {
+				t.Errorf("Expected max memory to be %v but found: %v", test.maxMemory, consulPlugin.MaxMemory)
+			}
+
+			if consulPlugin.TTLNegative != test.ttlNegative {
+				t.Errorf("Expected negative TTL to be %v but found: %v", test.ttlNegative, consulPlugin.TTLNegative)
+			}
+
+			if consulPlugin.MinTTL != test.minTTL {
+				t.Errorf("Expected min TTL to be %v but found: %v", test.minTTL, consulPlugin.MinTTL)
+			}
+
+			if consulPlugin.MaxTTL != test.maxTTL {
+				t.Errorf("Expected max TTL to be %v but found: %v", test.maxTTL, consulPlugin.MaxTTL)
+			}
+
+			if consulPlugin.TTLAdaptiveMin != test.ttlAdaptiveMin || consulPlugin.TTLAdaptiveMax != test.ttlAdaptiveMax {
+				t.Errorf("Expected adaptive TTL to be [%v, %v] but found: [%v, %v]", test.ttlAdaptiveMin, test.ttlAdaptiveMax, consulPlugin.TTLAdaptiveMin, consulPlugin.TTLAdaptiveMax)
+			}
+
+			if consulPlugin.Persist != test.persist {
+				t.Errorf("Expected persist path to be %q but found: %q", test.persist, consulPlugin.Persist)
+			}
+
+			if persistInterval := test.persistInterval; persistInterval == 0 {
+				if consulPlugin.PersistInterval != defaultPersistInterval {
+					t.Errorf("Expected persist interval to be %v but found: %v", defaultPersistInterval, consulPlugin.PersistInterval)
+				}
+			} else if consulPlugin.PersistInterval != persistInterval {
+				t.Errorf("Expected persist interval to be %v but found: %v", persistInterval, consulPlugin.PersistInterval)
+			}
+
+			if cleanupInterval := test.cleanupInterval; cleanupInterval == 0 {
+				if consulPlugin.CleanupInterval != defaultCleanupInterval {
+					t.Errorf("Expected cleanup interval to be %v but found: %v", defaultCleanupInterval, consulPlugin.CleanupInterval)
+				}
+			} else if consulPlugin.CleanupInterval != cleanupInterval {
+				t.Errorf("Expected cleanup interval to be %v but found: %v", cleanupInterval, consulPlugin.CleanupInterval)
+			}
+
+			if consulPlugin.RefreshAll != test.refreshAll {
+				t.Errorf("Expected refresh interval to be %v but found: %v", test.refreshAll, consulPlugin.RefreshAll)
+			}
+
+			if consulPlugin.AdminAddr != test.adminAddr || consulPlugin.AdminToken != test.adminToken {
+				t.Errorf("Expected admin API to be %q %q but found: %q %q", test.adminAddr, test.adminToken, consulPlugin.AdminAddr, consulPlugin.AdminToken)
+			}
+
+			if metrics := test.metrics; metrics == "" {
+				if consulPlugin.Metrics != defaultMetrics {
+					t.Errorf("Expected metrics to be %q but found: %q", defaultMetrics, consulPlugin.Metrics)
+				}
+			} else if consulPlugin.Metrics != metrics {
+				t.Errorf("Expected metrics to be %q but found: %q", metrics, consulPlugin.Metrics)
+			}
+
+			if consulPlugin.QueryLog != test.queryLog {
+				t.Errorf("Expected query log rate to be %g but found: %g", test.queryLog, consulPlugin.QueryLog)
+			}
+
+			if consulPlugin.SlowLog != test.slowLog {
+				t.Errorf("Expected slow log threshold to be %v but found: %v", test.slowLog, consulPlugin.SlowLog)
+			}
+
+			if consulPlugin.InvalidAddrLog != test.invalidAddrLog {
+				t.Errorf("Expected invalid address log interval to be %v but found: %v", test.invalidAddrLog, consulPlugin.InvalidAddrLog)
+			}
+
+			if !reflect.DeepEqual(consulPlugin.DNSSEC, test.dnssec) {
+				t.Errorf("Expected DNSSEC keys to be %v but found: %v", test.dnssec, consulPlugin.DNSSEC)
+			}
+
+			if gatewayMode := test.gatewayMode; gatewayMode == "" {
+				if consulPlugin.GatewayMode != defaultGatewayMode {
+					t.Errorf("Expected gateway mode to be %v but found: %v", defaultGatewayMode, consulPlugin.GatewayMode)
+				}
+			} else if consulPlugin.GatewayMode != gatewayMode {
+				t.Errorf("Expected gateway mode to be %v but found: %v", gatewayMode, consulPlugin.GatewayMode)
+			}
+
+			if gateway := test.gateway; gateway == "" {
+				if consulPlugin.Gateway != defaultGateway {
+					t.Errorf("Expected gateway to be %v but found: %v", defaultGateway, consulPlugin.Gateway)
+				}
+			} else if consulPlugin.Gateway != gateway {
+				t.Errorf("Expected gateway to be %v but found: %v", gateway, consulPlugin.Gateway)
+			}
+
+			if consulPlugin.LegacyNXDomain != test.legacyNXDomain {
+				t.Errorf("Expected legacy NXDOMAIN to be %t but found: %t", test.legacyNXDomain, consulPlugin.LegacyNXDomain)
+			}
+
+			if consulPlugin.NoClientCache != test.noClientCache {
+				t.Errorf("Expected no client cache to be %t but found: %t", test.noClientCache, consulPlugin.NoClientCache)
+			}
+
+			if consulPlugin.PackedResponses != test.packedResponses {
+				t.Errorf("Expected packed responses to be %d but found: %d", test.packedResponses, consulPlugin.PackedResponses)
+			}
+
+			if consulPlugin.Chaos != test.chaos {
+				t.Errorf("Expected chaos to be %t but found: %t", test.chaos, consulPlugin.Chaos)
+			}
+
+			if version := test.chaosVersion; version == "" {
+				if consulPlugin.ChaosVersion != defaultChaosVersion {
+					t.Errorf("Expected chaos version to be %v but found: %v", defaultChaosVersion, consulPlugin.ChaosVersion)
+				}
+			} else if consulPlugin.ChaosVersion != version {
+				t.Errorf("Expected chaos version to be %v but found: %v", version, consulPlugin.ChaosVersion)
+			}
+
+			if consulPlugin.ChaosIdentity != test.chaosIdentity {
+				t.Errorf("Expected chaos identity to be %v but found: %v", test.chaosIdentity, consulPlugin.ChaosIdentity)
+			}
+
+			rcodes := []int{consulPlugin.RcodeForeign, consulPlugin.RcodeUnsupported, consulPlugin.RcodeMalformed}
+			if test.rcodes == nil {
+				if defaults := []int{defaultRcodeForeign, defaultRcodeUnsupported, defaultRcodeMalformed}; !reflect.DeepEqual(rcodes, defaults) {
+					t.Errorf("Expected rcodes to be %v but found: %v", defaults, rcodes)
+				}
+			} else if !reflect.DeepEqual(rcodes, test.rcodes) {
+				t.Errorf("Expected rcodes to be %v but found: %v", test.rcodes, rcodes)
+			}
+
+			if !reflect.DeepEqual(consulPlugin.ACLs, test.acls) {
+				t.Errorf("Expected ACLs to be %v but found: %v", test.acls, consulPlugin.ACLs)
+			}
+
+			if !reflect.DeepEqual(consulPlugin.Views, test.views) {
+				t.Errorf("Expected views to be %v but found: %v", test.views, consulPlugin.Views)
+			}
+
+			if consulPlugin.MaxRequests != test.maxRequests {
+				t.Errorf("Expected max requests to be %d but found: %d", test.maxRequests, consulPlugin.MaxRequests)
+			}
+
+			if consulPlugin.MaxConcurrentFetches != test.maxFetches {
+				t.Errorf("Expected max concurrent fetches to be %d but found: %d", test.maxFetches, consulPlugin.MaxConcurrentFetches)
+			}
+
+			if consulPlugin.DebugAddr != test.debugAddr {
+				t.Errorf("Expected debug address to be %q but found: %q", test.debugAddr, consulPlugin.DebugAddr)
+			}
+
+			if consulPlugin.HealthAddr != test.healthAddr {
+				t.Errorf("Expected health address to be %q but found: %q", test.healthAddr, consulPlugin.HealthAddr)
+			}
 		})
 	}
 }
@@ -165,6 +1192,283 @@ func TestSetupFailure(t *testing.T) {
 		`consul { # too many arguments to 'prefetch'
 			prefetch 10 1s 10% whatever
 		}`,
+		`consul { # too many arguments to 'watch'
+			watch whatever
+		}`,
+		`consul { # missing argument to 'backend'
+			backend
+		}`,
+		`consul { # invalid argument to 'backend'
+			backend grpc
+		}`,
+		`consul { # missing argument to 'near'
+			near
+		}`,
+		`consul { # invalid argument to 'policy'
+			policy random
+		}`,
+		`consul { # missing argument to 'filter'
+			filter
+		}`,
+		`consul { # placeholder in a top-level 'or' of 'filter'
+			filter Service.Meta.env == prod or Service.Meta.zone == {tag}
+		}`,
+		`consul { # invalid argument to 'health'
+			health critical
+		}`,
+		`consul { # missing argument to 'node_meta'
+			node_meta
+		}`,
+		`consul { # invalid argument to 'node_meta'
+			node_meta storage
+		}`,
+		`consul { # missing key in argument to 'node_meta'
+			node_meta =ssd
+		}`,
+		`consul { # invalid argument to 'agent_refresh'
+			agent_refresh whatever
+		}`,
+		`consul { # negative argument to 'agent_refresh'
+			agent_refresh -1s
+		}`,
+		`consul { # missing argument to 'datacenter_refresh'
+			datacenter_refresh
+		}`,
+		`consul { # invalid argument to 'datacenter_refresh'
+			datacenter_refresh whatever
+		}`,
+		`consul { # missing argument to 'retry'
+			retry
+		}`,
+		`consul { # invalid argument to 'retry'
+			retry 0
+		}`,
+		`consul { # invalid backoff argument to 'retry'
+			retry 3 whatever
+		}`,
+		`consul { # max backoff lower than backoff in 'retry'
+			retry 3 1s 100ms
+		}`,
+		`consul { # too many arguments to 'retry'
+			retry 3 1s 2s 3s
+		}`,
+		`consul { # missing argument to 'retry_status'
+			retry_status
+		}`,
+		`consul { # invalid argument to 'retry_status'
+			retry_status 42
+		}`,
+		`consul { # missing argument to 'breaker'
+			breaker
+		}`,
+		`consul { # negative argument to 'breaker'
+			breaker -1
+		}`,
+		`consul { # invalid cool-down argument to 'breaker'
+			breaker 5 0s
+		}`,
+		`consul { # missing argument to 'max_stale'
+			max_stale
+		}`,
+		`consul { # negative argument to 'max_stale'
+			max_stale -1m
+		}`,
+		`consul { # missing argument to 'timeout'
+			timeout
+		}`,
+		`consul { # invalid argument to 'timeout'
+			timeout 0s
+		}`,
+		`consul { # missing argument to 'user_agent'
+			user_agent
+		}`,
+		`consul { # missing value to 'header'
+			header Authorization
+		}`,
+		`consul { # invalid name to 'header'
+			header "X Token" secret
+		}`,
+		`consul { # missing argument to 'warmup'
+			warmup
+		}`,
+		`consul { # invalid argument to 'warmup'
+			warmup www.example.com
+		}`,
+		`consul { # missing argument to 'max_memory'
+			max_memory
+		}`,
+		`consul { # invalid argument to 'max_memory'
+			max_memory 10TB
+		}`,
+		`consul { # negative argument to 'max_memory'
+			max_memory -1MB
+		}`,
+		`consul { # missing argument to 'ttl_negative'
+			ttl_negative
+		}`,
+		`consul { # invalid argument to 'ttl_negative'
+			ttl_negative 0s
+		}`,
+		`consul { # missing argument to 'min_ttl'
+			min_ttl
+		}`,
+		`consul { # fractional argument to 'max_ttl'
+			max_ttl 1500ms
+		}`,
+		`consul { # min_ttl greater than max_ttl
+			min_ttl 1m
+			max_ttl 10s
+		}`,
+		`consul { # missing argument to 'ttl_adaptive'
+			ttl_adaptive 10s
+		}`,
+		`consul { # invalid argument to 'ttl_adaptive'
+			ttl_adaptive 10s whatever
+		}`,
+		`consul { # inverted bounds in 'ttl_adaptive'
+			ttl_adaptive 10m 10s
+		}`,
+		`consul { # missing argument to 'persist'
+			persist
+		}`,
+		`consul { # invalid interval argument to 'persist'
+			persist /tmp/consul.json 0s
+		}`,
+		`consul { # invalid interval argument to 'cleanup'
+			cleanup 0s
+		}`,
+		`consul { # missing argument to 'refresh_all'
+			refresh_all
+		}`,
+		`consul { # invalid interval argument to 'refresh_all'
+			refresh_all 0s
+		}`,
+		`consul { # missing file in 'warmup_file'
+			warmup_file testdata/whatever
+		}`,
+		`consul { # missing token to 'admin'
+			admin localhost:8600
+		}`,
+		`consul { # non-loopback address to 'debug'
+			debug 0.0.0.0:8601
+		}`,
+		`consul { # invalid argument to 'metrics'
+			metrics verbose
+		}`,
+		`consul { # missing argument to 'zones'
+			zones
+		}`,
+		`consul { # invalid rate to 'query_log'
+			query_log 1.5
+		}`,
+		`consul { # invalid threshold to 'slow_log'
+			slow_log 0s
+		}`,
+		`consul { # invalid interval to 'invalid_addr_log'
+			invalid_addr_log -1s
+		}`,
+		`consul { # missing argument to 'maxreq'
+			maxreq
+		}`,
+		`consul { # invalid argument to 'maxreq'
+			maxreq 0
+		}`,
+		`consul { # invalid argument to 'max_concurrent_fetches'
+			max_concurrent_fetches -1
+		}`,
+		`consul { # missing argument to 'rcode'
+			rcode foreign
+		}`,
+		`consul { # invalid scope to 'rcode'
+			rcode everything NXDOMAIN
+		}`,
+		`consul { # invalid rcode to 'rcode'
+			rcode foreign BADVERS
+		}`,
+		`consul { # too many arguments to 'no_client_cache'
+			no_client_cache 0s
+		}`,
+		`consul { # missing argument to 'packed_responses'
+			packed_responses
+		}`,
+		`consul { # invalid argument to 'packed_responses'
+			packed_responses -1
+		}`,
+		`consul { # too many arguments to 'chaos'
+			chaos v1 resolver-1 extra
+		}`,
+		`consul { # missing argument to 'dnssec'
+			dnssec
+		}`,
+		`consul { # missing key to 'dnssec'
+			dnssec testdata/Kconsul.+013+00000
+		}`,
+		`consul { # missing argument to 'gateway_mode'
+			gateway_mode
+		}`,
+		`consul { # invalid argument to 'gateway_mode'
+			gateway_mode whatever
+		}`,
+		`consul { # unexpected argument to 'legacy_nxdomain'
+			legacy_nxdomain true
+		}`,
+		`consul { # missing block to 'acl'
+			acl
+		}`,
+		`consul { # empty 'acl' block
+			acl {
+			}
+		}`,
+		`consul { # invalid rule in 'acl' block
+			acl {
+				permit 10.0.0.0/8
+			}
+		}`,
+		`consul { # invalid subnet in 'acl' block
+			acl {
+				allow 10.0.0.0/33
+			}
+		}`,
+		`consul { # unterminated 'acl' block
+			acl {
+				allow 10.0.0.0/8
+		`,
+		`consul { # missing subnet to 'view'
+			view {
+				tag internal
+			}
+		}`,
+		`consul { # invalid subnet to 'view'
+			view 10.0.0.0/33 {
+				tag internal
+			}
+		}`,
+		`consul { # missing block to 'view'
+			view 10.0.0.0/8
+		}`,
+		`consul { # empty 'view' block
+			view 10.0.0.0/8 {
+			}
+		}`,
+		`consul { # invalid entry in 'view' block
+			view 10.0.0.0/8 {
+				near _agent
+			}
+		}`,
+		`consul { # missing argument to 'tag' in 'view' block
+			view 10.0.0.0/8 {
+				tag
+			}
+		}`,
+		`consul { # invalid address to 'debug'
+			debug localhost
+		}`,
+		`consul { # missing argument to 'health_addr'
+			health_addr
+		}`,
+		`consul { # invalid address to 'health_addr'
+			health_addr localhost
+		}`,
 		`consul { # invalid plugin configuration entry
 			whatever
 		}`,
@@ -181,3 +1485,11 @@ func TestSetupFailure(t *testing.T) {
 		})
 	}
 }
+
+func cidr(s string) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipnet
+}
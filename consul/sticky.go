@@ -0,0 +1,74 @@
+package consul
+
+import (
+	"net"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// clientOf returns the identity of the client that sent the query in state,
+// which is the subnet of the EDNS client subnet option when present, so all the
+// clients behind a resolver reporting it are treated as one, or the address of
+// the client otherwise.
+func clientOf(state request.Request) []byte {
+	if opt := state.Req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				bits := 8 * net.IPv4len
+				if ecs.Family == 2 {
+					bits = 8 * net.IPv6len
+				}
+				return ecs.Address.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits)).To16()
+			}
+		}
+	}
+	return net.ParseIP(state.IP()).To16()
+}
+
+// sticky returns the service of srv that client is assigned to.
+//
+// Services are selected by rendezvous hashing, the client is assigned to the
+// service with the highest hash of the pair, so clients only move to another
+// service when the one they were assigned to is removed, and the clients of a
+// removed service are spread evenly across the remaining ones.
+func sticky(srv []service, client []byte) service {
+	c := fnv64(fnv64Offset, client)
+	best, max := 0, uint64(0)
+
+	for i, s := range srv {
+		h := fnv64(c, s.addr.To16())
+		h = fnv64(h, []byte{byte(s.port >> 8), byte(s.port)})
+		h = fnv64(h, []byte(s.node))
+
+		if h = mix64(h); i == 0 || h > max {
+			best, max = i, h
+		}
+	}
+
+	return srv[best]
+}
+
+const (
+	fnv64Offset = 14695981039346656037
+	fnv64Prime  = 1099511628211
+)
+
+// fnv64 continues the FNV-1a hash h with the bytes of b.
+func fnv64(h uint64, b []byte) uint64 {
+	for _, c := range b {
+		h = (h ^ uint64(c)) * fnv64Prime
+	}
+	return h * fnv64Prime // separates the byte slices, like key.hash
+}
+
+// mix64 is the finalizer of splitmix64, FNV hashes of inputs which only differ
+// in their last bytes are not spread well enough to be compared.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
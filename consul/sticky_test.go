@@ -0,0 +1,53 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestSticky(t *testing.T) {
+	srv := make([]service, 5)
+	for i := range srv {
+		srv[i] = service{
+			addr: net.ParseIP(fmt.Sprintf("192.168.0.%d", i+1)),
+			port: 10001,
+			node: fmt.Sprintf("host-%d.node.dc1.consul.", i+1),
+		}
+	}
+
+	clients := make([][]byte, 1000)
+	for i := range clients {
+		clients[i] = net.ParseIP(fmt.Sprintf("10.0.%d.%d", i/256, i%256)).To16()
+	}
+
+	assigned := make([]service, len(clients))
+	counts := map[string]int{}
+
+	for i, client := range clients {
+		assigned[i] = sticky(srv, client)
+		counts[assigned[i].addr.String()]++
+	}
+
+	for _, s := range srv {
+		if n := counts[s.addr.String()]; n < 100 || n > 300 {
+			t.Errorf("Expected about 200 clients to be assigned to %s but found: %d", s.addr, n)
+		}
+	}
+
+	// Removing a service must only move the clients that were assigned to it.
+	removed := srv[2]
+	remaining := append(append([]service{}, srv[:2]...), srv[3:]...)
+
+	for i, client := range clients {
+		s := sticky(remaining, client)
+
+		if assigned[i].addr.Equal(removed.addr) {
+			if s.addr.Equal(removed.addr) {
+				t.Errorf("Expected client %s to be moved away from the removed service", net.IP(client))
+			}
+		} else if !s.addr.Equal(assigned[i].addr) {
+			t.Errorf("Expected client %s to stay on %s but found: %s", net.IP(client), assigned[i].addr, s.addr)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+)
+
+// transferZone is the zone that secondaries can transfer from the plugin.
+const transferZone = "consul."
+
+// Transfer satisfies the transfer.Transferer interface, it returns the records
+// of a zone synthesized from all the healthy services of the local datacenter.
+//
+// The serial of the zone is the consul index of the service catalog, when it
+// has not changed since serial the zone is reported to be up to date with a
+// single SOA record.
+func (c *Consul) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	if dns.Fqdn(strings.ToLower(zone)) != transferZone {
+		return nil, transfer.ErrNotAuthoritative
+	}
+
+	if len(c.Zones) != 0 && plugin.Zones(c.Zones).Matches(transferZone) == "" {
+		return nil, transfer.ErrNotAuthoritative
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	cache, agent, err := c.grabCache(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	catalog, index, err := cache.fetchCatalog(ctx, agent.Config.Datacenter)
+	if err != nil {
+		return nil, err
+	}
+
+	soa := c.soa(uint32(index))
+
+	if serial != 0 && serial == soa.Serial {
+		ch := make(chan []dns.RR, 1)
+		ch <- []dns.RR{soa}
+		close(ch)
+		return ch, nil
+	}
+
+	names := make([]string, 0, len(catalog))
+	for name := range catalog {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Records are all loaded before the transfer starts, so failures are
+	// reported to the secondary instead of sending a partial zone.
+	rrs := make([][]dns.RR, 0, len(names)+2)
+	rrs = append(rrs, []dns.RR{soa})
+
+	for _, name := range names {
+		k := key{name: name, dc: agent.Config.Datacenter, qtype: dns.TypeANY}
+		srv, _, err := cache.load(k)
+		if err != nil {
+			return nil, err
+		}
+		if len(srv) != 0 {
+			rrs = append(rrs, c.transferRecords(name, catalog[name], srv))
+		}
+	}
+
+	rrs = append(rrs, []dns.RR{soa})
+	ch := make(chan []dns.RR, len(rrs))
+
+	for _, r := range rrs {
+		ch <- r
+	}
+
+	close(ch)
+	return ch, nil
+}
+
+// transferRecords returns the records of a service in the transferred zone.
+func (c *Consul) transferRecords(name string, tags []string, srv []service) []dns.RR {
+	qname := name + ".service." + transferZone
+	ttl := c.clampTTL(c.TTL - time.Second)
+	rrs := make([]dns.RR, 0, 3*len(srv)+1)
+	nodes := make(map[string]bool, len(srv))
+
+	for _, s := range srv {
+		rrs = append(rrs, s.ANY(qname, ttl), s.SRV(qname, ttl))
+	}
+
+	for _, s := range srv {
+		if !nodes[s.node] {
+			nodes[s.node] = true
+			rrs = append(rrs, s.ANY(s.node, ttl))
+		}
+	}
+
+	if len(tags) != 0 {
+		rrs = append(rrs, &dns.TXT{
+			Hdr: srv[0].header(qname, dns.TypeTXT, ttl),
+			Txt: tags,
+		})
+	}
+
+	return rrs
+}
+
+// soa returns the SOA record of the transferred zone, secondaries check for
+// changes of the zone every TTL.
+func (c *Consul) soa(serial uint32) *dns.SOA {
+	ttl := uint32(c.TTL / time.Second)
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: transferZone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "ns." + transferZone,
+		Mbox:    "hostmaster." + transferZone,
+		Serial:  serial,
+		Refresh: ttl,
+		Retry:   ttl,
+		Expire:  10 * ttl,
+		Minttl:  ttl,
+	}
+}
+
+// fetchCatalog returns the names and tags of all the services registered in
+// the catalog of dc, and the consul index of the catalog.
+func (c *cache) fetchCatalog(ctx context.Context, dc string) (catalog map[string][]string, index uint64, err error) {
+	q := url.Values{}
+	if len(dc) != 0 {
+		q.Set("dc", dc)
+	}
+	for k, v := range c.nodeMeta {
+		q.Add("node-meta", k+":"+v)
+	}
+
+	var res *http.Response
+	if res, err = c.client.get(ctx, "/v1/catalog/services?"+q.Encode()); err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		err = httpError(res)
+		return
+	}
+
+	index, _ = strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	err = json.NewDecoder(res.Body).Decode(&catalog)
+	return
+}
@@ -0,0 +1,115 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+)
+
+func TestConsulTransfer(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true, tags: []string{"primary"}},
+		{node: "host-2", name: "service-1", addr: "192.168.0.2", port: 10001, pass: true},
+		{node: "host-1", name: "service-2", addr: "fe80::1", port: 10002, pass: true},
+		{node: "host-3", name: "service-3", addr: "192.168.0.3", port: 10003},
+	})
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+
+	ch, err := consul.Transfer("consul.", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rrs []dns.RR
+	for r := range ch {
+		rrs = append(rrs, r...)
+	}
+
+	if len(rrs) < 2 {
+		t.Fatalf("Expected the zone to start and end with a SOA record but found: %v", rrs)
+	}
+
+	for _, rr := range []dns.RR{rrs[0], rrs[len(rrs)-1]} {
+		if soa, ok := rr.(*dns.SOA); !ok {
+			t.Errorf("Expected a SOA record but found: %s", rr)
+		} else if soa.Serial != 4 {
+			t.Errorf("Expected the serial to be the catalog index but found: %d", soa.Serial)
+		}
+	}
+
+	found := make(map[string]int)
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		found[rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype]]++
+	}
+
+	expected := map[string]int{
+		"service-1.service.consul. A":    2,
+		"service-1.service.consul. SRV":  2,
+		"service-1.service.consul. TXT":  1,
+		"service-2.service.consul. AAAA": 1,
+		"service-2.service.consul. SRV":  1,
+		"host-1.node.dc1.consul. A":      1,
+		"host-2.node.dc1.consul. A":      1,
+		"host-1.node.dc1.consul. AAAA":   1,
+	}
+
+	for name, n := range expected {
+		if found[name] != n {
+			t.Errorf("Expected %d %s records but found %d", n, name, found[name])
+		}
+	}
+
+	if len(found) != len(expected) {
+		t.Errorf("Expected %d record sets but found %d: %v", len(expected), len(found), found)
+	}
+}
+
+func TestConsulTransferUpToDate(t *testing.T) {
+	server := consulServer("dc1", []consulServerService{
+		{node: "host-1", name: "service-1", addr: "192.168.0.1", port: 10001, pass: true},
+	})
+	defer server.Close()
+
+	consul := New()
+	consul.Addr = server.URL
+
+	ch, err := consul.Transfer("consul.", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rrs []dns.RR
+	for r := range ch {
+		rrs = append(rrs, r...)
+	}
+
+	if len(rrs) != 1 || rrs[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("Expected a single SOA record but found: %v", rrs)
+	}
+}
+
+func TestConsulTransferNotAuthoritative(t *testing.T) {
+	tests := []struct {
+		zone  string
+		zones []string
+	}{
+		{zone: "example.com."},
+		{zone: "service.consul."},
+		{zone: "consul.", zones: []string{"service.consul."}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.zone, func(t *testing.T) {
+			consul := New()
+			consul.Zones = test.zones
+
+			if _, err := consul.Transfer(test.zone, 0); err != transfer.ErrNotAuthoritative {
+				t.Errorf("Expected %v but got: %v", transfer.ErrNotAuthoritative, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package consul
+
+import (
+	"net"
+)
+
+// View resolves the queries of clients in a set of subnets to the services of
+// a consul tag or datacenter, when the queried names do not specify them.
+type View struct {
+	// Subnets of the clients that the view applies to.
+	Nets []*net.IPNet
+
+	// Tag and datacenter of the services returned to clients of the view, the
+	// tag is not applied to queries for service instances. Empty values keep
+	// the defaults.
+	Tag string
+	DC  string
+}
+
+// contains returns true if the client at ip belongs to the view.
+func (v *View) contains(ip net.IP) bool {
+	for _, n := range v.Nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// viewOf returns the first view that the client at ip belongs to, or nil if it
+// belongs to none.
+func (c *Consul) viewOf(ip net.IP) *View {
+	for i := range c.Views {
+		if v := &c.Views[i]; v.contains(ip) {
+			return v
+		}
+	}
+	return nil
+}
+
+// parseViewKey is like parseKey but applies the view that the client at ip
+// belongs to, if any.
+func (c *Consul) parseViewKey(qname string, qtype uint16, agent consulAgent, ip net.IP) (k key, rcode int) {
+	v := c.viewOf(ip)
+	if v == nil {
+		return parseKey(qname, qtype, agent)
+	}
+
+	if len(v.DC) != 0 {
+		agent.Config.Datacenter = v.DC
+	}
+
+	if k, rcode = parseKey(qname, qtype, agent); len(k.tag) == 0 && len(k.id) == 0 {
+		k.tag = v.Tag
+	}
+	return
+}
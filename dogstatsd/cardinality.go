@@ -0,0 +1,80 @@
+package dogstatsd
+
+import "strings"
+
+// Value of the tags of the series that the metrics over the limit of tag sets
+// are aggregated in.
+const otherTagValue = "other"
+
+// limitTagSets returns metrics with at most max unique tag sets per metric
+// name, in the order they are first seen. The metrics of the tag sets over the
+// limit have all their tag values replaced with "other", their counters and
+// gauges are aggregated by summing their values, and the observations of their
+// histograms are kept. The number of tag sets aggregated is passed to dropped
+// for each metric name which exceeded the limit.
+func limitTagSets(metrics []metric, max int, dropped func(name string, n int)) []metric {
+	type series struct {
+		name string
+		tags tags
+	}
+
+	seen := make(map[string]map[tags]struct{})
+	overflow := make(map[string]map[tags]struct{})
+	others := make(map[series]int)
+
+	// At most one metric is appended for each metric read, so the metrics
+	// are filtered in place.
+	limited := metrics[:0]
+
+	for _, m := range metrics {
+		sets := seen[m.name]
+		if sets == nil {
+			sets = make(map[tags]struct{})
+			seen[m.name] = sets
+		}
+
+		if _, ok := sets[m.tags]; ok || len(sets) < max {
+			sets[m.tags] = struct{}{}
+			limited = append(limited, m)
+			continue
+		}
+
+		if overflow[m.name] == nil {
+			overflow[m.name] = make(map[tags]struct{})
+		}
+		overflow[m.name][m.tags] = struct{}{}
+		m.tags = otherTags(m.tags)
+
+		switch m.kind {
+		case counter, gauge:
+			s := series{name: m.name, tags: m.tags}
+			if i, ok := others[s]; ok {
+				limited[i].value += m.value
+				continue
+			}
+			others[s] = len(limited)
+		}
+
+		limited = append(limited, m)
+	}
+
+	for name, sets := range overflow {
+		dropped(name, len(sets))
+	}
+
+	return limited
+}
+
+// otherTags returns t with all its tag values replaced with "other", tags
+// without a name are made of their value only.
+func otherTags(t tags) tags {
+	if t == "" {
+		return t
+	}
+
+	list := strings.Split(string(t), ",")
+	for i, tag := range list {
+		list[i] = tag[:strings.IndexByte(tag, ':')+1] + otherTagValue
+	}
+	return tags(strings.Join(list, ","))
+}
@@ -0,0 +1,60 @@
+package dogstatsd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLimitTagSets(t *testing.T) {
+	metrics := []metric{
+		{kind: counter, name: "coredns.dns.exchanges", value: 4, tags: "exchange:a"},
+		{kind: counter, name: "coredns.dns.exchanges", value: 3, tags: "exchange:b"},
+		{kind: counter, name: "coredns.dns.exchanges", value: 2, tags: "exchange:c"},
+		{kind: counter, name: "coredns.dns.exchanges", value: 1, tags: "exchange:d"},
+		{kind: gauge, name: "coredns.dns.cache.size", value: 42},
+		{kind: histogram, name: "coredns.dns.request.duration", value: 1, tags: "server:a"},
+		{kind: histogram, name: "coredns.dns.request.duration", value: 2, tags: "server:a"},
+		{kind: histogram, name: "coredns.dns.request.duration", value: 3, tags: "server:b"},
+		{kind: histogram, name: "coredns.dns.request.duration", value: 4, tags: "server:c"},
+		{kind: histogram, name: "coredns.dns.request.duration", value: 5, tags: "server:d"},
+	}
+
+	dropped := map[string]int{}
+	limited := limitTagSets(metrics, 2, func(name string, n int) { dropped[name] += n })
+
+	expected := []metric{
+		{kind: counter, name: "coredns.dns.exchanges", value: 4, tags: "exchange:a"},
+		{kind: counter, name: "coredns.dns.exchanges", value: 3, tags: "exchange:b"},
+		{kind: counter, name: "coredns.dns.exchanges", value: 3, tags: "exchange:other"},
+		{kind: gauge, name: "coredns.dns.cache.size", value: 42},
+		{kind: histogram, name: "coredns.dns.request.duration", value: 1, tags: "server:a"},
+		{kind: histogram, name: "coredns.dns.request.duration", value: 2, tags: "server:a"},
+		{kind: histogram, name: "coredns.dns.request.duration", value: 3, tags: "server:b"},
+		{kind: histogram, name: "coredns.dns.request.duration", value: 4, tags: "server:other"},
+		{kind: histogram, name: "coredns.dns.request.duration", value: 5, tags: "server:other"},
+	}
+
+	if !reflect.DeepEqual(limited, expected) {
+		t.Errorf("\nexpected: %+v\nfound:    %+v", expected, limited)
+	}
+
+	if !reflect.DeepEqual(dropped, map[string]int{
+		"coredns.dns.exchanges":        2,
+		"coredns.dns.request.duration": 2,
+	}) {
+		t.Errorf("Unexpected dropped tag sets: %v", dropped)
+	}
+}
+
+func TestOtherTags(t *testing.T) {
+	for t0, t1 := range map[tags]tags{
+		"":                         "",
+		"exchange:a":               "exchange:other",
+		"client:a,name:b,canary":   "client:other,name:other,other",
+		"rcode:SERVFAIL,name:a:b.": "rcode:other,name:other",
+	} {
+		if t2 := otherTags(t0); t2 != t1 {
+			t.Errorf("%q: expected %q but found: %q", t0, t1, t2)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package dogstatsd
 
 import (
 	"sort"
+	"strings"
 	"sync"
 )
 
@@ -40,6 +41,36 @@ func (c *counterStore) top(n int) []counterEntry {
 	return count
 }
 
+// topGroups is like top but returns the top n keys of each group, the group of
+// a key is the part before its first '/'.
+func (c *counterStore) topGroups(n int) []counterEntry {
+	index := c.swap(make(map[string]int64, 1000))
+	groups := make(map[string][]counterEntry)
+
+	for key, value := range index {
+		group := key
+		if i := strings.IndexByte(key, '/'); i >= 0 {
+			group = key[:i]
+		}
+		groups[group] = append(groups[group], counterEntry{key: key, value: value})
+	}
+
+	count := make([]counterEntry, 0, len(groups)*n)
+
+	for _, group := range groups {
+		sort.Sort(sort.Reverse(
+			counterEntriesByValue(group),
+		))
+
+		if n < len(group) {
+			group = group[:n]
+		}
+		count = append(count, group...)
+	}
+
+	return count
+}
+
 func (c *counterStore) swap(m map[string]int64) map[string]int64 {
 	c.mutex.Lock()
 	m, c.index = c.index, m
@@ -52,12 +83,35 @@ type counterEntry struct {
 	value int64
 }
 
+// clientTagsSeparator separates the name of a client from the tags formatted
+// for the client, both are part of the keys of clients and exchanges counters.
+const clientTagsSeparator = "\x00"
+
 func (c counterEntry) metric(name string, tag string) metric {
+	key, clientTags := c.key, ""
+	if i := strings.Index(key, clientTagsSeparator); i >= 0 {
+		key, clientTags = key[:i], ","+key[i+1:]
+	}
+	return metric{
+		kind:  counter,
+		name:  name,
+		value: float64(c.value),
+		tags:  tags(tag + ":" + key + clientTags),
+	}
+}
+
+// groupMetric is like metric for entries returned by topGroups, the group and
+// the rest of the key are reported as two tags.
+func (c counterEntry) groupMetric(name string, groupTag string, tag string) metric {
+	group, key := c.key, ""
+	if i := strings.IndexByte(c.key, '/'); i >= 0 {
+		group, key = c.key[:i], c.key[i+1:]
+	}
 	return metric{
 		kind:  counter,
 		name:  name,
 		value: float64(c.value),
-		tags:  tags(tag + ":" + c.key),
+		tags:  tags(groupTag + ":" + group + "," + tag + ":" + key),
 	}
 }
 
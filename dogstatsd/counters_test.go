@@ -2,6 +2,7 @@ package dogstatsd
 
 import (
 	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -34,3 +35,32 @@ func TestCounterStore(t *testing.T) {
 		t.Error("top counters mismatch:", top3)
 	}
 }
+
+func TestCounterStoreGroups(t *testing.T) {
+	c := makeCounterStore()
+
+	for i := 0; i != 3; i++ {
+		c.incr("A/www.segment.com.")
+	}
+
+	c.incr("A/www.github.com.")
+	c.incr("A/www.google.com.")
+	c.incr("A/www.google.com.")
+	c.incr("AAAA/www.segment.com.")
+
+	top2 := c.topGroups(2)
+	sort.Slice(top2, func(i, j int) bool { return top2[i].key < top2[j].key })
+
+	if !reflect.DeepEqual(top2, []counterEntry{
+		{key: "A/www.google.com.", value: 2},
+		{key: "A/www.segment.com.", value: 3},
+		{key: "AAAA/www.segment.com.", value: 1},
+	}) {
+		t.Error("top counters mismatch:", top2)
+	}
+
+	m := top2[2].groupMetric("coredns.dns.names.qtype.top2", "qtype", "name")
+	if m.tags != "qtype:AAAA,name:www.segment.com." || m.value != 1 {
+		t.Errorf("Unexpected metric: %+v", m)
+	}
+}
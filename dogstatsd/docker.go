@@ -2,16 +2,51 @@ package dogstatsd
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
 
 type dockerClient struct {
-	host string
+	host      string
+	tlsConfig *tls.Config
+}
+
+// makeDockerTLSConfig returns the TLS configuration of a client of the docker
+// daemon authenticating with the certificate and key loaded from certFile and
+// keyFile, and verifying the daemon with the certificates of caFile, or with
+// the certificates of the system if caFile is empty.
+func makeDockerTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+
+		config.RootCAs = roots
+	}
+
+	return config, nil
 }
 
 func (c *dockerClient) listContainers() (containers []dockerContainer, err error) {
@@ -19,16 +54,76 @@ func (c *dockerClient) listContainers() (containers []dockerContainer, err error
 	return
 }
 
-func (c *dockerClient) get(path string, ret interface{}) (err error) {
+// inspectContainer returns the container with the given id, found is false if
+// the container does not exist.
+func (c *dockerClient) inspectContainer(id string) (container dockerContainer, found bool, err error) {
+	var inspect dockerContainerInspect
+
+	if err = c.get("/containers/"+url.PathEscape(id)+"/json", &inspect); err != nil {
+		if e, ok := err.(*dockerError); ok && e.status == http.StatusNotFound {
+			err = nil
+		}
+		return
+	}
+
+	container = dockerContainer{
+		ID:              inspect.ID,
+		Image:           inspect.Config.Image,
+		Labels:          inspect.Config.Labels,
+		NetworkSettings: inspect.NetworkSettings,
+	}
+	return container, true, nil
+}
+
+// events streams the events of containers which may change the addresses of
+// the containers to f, until ctx is canceled or the stream is interrupted.
+func (c *dockerClient) events(ctx context.Context, f func(dockerEvent)) error {
+	filters := `{"type":["container","network"],"event":["start","die","destroy","connect","disconnect"]}`
+
+	res, done, err := c.open(ctx, "/events?filters="+url.QueryEscape(filters))
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	for dec := json.NewDecoder(res.Body); ; {
+		var e dockerEvent
+		if err := dec.Decode(&e); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("reading docker events: %s", err)
+		}
+		f(e)
+	}
+}
+
+func (c *dockerClient) get(path string, ret interface{}) error {
+	if len(c.host) == 0 {
+		return nil
+	}
+
+	res, done, err := c.open(context.Background(), path)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return json.NewDecoder(res.Body).Decode(ret)
+}
+
+// open sends a GET request for path to the docker daemon, done must be called
+// to release the response when err is nil.
+func (c *dockerClient) open(ctx context.Context, path string) (res *http.Response, done func(), err error) {
 	var req *http.Request
-	var res *http.Response
 
 	if len(c.host) == 0 {
+		err = errors.New("no docker host configured")
 		return
 	}
 
+	network, address := dockerNetworkAddress(c.host)
 	dialContext := func(ctx context.Context, _, _ string) (net.Conn, error) {
-		network, address := dockerNetworkAddress(c.host)
 		return (&net.Dialer{Timeout: 4 * time.Second}).DialContext(ctx, network, address)
 	}
 
@@ -36,32 +131,91 @@ func (c *dockerClient) get(path string, ret interface{}) (err error) {
 		DialContext:            dialContext,
 		DisableKeepAlives:      true,
 		DisableCompression:     true,
+		TLSHandshakeTimeout:    5 * time.Second,
 		ResponseHeaderTimeout:  5 * time.Second,
 		ExpectContinueTimeout:  5 * time.Second,
 		MaxResponseHeaderBytes: 1024 * 1024,
 	}
-	defer transport.CloseIdleConnections()
 
-	if req, err = http.NewRequest(http.MethodGet, "http://docker"+path, nil); err != nil {
+	scheme := "http"
+
+	if c.tlsConfig != nil {
+		scheme = "https"
+		transport.TLSClientConfig = c.tlsConfig.Clone()
+
+		// The requests are sent to a fake host name, the certificate of the
+		// daemon is verified against the host of its address instead.
+		if transport.TLSClientConfig.ServerName == "" {
+			transport.TLSClientConfig.ServerName, _, _ = net.SplitHostPort(address)
+		}
+	}
+
+	if req, err = http.NewRequest(http.MethodGet, scheme+"://docker"+path, nil); err != nil {
+		transport.CloseIdleConnections()
 		return
 	}
 
-	if res, err = transport.RoundTrip(req); err != nil {
+	if res, err = transport.RoundTrip(req.WithContext(ctx)); err != nil {
+		transport.CloseIdleConnections()
 		return
 	}
-	defer res.Body.Close()
+
+	done = func() {
+		res.Body.Close()
+		transport.CloseIdleConnections()
+	}
 
 	if res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("%s: %s", req.URL, res.Status)
-		return
+		done()
+		err = &dockerError{url: req.URL.String(), status: res.StatusCode, text: res.Status}
+		res, done = nil, nil
 	}
 
-	err = json.NewDecoder(res.Body).Decode(ret)
 	return
 }
 
+type dockerError struct {
+	url    string
+	status int
+	text   string
+}
+
+func (e *dockerError) Error() string { return e.url + ": " + e.text }
+
+type dockerEvent struct {
+	Type   string
+	Action string
+	Actor  dockerEventActor
+}
+
+type dockerEventActor struct {
+	ID         string
+	Attributes map[string]string
+}
+
+// containerID returns the id of the container that the event occurred on.
+func (e dockerEvent) containerID() string {
+	if e.Type == "network" {
+		return e.Actor.Attributes["container"]
+	}
+	return e.Actor.ID
+}
+
+type dockerContainerInspect struct {
+	ID              string `json:"Id"`
+	Config          dockerContainerConfig
+	NetworkSettings dockerNetworkSettings
+}
+
+type dockerContainerConfig struct {
+	Image  dockerImage
+	Labels map[string]string
+}
+
 type dockerContainer struct {
+	ID              string `json:"Id"`
 	Image           dockerImage
+	Labels          map[string]string
 	NetworkSettings dockerNetworkSettings
 }
 
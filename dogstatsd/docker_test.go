@@ -1,10 +1,28 @@
 package dogstatsd
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	corednstest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
 )
 
 func TestDockerImage(t *testing.T) {
@@ -271,7 +289,16 @@ func TestDockerClient(t *testing.T) {
 
 	if !reflect.DeepEqual(containers, []dockerContainer{
 		{
+			ID:    "89763c167db7c57a248a152877056cdefd4fb6dc1ab14113db3c42afc12e8574",
 			Image: "segment/coredns:1.4.4",
+			Labels: map[string]string{
+				"com.docker.compose.config-hash":      "3a875203c1620a6d8f1566605beddc87bb2b9581e2f9e364d0095be99c6ead85",
+				"com.docker.compose.container-number": "1",
+				"com.docker.compose.oneoff":           "False",
+				"com.docker.compose.project":          "coredns",
+				"com.docker.compose.service":          "coredns",
+				"com.docker.compose.version":          "1.19.0-rc2",
+			},
 			NetworkSettings: dockerNetworkSettings{
 				Networks: map[string]dockerNetwork{
 					"coredns_vpc": {
@@ -285,7 +312,16 @@ func TestDockerClient(t *testing.T) {
 		},
 
 		{
+			ID:    "5cd9f15a16621239c49549eb6c741f49c0b29dc6f8cf80a964c9e7c0bbb942c7",
 			Image: "segment/dogstatsd",
+			Labels: map[string]string{
+				"com.docker.compose.config-hash":      "6ec2e9f388383ffbb18e8376f44adde36a17014830d3633a13c99d92566058f7",
+				"com.docker.compose.container-number": "1",
+				"com.docker.compose.oneoff":           "False",
+				"com.docker.compose.project":          "coredns",
+				"com.docker.compose.service":          "dogstatsd",
+				"com.docker.compose.version":          "1.19.0-rc2",
+			},
 			NetworkSettings: dockerNetworkSettings{
 				Networks: map[string]dockerNetwork{
 					"coredns_vpc": {
@@ -301,3 +337,281 @@ func TestDockerClient(t *testing.T) {
 		t.Error(containers)
 	}
 }
+
+func TestDockerClientTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "coredns"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCert, err := x509.ParseCertificate(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "coredns" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`[{"Id": "89763c167db7", "Image": "segment/coredns:1.4.4"}]`))
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  x509.NewCertPool(),
+	}
+	server.TLS.ClientCAs.AddCert(clientCert)
+	server.StartTLS()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "dogstatsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]*pem.Block{
+		"cert.pem": {Type: "CERTIFICATE", Bytes: cert},
+		"key.pem":  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+		"ca.pem":   {Type: "CERTIFICATE", Bytes: server.Certificate().Raw},
+	}
+
+	for name, block := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tlsConfig, err := makeDockerTLSConfig(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := dockerClient{
+		host:      "tcp://" + server.Listener.Addr().String(),
+		tlsConfig: tlsConfig,
+	}
+
+	containers, err := client.listContainers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(containers, []dockerContainer{{ID: "89763c167db7", Image: "segment/coredns:1.4.4"}}) {
+		t.Error(containers)
+	}
+
+	// The certificate of the daemon is not trusted without the CA.
+	if tlsConfig, err = makeDockerTLSConfig(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	client.tlsConfig = tlsConfig
+
+	if _, err := client.listContainers(); err == nil {
+		t.Error("Expected an error verifying the certificate of the docker daemon")
+	}
+}
+
+func TestDockerWatch(t *testing.T) {
+	started := make(chan struct{})
+	events := make(chan string)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/events":
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			close(started)
+			for {
+				select {
+				case e := <-events:
+					w.Write([]byte(e + "\n"))
+					w.(http.Flusher).Flush()
+				case <-r.Context().Done():
+					return
+				}
+			}
+
+		case "/containers/json":
+			w.Write([]byte(`[{"Id": "a", "Image": "segment/api:1.0", "NetworkSettings": {"Networks": {"vpc": {"IPAddress": "10.5.0.2"}}}}]`))
+
+		case "/containers/b/json":
+			w.Write([]byte(`{"Id": "b", "Image": "sha256:0123", "Config": {"Image": "segment/worker:2.0"}, "NetworkSettings": {"Networks": {"vpc": {"IPAddress": "10.5.0.3"}}}}`))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	plugin := New()
+	plugin.DockerHost = server.URL[7:]
+	plugin.once.Do(plugin.init)
+	plugin.wg.Add(1)
+	go plugin.watchDocker(plugin.ctx)
+	defer plugin.Stop()
+
+	assertCache := func(expected map[string][]string) {
+		t.Helper()
+		var cache map[string][]string
+		for i := 0; i != 100; i++ {
+			if cache, _ = plugin.clientCache.Load().(map[string][]string); reflect.DeepEqual(cache, expected) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("docker cache mismatch:", cache)
+	}
+
+	<-started
+	assertCache(map[string][]string{"10.5.0.2": {"api"}})
+
+	events <- `{"Type": "container", "Action": "start", "Actor": {"ID": "b"}}`
+	assertCache(map[string][]string{"10.5.0.2": {"api"}, "10.5.0.3": {"worker"}})
+
+	events <- `{"Type": "container", "Action": "die", "Actor": {"ID": "a"}}`
+	assertCache(map[string][]string{"10.5.0.3": {"worker"}})
+
+	events <- `{"Type": "network", "Action": "disconnect", "Actor": {"ID": "vpc", "Attributes": {"container": "c"}}}`
+	assertCache(map[string][]string{"10.5.0.3": {"worker"}})
+}
+
+func TestDockerRefresh(t *testing.T) {
+	lists := make(chan struct{}, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/events":
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+
+		case "/containers/json":
+			select {
+			case lists <- struct{}{}:
+			default:
+			}
+			w.Write([]byte(`[]`))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	plugin := New()
+	plugin.DockerHost = server.URL[7:]
+	plugin.DockerRefresh = 20 * time.Millisecond // for the purpose of the test, forbidden otherwise
+	plugin.once.Do(plugin.init)
+	plugin.wg.Add(1)
+	go plugin.watchDocker(plugin.ctx)
+	defer plugin.Stop()
+
+	// The containers are listed once when the watch starts, then on every
+	// refresh while the flush interval is a minute.
+	for i := 0; i != 3; i++ {
+		select {
+		case <-lists:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The containers were listed %d times only", i)
+		}
+	}
+}
+
+func TestDockerLookup(t *testing.T) {
+	next := plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		return dns.RcodeSuccess, nil
+	})
+
+	var lists int32
+	var containers atomic.Value
+	containers.Store(`[]`)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/events":
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+
+		case "/containers/json":
+			atomic.AddInt32(&lists, 1)
+			w.Write([]byte(containers.Load().(string)))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	plugin := New()
+	plugin.DockerHost = server.URL[7:]
+	plugin.Next = next
+	plugin.once.Do(plugin.init)
+	plugin.wg.Add(1)
+	go plugin.watchDocker(plugin.ctx)
+	defer plugin.Stop()
+
+	query := func(ip string) {
+		r := new(dns.Msg)
+		r.SetQuestion("www.segment.com.", dns.TypeA)
+		plugin.ServeDNS(context.Background(), &corednstest.ResponseWriter{RemoteIP: ip}, r)
+	}
+
+	waitLists := func(n int32) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&lists) < n; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("The containers were listed %d times only", atomic.LoadInt32(&lists))
+			}
+		}
+	}
+
+	// The container was started without its event being received, it is
+	// looked up on its first query after the lookup interval.
+	waitLists(1)
+	containers.Store(`[{"Id": "a", "Image": "segment/api:1.0", "NetworkSettings": {"Networks": {"vpc": {"IPAddress": "10.5.0.2"}}}}]`)
+
+	for deadline := time.Now().Add(5 * time.Second); !plugin.dockerCached("10.5.0.2"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("The container was not looked up")
+		}
+		query("10.5.0.2")
+	}
+
+	// A client which is not a container is only looked up once until the
+	// next refresh.
+	time.Sleep(dockerLookupInterval)
+	n := atomic.LoadInt32(&lists)
+	query("10.5.0.9")
+	waitLists(n + 1)
+
+	for i := 0; i != 10; i++ {
+		time.Sleep(dockerLookupInterval / 5)
+		query("10.5.0.9")
+	}
+
+	if m := atomic.LoadInt32(&lists); m != n+1 {
+		t.Errorf("Expected the containers to be listed %d times but found: %d", n+1, m)
+	}
+}
@@ -11,26 +11,35 @@ package dogstatsd
 // The complex parts about bridging between prometheus and dogstatsd are the
 // subtle variations in how they implement similar concepts. For example, in
 // prometheus counters are always incrementing values, but in dogstatsd only
-// the increments are published. Same goes with the summaries and historigrams
-// of prometheus, which are merged into a single histogram concept in dogstatsd.
+// the increments are published. Same goes with the historigrams of prometheus,
+// which are merged into a single histogram concept in dogstatsd, and with the
+// summaries, which are split into gauges for their quantiles and counters for
+// their count and sum of observations.
 //
 // In order to provide meaningful insights, the translation layer has to
 // remember the state of the previous iteration in order to compute values to
 // push to the dogstatsd agent.
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
@@ -46,9 +55,33 @@ type Dogstatsd struct {
 	// Size of the socket buffer used to push metrics to the dogstatsd agent.
 	BufferSize int
 
+	// Format is the format of the metrics pushed to the agent, either
+	// "dogstatsd", "statsd" for plain statsd metrics without tags, which are
+	// named after StatsdTemplate, "influx" for the statsd format of telegraf
+	// with tags in the names of metrics, or "graphite" for the plaintext
+	// protocol of graphite, with paths named after StatsdTemplate. Events and
+	// service checks are only sent in the dogstatsd format.
+	Format string
+
+	// StatsdTemplate is the template of the names of metrics in the statsd
+	// and graphite formats, where "{metric}" is replaced with the name of the
+	// metric and "{TAG}" with the value of its tag named TAG.
+	StatsdTemplate string
+
 	// Time interval between flushes of metrics to the dogstasd agent.
 	FlushInterval time.Duration
 
+	// FlushJitter spreads the flushes of instances sharing an agent, each
+	// flush is moved by a random duration of up to half the jitter before or
+	// after the flush interval.
+	FlushJitter time.Duration
+
+	// TopN is the number of most popular clients, names, and exchanges that
+	// are reported, counted over TopInterval. When TopInterval is zero the
+	// top counters are reported on every flush.
+	TopN        int
+	TopInterval time.Duration
+
 	// Reg is the prometheus registry used by the metrics plugin where all
 	// metrics are registered.
 	Reg *prometheus.Registry
@@ -59,21 +92,159 @@ type Dogstatsd struct {
 	EnableGoMetrics      bool
 	EnableProcessMetrics bool
 
+	// When enabled, histograms are reported as distributions instead of
+	// dogstatsd histograms, their percentiles are then aggregated globally
+	// by datadog instead of being averaged across coredns instances.
+	EnableDistributions bool
+
+	// When enabled, histograms of durations in seconds are reported as
+	// dogstatsd timers in milliseconds.
+	EnableTimers bool
+
+	// When enabled, datadog events are sent to the agent when the plugin
+	// starts, stops, or reloads, and when flushing metrics or watching docker
+	// containers keeps failing.
+	EnableEvents bool
+
+	// When enabled, the "coredns.up" service check is sent to the agent on
+	// every flush, its status is WARNING or CRITICAL when the percentage of
+	// queries which failed since the last flush reaches ServiceCheckWarning
+	// or ServiceCheckCritical.
+	EnableServiceCheck   bool
+	ServiceCheckWarning  float64
+	ServiceCheckCritical float64
+
+	// Clients configures how the clients of the top counters are identified,
+	// either "docker" to report the images of the docker containers sending
+	// the queries, "kubernetes" to report the namespaces and workloads of the
+	// pods sending the queries, "ecs" to report the services or task families
+	// of the ECS tasks sending the queries, "ip" to report their IP addresses, or "subnet"
+	// to report their /24 (IPv4) or /64 (IPv6) networks.
+	Clients string
+
+	// DockerRefresh is the time interval between listings of the docker
+	// containers, which catch up on events that may have been missed. The
+	// flush interval is used when zero.
+	DockerRefresh time.Duration
+
+	// KubernetesRefresh is the time interval between listings of the pods in
+	// kubernetes mode. The flush interval is used when zero.
+	KubernetesRefresh time.Duration
+
+	// ECSRefresh is the time interval between listings of the tasks in ecs
+	// mode. The flush interval is used when zero.
+	ECSRefresh time.Duration
+
+	// DockerLabels is the list of labels of docker containers that are added
+	// as tags to the clients and exchanges counters in docker mode.
+	DockerLabels []string
+
+	// DockerHost is the address of the docker daemon that containers are
+	// listed from in docker mode, either a unix socket or a tcp address. New
+	// initializes it from the DOCKER_HOST environment variable.
+	DockerHost string
+
+	// DockerTLSConfig is the TLS configuration of the connections to the
+	// docker daemon at a tcp address, TLS is not used when it is nil.
+	DockerTLSConfig *tls.Config
+
 	// ZoneNames is the list of zones that this plugin reports metrics for.
 	ZoneNames []string
 
+	// Include and Exclude are lists of glob patterns matched against the
+	// names of prometheus metric families. When Include is not empty, only
+	// the families matching one of its patterns are reported, and families
+	// matching one of the patterns of Exclude are never reported.
+	Include []string
+	Exclude []string
+
+	// StripTags maps glob patterns matched against the names of prometheus
+	// metric families to lists of labels removed from their metrics. Metrics
+	// left with the same labels are aggregated by summing their values.
+	StripTags map[string][]string
+
+	// Tags is a list of tags added to all metrics, formatted as "name:value".
+	// New initializes it from the unified service tagging environment
+	// variables of datadog.
+	Tags []string
+
+	// ContainerID is added to all metrics when it is not empty, so the agent
+	// adds the tags of the container that CoreDNS runs in when origin
+	// detection is enabled. New initializes it from the cgroups of the
+	// process.
+	ContainerID string
+
+	// Hostname is added to all metrics as a "host" tag when it is not empty,
+	// so metrics of instances pushing to a shared agent can be told apart.
+	Hostname string
+
+	// MetricNames and TagNames map the names of prometheus metrics and labels
+	// to the names of the dogstatsd metrics and tags they are reported as.
+	MetricNames map[string]string
+	TagNames    map[string]string
+
+	// Untyped is the type that untyped prometheus metrics are reported as,
+	// either "gauge", "counter", or "none" to not report them.
+	Untyped string
+
+	// BucketValue is the value that the observations of histogram buckets are
+	// reported as, either "random" for a random value between the bounds of
+	// the bucket, "midpoint", "upper" or "lower" for its middle, upper or
+	// lower bound.
+	BucketValue string
+
+	// MaxTagSets is the maximum number of unique tag sets of each metric that
+	// are reported by a flush, the metrics of the other tag sets are reported
+	// with all their tag values set to "other". There is no limit when zero.
+	MaxTagSets int
+
+	// Percentiles is the list of percentiles, between 0 and 100, of the
+	// observations of histograms since the last flush which are reported as
+	// gauges, estimated from the buckets of the histograms.
+	Percentiles []float64
+
 	once   sync.Once
 	wg     sync.WaitGroup
 	ctx    context.Context
 	cancel context.CancelFunc
 	zones  map[string]struct{}
+	tags   tags
+
+	statsdTemplate nameTemplate
+
+	// Connection to the agent when its address is a stream socket, which is
+	// kept open across flushes.
+	conn net.Conn
+
+	// Events and service check waiting to be written to the agent with the
+	// next flush.
+	pendingMutex sync.Mutex
+	events       []event
+	serviceCheck *serviceCheck
+	health       healthCounters
+
+	// Numbers of consecutive errors flushing metrics, which is only used by
+	// the goroutine writing to the agent, and watching docker containers,
+	// which is only used by the docker watcher.
+	flushFailures  int
+	dockerFailures int
+
+	// Set when the configuration is reloaded, so the plugin reports its stop
+	// as a reload.
+	reloading int32
 
-	dockerClient dockerClient
-	dockerCache  atomic.Value
+	dockerClient     dockerClient
+	dockerLookups    chan string
+	kubernetesClient kubernetesClient
+	ecsClient        ecsClient
+	clientCache      atomic.Value
 
 	clients   counterStore
 	names     counterStore
 	exchanges counterStore
+	qtypes    counterStore
+	failures  counterStore
+	topTime   time.Time
 
 	// Generates a random float64 value between min and max. It's made
 	// configurable so it can be mocked during tests.
@@ -84,6 +255,32 @@ const (
 	defaultAddr          = "udp://localhost:8125"
 	defaultBufferSize    = 1024
 	defaultFlushInterval = 1 * time.Minute
+	defaultTopN          = 10
+	defaultClients       = "docker"
+	defaultUntyped       = "gauge"
+	defaultBucketValue   = "random"
+
+	defaultServiceCheckWarning  = 1
+	defaultServiceCheckCritical = 5
+
+	defaultFormat         = "dogstatsd"
+	defaultStatsdTemplate = "{metric}"
+
+	// Delay before watching docker again after an error.
+	dockerRetryDelay = 5 * time.Second
+
+	// Minimum delay between listings of the docker containers looked up for
+	// addresses which are not in the cache.
+	dockerLookupInterval = 1 * time.Second
+
+	// Timeout of the connections and writes to agents at stream sockets.
+	streamTimeout = 10 * time.Second
+
+	// Number of flushes of metrics waiting to be written to the agent.
+	flushQueueSize = 4
+
+	// Maximum time that Stop waits for the last flush.
+	stopTimeout = 2 * time.Second
 )
 
 func init() {
@@ -96,50 +293,206 @@ func New() *Dogstatsd {
 		Addr:          defaultAddr,
 		BufferSize:    defaultBufferSize,
 		FlushInterval: defaultFlushInterval,
-
-		dockerClient: dockerClient{
-			host: os.Getenv("DOCKER_HOST"),
-		},
+		TopN:          defaultTopN,
+		Clients:       defaultClients,
+		Untyped:       defaultUntyped,
+		BucketValue:   defaultBucketValue,
+		Format:        defaultFormat,
+		Tags:          envTags(),
+		DockerHost:    os.Getenv("DOCKER_HOST"),
+		ContainerID:   envContainerID(),
+
+		ServiceCheckWarning:  defaultServiceCheckWarning,
+		ServiceCheckCritical: defaultServiceCheckCritical,
+		StatsdTemplate:       defaultStatsdTemplate,
+
+		kubernetesClient: makeKubernetesClient(),
+		ecsClient:        makeECSClient(),
 
 		clients:   makeCounterStore(),
 		names:     makeCounterStore(),
 		exchanges: makeCounterStore(),
+		qtypes:    makeCounterStore(),
+		failures:  makeCounterStore(),
 	}
 }
 
+// envTags returns the list of tags configured by the environment variables
+// that datadog clients use for unified service tagging. DD_TAGS is a list of
+// tags separated by commas or spaces.
+func envTags() []string {
+	list := strings.FieldsFunc(os.Getenv("DD_TAGS"), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+
+	for _, env := range []struct{ tag, name string }{
+		{"env", "DD_ENV"},
+		{"service", "DD_SERVICE"},
+		{"version", "DD_VERSION"},
+	} {
+		if value := os.Getenv(env.name); value != "" {
+			list = append(list, env.tag+":"+value)
+		}
+	}
+
+	return list
+}
+
 // Name returns the name of the plugin.
 func (d *Dogstatsd) Name() string { return "dogstatsd" }
 
 // ServeDNS satisfies the plugin.Handler interface.
 func (d *Dogstatsd) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
-	if cache, ok := d.dockerCache.Load().(map[string][]string); ok {
-		addr := w.RemoteAddr().String()
-		addr, _, _ = net.SplitHostPort(addr)
-		// If we have one or more client registered for the address we increment
-		// the corresponding counters.
-		for _, a := range cache[addr] {
-			d.clients.incr(a)
-			d.exchanges.incr(a + "/" + r.Question[0].Name)
+	name := r.Question[0].Name
+
+	switch d.Clients {
+	case "ip", "subnet":
+		addr := clientAddr(w.RemoteAddr(), d.Clients == "subnet")
+		d.clients.incr(addr)
+		d.exchanges.incr(addr + "/" + name)
+
+	default:
+		if cache, ok := d.clientCache.Load().(map[string][]string); ok {
+			addr := w.RemoteAddr().String()
+			addr, _, _ = net.SplitHostPort(addr)
+			clients := cache[addr]
+			if len(clients) == 0 && d.Clients == "docker" {
+				d.lookupDocker(addr)
+			}
+			// If we have one or more client registered for the address we
+			// increment the corresponding counters.
+			for _, a := range clients {
+				// The client may be followed by its tags, which are kept
+				// at the end of the exchange.
+				client, clientTags := a, ""
+				if i := strings.Index(a, clientTagsSeparator); i >= 0 {
+					client, clientTags = a[:i], a[i:]
+				}
+				d.clients.incr(a)
+				d.exchanges.incr(client + "/" + name + clientTags)
+			}
 		}
 	}
 
-	d.names.incr(r.Question[0].Name)
-	return plugin.NextOrFailure(d.Name(), d.Next, ctx, w, r)
+	d.names.incr(name)
+	d.qtypes.incr(dns.Type(r.Question[0].Qtype).String() + "/" + name)
+
+	rw := dnstest.NewRecorder(w)
+	rcode, err := plugin.NextOrFailure(d.Name(), d.Next, ctx, rw, r)
+
+	// When the handlers did not write the response the server writes one with
+	// the rcode they returned.
+	if !plugin.ClientWrite(rcode) {
+		rw.Rcode = rcode
+	}
+
+	switch rw.Rcode {
+	case dns.RcodeNameError, dns.RcodeServerFailure:
+		d.failures.incr(dns.RcodeToString[rw.Rcode] + "/" + name)
+	}
+
+	if d.EnableServiceCheck {
+		d.health.incr(rw.Rcode == dns.RcodeServerFailure || err != nil)
+	}
+
+	return rcode, err
+}
+
+// clientAddr returns the IP address of a client, or the /24 (IPv4) or /64 (IPv6)
+// network of the address when subnet is true.
+func clientAddr(addr net.Addr, subnet bool) string {
+	var ip net.IP
+
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, _ := net.SplitHostPort(addr.String())
+		ip = net.ParseIP(host)
+	}
+
+	switch {
+	case ip == nil:
+		return addr.String()
+	case !subnet:
+		return ip.String()
+	case ip.To4() != nil:
+		return ip.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	default:
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
 }
 
 // Start the dogstatsd plugin. The method returns immediatly after starting the
 // plugin's internal goroutine.
 func (d *Dogstatsd) Start() {
 	d.once.Do(d.init)
+	d.queueEvent(event{
+		title:     "CoreDNS started",
+		text:      fmt.Sprintf("CoreDNS started pushing metrics to the dogstatsd agent at %s.", d.Addr),
+		alertType: "info",
+	})
 	d.wg.Add(1)
 	go d.run(d.ctx)
+
+	if d.Clients == "docker" && d.DockerHost != "" {
+		d.wg.Add(1)
+		go d.watchDocker(d.ctx)
+	}
+
+	if d.Clients == "kubernetes" {
+		d.wg.Add(1)
+		go d.pollClients(d.ctx, d.KubernetesRefresh, d.refreshKubernetesCache)
+	}
+
+	if d.Clients == "ecs" {
+		d.wg.Add(1)
+		go d.pollClients(d.ctx, d.ECSRefresh, d.refreshECSCache)
+	}
 }
 
-// Stop interrupts the runing plugin.
+// Stop interrupts the runing plugin, after a last flush of the metrics which
+// is given up on after a short timeout.
 func (d *Dogstatsd) Stop() {
 	d.once.Do(d.init)
+
+	// The event is queued before the plugin is interrupted so it is written
+	// by the last flush.
+	if atomic.LoadInt32(&d.reloading) != 0 {
+		d.queueEvent(event{
+			title:     "CoreDNS reloaded",
+			text:      "CoreDNS is reloading its configuration.",
+			alertType: "info",
+		})
+	} else {
+		d.queueEvent(event{
+			title:     "CoreDNS stopped",
+			text:      fmt.Sprintf("CoreDNS stopped pushing metrics to the dogstatsd agent at %s.", d.Addr),
+			alertType: "warning",
+		})
+	}
+
 	d.cancel()
-	d.wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		log.Printf("[WARN] the last flush of metrics to the dogstatsd agent at %s did not complete within %s", d.Addr, stopTimeout)
+	}
+}
+
+// Reload marks the plugin as stopped by a reload of the configuration instead
+// of a shutdown of CoreDNS.
+func (d *Dogstatsd) Reload() {
+	atomic.StoreInt32(&d.reloading, 1)
 }
 
 func (d *Dogstatsd) init() {
@@ -149,40 +502,260 @@ func (d *Dogstatsd) init() {
 	for _, zone := range d.ZoneNames {
 		d.zones[zone] = struct{}{}
 	}
+
+	tags := d.Tags
+	if d.Hostname != "" {
+		tags = append(tags[:len(tags):len(tags)], "host:"+d.Hostname)
+	}
+	d.tags = makeGlobalTags(tags)
+
+	if d.Format == "statsd" || d.Format == "graphite" {
+		template, err := parseNameTemplate(d.StatsdTemplate)
+		if err != nil {
+			log.Printf("[WARN] %s, falling back to %s", err, defaultStatsdTemplate)
+			template, _ = parseNameTemplate(defaultStatsdTemplate)
+		}
+		d.statsdTemplate = template
+	}
+
+	d.dockerClient = dockerClient{
+		host:      d.DockerHost,
+		tlsConfig: d.DockerTLSConfig,
+	}
+	d.dockerLookups = make(chan string, 100)
 }
 
 func (d *Dogstatsd) run(ctx context.Context) {
 	defer d.wg.Done()
-	log.Printf("[INFO] dogstatsd %s { buffer %d; flush %s; go %t; process %t; zones %s }", d.Addr, d.BufferSize, d.FlushInterval, d.EnableGoMetrics, d.EnableProcessMetrics, d.ZoneNames)
+	log.Printf("[INFO] dogstatsd %s { buffer %d; format %s %s; flush %s %s; topn %d %s; clients %s; docker %s; docker_refresh %s; docker_labels %s; kubernetes_refresh %s; ecs_refresh %s; go %t; process %t; distributions %t; timers %t; events %t; service_check %t %g %g; untyped %s; bucket_value %s; percentiles %v; max_tag_sets %d; tags %s; hostname %q; container_id %q; zones %s }", d.Addr, d.BufferSize, d.Format, d.StatsdTemplate, d.FlushInterval, d.FlushJitter, d.TopN, d.TopInterval, d.Clients, d.DockerHost, d.DockerRefresh, d.DockerLabels, d.KubernetesRefresh, d.ECSRefresh, d.EnableGoMetrics, d.EnableProcessMetrics, d.EnableDistributions, d.EnableTimers, d.EnableEvents, d.EnableServiceCheck, d.ServiceCheckWarning, d.ServiceCheckCritical, d.Untyped, d.BucketValue, d.Percentiles, d.MaxTagSets, d.Tags, d.Hostname, d.ContainerID, d.ZoneNames)
 
-	ticker := time.NewTicker(d.FlushInterval)
-	defer ticker.Stop()
+	timer := time.NewTimer(d.flushDelay())
+	defer timer.Stop()
+
+	// The metrics are written by a separate goroutine so a slow agent does
+	// not delay the collection of metrics.
+	queue := make(chan []metric, flushQueueSize)
+	defer close(queue)
+	d.wg.Add(1)
+	go d.flush(queue)
 
+	// The prometheus metrics outlive the plugin when the configuration is
+	// reloaded, the first collection only sets the baseline of counters and
+	// histograms in the state, otherwise their whole values would be reported
+	// as increments.
 	state := make(state)
+	baseline := true
+	report := func() {
+		d.checkHealth()
+		metrics, err := d.collectMetrics(state)
+		if err != nil {
+			log.Printf("[ERROR] collecting metrics: %s", err)
+			return
+		}
+		if baseline {
+			metrics, baseline = gaugeMetrics(metrics), false
+		}
+		d.queueMetrics(queue, metrics)
+	}
+
 	for {
-		d.refreshDockerCache()
-		d.reportMetrics(state)
+		report()
 		select {
-		case <-ticker.C:
+		case <-timer.C:
+			timer.Reset(d.flushDelay())
 		case <-ctx.Done():
+			// The counters incremented since the last flush are reported by
+			// a last flush when the plugin stops, including the top counters
+			// even if their interval has not elapsed.
+			d.topTime = time.Time{}
+			report()
 			return
 		}
 	}
 }
 
-func (d *Dogstatsd) refreshDockerCache() {
-	containers, err := d.dockerClient.listContainers()
+// watchDocker keeps the cache of docker clients up to date until ctx is
+// canceled. The cache is updated by the events of the docker daemon as soon as
+// containers are started or stopped, and the containers are listed again every
+// DockerRefresh in case events were missed, or as soon as a query is received
+// from an address which is not in the cache.
+func (d *Dogstatsd) watchDocker(ctx context.Context) {
+	defer d.wg.Done()
+
+	for {
+		err := d.syncDocker(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[ERROR] failed to watch containers from docker at %s: %s", d.dockerClient.host, err)
+
+		if d.dockerFailures++; d.dockerFailures == errorEventThreshold {
+			d.queueEvent(event{
+				title:     "CoreDNS failed to watch docker containers",
+				text:      fmt.Sprintf("CoreDNS failed to watch containers from docker at %s %d times in a row: %s", d.dockerClient.host, d.dockerFailures, err),
+				alertType: "error",
+			})
+		}
 
-	if err != nil {
-		log.Printf("[ERROR] failed to list containers from docker at %s: %s", d.dockerClient.host, err)
-		return
+		select {
+		case <-time.After(dockerRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncDocker lists the containers and applies the events of the docker daemon
+// to the docker cache, until an error occurs or ctx is canceled.
+func (d *Dogstatsd) syncDocker(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The events are subscribed to before listing the containers so changes
+	// made while the list is loaded are not missed.
+	events := make(chan dockerEvent, 100)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.dockerClient.events(ctx, func(e dockerEvent) {
+			select {
+			case events <- e:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	refresh := d.DockerRefresh
+	if refresh == 0 {
+		refresh = d.FlushInterval
+	}
+
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+
+	var containers map[string]dockerContainer
+	var listTime time.Time
+
+	// Addresses which were looked up and not found since the last refresh,
+	// so clients which are not containers don't cause a listing every time
+	// they send a query.
+	missed := map[string]struct{}{}
+
+	list := func() error {
+		list, err := d.dockerClient.listContainers()
+		if err != nil {
+			return err
+		}
+		listTime = time.Now()
+		d.dockerFailures = 0
+		containers = make(map[string]dockerContainer, len(list))
+		for _, container := range list {
+			containers[container.ID] = container
+		}
+		d.storeDockerCache(containers)
+		return nil
+	}
+
+	if err := list(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case e := <-events:
+			id := e.containerID()
+
+			switch e.Action {
+			case "die", "destroy":
+				delete(containers, id)
+
+			default: // start, connect, disconnect
+				container, found, err := d.dockerClient.inspectContainer(id)
+				if err != nil {
+					return err
+				}
+				if found {
+					containers[id] = container
+				} else {
+					delete(containers, id)
+				}
+			}
+
+			d.storeDockerCache(containers)
+
+		case <-ticker.C:
+			if err := list(); err != nil {
+				return err
+			}
+			missed = map[string]struct{}{}
+
+		case addr := <-d.dockerLookups:
+			// Lookups received before the interval has elapsed are dropped,
+			// the address is looked up again on its next query.
+			if _, ok := missed[addr]; ok || d.dockerCached(addr) || time.Since(listTime) < dockerLookupInterval {
+				break
+			}
+			if err := list(); err != nil {
+				return err
+			}
+			if !d.dockerCached(addr) {
+				missed[addr] = struct{}{}
+			}
+
+		case err := <-errc:
+			return err
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// lookupDocker asks the docker watcher to look up the container of addr, which
+// is not in the cache. The lookup is dropped if the watcher is busy so queries
+// are never blocked.
+func (d *Dogstatsd) lookupDocker(addr string) {
+	select {
+	case d.dockerLookups <- addr:
+	default:
+	}
+}
+
+// dockerCached returns true if addr has clients in the docker cache.
+func (d *Dogstatsd) dockerCached(addr string) bool {
+	cache, _ := d.clientCache.Load().(map[string][]string)
+	return len(cache[addr]) != 0
+}
+
+// dockerLabelTags returns the tags made of the DockerLabels of a container,
+// prefixed with clientTagsSeparator, or an empty string if the container has
+// none of the labels.
+func (d *Dogstatsd) dockerLabelTags(labels map[string]string) string {
+	var b []byte
+
+	for _, label := range d.DockerLabels {
+		value, ok := labels[label]
+		if !ok {
+			continue
+		}
+		if len(b) == 0 {
+			b = append(b, clientTagsSeparator...)
+		} else {
+			b = append(b, ',')
+		}
+		b = appendTagName(b, label)
+		b = append(b, ':')
+		b = appendTagValue(b, value)
 	}
 
+	return string(b)
+}
+
+func (d *Dogstatsd) storeDockerCache(containers map[string]dockerContainer) {
 	cache := map[string][]string{}
 
 	for _, container := range containers {
 		for _, network := range container.NetworkSettings.Networks {
-			imageName := container.Image.name()
+			imageName := container.Image.name() + d.dockerLabelTags(container.Labels)
 			ipAddress := network.IPAddress
 			if len(ipAddress) == 0 {
 				ipAddress = network.IPAMConfig.IPv4Address
@@ -196,10 +769,136 @@ func (d *Dogstatsd) refreshDockerCache() {
 		}
 	}
 
-	d.dockerCache.Store(cache)
+	d.clientCache.Store(cache)
+}
+
+// pollClients calls refresh to list the clients every interval, or every flush
+// interval when it is zero, until ctx is canceled. The clients are listed apart
+// from the flushes so slow APIs do not delay the metrics.
+func (d *Dogstatsd) pollClients(ctx context.Context, interval time.Duration, refresh func()) {
+	defer d.wg.Done()
+
+	if interval == 0 {
+		interval = d.FlushInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		refresh()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *Dogstatsd) refreshKubernetesCache() {
+	pods, err := d.kubernetesClient.listPods()
+
+	if err != nil {
+		log.Printf("[ERROR] failed to list pods from kubernetes at %s: %s", d.kubernetesClient.host, err)
+		return
+	}
+
+	cache := map[string][]string{}
+
+	for _, pod := range pods {
+		// Pods on the host network share the address of their node, queries
+		// sent from those addresses cannot be attributed to a single pod.
+		if pod.Spec.HostNetwork {
+			continue
+		}
+		podName := pod.name()
+		for _, ipAddress := range pod.ips() {
+			cache[ipAddress] = append(cache[ipAddress], podName)
+		}
+	}
+
+	d.clientCache.Store(cache)
 }
 
+func (d *Dogstatsd) refreshECSCache() {
+	tasks, err := d.ecsClient.listTasks()
+
+	if err != nil {
+		log.Printf("[ERROR] failed to list tasks from ECS: %s", err)
+		return
+	}
+
+	cache := map[string][]string{}
+
+	for _, task := range tasks {
+		taskName := task.name()
+		for _, ipAddress := range task.ips() {
+			cache[ipAddress] = append(cache[ipAddress], taskName)
+		}
+	}
+
+	d.clientCache.Store(cache)
+}
+
+// flushDelay returns the time until the next flush.
+func (d *Dogstatsd) flushDelay() time.Duration {
+	if d.FlushJitter == 0 {
+		return d.FlushInterval
+	}
+
+	random := d.randFloat64
+	if random == nil {
+		random = randFloat64
+	}
+
+	return d.FlushInterval + time.Duration(random(-0.5, 0.5)*float64(d.FlushJitter))
+}
+
+// flush writes the metrics received from queue to the agent until queue is
+// closed.
+func (d *Dogstatsd) flush(queue <-chan []metric) {
+	defer d.wg.Done()
+	defer d.closeStream()
+
+	for metrics := range queue {
+		if err := d.flushMetrics(metrics); err != nil {
+			log.Printf("[ERROR] flushing metrics to the dogstatsd agent at %s: %s", d.Addr, err)
+		}
+	}
+}
+
+// queueMetrics queues metrics to be written to the agent, the metrics are
+// dropped if the queue is full because the agent is slower to write to than
+// the flush interval.
+func (d *Dogstatsd) queueMetrics(queue chan<- []metric, metrics []metric) bool {
+	select {
+	case queue <- metrics:
+		return true
+	default:
+		log.Printf("[WARN] dropping %d metrics, the flushes to the dogstatsd agent at %s are too slow", len(metrics), d.Addr)
+		agentMetrics{addr: d.Addr}.droppedFlushesInc()
+		return false
+	}
+}
+
+// gaugeMetrics returns the gauges of metrics, which are reported as they are
+// instead of as increments. The gauges of percentiles are not included, they
+// are estimated from all the observations of histograms before the baseline.
+func gaugeMetrics(metrics []metric) []metric {
+	gauges := metrics[:0]
+	for _, m := range metrics {
+		if m.kind == gauge && !m.percentile {
+			gauges = append(gauges, m)
+		}
+	}
+	return gauges
+}
+
+// reportMetrics collects the metrics and writes them to the agent without going
+// through the queue of flushes.
 func (d *Dogstatsd) reportMetrics(state state) {
+	d.checkHealth()
 	metrics, err := d.collectMetrics(state)
 
 	if err != nil {
@@ -219,9 +918,29 @@ func (d *Dogstatsd) collectMetrics(state state) ([]metric, error) {
 	}
 
 	metrics := make([]metric, 0, 2*len(metricFamilies))
-	rand := d.randFloat64
-	if rand == nil {
-		rand = randFloat64
+	t := translation{
+		histograms:  histogram,
+		timers:      d.EnableTimers,
+		metricNames: d.MetricNames,
+		tagNames:    d.TagNames,
+	}
+
+	random := d.randFloat64
+	if random == nil {
+		random = randFloat64
+	}
+
+	if d.EnableDistributions {
+		t.histograms = distribution
+	}
+
+	var ok bool
+	if t.untyped, ok = untypedKind(d.Untyped); !ok {
+		return nil, fmt.Errorf("unsupported type for untyped metrics: %q", d.Untyped)
+	}
+
+	if t.bucketValue, ok = bucketValueFunc(d.BucketValue, random); !ok {
+		return nil, fmt.Errorf("unsupported value for histogram buckets: %q", d.BucketValue)
 	}
 
 	for _, f := range metricFamilies {
@@ -233,12 +952,36 @@ func (d *Dogstatsd) collectMetrics(state state) ([]metric, error) {
 			continue
 		}
 
-		for _, m := range f.Metric {
+		if !d.matchName(*f.Name) {
+			continue
+		}
+
+		familyMetrics := f.Metric
+
+		if labels := d.strippedLabels(*f.Name); len(labels) != 0 {
+			// Zones are matched before aggregating the metrics, the zone
+			// label may be one of the stripped labels.
+			familyMetrics = make([]*dto.Metric, 0, len(f.Metric))
+			for _, m := range f.Metric {
+				if d.matchZones(m) {
+					familyMetrics = append(familyMetrics, m)
+				}
+			}
+			familyMetrics = stripLabels(*f.Type, familyMetrics, labels)
+		}
+
+		for _, m := range familyMetrics {
 			if !d.matchZones(m) {
 				continue
 			}
 
-			for _, v := range makeMetrics(f, m, rand) {
+			translated := makeMetrics(f, m, t)
+
+			if len(d.Percentiles) != 0 && *f.Type == dto.MetricType_HISTOGRAM {
+				metrics = append(metrics, state.percentileMetrics(m.Histogram, translated, d.Percentiles)...)
+			}
+
+			for _, v := range translated {
 				if v, ok := state.observe(v); ok {
 					metrics = append(metrics, v)
 				}
@@ -246,21 +989,68 @@ func (d *Dogstatsd) collectMetrics(state state) ([]metric, error) {
 		}
 	}
 
-	for _, c := range d.clients.top(10) {
-		metrics = append(metrics, c.metric("coredns.dns.clients.top10", "client"))
-	}
+	if d.topDue(time.Now()) {
+		n := d.TopN
+		suffix := ".top" + strconv.Itoa(n)
+
+		for _, c := range d.clients.top(n) {
+			metrics = append(metrics, c.metric("coredns.dns.clients"+suffix, "client"))
+		}
+
+		for _, c := range d.names.top(n) {
+			metrics = append(metrics, c.metric("coredns.dns.names"+suffix, "name"))
+		}
+
+		for _, c := range d.exchanges.top(n) {
+			metrics = append(metrics, c.metric("coredns.dns.exchanges"+suffix, "exchange"))
+		}
+
+		for _, c := range d.qtypes.topGroups(n) {
+			metrics = append(metrics, c.groupMetric("coredns.dns.names.qtype"+suffix, "qtype", "name"))
+		}
 
-	for _, c := range d.names.top(10) {
-		metrics = append(metrics, c.metric("coredns.dns.names.top10", "name"))
+		for _, c := range d.failures.topGroups(n) {
+			metrics = append(metrics, c.groupMetric("coredns.dns.names.rcode"+suffix, "rcode", "name"))
+		}
 	}
 
-	for _, c := range d.exchanges.top(10) {
-		metrics = append(metrics, c.metric("coredns.dns.exchanges.top10", "exchange"))
+	if d.MaxTagSets != 0 {
+		metrics = limitTagSets(metrics, d.MaxTagSets, agentMetrics{addr: d.Addr}.droppedTagSetsAdd)
 	}
 
 	return metrics, nil
 }
 
+// topDue returns true if the top counters must be reported by the flush at now,
+// which happens on every flush unless TopInterval is set.
+func (d *Dogstatsd) topDue(now time.Time) bool {
+	// Flushes are triggered by a ticker which may fire a bit early, half a
+	// flush interval of tolerance avoids delaying the report by a whole flush.
+	if now.Add(d.FlushInterval / 2).Before(d.topTime.Add(d.TopInterval)) {
+		return false
+	}
+	d.topTime = now
+	return true
+}
+
+func (d *Dogstatsd) matchName(name string) bool {
+	if len(d.Include) != 0 && !matchAny(d.Include, name) {
+		return false
+	}
+	return !matchAny(d.Exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		// Patterns are validated when the configuration is parsed, errors
+		// are ignored here.
+		if match, _ := path.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Dogstatsd) matchZones(m *dto.Metric) bool {
 	hasZone := false
 
@@ -280,7 +1070,54 @@ func (d *Dogstatsd) matchZones(m *dto.Metric) bool {
 	return !hasZone // no zones on the metric? OK
 }
 
+// flushMetrics writes the pending events, service check, and metrics to the
+// agent. The events are queued again when the flush fails, so they may be sent
+// twice if it only failed after they were written, the service check is not
+// since the next flush has a newer one.
 func (d *Dogstatsd) flushMetrics(metrics []metric) error {
+	agent := agentMetrics{addr: d.Addr}
+	agent.flushesInc()
+	start := time.Now()
+	events := d.takeEvents()
+	checks := d.takeServiceChecks()
+
+	if d.Format != "dogstatsd" {
+		events, checks = nil, nil
+	}
+
+	var err error
+	if isStream(d.Addr) {
+		err = d.flushStream(events, checks, metrics)
+	} else {
+		err = d.flushDatagrams(events, checks, metrics)
+	}
+
+	agent.flushDurationsObserve(time.Since(start))
+	if err != nil {
+		agent.flushErrorsInc()
+		d.requeueEvents(events)
+
+		if d.flushFailures++; d.flushFailures == errorEventThreshold {
+			d.queueEvent(event{
+				title:     "CoreDNS failed to flush metrics",
+				text:      fmt.Sprintf("CoreDNS failed to flush metrics to the dogstatsd agent at %s %d times in a row: %s", d.Addr, d.flushFailures, err),
+				alertType: "error",
+			})
+		}
+	} else {
+		d.flushFailures = 0
+	}
+	return err
+}
+
+// flushDatagrams writes events, service checks, and metrics to an agent at a
+// datagram socket, in datagrams of up to the buffer size. The tag values of
+// metrics which exceed the buffer size are truncated, or the metrics are
+// dropped if they still don't fit. Events and service checks which exceed the
+// buffer size are dropped.
+func (d *Dogstatsd) flushDatagrams(events []event, checks []serviceCheck, metrics []metric) error {
+	agent := agentMetrics{addr: d.Addr}
+
 	conn, bufferSize, err := dial(d.Addr, d.BufferSize)
 	if err != nil {
 		return err
@@ -289,39 +1126,202 @@ func (d *Dogstatsd) flushMetrics(metrics []metric) error {
 
 	out := make([]byte, 0, bufferSize)
 	buf := make([]byte, 0, bufferSize)
+	now := time.Now()
 
-	for _, m := range metrics {
-		buf = appendMetric(buf[:0], m)
+	write := func(buf []byte) error {
+		if (len(out) + len(buf)) > bufferSize {
+			n, err := conn.Write(out)
+			agent.writtenBytesAdd(n)
+			if err != nil {
+				return err
+			}
+			out = out[:0]
+		}
+		out = append(out, buf...)
+		return nil
+	}
+
+	for _, e := range events {
+		buf = appendEvent(buf[:0], e, d.Hostname, d.tags)
 
 		if len(buf) > bufferSize {
-			log.Printf("[WARN] dogstatsd metric of size %d B exceeds the configured buffer size of %d B", len(buf), bufferSize)
+			log.Printf("[WARN] dogstatsd event of size %d B exceeds the configured buffer size of %d B", len(buf), bufferSize)
 			continue
 		}
 
-		if (len(out) + len(buf)) > bufferSize {
-			if _, err := conn.Write(out); err != nil {
+		if err := write(buf); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range checks {
+		buf = appendServiceCheck(buf[:0], c, d.Hostname, d.tags)
+
+		if len(buf) > bufferSize {
+			log.Printf("[WARN] dogstatsd service check of size %d B exceeds the configured buffer size of %d B", len(buf), bufferSize)
+			continue
+		}
+
+		if err := write(buf); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range metrics {
+		buf = d.appendMetric(buf[:0], m, now)
+
+		if len(buf) > bufferSize {
+			// The tags are only truncated to fit the size of metrics in the
+			// dogstatsd format.
+			t, ok := truncateTags(m, d.tags, d.ContainerID, bufferSize)
+			if !ok || d.Format != "dogstatsd" {
+				log.Printf("[WARN] dogstatsd metric of size %d B exceeds the configured buffer size of %d B", len(buf), bufferSize)
+				agent.droppedMetricsInc()
+				continue
+			}
+			// The series of the truncated metric may be merged with others
+			// which only differ after the truncated length.
+			log.Printf("[WARN] dogstatsd metric of size %d B exceeds the configured buffer size of %d B, its tag values were truncated", len(buf), bufferSize)
+			agent.truncatedMetricsInc()
+			buf = d.appendMetric(buf[:0], t, now)
+		}
+
+		if err := write(buf); err != nil {
+			return err
+		}
+	}
+
+	if len(out) != 0 {
+		var n int
+		n, err = conn.Write(out)
+		agent.writtenBytesAdd(n)
+	}
+	return err
+}
+
+// flushStream writes events, service checks, and metrics to the connection to
+// an agent at a stream socket. They are framed by the newline they end with, so
+// they are never dropped for exceeding the buffer size, which only sets the
+// size of the writes.
+func (d *Dogstatsd) flushStream(events []event, checks []serviceCheck, metrics []metric) error {
+	out := make([]byte, 0, d.BufferSize)
+	now := time.Now()
+
+	write := func() error {
+		if len(out) >= d.BufferSize {
+			if err := d.writeStream(out); err != nil {
 				return err
 			}
 			out = out[:0]
 		}
+		return nil
+	}
 
-		out = append(out, buf...)
+	for _, e := range events {
+		out = appendEvent(out, e, d.Hostname, d.tags)
+
+		if err := write(); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range checks {
+		out = appendServiceCheck(out, c, d.Hostname, d.tags)
+
+		if err := write(); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range metrics {
+		out = d.appendMetric(out, m, now)
+
+		if err := write(); err != nil {
+			return err
+		}
 	}
 
 	if len(out) != 0 {
-		_, err = conn.Write(out)
+		return d.writeStream(out)
 	}
-	return err
+	return nil
+}
+
+// appendMetric appends m to b in the format of the agent, now is the time of
+// the flush.
+func (d *Dogstatsd) appendMetric(b []byte, m metric, now time.Time) []byte {
+	switch d.Format {
+	case "statsd":
+		return appendStatsdMetric(b, m, d.tags, d.statsdTemplate)
+	case "graphite":
+		return appendGraphiteMetric(b, m, d.tags, d.statsdTemplate, now)
+	case "influx":
+		return appendInfluxMetric(b, m, d.tags)
+	default:
+		return appendMetric(b, m, d.tags, d.ContainerID)
+	}
+}
+
+// writeStream writes b to the connection to the agent, which is opened if it
+// was not. The agent may have closed a connection which was already open since
+// the last flush, so the metrics which were not entirely written are written
+// again once on a new connection when the write fails.
+func (d *Dogstatsd) writeStream(b []byte) error {
+	for retry := d.conn != nil; ; retry = false {
+		if d.conn == nil {
+			network, address := splitAddr(d.Addr)
+			conn, err := net.DialTimeout(network, address, streamTimeout)
+			if err != nil {
+				return err
+			}
+			d.conn = conn
+		}
+
+		d.conn.SetWriteDeadline(time.Now().Add(streamTimeout))
+		n, err := d.conn.Write(b)
+		agentMetrics{addr: d.Addr}.writtenBytesAdd(n)
+		if err == nil {
+			return nil
+		}
+		d.closeStream()
+
+		if !retry {
+			return err
+		}
+		b = b[bytes.LastIndexByte(b[:n], '\n')+1:]
+	}
+}
+
+func (d *Dogstatsd) closeStream() {
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+}
+
+// isStream returns true if the address of the agent is a stream socket.
+func isStream(address string) bool {
+	switch network, _ := splitAddr(address); network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return true
+	}
+	return false
+}
+
+// splitAddr splits the network from the address of the agent, which defaults
+// to udp.
+func splitAddr(address string) (network, addr string) {
+	if i := strings.Index(address, "://"); i >= 0 {
+		return address[:i], address[i+3:]
+	}
+	return "udp", address
 }
 
 // taken from https://github.com/segmentio/stats/datadog
 func dial(address string, bufferSizeHint int) (conn net.Conn, bufferSize int, err error) {
-	var network = "udp"
 	var f *os.File
 
-	if i := strings.Index(address, "://"); i >= 0 {
-		network, address = address[:i], address[i+3:]
-	}
+	network, address := splitAddr(address)
 
 	if conn, err = net.Dial(network, address); err != nil {
 		return
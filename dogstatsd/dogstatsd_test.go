@@ -1,15 +1,24 @@
 package dogstatsd
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/coredns/coredns/plugin"
+	corednstest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -197,6 +206,958 @@ func testDogstatsdMerge(t *testing.T, plugin *Dogstatsd, server server, state st
 	)
 }
 
+func TestDogstatsdSummary(t *testing.T) {
+	server, plugin, state := setupTest()
+	defer server.Close()
+
+	summary1 := prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace:  "coredns",
+		Subsystem:  "segment",
+		Name:       "summary1",
+		Help:       "Test summary 1.",
+		Objectives: map[float64]float64{0.5: 0.05, 0.99: 0.001},
+	})
+	plugin.Reg.MustRegister(summary1, gauge1)
+	gauge1.Set(10)
+
+	// Summaries without observations only report their count and sum, which
+	// are zero and therefore not reported either.
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.segment.gauge1:10|g|#a:hello-1,b:hello-2,c:hello-3",
+	)
+
+	summary1.Observe(42)
+	summary1.Observe(42)
+
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.segment.summary1:42|g|#quantile:0.5",
+		"coredns.segment.summary1:42|g|#quantile:0.99",
+		"coredns.segment.summary1.count:2|c",
+		"coredns.segment.summary1.sum:84|c",
+		"coredns.segment.gauge1:10|g|#a:hello-1,b:hello-2,c:hello-3",
+	)
+
+	// The quantiles are not repeated until the summary observes new values.
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.segment.gauge1:10|g|#a:hello-1,b:hello-2,c:hello-3",
+	)
+
+	summary1.Observe(42)
+
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.segment.summary1:42|g|#quantile:0.5",
+		"coredns.segment.summary1:42|g|#quantile:0.99",
+		"coredns.segment.summary1.count:1|c",
+		"coredns.segment.summary1.sum:42|c",
+		"coredns.segment.gauge1:10|g|#a:hello-1,b:hello-2,c:hello-3",
+	)
+}
+
+func TestDogstatsdUntyped(t *testing.T) {
+	tests := []struct {
+		untyped string
+		packets []string
+	}{
+		{
+			untyped: "gauge",
+			packets: []string{
+				"coredns.segment.untyped1:42|g",
+				"coredns.segment.untyped1:42|g",
+			},
+		},
+		{
+			untyped: "counter",
+			packets: []string{
+				"coredns.segment.untyped1:42|c",
+			},
+		},
+		{
+			untyped: "none",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.untyped, func(t *testing.T) {
+			server, plugin, state := setupTest()
+			defer server.Close()
+
+			untyped1 := prometheus.NewUntypedFunc(prometheus.UntypedOpts{
+				Namespace: "coredns",
+				Subsystem: "segment",
+				Name:      "untyped1",
+				Help:      "Test untyped 1.",
+			}, func() float64 { return 42 })
+			plugin.Reg.MustRegister(untyped1, gauge1)
+			plugin.Untyped = test.untyped
+			gauge1.Set(10)
+
+			plugin.reportMetrics(state)
+			plugin.reportMetrics(state)
+			assertRead(t, server, append(test.packets,
+				"coredns.segment.gauge1:10|g|#a:hello-1,b:hello-2,c:hello-3",
+				"coredns.segment.gauge1:10|g|#a:hello-1,b:hello-2,c:hello-3",
+			)...)
+		})
+	}
+}
+
+func TestDogstatsdDistributions(t *testing.T) {
+	server, plugin, state := setupTest()
+	defer server.Close()
+
+	histogram2 := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "coredns",
+		Subsystem: "segment",
+		Name:      "histogram2",
+		Help:      "Test histogram 2.",
+		Buckets:   []float64{10, 20},
+	})
+	plugin.Reg.MustRegister(histogram2)
+	plugin.EnableDistributions = true
+
+	histogram2.Observe(5)
+	histogram2.Observe(15)
+	histogram2.Observe(15)
+
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.segment.histogram2:0|d",
+		"coredns.segment.histogram2:10|d|@0.5",
+	)
+}
+
+func TestDogstatsdTimers(t *testing.T) {
+	server, plugin, state := setupTest()
+	defer server.Close()
+
+	histogram3 := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "coredns",
+		Subsystem: "segment",
+		Name:      "request_duration_seconds",
+		Help:      "Test duration histogram.",
+		Buckets:   []float64{0.25, 0.5},
+	})
+	histogram4 := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "coredns",
+		Subsystem: "segment",
+		Name:      "response_size_bytes",
+		Help:      "Test size histogram.",
+		Buckets:   []float64{512},
+	})
+	plugin.Reg.MustRegister(histogram3, histogram4)
+	plugin.EnableTimers = true
+
+	histogram3.Observe(0.1)
+	histogram3.Observe(0.3)
+	histogram3.Observe(0.3)
+	histogram4.Observe(100)
+
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.segment.request.duration:0|ms",
+		"coredns.segment.request.duration:250|ms|@0.5",
+		"coredns.segment.response.size.bytes:0|h",
+	)
+}
+
+func TestEnvTags(t *testing.T) {
+	for name, value := range map[string]string{
+		"DD_TAGS":    "team:dns, region:us-west-2 canary",
+		"DD_ENV":     "prod",
+		"DD_SERVICE": "coredns",
+		"DD_VERSION": "",
+	} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	list := envTags()
+	expected := []string{"team:dns", "region:us-west-2", "canary", "env:prod", "service:coredns"}
+
+	if !reflect.DeepEqual(list, expected) {
+		t.Errorf("Unexpected tags from the environment:\n%q\n%q", expected, list)
+	}
+}
+
+func TestDogstatsdHostname(t *testing.T) {
+	server := dogstatsdServer()
+	defer server.Close()
+
+	plugin := dogstastdPlugin(server.addr())
+	plugin.Reg.MustRegister(gauge1)
+	plugin.Tags = []string{"env:prod"}
+	plugin.Hostname = "coredns-1"
+	plugin.once.Do(plugin.init)
+	gauge1.Set(10)
+
+	plugin.reportMetrics(make(state))
+	assertRead(t, server,
+		"coredns.segment.gauge1:10|g|#a:hello-1,b:hello-2,c:hello-3,env:prod,host:coredns-1",
+	)
+}
+
+func TestDogstatsdStatsd(t *testing.T) {
+	server := dogstatsdServer()
+	defer server.Close()
+
+	plugin := dogstastdPlugin(server.addr())
+	plugin.Reg.MustRegister(gauge1)
+	plugin.Format = "statsd"
+	plugin.StatsdTemplate = "{metric}.{a}.{c}"
+	plugin.EnableEvents = true
+	plugin.once.Do(plugin.init)
+	gauge1.Set(10)
+
+	// The events are not written in the statsd format.
+	plugin.queueEvent(event{title: "CoreDNS started"})
+	plugin.reportMetrics(make(state))
+	assertRead(t, server, "coredns.segment.gauge1.hello-1.hello-3:10|g")
+}
+
+func TestDogstatsdInflux(t *testing.T) {
+	server := dogstatsdServer()
+	defer server.Close()
+
+	plugin := dogstastdPlugin(server.addr())
+	plugin.Reg.MustRegister(gauge1)
+	plugin.Format = "influx"
+	plugin.Tags = []string{"env:prod"}
+	plugin.once.Do(plugin.init)
+	gauge1.Set(10)
+
+	plugin.reportMetrics(make(state))
+	assertRead(t, server, "coredns.segment.gauge1,a=hello-1,b=hello-2,c=hello-3,env=prod:10|g")
+}
+
+func TestDogstatsdMappings(t *testing.T) {
+	server, plugin, state := setupTest()
+	defer server.Close()
+
+	histogram5 := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "coredns",
+		Subsystem: "segment",
+		Name:      "lookup_duration_seconds",
+		Help:      "Test mapped histogram.",
+		Buckets:   []float64{0.5},
+	}, []string{"server"})
+	plugin.Reg.MustRegister(histogram5, gauge1)
+	plugin.EnableTimers = true
+	plugin.MetricNames = map[string]string{"coredns_segment_lookup_duration_seconds": "coredns.lookup.latency"}
+	plugin.TagNames = map[string]string{"server": "srv", "A": "first"}
+	gauge1.Set(10)
+
+	histogram5.WithLabelValues("dns://:53").Observe(0.1)
+
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.lookup.latency:0|ms|#srv:dns://:53",
+		"coredns.segment.gauge1:10|g|#first:hello-1,b:hello-2,c:hello-3",
+	)
+}
+
+func TestDogstatsdFilters(t *testing.T) {
+	tests := []struct {
+		include []string
+		exclude []string
+		packets []string
+	}{
+		{
+			packets: []string{
+				"coredns.segment.gauge1:10|g|#a:hello-1,b:hello-2,c:hello-3",
+				"coredns.segment.gauge2:20|g",
+			},
+		},
+		{
+			include: []string{"coredns_segment_gauge1"},
+			packets: []string{
+				"coredns.segment.gauge1:10|g|#a:hello-1,b:hello-2,c:hello-3",
+			},
+		},
+		{
+			exclude: []string{"*_gauge1"},
+			packets: []string{
+				"coredns.segment.gauge2:20|g",
+			},
+		},
+		{
+			include: []string{"coredns_segment_*"},
+			exclude: []string{"*_gauge2"},
+			packets: []string{
+				"coredns.segment.gauge1:10|g|#a:hello-1,b:hello-2,c:hello-3",
+			},
+		},
+	}
+
+	gauge2 := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "coredns",
+		Subsystem: "segment",
+		Name:      "gauge2",
+		Help:      "Test gauge 2.",
+	})
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			server, plugin, state := setupTest()
+			defer server.Close()
+
+			plugin.Reg.MustRegister(gauge1, gauge2)
+			plugin.Include = test.include
+			plugin.Exclude = test.exclude
+			gauge1.Set(10)
+			gauge2.Set(20)
+
+			// Gauges are reported on every flush, the second flush must
+			// report the same metrics as the first.
+			plugin.reportMetrics(state)
+			plugin.reportMetrics(state)
+			assertRead(t, server, append(test.packets, test.packets...)...)
+		})
+	}
+}
+
+func TestDogstatsdStripTags(t *testing.T) {
+	server, plugin, state := setupTest()
+	defer server.Close()
+
+	counter3 := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "coredns",
+		Subsystem: "segment",
+		Name:      "counter3",
+		Help:      "Test counter 3.",
+	}, []string{"dc", "name"})
+	plugin.Reg.MustRegister(counter3)
+	plugin.StripTags = map[string][]string{"coredns_segment_*": {"name"}}
+
+	counter3.WithLabelValues("dc1", "service-1").Add(1)
+	counter3.WithLabelValues("dc1", "service-2").Add(2)
+	counter3.WithLabelValues("dc2", "service-1").Add(3)
+
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.segment.counter3:3|c|#dc:dc1",
+		"coredns.segment.counter3:3|c|#dc:dc2",
+	)
+
+	counter3.WithLabelValues("dc1", "service-3").Add(1)
+
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.segment.counter3:1|c|#dc:dc1",
+	)
+}
+
+func TestDogstatsdMaxTagSets(t *testing.T) {
+	server, plugin, state := setupTest()
+	defer server.Close()
+
+	counter4 := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "coredns",
+		Subsystem: "segment",
+		Name:      "counter4",
+		Help:      "Test counter 4.",
+	}, []string{"name"})
+	plugin.Reg.MustRegister(counter4)
+	plugin.MaxTagSets = 2
+
+	counter4.WithLabelValues("service-1").Add(1)
+	counter4.WithLabelValues("service-2").Add(2)
+	counter4.WithLabelValues("service-3").Add(3)
+	counter4.WithLabelValues("service-4").Add(4)
+
+	dropped := metricValue(droppedTagSets.WithLabelValues(plugin.Addr, "coredns_segment_counter4"))
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.segment.counter4:1|c|#name:service-1",
+		"coredns.segment.counter4:2|c|#name:service-2",
+		"coredns.segment.counter4:7|c|#name:other",
+	)
+
+	if n := metricValue(droppedTagSets.WithLabelValues(plugin.Addr, "coredns_segment_counter4")); n != dropped+2 {
+		t.Errorf("Expected %g dropped tag sets but found: %g", dropped+2, n)
+	}
+}
+
+func TestDogstatsdTopN(t *testing.T) {
+	server, plugin, state := setupTest()
+	defer server.Close()
+
+	plugin.TopN = 2
+	plugin.TopInterval = 5 * time.Minute
+	plugin.FlushInterval = 1 * time.Minute
+
+	incr := func() {
+		for i := 0; i != 3; i++ {
+			plugin.names.incr("www.segment.com.")
+		}
+		plugin.names.incr("www.github.com.")
+		plugin.names.incr("www.google.com.")
+		plugin.names.incr("www.google.com.")
+	}
+
+	incr()
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.dns.names.top2:3|c|#name:www.segment.com.",
+		"coredns.dns.names.top2:2|c|#name:www.google.com.",
+	)
+
+	// The counters keep accumulating until the interval elapsed, which is
+	// reached within half a flush interval.
+	incr()
+	plugin.reportMetrics(state)
+	plugin.topTime = plugin.topTime.Add(-4*time.Minute - 31*time.Second)
+	incr()
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.dns.names.top2:6|c|#name:www.segment.com.",
+		"coredns.dns.names.top2:4|c|#name:www.google.com.",
+	)
+}
+
+func TestDogstatsdFailures(t *testing.T) {
+	next := plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		switch r.Question[0].Name {
+		case "missing.segment.com.":
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNameError)
+			w.WriteMsg(m)
+			return dns.RcodeNameError, nil
+		case "broken.segment.com.":
+			return dns.RcodeServerFailure, errors.New("broken")
+		default:
+			m := new(dns.Msg)
+			m.SetReply(r)
+			w.WriteMsg(m)
+			return dns.RcodeSuccess, nil
+		}
+	})
+
+	server, plugin, state := setupTest()
+	defer server.Close()
+	plugin.Next = next
+
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"www.segment.com.", dns.TypeA},
+		{"www.segment.com.", dns.TypeAAAA},
+		{"missing.segment.com.", dns.TypeA},
+		{"missing.segment.com.", dns.TypeA},
+		{"broken.segment.com.", dns.TypeA},
+	} {
+		r := new(dns.Msg)
+		r.SetQuestion(q.name, q.qtype)
+		plugin.ServeDNS(context.Background(), &corednstest.ResponseWriter{}, r)
+	}
+
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.dns.names.top10:2|c|#name:missing.segment.com.",
+		"coredns.dns.names.top10:2|c|#name:www.segment.com.",
+		"coredns.dns.names.top10:1|c|#name:broken.segment.com.",
+		"coredns.dns.names.qtype.top10:2|c|#qtype:A,name:missing.segment.com.",
+		"coredns.dns.names.qtype.top10:1|c|#qtype:A,name:www.segment.com.",
+		"coredns.dns.names.qtype.top10:1|c|#qtype:A,name:broken.segment.com.",
+		"coredns.dns.names.qtype.top10:1|c|#qtype:AAAA,name:www.segment.com.",
+		"coredns.dns.names.rcode.top10:2|c|#rcode:NXDOMAIN,name:missing.segment.com.",
+		"coredns.dns.names.rcode.top10:1|c|#rcode:SERVFAIL,name:broken.segment.com.",
+	)
+}
+
+func TestDogstatsdClients(t *testing.T) {
+	tests := []struct {
+		clients string
+		packets []string
+	}{
+		{
+			clients: "ip",
+			packets: []string{
+				"coredns.dns.clients.top10:2|c|#client:10.0.0.1",
+				"coredns.dns.clients.top10:1|c|#client:10.0.0.2",
+				"coredns.dns.clients.top10:1|c|#client:2001:db8::1",
+				"coredns.dns.exchanges.top10:2|c|#exchange:10.0.0.1/www.segment.com.",
+				"coredns.dns.exchanges.top10:1|c|#exchange:10.0.0.2/www.segment.com.",
+				"coredns.dns.exchanges.top10:1|c|#exchange:2001:db8::1/www.segment.com.",
+			},
+		},
+		{
+			clients: "subnet",
+			packets: []string{
+				"coredns.dns.clients.top10:3|c|#client:10.0.0.0/24",
+				"coredns.dns.clients.top10:1|c|#client:2001:db8::/64",
+				"coredns.dns.exchanges.top10:3|c|#exchange:10.0.0.0/24/www.segment.com.",
+				"coredns.dns.exchanges.top10:1|c|#exchange:2001:db8::/64/www.segment.com.",
+			},
+		},
+	}
+
+	next := plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+
+	for _, test := range tests {
+		t.Run(test.clients, func(t *testing.T) {
+			server, plugin, state := setupTest()
+			defer server.Close()
+
+			plugin.Clients = test.clients
+			plugin.Next = next
+
+			for _, ip := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.2", "2001:db8::1"} {
+				r := new(dns.Msg)
+				r.SetQuestion("www.segment.com.", dns.TypeA)
+				plugin.ServeDNS(context.Background(), &corednstest.ResponseWriter{RemoteIP: ip}, r)
+			}
+
+			plugin.reportMetrics(state)
+			assertRead(t, server, append(test.packets,
+				"coredns.dns.names.top10:4|c|#name:www.segment.com.",
+				"coredns.dns.names.qtype.top10:4|c|#qtype:A,name:www.segment.com.",
+			)...)
+		})
+	}
+}
+
+func TestDogstatsdDockerLabels(t *testing.T) {
+	next := plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+
+	server, plugin, state := setupTest()
+	defer server.Close()
+
+	plugin.Next = next
+	plugin.BufferSize = 512 // the tagged exchange doesn't fit in 100 bytes
+	plugin.DockerLabels = []string{"com.docker.compose.service", "team"}
+	plugin.storeDockerCache(map[string]dockerContainer{
+		"a": {
+			Image:           "segment/api:1.0",
+			Labels:          map[string]string{"com.docker.compose.service": "api", "team": "Core"},
+			NetworkSettings: dockerNetworkSettings{Networks: map[string]dockerNetwork{"vpc": {IPAddress: "10.5.0.2"}}},
+		},
+		"b": {
+			Image:           "segment/worker:1.0",
+			NetworkSettings: dockerNetworkSettings{Networks: map[string]dockerNetwork{"vpc": {IPAddress: "10.5.0.3"}}},
+		},
+	})
+
+	for _, ip := range []string{"10.5.0.2", "10.5.0.3"} {
+		r := new(dns.Msg)
+		r.SetQuestion("www.segment.com.", dns.TypeA)
+		plugin.ServeDNS(context.Background(), &corednstest.ResponseWriter{RemoteIP: ip}, r)
+	}
+
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.dns.clients.top10:1|c|#client:api,com.docker.compose.service:api,team:core",
+		"coredns.dns.clients.top10:1|c|#client:worker",
+		"coredns.dns.exchanges.top10:1|c|#exchange:api/www.segment.com.,com.docker.compose.service:api,team:core",
+		"coredns.dns.exchanges.top10:1|c|#exchange:worker/www.segment.com.",
+		"coredns.dns.names.top10:2|c|#name:www.segment.com.",
+		"coredns.dns.names.qtype.top10:2|c|#qtype:A,name:www.segment.com.",
+	)
+}
+
+func TestDogstatsdStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dogstatsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			address := "127.0.0.1:0"
+			if network == "unix" {
+				address = dir + "/dsd.socket"
+			}
+
+			l, err := net.Listen(network, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			conns := make(chan net.Conn, 2)
+			go func() {
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						return
+					}
+					conns <- conn
+				}
+			}()
+
+			plugin := dogstastdPlugin(network + "://" + l.Addr().String())
+			plugin.BufferSize = 10 // metrics larger than the buffer are not dropped
+			defer plugin.closeStream()
+
+			metrics := []metric{
+				{kind: counter, name: "coredns.dns.requests", value: 1, tags: "zone:segment.com."},
+				{kind: gauge, name: "coredns.dns.cache.size", value: 42},
+			}
+
+			readLines := func(conn net.Conn, expected ...string) {
+				t.Helper()
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				r := bufio.NewReader(conn)
+				for _, line := range expected {
+					found, err := r.ReadString('\n')
+					if err != nil {
+						t.Fatal(err)
+					}
+					if found != line+"\n" {
+						t.Errorf("Expected %q but found: %q", line, found)
+					}
+				}
+			}
+
+			if err := plugin.flushMetrics(metrics); err != nil {
+				t.Fatal(err)
+			}
+			conn := <-conns
+			readLines(conn, "coredns.dns.requests:1|c|#zone:segment.com.", "coredns.dns.cache.size:42|g")
+
+			// The connection is kept across flushes.
+			if err := plugin.flushMetrics(metrics[1:]); err != nil {
+				t.Fatal(err)
+			}
+			readLines(conn, "coredns.dns.cache.size:42|g")
+
+			// Writes to a connection closed by the agent may only fail after
+			// a few flushes, the plugin then reconnects and writes again.
+			conn.Close()
+			for i := 0; ; i++ {
+				if err := plugin.flushMetrics(metrics[1:]); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case conn = <-conns:
+					defer conn.Close()
+					readLines(conn, "coredns.dns.cache.size:42|g")
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+				if i == 100 {
+					t.Fatal("The plugin did not reconnect to the agent")
+				}
+			}
+		})
+	}
+}
+
+func TestDogstatsdGraphite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	plugin := dogstastdPlugin("tcp://" + l.Addr().String())
+	plugin.Format = "graphite"
+	plugin.StatsdTemplate = "{metric}.{zone}"
+	plugin.once.Do(plugin.init)
+	defer plugin.closeStream()
+
+	metrics := []metric{
+		{kind: counter, name: "coredns.dns.requests", value: 1, tags: "zone:segment.com."},
+		{kind: histogram, name: "coredns.dns.request.duration", value: 0.25, tags: "zone:segment.com."},
+		{kind: gauge, name: "coredns.dns.cache.size", value: 42},
+	}
+
+	start := time.Now().Unix()
+	if err := plugin.flushMetrics(metrics); err != nil {
+		t.Fatal(err)
+	}
+	end := time.Now().Unix()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	for _, expected := range []string{
+		"coredns.dns.requests.segment_com_ 1",
+		"coredns.dns.cache.size 42",
+	} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		i := strings.LastIndexByte(line, ' ')
+		if line[:i] != expected {
+			t.Errorf("Expected %q but found: %q", expected, line[:i])
+		}
+		if ts, err := strconv.ParseInt(line[i+1:len(line)-1], 10, 64); err != nil || ts < start || ts > end {
+			t.Errorf("Expected the timestamp to be the time of the flush but found: %q", line[i+1:])
+		}
+	}
+}
+
+func TestDogstatsdPercentiles(t *testing.T) {
+	server, plugin, state := setupTest()
+	defer server.Close()
+
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "coredns",
+		Subsystem: "segment",
+		Name:      "percentiles",
+		Buckets:   []float64{1, 2, 4},
+	})
+	plugin.Reg.MustRegister(h)
+	plugin.Percentiles = []float64{50, 90}
+
+	for _, v := range []float64{0.5, 0.5, 1.5, 1.5, 1.5, 1.5, 1.5, 1.5, 3, 3} {
+		h.Observe(v)
+	}
+
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.segment.percentiles:0|h|@0.5",
+		"coredns.segment.percentiles:1|h|@0.16666666666666666",
+		"coredns.segment.percentiles:2|h|@0.5",
+		"coredns.segment.percentiles.median:1.5|g",
+		"coredns.segment.percentiles.90percentile:3|g",
+	)
+
+	// The percentiles are estimated from the observations since the last
+	// flush only.
+	h.Observe(3.5)
+
+	plugin.reportMetrics(state)
+	assertRead(t, server,
+		"coredns.segment.percentiles:2|h",
+		"coredns.segment.percentiles.median:3|g",
+		"coredns.segment.percentiles.90percentile:3.8|g",
+	)
+
+	// And are not reported when the histogram observed nothing.
+	plugin.reportMetrics(state)
+	plugin.Percentiles = nil
+	h.Observe(0.5)
+	plugin.reportMetrics(state)
+	assertRead(t, server, "coredns.segment.percentiles:0|h")
+}
+
+func TestDogstatsdRun(t *testing.T) {
+	server, plugin, _ := setupTest()
+	defer server.Close()
+
+	running := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "coredns",
+		Subsystem: "segment",
+		Name:      "run",
+	})
+	running.Set(1)
+	plugin.Reg.MustRegister(running)
+
+	// Counters were incremented before the plugin started when it is started
+	// again after the configuration was reloaded.
+	runs := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "coredns",
+		Subsystem: "segment",
+		Name:      "runs",
+	})
+	runs.Add(5)
+	plugin.Reg.MustRegister(runs)
+
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "coredns",
+		Subsystem: "segment",
+		Name:      "latency",
+		Buckets:   []float64{1, 2, 4},
+	})
+	latency.Observe(0.5)
+	latency.Observe(0.5)
+	plugin.Reg.MustRegister(latency)
+	plugin.Percentiles = []float64{50}
+
+	// The metrics are collected and written once when the plugin starts, the
+	// counters and histograms only set their baseline, and the percentiles
+	// of histograms are not reported.
+	plugin.Start()
+	assertRead(t, server, "coredns.segment.run:1|g")
+
+	// And once more when it stops, without waiting for the flush interval.
+	running.Set(2)
+	runs.Add(2)
+	latency.Observe(3)
+	plugin.Stop()
+	assertRead(t, server,
+		"coredns.segment.run:2|g",
+		"coredns.segment.runs:2|c",
+		"coredns.segment.latency:2|h",
+		"coredns.segment.latency.median:3|g",
+	)
+}
+
+func TestDogstatsdFlushDelay(t *testing.T) {
+	plugin := dogstastdPlugin("udp://127.0.0.1:1")
+	plugin.FlushInterval = 10 * time.Second
+
+	if delay := plugin.flushDelay(); delay != 10*time.Second {
+		t.Errorf("Expected the delay without jitter to be 10s but found: %s", delay)
+	}
+
+	plugin.FlushJitter = 2 * time.Second
+
+	for r, expected := range map[float64]time.Duration{
+		-0.5: 9 * time.Second,
+		0:    10 * time.Second,
+		0.25: 10500 * time.Millisecond,
+	} {
+		plugin.randFloat64 = func(min, max float64) float64 { return r }
+
+		if delay := plugin.flushDelay(); delay != expected {
+			t.Errorf("Expected the delay to be %s but found: %s", expected, delay)
+		}
+	}
+}
+
+func TestDogstatsdQueue(t *testing.T) {
+	plugin := dogstastdPlugin("udp://127.0.0.1:1")
+	queue := make(chan []metric, 1)
+	metrics := []metric{{kind: gauge, name: "coredns.dns.cache.size", value: 42}}
+
+	if !plugin.queueMetrics(queue, metrics) {
+		t.Error("Expected the metrics to be queued")
+	}
+
+	// The previous flush is not done, the metrics are dropped.
+	dropped := metricValue(droppedFlushes.WithLabelValues(plugin.Addr))
+	if plugin.queueMetrics(queue, metrics) {
+		t.Error("Expected the metrics to be dropped")
+	}
+	if n := metricValue(droppedFlushes.WithLabelValues(plugin.Addr)); n != dropped+1 {
+		t.Errorf("Expected %g dropped flushes but found: %g", dropped+1, n)
+	}
+}
+
+func TestDogstatsdEvents(t *testing.T) {
+	server, plugin, _ := setupTest()
+	defer server.Close()
+
+	plugin.EnableEvents = true
+	plugin.queueEvent(event{
+		title:     "CoreDNS started",
+		text:      "Hello",
+		alertType: "info",
+		time:      time.Unix(1500000000, 0),
+	})
+
+	// The events are written before the metrics of the flush.
+	metrics := []metric{{kind: gauge, name: "coredns.dns.cache.size", value: 42}}
+	if err := plugin.flushMetrics(metrics); err != nil {
+		t.Fatal(err)
+	}
+	assertRead(t, server,
+		"_e{15,5}:CoreDNS started|Hello|d:1500000000|t:info",
+		"coredns.dns.cache.size:42|g",
+	)
+
+	// An error event is queued once the flushes failed enough times in a row.
+	addr := plugin.Addr
+	plugin.Addr = "tcp://127.0.0.1:1" // nothing listens on this port
+	for i := 0; i != errorEventThreshold+1; i++ {
+		if err := plugin.flushMetrics(metrics); err == nil {
+			t.Fatal("Expected an error flushing to an agent which is not listening")
+		}
+	}
+
+	events := plugin.takeEvents()
+	if len(events) != 1 || events[0].title != "CoreDNS failed to flush metrics" || events[0].alertType != "error" {
+		t.Errorf("Expected a single error event but found: %+v", events)
+	}
+
+	plugin.Addr = addr
+	if err := plugin.flushMetrics(metrics); err != nil {
+		t.Fatal(err)
+	}
+	if plugin.flushFailures != 0 {
+		t.Errorf("Expected the count of flush failures to be reset but found: %d", plugin.flushFailures)
+	}
+	assertRead(t, server, "coredns.dns.cache.size:42|g")
+}
+
+func TestDogstatsdReloadEvents(t *testing.T) {
+	server, plugin, _ := setupTest()
+	defer server.Close()
+
+	plugin.BufferSize = 512 // the events exceed the buffer size of the test
+	plugin.EnableEvents = true
+	plugin.Start()
+	text := "CoreDNS started pushing metrics to the dogstatsd agent at " + plugin.Addr + "."
+	assertEvent(t, server, fmt.Sprintf("_e{15,%d}:CoreDNS started|%s|t:info", len(text), text))
+
+	plugin.Reload()
+	plugin.Stop()
+	assertEvent(t, server, "_e{16,39}:CoreDNS reloaded|CoreDNS is reloading its configuration.|t:info")
+}
+
+func TestDogstatsdServiceCheck(t *testing.T) {
+	next := plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		switch r.Question[0].Name {
+		case "broken.segment.com.":
+			return dns.RcodeServerFailure, errors.New("broken")
+		case "servfail.segment.com.":
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+			w.WriteMsg(m)
+			return dns.RcodeServerFailure, nil
+		default:
+			m := new(dns.Msg)
+			m.SetReply(r)
+			w.WriteMsg(m)
+			return dns.RcodeSuccess, nil
+		}
+	})
+
+	server, plugin, _ := setupTest()
+	defer server.Close()
+	plugin.Next = next
+	plugin.EnableServiceCheck = true
+
+	for _, name := range []string{
+		"www.segment.com.",
+		"www.segment.com.",
+		"broken.segment.com.",
+		"servfail.segment.com.",
+	} {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		plugin.ServeDNS(context.Background(), &corednstest.ResponseWriter{}, r)
+	}
+
+	plugin.checkHealth()
+	checks := plugin.takeServiceChecks()
+	if len(checks) != 1 || checks[0].status != serviceCheckCritical || checks[0].message != "2 of 4 queries (50.00%) failed since the last check." {
+		t.Errorf("Expected a critical service check but found: %+v", checks)
+	}
+
+	// The counters were reset by the check.
+	plugin.checkHealth()
+	if err := plugin.flushMetrics(nil); err != nil {
+		t.Fatal(err)
+	}
+	assertEvent(t, server, "_sc|coredns.up|0|m:No queries since the last check.")
+}
+
 func TestDogstatsdGoMetrics(t *testing.T) {
 	t.Run("enabled", func(t *testing.T) { testDogstatsdGoMetrics(t, true) })
 	t.Run("disabled", func(t *testing.T) { testDogstatsdGoMetrics(t, false) })
@@ -240,6 +1201,8 @@ func dogstastdPlugin(addr string) *Dogstatsd {
 	plugin.Addr = addr
 	plugin.BufferSize = 100 // for the purpose of the test, forbidden otherwise
 	plugin.Reg = prometheus.NewRegistry()
+	plugin.Tags = nil // not from the environment of the test
+	plugin.ContainerID = ""
 	plugin.randFloat64 = func(min, max float64) float64 { return min }
 	return plugin
 }
@@ -282,6 +1245,26 @@ func (s server) addr() string {
 	return a.Network() + "://" + a.String()
 }
 
+// assertEvent reads an event or a service check from s and compares it to the
+// expected one, without its time.
+func assertEvent(t *testing.T, s server, expected string) {
+	t.Helper()
+
+	p, ok := <-s.packets
+	if !ok {
+		t.Fatal("unexpected EOF")
+	}
+
+	if i := strings.Index(p, "|d:"); i >= 0 {
+		j := strings.IndexByte(p[i+1:], '|')
+		p = p[:i] + p[i+1+j:]
+	}
+
+	if p != expected {
+		t.Errorf("\nexpected: %q\nfound:    %q", expected, p)
+	}
+}
+
 func assertRead(t *testing.T, s server, packets ...string) {
 	t.Helper()
 
@@ -0,0 +1,339 @@
+package dogstatsd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ecsClient lists the tasks running in the ECS cluster of the task that coredns
+// runs in. The ECS API is called directly instead of through the AWS SDK, only
+// two actions are needed.
+type ecsClient struct {
+	// URL of the task metadata endpoint (version 4) of the coredns task, empty
+	// when not running on ECS.
+	metadata string
+
+	// URL of the ECS API endpoint, derived from the region when empty.
+	endpoint string
+
+	// Region of the ECS cluster, taken from the task metadata when empty.
+	region string
+}
+
+func makeECSClient() ecsClient {
+	c := ecsClient{
+		metadata: os.Getenv("ECS_CONTAINER_METADATA_URI_V4"),
+		region:   os.Getenv("AWS_REGION"),
+	}
+	if c.region == "" {
+		c.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return c
+}
+
+func (c *ecsClient) listTasks() (tasks []ecsTask, err error) {
+	if len(c.metadata) == 0 {
+		return nil, errors.New("not running on ECS, ECS_CONTAINER_METADATA_URI_V4 is not set")
+	}
+
+	var self ecsTaskMetadata
+	if err = c.getJSON(c.metadata+"/task", nil, &self); err != nil {
+		return
+	}
+
+	region := c.region
+	if region == "" {
+		// arn:aws:ecs:region:account:task/cluster/id
+		if parts := strings.Split(self.TaskARN, ":"); len(parts) > 3 {
+			region = parts[3]
+		}
+	}
+
+	creds, err := ecsCredentials()
+	if err != nil {
+		return
+	}
+
+	var arns []string
+	list := ecsListTasksRequest{Cluster: self.Cluster, DesiredStatus: "RUNNING"}
+
+	for {
+		var res ecsListTasksResponse
+		if err = c.call(region, creds, "ListTasks", list, &res); err != nil {
+			return
+		}
+		arns = append(arns, res.TaskARNs...)
+		if list.NextToken = res.NextToken; list.NextToken == "" {
+			break
+		}
+	}
+
+	// DescribeTasks accepts at most 100 tasks per call.
+	for len(arns) != 0 {
+		n := len(arns)
+		if n > 100 {
+			n = 100
+		}
+
+		var res ecsDescribeTasksResponse
+		if err = c.call(region, creds, "DescribeTasks", ecsDescribeTasksRequest{Cluster: self.Cluster, Tasks: arns[:n]}, &res); err != nil {
+			return
+		}
+
+		tasks = append(tasks, res.Tasks...)
+		arns = arns[n:]
+	}
+
+	return
+}
+
+func (c *ecsClient) call(region string, creds awsCredentials, action string, params interface{}, ret interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	endpoint := c.endpoint
+	if endpoint == "" {
+		endpoint = "https://ecs." + region + ".amazonaws.com"
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonEC2ContainerServiceV20141113."+action)
+	signRequest(req, body, creds, region, "ecs", time.Now())
+
+	return doJSON(req, ret)
+}
+
+func (c *ecsClient) getJSON(url string, header http.Header, ret interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return doJSON(req, ret)
+}
+
+func doJSON(req *http.Request, ret interface{}) error {
+	client := http.Client{Timeout: 5 * time.Second}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s: %s", req.URL, res.Status, bytes.TrimSpace(b))
+	}
+
+	return json.NewDecoder(res.Body).Decode(ret)
+}
+
+type ecsTaskMetadata struct {
+	Cluster string
+	TaskARN string
+}
+
+type ecsListTasksRequest struct {
+	Cluster       string `json:"cluster,omitempty"`
+	DesiredStatus string `json:"desiredStatus,omitempty"`
+	NextToken     string `json:"nextToken,omitempty"`
+}
+
+type ecsListTasksResponse struct {
+	TaskARNs  []string `json:"taskArns"`
+	NextToken string   `json:"nextToken"`
+}
+
+type ecsDescribeTasksRequest struct {
+	Cluster string   `json:"cluster,omitempty"`
+	Tasks   []string `json:"tasks"`
+}
+
+type ecsDescribeTasksResponse struct {
+	Tasks []ecsTask `json:"tasks"`
+}
+
+type ecsTask struct {
+	Group             string         `json:"group"`
+	TaskDefinitionARN string         `json:"taskDefinitionArn"`
+	Containers        []ecsContainer `json:"containers"`
+}
+
+type ecsContainer struct {
+	NetworkInterfaces []ecsNetworkInterface `json:"networkInterfaces"`
+}
+
+type ecsNetworkInterface struct {
+	PrivateIPv4Address string `json:"privateIpv4Address"`
+	IPv6Address        string `json:"ipv6Address"`
+}
+
+// name returns the name of the service that started the task, or the family of
+// its task definition for tasks not started by a service.
+func (task ecsTask) name() string {
+	if strings.HasPrefix(task.Group, "service:") {
+		return strings.TrimPrefix(task.Group, "service:")
+	}
+	// arn:aws:ecs:region:account:task-definition/family:revision
+	family := task.TaskDefinitionARN
+	if i := strings.LastIndexByte(family, '/'); i >= 0 {
+		family = family[i+1:]
+	}
+	if i := strings.LastIndexByte(family, ':'); i >= 0 {
+		family = family[:i]
+	}
+	return family
+}
+
+// ips returns the IP addresses of the task, only tasks using the awsvpc network
+// mode have their own addresses.
+func (task ecsTask) ips() []string {
+	var ips []string
+	for _, container := range task.Containers {
+		for _, iface := range container.NetworkInterfaces {
+			for _, ip := range []string{iface.PrivateIPv4Address, iface.IPv6Address} {
+				if ip != "" && !containsString(ips, ip) {
+					ips = append(ips, ip)
+				}
+			}
+		}
+	}
+	return ips
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+}
+
+// ecsCredentials returns the AWS credentials set in the environment, or the
+// credentials of the task role served by the ECS agent.
+func ecsCredentials() (creds awsCredentials, err error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		creds.AccessKeyID = id
+		creds.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		creds.Token = os.Getenv("AWS_SESSION_TOKEN")
+		return
+	}
+
+	url := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		url = "http://169.254.170.2" + uri
+	}
+	if url == "" {
+		err = errors.New("no AWS credentials found in the environment or the task role")
+		return
+	}
+
+	header := http.Header{}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		header.Set("Authorization", token)
+	}
+
+	err = (&ecsClient{}).getJSON(url, header, &creds)
+	return
+}
+
+// signRequest signs req with the version 4 signature of AWS, body must be the
+// content of the request body.
+//
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func signRequest(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, s := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+hex.EncodeToString(hmacSHA256(key, stringToSign)))
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
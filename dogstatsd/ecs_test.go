@@ -0,0 +1,201 @@
+package dogstatsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignRequest(t *testing.T) {
+	// The get-vanilla case of the signature version 4 test suite.
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	date, _ := time.Parse("20060102T150405Z", "20150830T123600Z")
+
+	signRequest(req, nil, awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}, "us-east-1", "service", date)
+
+	const expected = "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("authorization mismatch:\n%s\n%s", expected, auth)
+	}
+}
+
+func TestECSTask(t *testing.T) {
+	tests := []struct {
+		task ecsTask
+		name string
+		ips  []string
+	}{
+		{
+			task: ecsTask{
+				Group:             "service:api",
+				TaskDefinitionARN: "arn:aws:ecs:us-west-2:123456789012:task-definition/api-production:42",
+				Containers: []ecsContainer{
+					{NetworkInterfaces: []ecsNetworkInterface{{PrivateIPv4Address: "10.1.0.4", IPv6Address: "fd00::4"}}},
+					{NetworkInterfaces: []ecsNetworkInterface{{PrivateIPv4Address: "10.1.0.4", IPv6Address: "fd00::4"}}},
+				},
+			},
+			name: "api",
+			ips:  []string{"10.1.0.4", "fd00::4"},
+		},
+
+		{
+			task: ecsTask{
+				Group:             "family:migrations",
+				TaskDefinitionARN: "arn:aws:ecs:us-west-2:123456789012:task-definition/migrations:3",
+				Containers:        []ecsContainer{{}},
+			},
+			name: "migrations",
+		},
+	}
+
+	for _, test := range tests {
+		if name := test.task.name(); name != test.name {
+			t.Errorf("%s: name mismatch: %s != %s", test.task.Group, name, test.name)
+		}
+		if ips := test.task.ips(); !reflect.DeepEqual(ips, test.ips) {
+			t.Errorf("%s: ips mismatch: %q != %q", test.task.Group, ips, test.ips)
+		}
+	}
+}
+
+func TestECSClient(t *testing.T) {
+	for name, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		"AWS_SESSION_TOKEN":     "",
+	} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v4/coredns/task" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{
+  "Cluster": "arn:aws:ecs:us-west-2:123456789012:cluster/production",
+  "TaskARN": "arn:aws:ecs:us-west-2:123456789012:task/production/0123456789abcdef"
+}`))
+	}))
+	defer metadata.Close()
+
+	var describes [][]string
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/us-west-2/ecs/aws4_request") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req struct {
+			Cluster   string   `json:"cluster"`
+			NextToken string   `json:"nextToken"`
+			Tasks     []string `json:"tasks"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		if req.Cluster != "arn:aws:ecs:us-west-2:123456789012:cluster/production" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonEC2ContainerServiceV20141113.ListTasks":
+			switch req.NextToken {
+			case "":
+				w.Write([]byte(`{"taskArns": ["task-1", "task-2"], "nextToken": "page-2"}`))
+			default:
+				w.Write([]byte(`{"taskArns": ["task-3"]}`))
+			}
+
+		case "AmazonEC2ContainerServiceV20141113.DescribeTasks":
+			describes = append(describes, req.Tasks)
+			w.Write([]byte(`{"tasks": [
+  {
+    "group": "service:api",
+    "taskDefinitionArn": "arn:aws:ecs:us-west-2:123456789012:task-definition/api:42",
+    "containers": [{"networkInterfaces": [{"privateIpv4Address": "10.1.0.4"}]}]
+  },
+  {
+    "group": "service:api",
+    "taskDefinitionArn": "arn:aws:ecs:us-west-2:123456789012:task-definition/api:42",
+    "containers": [{"networkInterfaces": [{"privateIpv4Address": "10.1.0.5"}]}]
+  },
+  {
+    "group": "family:worker",
+    "taskDefinitionArn": "arn:aws:ecs:us-west-2:123456789012:task-definition/worker:7",
+    "containers": [{"networkInterfaces": []}]
+  }
+]}`))
+
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer api.Close()
+
+	plugin := New()
+	plugin.ecsClient = ecsClient{
+		metadata: metadata.URL + "/v4/coredns",
+		endpoint: api.URL,
+	}
+	plugin.refreshECSCache()
+
+	if !reflect.DeepEqual(describes, [][]string{{"task-1", "task-2", "task-3"}}) {
+		t.Error("described tasks mismatch:", describes)
+	}
+
+	cache, _ := plugin.clientCache.Load().(map[string][]string)
+
+	if !reflect.DeepEqual(cache, map[string][]string{
+		"10.1.0.4": {"api"},
+		"10.1.0.5": {"api"},
+	}) {
+		t.Error("ECS cache mismatch:", cache)
+	}
+}
+
+func TestECSRefresh(t *testing.T) {
+	lists := make(chan struct{}, 10)
+
+	// Failing to read the task metadata is enough to count the listings.
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case lists <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer metadata.Close()
+
+	agent := dogstatsdServer()
+	defer agent.Close()
+
+	plugin := dogstastdPlugin(agent.addr())
+	plugin.Clients = "ecs"
+	plugin.ECSRefresh = 20 * time.Millisecond // for the purpose of the test, forbidden otherwise
+	plugin.ecsClient = ecsClient{metadata: metadata.URL + "/v4/coredns"}
+	plugin.Start()
+	defer plugin.Stop()
+
+	// The tasks are listed when the plugin starts, then on every refresh
+	// while the flush interval is a minute.
+	for i := 0; i != 3; i++ {
+		select {
+		case <-lists:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The tasks were listed %d times only", i)
+		}
+	}
+}
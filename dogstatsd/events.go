@@ -0,0 +1,109 @@
+package dogstatsd
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of consecutive errors flushing metrics or watching docker containers
+// which trigger an error event.
+const errorEventThreshold = 5
+
+// Maximum number of events waiting to be written to the agent, the oldest
+// events are dropped when the agent cannot be written to for a while.
+const maxPendingEvents = 100
+
+type event struct {
+	title     string
+	text      string
+	alertType string // info, warning, error, or success
+	time      time.Time
+}
+
+// appendEvent appends the dogstatsd representation of e to b, the hostname is
+// omitted when empty.
+func appendEvent(b []byte, e event, hostname string, global tags) []byte {
+	title := escapeEventText(e.title)
+	text := escapeEventText(e.text)
+
+	b = append(b, "_e{"...)
+	b = strconv.AppendInt(b, int64(len(title)), 10)
+	b = append(b, ',')
+	b = strconv.AppendInt(b, int64(len(text)), 10)
+	b = append(b, "}:"...)
+	b = append(b, title...)
+	b = append(b, '|')
+	b = append(b, text...)
+
+	if !e.time.IsZero() {
+		b = append(b, "|d:"...)
+		b = strconv.AppendInt(b, e.time.Unix(), 10)
+	}
+
+	if hostname != "" {
+		b = append(b, "|h:"...)
+		b = append(b, hostname...)
+	}
+
+	if e.alertType != "" {
+		b = append(b, "|t:"...)
+		b = append(b, e.alertType...)
+	}
+
+	if len(global) != 0 {
+		b = append(b, '|', '#')
+		b = append(b, global...)
+	}
+
+	return append(b, '\n')
+}
+
+// escapeEventText escapes the newlines of s, which would end the event.
+func escapeEventText(s string) string {
+	return strings.Replace(s, "\n", "\\n", -1)
+}
+
+// queueEvent queues e to be written to the agent with the next flush, if events
+// are enabled.
+func (d *Dogstatsd) queueEvent(e event) {
+	if !d.EnableEvents {
+		return
+	}
+
+	if e.time.IsZero() {
+		e.time = time.Now()
+	}
+
+	d.pendingMutex.Lock()
+	d.events = append(d.events, e)
+	if n := len(d.events) - maxPendingEvents; n > 0 {
+		d.events = append(d.events[:0], d.events[n:]...)
+	}
+	d.pendingMutex.Unlock()
+}
+
+// takeEvents returns the events waiting to be written to the agent, and removes
+// them from the queue.
+func (d *Dogstatsd) takeEvents() []event {
+	d.pendingMutex.Lock()
+	events := d.events
+	d.events = nil
+	d.pendingMutex.Unlock()
+	return events
+}
+
+// requeueEvents puts back events which failed to be written to the agent at the
+// front of the queue.
+func (d *Dogstatsd) requeueEvents(events []event) {
+	if len(events) == 0 {
+		return
+	}
+
+	d.pendingMutex.Lock()
+	d.events = append(events, d.events...)
+	if n := len(d.events) - maxPendingEvents; n > 0 {
+		d.events = append(d.events[:0], d.events[n:]...)
+	}
+	d.pendingMutex.Unlock()
+}
@@ -0,0 +1,83 @@
+package dogstatsd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAppendEvent(t *testing.T) {
+	tests := []struct {
+		s        string
+		e        event
+		hostname string
+		g        tags
+	}{
+		{
+			s: "_e{15,0}:CoreDNS started|\n",
+			e: event{title: "CoreDNS started"},
+		},
+
+		{
+			s: "_e{15,12}:CoreDNS started|Hello\\nWorld|d:1500000000|t:info\n",
+			e: event{
+				title:     "CoreDNS started",
+				text:      "Hello\nWorld",
+				alertType: "info",
+				time:      time.Unix(1500000000, 0),
+			},
+		},
+
+		{
+			s: "_e{15,5}:CoreDNS stopped|Hello|h:coredns-1|t:warning|#env:prod,host:coredns-1\n",
+			e: event{
+				title:     "CoreDNS stopped",
+				text:      "Hello",
+				alertType: "warning",
+			},
+			hostname: "coredns-1",
+			g:        makeGlobalTags([]string{"env:prod", "host:coredns-1"}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.e.title, func(t *testing.T) {
+			if s := string(appendEvent(nil, test.e, test.hostname, test.g)); s != test.s {
+				t.Errorf("\nexpected: %q\nfound:    %q", test.s, s)
+			}
+		})
+	}
+}
+
+func TestQueueEvent(t *testing.T) {
+	d := New()
+	d.queueEvent(event{title: "disabled"})
+
+	if events := d.takeEvents(); len(events) != 0 {
+		t.Errorf("Expected no events to be queued when they are disabled but found: %v", events)
+	}
+
+	d.EnableEvents = true
+	for i := 0; i != maxPendingEvents+1; i++ {
+		d.queueEvent(event{title: "event", text: string(rune('a' + i%26))})
+	}
+
+	// The oldest event was dropped.
+	events := d.takeEvents()
+	if len(events) != maxPendingEvents {
+		t.Fatalf("Expected %d events but found: %d", maxPendingEvents, len(events))
+	}
+	if events[0].text != "b" {
+		t.Errorf("Expected the oldest event to be dropped but found: %+v", events[0])
+	}
+	if events[0].time.IsZero() {
+		t.Error("Expected the time of the event to be set")
+	}
+
+	d.queueEvent(event{title: "new"})
+	d.requeueEvents(events[:1])
+
+	events = d.takeEvents()
+	if len(events) != 2 || events[0].text != "b" || events[1].title != "new" {
+		t.Errorf("Expected the requeued events to be first but found: %+v", events)
+	}
+}
@@ -0,0 +1,26 @@
+package dogstatsd
+
+import (
+	"strconv"
+	"time"
+)
+
+// appendGraphiteMetric appends the representation of m in the plaintext
+// protocol of graphite, "path value timestamp", to b. Its path is made from the
+// template. Graphite stores the values of series as they are, so only counters,
+// which are the increments since the last flush, and gauges are reported. The
+// percentiles of histograms are reported as gauges when they are configured.
+func appendGraphiteMetric(b []byte, m metric, global tags, template nameTemplate, now time.Time) []byte {
+	switch m.kind {
+	case counter, gauge:
+	default:
+		return b
+	}
+
+	b = template.appendName(b, m, global)
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, m.value, 'g', -1, 64)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, now.Unix(), 10)
+	return append(b, '\n')
+}
@@ -0,0 +1,42 @@
+package dogstatsd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAppendGraphiteMetric(t *testing.T) {
+	template, err := parseNameTemplate("{metric}.{zone}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1500000000, 0)
+	tests := []struct {
+		s string
+		m metric
+	}{
+		{
+			s: "coredns.dns.requests.total.example_org_ 10 1500000000\n",
+			m: metric{kind: counter, name: "coredns_dns_requests_total", value: 10, tags: "zone:example.org."},
+		},
+
+		{
+			s: "coredns.dns.cache.size -1.5 1500000000\n",
+			m: metric{kind: gauge, name: "coredns_dns_cache_size", value: -1.5},
+		},
+
+		{ // the observations of histograms are not reported
+			s: "",
+			m: metric{kind: histogram, name: "coredns_dns_request_duration_seconds", value: 0.25},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.m.name, func(t *testing.T) {
+			if s := string(appendGraphiteMetric(nil, test.m, "", template, now)); s != test.s {
+				t.Errorf("\nexpected: %q\nfound:    %q", test.s, s)
+			}
+		})
+	}
+}
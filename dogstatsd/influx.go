@@ -0,0 +1,82 @@
+package dogstatsd
+
+import (
+	"strconv"
+	"strings"
+)
+
+// appendInfluxMetric appends the representation of m in the statsd format of
+// telegraf, where tags follow the name as "name,tag1=v1,tag2=v2", to b. Tags
+// without a name are omitted, and the characters of tag names and values which
+// separate the parts of the line are replaced by underscores.
+func appendInfluxMetric(b []byte, m metric, global tags) []byte {
+	// A gauge with a sign is an increment of the gauge in statsd, negative
+	// values are set by resetting the gauge to zero first.
+	if m.kind == gauge && m.value < 0 {
+		b = appendInfluxName(b, m, global)
+		b = append(b, ":0|g\n"...)
+	}
+
+	b = appendInfluxName(b, m, global)
+	b = append(b, ':')
+	b = strconv.AppendFloat(b, m.value, 'g', -1, 64)
+
+	switch m.kind {
+	case counter:
+		b = append(b, "|c"...)
+	case gauge:
+		b = append(b, "|g"...)
+	case timer:
+		b = append(b, "|ms"...)
+	default:
+		b = append(b, "|h"...)
+	}
+
+	if m.rate != 0 && m.rate != 1 {
+		b = append(b, '|', '@')
+		b = strconv.AppendFloat(b, m.rate, 'g', -1, 64)
+	}
+
+	return append(b, '\n')
+}
+
+func appendInfluxName(b []byte, m metric, global tags) []byte {
+	b = appendName(b, m.name)
+	b = appendInfluxTags(b, m.tags)
+	b = appendInfluxTags(b, global)
+	return b
+}
+
+func appendInfluxTags(b []byte, t tags) []byte {
+	for s := string(t); s != ""; {
+		tag := s
+		if i := strings.IndexByte(s, ','); i >= 0 {
+			tag, s = s[:i], s[i+1:]
+		} else {
+			s = ""
+		}
+
+		i := strings.IndexByte(tag, ':')
+		if i < 0 {
+			continue
+		}
+
+		b = append(b, ',')
+		b = appendInfluxTagPart(b, tag[:i])
+		b = append(b, '=')
+		b = appendInfluxTagPart(b, tag[i+1:])
+	}
+	return b
+}
+
+func appendInfluxTagPart(b []byte, s string) []byte {
+	for i := 0; i != len(s); i++ {
+		switch c := s[i]; c {
+		case ',', '=', ':', '|', ' ':
+			b = append(b, '_')
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
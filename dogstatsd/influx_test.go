@@ -0,0 +1,56 @@
+package dogstatsd
+
+import "testing"
+
+func TestAppendInfluxMetric(t *testing.T) {
+	tests := []struct {
+		s string
+		m metric
+		g tags
+	}{
+		{
+			s: "coredns.dns.requests.total:1|c\n",
+			m: metric{kind: counter, name: "coredns_dns_requests_total", value: 1},
+		},
+
+		{
+			s: "coredns.dns.requests.total,server=dns_//_53,zone=example.org.,env=prod:1|c\n",
+			m: metric{
+				kind:  counter,
+				name:  "coredns_dns_requests_total",
+				value: 1,
+				tags:  "server:dns://:53,zone:example.org.",
+			},
+			g: "env:prod,canary",
+		},
+
+		{ // negative gauge
+			s: "coredns.temperature:0|g\ncoredns.temperature:-1.5|g\n",
+			m: metric{kind: gauge, name: "coredns_temperature", value: -1.5},
+		},
+
+		{
+			s: "coredns.dns.request.duration.seconds,server=dns_//_53:0.25|h|@0.5\n",
+			m: metric{
+				kind:  histogram,
+				name:  "coredns_dns_request_duration_seconds",
+				value: 0.25,
+				rate:  0.5,
+				tags:  "server:dns://:53",
+			},
+		},
+
+		{
+			s: "coredns.dns.request.duration:250|ms\n",
+			m: metric{kind: timer, name: "coredns_dns_request_duration", value: 250},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.m.name, func(t *testing.T) {
+			if s := string(appendInfluxMetric(nil, test.m, test.g)); s != test.s {
+				t.Errorf("\nexpected: %q\nfound:    %q", test.s, s)
+			}
+		})
+	}
+}
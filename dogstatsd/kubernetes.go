@@ -0,0 +1,201 @@
+package dogstatsd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	kubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubernetesCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+type kubernetesClient struct {
+	// URL of the kubernetes API server, empty when not running in a cluster.
+	host string
+
+	// The token is read on every request because service account tokens are
+	// rotated by the kubelet.
+	tokenFile string
+	caFile    string
+}
+
+// makeKubernetesClient returns a client configured for the in-cluster access to
+// the kubernetes API.
+func makeKubernetesClient() kubernetesClient {
+	c := kubernetesClient{
+		tokenFile: kubernetesTokenFile,
+		caFile:    kubernetesCAFile,
+	}
+
+	if host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"); host != "" && port != "" {
+		c.host = "https://" + net.JoinHostPort(host, port)
+	}
+
+	return c
+}
+
+func (c *kubernetesClient) listPods() (pods []kubernetesPod, err error) {
+	query := url.Values{}
+	query.Set("fieldSelector", "status.phase=Running")
+	query.Set("limit", "500")
+
+	// Pods are listed in pages so large clusters do not produce huge responses.
+	for {
+		var list kubernetesPodList
+
+		if err = c.get("/api/v1/pods?"+query.Encode(), &list); err != nil {
+			return
+		}
+
+		pods = append(pods, list.Items...)
+
+		if list.Metadata.Continue == "" {
+			return
+		}
+
+		query.Set("continue", list.Metadata.Continue)
+	}
+}
+
+func (c *kubernetesClient) get(path string, ret interface{}) (err error) {
+	var req *http.Request
+	var res *http.Response
+
+	if len(c.host) == 0 {
+		return errors.New("not running in a kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	transport := &http.Transport{
+		DisableKeepAlives:      true,
+		TLSHandshakeTimeout:    5 * time.Second,
+		ResponseHeaderTimeout:  5 * time.Second,
+		MaxResponseHeaderBytes: 1024 * 1024,
+	}
+	defer transport.CloseIdleConnections()
+
+	if c.caFile != "" {
+		var ca []byte
+
+		if ca, err = ioutil.ReadFile(c.caFile); err != nil {
+			return
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("%s: no certificates found", c.caFile)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	if req, err = http.NewRequest(http.MethodGet, c.host+path, nil); err != nil {
+		return
+	}
+
+	if c.tokenFile != "" {
+		var token []byte
+
+		if token, err = ioutil.ReadFile(c.tokenFile); err != nil {
+			return
+		}
+
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	if res, err = transport.RoundTrip(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: %s", req.URL, res.Status)
+		return
+	}
+
+	err = json.NewDecoder(res.Body).Decode(ret)
+	return
+}
+
+type kubernetesPodList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []kubernetesPod `json:"items"`
+}
+
+type kubernetesPod struct {
+	Metadata kubernetesPodMetadata `json:"metadata"`
+	Spec     kubernetesPodSpec     `json:"spec"`
+	Status   kubernetesPodStatus   `json:"status"`
+}
+
+type kubernetesPodMetadata struct {
+	Name            string                     `json:"name"`
+	Namespace       string                     `json:"namespace"`
+	Labels          map[string]string          `json:"labels"`
+	OwnerReferences []kubernetesOwnerReference `json:"ownerReferences"`
+}
+
+type kubernetesOwnerReference struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+type kubernetesPodSpec struct {
+	HostNetwork bool `json:"hostNetwork"`
+}
+
+type kubernetesPodStatus struct {
+	PodIP  string            `json:"podIP"`
+	PodIPs []kubernetesPodIP `json:"podIPs"`
+}
+
+type kubernetesPodIP struct {
+	IP string `json:"ip"`
+}
+
+// name returns the namespace and the name of the workload that the pod belongs
+// to, which is the deployment for pods of replica sets created by deployments,
+// the owner of the pod for other controllers, or the pod itself.
+func (pod kubernetesPod) name() string {
+	name := pod.Metadata.Name
+
+	for _, owner := range pod.Metadata.OwnerReferences {
+		name = owner.Name
+		// Deployments name their replica sets after the hash of the pod
+		// template, which is also set as a label on the pods.
+		if hash := pod.Metadata.Labels["pod-template-hash"]; owner.Kind == "ReplicaSet" && hash != "" {
+			name = strings.TrimSuffix(name, "-"+hash)
+		}
+		break
+	}
+
+	return pod.Metadata.Namespace + "/" + name
+}
+
+// ips returns the IP addresses of the pod.
+func (pod kubernetesPod) ips() []string {
+	if len(pod.Status.PodIPs) == 0 {
+		if pod.Status.PodIP == "" {
+			return nil
+		}
+		return []string{pod.Status.PodIP}
+	}
+
+	ips := make([]string, len(pod.Status.PodIPs))
+	for i, ip := range pod.Status.PodIPs {
+		ips[i] = ip.IP
+	}
+	return ips
+}
@@ -0,0 +1,153 @@
+package dogstatsd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKubernetesPodName(t *testing.T) {
+	tests := []struct {
+		pod  kubernetesPod
+		name string
+	}{
+		{
+			pod: kubernetesPod{
+				Metadata: kubernetesPodMetadata{
+					Name:      "api-7d9f8b6c5-x2x4z",
+					Namespace: "default",
+					Labels:    map[string]string{"pod-template-hash": "7d9f8b6c5"},
+					OwnerReferences: []kubernetesOwnerReference{
+						{Kind: "ReplicaSet", Name: "api-7d9f8b6c5"},
+					},
+				},
+			},
+			name: "default/api",
+		},
+
+		{
+			pod: kubernetesPod{
+				Metadata: kubernetesPodMetadata{
+					Name:      "kafka-0",
+					Namespace: "streaming",
+					OwnerReferences: []kubernetesOwnerReference{
+						{Kind: "StatefulSet", Name: "kafka"},
+					},
+				},
+			},
+			name: "streaming/kafka",
+		},
+
+		{
+			pod: kubernetesPod{
+				Metadata: kubernetesPodMetadata{
+					Name:      "debug",
+					Namespace: "default",
+				},
+			},
+			name: "default/debug",
+		},
+	}
+
+	for _, test := range tests {
+		if name := test.pod.name(); name != test.name {
+			t.Errorf("%s: name mismatch: %s != %s", test.pod.Metadata.Name, name, test.name)
+		}
+	}
+}
+
+func TestKubernetesClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/pods" || r.URL.Query().Get("fieldSelector") != "status.phase=Running" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch r.URL.Query().Get("continue") {
+		case "":
+			w.Write([]byte(`{
+  "kind": "PodList",
+  "metadata": {"continue": "page-2"},
+  "items": [
+    {
+      "metadata": {
+        "name": "api-7d9f8b6c5-x2x4z",
+        "namespace": "default",
+        "labels": {"app": "api", "pod-template-hash": "7d9f8b6c5"},
+        "ownerReferences": [{"kind": "ReplicaSet", "name": "api-7d9f8b6c5"}]
+      },
+      "spec": {"nodeName": "node-1"},
+      "status": {"phase": "Running", "podIP": "10.1.0.4", "podIPs": [{"ip": "10.1.0.4"}, {"ip": "fd00::4"}]}
+    }
+  ]
+}`))
+		case "page-2":
+			w.Write([]byte(`{
+  "kind": "PodList",
+  "metadata": {},
+  "items": [
+    {
+      "metadata": {
+        "name": "kube-proxy-abcde",
+        "namespace": "kube-system",
+        "ownerReferences": [{"kind": "DaemonSet", "name": "kube-proxy"}]
+      },
+      "spec": {"hostNetwork": true},
+      "status": {"phase": "Running", "podIP": "192.168.0.10"}
+    }
+  ]
+}`))
+		default:
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer server.Close()
+
+	plugin := New()
+	plugin.kubernetesClient = kubernetesClient{host: server.URL}
+	plugin.refreshKubernetesCache()
+
+	cache, _ := plugin.clientCache.Load().(map[string][]string)
+
+	if !reflect.DeepEqual(cache, map[string][]string{
+		"10.1.0.4": {"default/api"},
+		"fd00::4":  {"default/api"},
+	}) {
+		t.Error("kubernetes cache mismatch:", cache)
+	}
+}
+
+func TestKubernetesRefresh(t *testing.T) {
+	lists := make(chan struct{}, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case lists <- struct{}{}:
+		default:
+		}
+		w.Write([]byte(`{"kind": "PodList", "metadata": {}, "items": []}`))
+	}))
+	defer server.Close()
+
+	agent := dogstatsdServer()
+	defer agent.Close()
+
+	plugin := dogstastdPlugin(agent.addr())
+	plugin.Clients = "kubernetes"
+	plugin.KubernetesRefresh = 20 * time.Millisecond // for the purpose of the test, forbidden otherwise
+	plugin.kubernetesClient = kubernetesClient{host: server.URL}
+	plugin.Start()
+	defer plugin.Stop()
+
+	// The pods are listed when the plugin starts, then on every refresh
+	// while the flush interval is a minute.
+	for i := 0; i != 3; i++ {
+		select {
+		case <-lists:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The pods were listed %d times only", i)
+		}
+	}
+}
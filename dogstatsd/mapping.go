@@ -0,0 +1,62 @@
+package dogstatsd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// addMapping adds a rule mapping the name of a prometheus metric or label to
+// the name of the dogstatsd metric or tag it is reported as. The rule is either
+// "metric_name" or "tag_name", and args are the names to map from and to.
+func (d *Dogstatsd) addMapping(rule string, args []string) error {
+	var names *map[string]string
+
+	switch rule {
+	case "metric_name":
+		names = &d.MetricNames
+	case "tag_name":
+		names = &d.TagNames
+	default:
+		return fmt.Errorf("unsupported mapping rule: %s", rule)
+	}
+
+	if len(args) != 2 {
+		return fmt.Errorf("%s expects the names to map from and to, got %d arguments", rule, len(args))
+	}
+
+	if *names == nil {
+		*names = make(map[string]string)
+	}
+
+	(*names)[args[0]] = args[1]
+	return nil
+}
+
+// loadMappings adds the mapping rules of the file at path, which has one rule
+// per line with the same syntax as in the plugin configuration. Empty lines and
+// lines starting with '#' are ignored.
+func (d *Dogstatsd) loadMappings(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if err := d.addMapping(fields[0], fields[1:]); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+	}
+
+	return s.Err()
+}
@@ -0,0 +1,72 @@
+package dogstatsd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadMappings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dogstatsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mappings")
+	if err := ioutil.WriteFile(path, []byte(`
+# Names of the datadog dashboards.
+metric_name coredns_dns_request_duration_seconds coredns.request.latency
+  metric_name coredns_dns_request_count_total coredns.request.count
+
+tag_name server srv
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := New()
+	d.TagNames = map[string]string{"zone": "domain"}
+
+	if err := d.loadMappings(path); err != nil {
+		t.Fatal(err)
+	}
+
+	metricNames := map[string]string{
+		"coredns_dns_request_duration_seconds": "coredns.request.latency",
+		"coredns_dns_request_count_total":      "coredns.request.count",
+	}
+	if !reflect.DeepEqual(d.MetricNames, metricNames) {
+		t.Errorf("Unexpected metric names:\n%v\n%v", metricNames, d.MetricNames)
+	}
+
+	tagNames := map[string]string{
+		"zone":   "domain",
+		"server": "srv",
+	}
+	if !reflect.DeepEqual(d.TagNames, tagNames) {
+		t.Errorf("Unexpected tag names:\n%v\n%v", tagNames, d.TagNames)
+	}
+
+	for _, test := range []struct {
+		content string
+		err     string
+	}{
+		{content: "label_name zone domain", err: "mappings:1: unsupported mapping rule"},
+		{content: "\nmetric_name a", err: "mappings:2: metric_name expects"},
+		{content: "tag_name a b c", err: "mappings:1: tag_name expects"},
+	} {
+		if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := New().loadMappings(path); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected an error containing %q but got: %v", test.content, test.err, err)
+		}
+	}
+
+	if err := New().loadMappings(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected an error loading a missing file")
+	}
+}
@@ -1,6 +1,8 @@
 package dogstatsd
 
 import (
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -18,9 +20,11 @@ type key struct {
 type kind int
 
 const (
-	counter   kind = 'c'
-	gauge     kind = 'g'
-	histogram kind = 'h'
+	counter      kind = 'c'
+	gauge        kind = 'g'
+	histogram    kind = 'h'
+	distribution kind = 'd'
+	timer        kind = 'm' // "ms" on the wire
 )
 
 type metric struct {
@@ -30,15 +34,85 @@ type metric struct {
 	rate  float64
 	tags  tags
 
-	// index of the histogram bucket that the metric was generated from.
+	// index of the histogram bucket or summary quantile that the metric was
+	// generated from.
 	index   int
 	count   uint64
 	version uint64
+
+	// percentile is true for the gauges of the percentiles of histograms,
+	// which are estimated from the observations since the last flush.
+	percentile bool
 }
 
-func makeMetrics(f *dto.MetricFamily, m *dto.Metric, rand func(min, max float64) float64) []metric {
-	name := makeName(*f.Name)
-	tags := makeTags(m)
+// untypedKind returns the kind of metrics that untyped prometheus metrics are
+// reported as for s, which is one of "gauge", "counter", or "none" to skip
+// them. The kind is zero for "none".
+func untypedKind(s string) (kind, bool) {
+	switch s {
+	case "gauge":
+		return gauge, true
+	case "counter":
+		return counter, true
+	case "none":
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// bucketValueFunc returns the function that computes the values that buckets of
+// histograms between min and max are reported as for s, which is one of
+// "random", "midpoint", "upper", or "lower".
+func bucketValueFunc(s string, random func(min, max float64) float64) (func(min, max float64) float64, bool) {
+	switch s {
+	case "random":
+		return random, true
+	case "midpoint":
+		return func(min, max float64) float64 { return (min + max) / 2 }, true
+	case "upper":
+		return func(min, max float64) float64 { return max }, true
+	case "lower":
+		return func(min, max float64) float64 { return min }, true
+	default:
+		return nil, false
+	}
+}
+
+// translation configures how prometheus metrics are translated to dogstatsd
+// metrics.
+type translation struct {
+	// Kind that the buckets of histograms are reported as, either histogram
+	// or distribution.
+	histograms kind
+
+	// Kind that untyped metrics are reported as, zero to skip them.
+	untyped kind
+
+	// When true, histograms of durations in seconds are reported as timers
+	// in milliseconds.
+	timers bool
+
+	// Names that metrics and tags are reported as, indexed by the names of
+	// the prometheus metrics and labels.
+	metricNames map[string]string
+	tagNames    map[string]string
+
+	// Returns the value that the observations of a histogram bucket between
+	// min and max are reported as.
+	bucketValue func(min, max float64) float64
+}
+
+// durationSuffix is the suffix of the names of prometheus histograms that are
+// reported as timers.
+const durationSuffix = "_duration_seconds"
+
+func makeMetrics(f *dto.MetricFamily, m *dto.Metric, t translation) []metric {
+	name, renamed := t.metricNames[*f.Name]
+	if !renamed {
+		name = makeName(*f.Name)
+	}
+	tags := makeTags(m, t.tagNames)
 
 	switch *f.Type {
 	case dto.MetricType_COUNTER:
@@ -62,15 +136,26 @@ func makeMetrics(f *dto.MetricFamily, m *dto.Metric, rand func(min, max float64)
 		metrics := make([]metric, 0, len(buckets))
 		acc := uint64(0)
 		min := 0.0
+		kind, scale := t.histograms, 1.0
+
+		// Timers are named after what they measure, the unit is implied by
+		// the metric type, so "coredns_dns_request_duration_seconds" becomes
+		// "coredns_dns_request_duration" unless it was renamed.
+		if t.timers && strings.HasSuffix(*f.Name, durationSuffix) {
+			if !renamed {
+				name = strings.TrimSuffix(name, "_seconds")
+			}
+			kind, scale = timer, 1000
+		}
 
 		for index, bucket := range buckets {
 			cct := *bucket.CumulativeCount
 			max := *bucket.UpperBound
 
 			metrics = append(metrics, metric{
-				kind:    histogram,
+				kind:    kind,
 				name:    name,
-				value:   rand(min, max),
+				value:   t.bucketValue(min, max) * scale,
 				tags:    tags,
 				index:   index,
 				count:   cct - acc,
@@ -83,12 +168,57 @@ func makeMetrics(f *dto.MetricFamily, m *dto.Metric, rand func(min, max float64)
 
 		return metrics
 
+	case dto.MetricType_SUMMARY:
+		quantiles := m.Summary.Quantile
+		metrics := make([]metric, 0, len(quantiles)+2)
+		count := *m.Summary.SampleCount
+
+		for index, quantile := range quantiles {
+			value := *quantile.Value
+			if math.IsNaN(value) { // no observations in the summary window
+				continue
+			}
+
+			metrics = append(metrics, metric{
+				kind:    gauge,
+				name:    name,
+				value:   value,
+				tags:    appendTag(tags, "quantile", strconv.FormatFloat(*quantile.Quantile, 'g', -1, 64)),
+				index:   index,
+				version: count,
+			})
+		}
+
+		return append(metrics,
+			metric{
+				kind:  counter,
+				name:  name + "_count",
+				value: float64(count),
+				tags:  tags,
+			},
+			metric{
+				kind:  counter,
+				name:  name + "_sum",
+				value: *m.Summary.SampleSum,
+				tags:  tags,
+			},
+		)
+
+	case dto.MetricType_UNTYPED:
+		// Untyped metrics are mostly registered by third-party plugins, there
+		// is no way to tell whether they behave like gauges or counters so the
+		// kind they are reported as is configured on the plugin.
+		if t.untyped == 0 {
+			return nil
+		}
+		return []metric{{
+			kind:  t.untyped,
+			name:  name,
+			value: *m.Untyped.Value,
+			tags:  tags,
+		}}
+
 	default:
-		// case dto.MetricType_SUMMARY:
-		// case dto.MetricType_UNTYPED:
-		//
-		// For now summary and untyped metrics are not used in coredns, so we
-		// will skip generating them.
 		return nil
 	}
 }
@@ -101,26 +231,94 @@ func makeName(s string) string {
 	return s
 }
 
-func appendMetric(b []byte, m metric) []byte {
+// appendMetric appends the dogstatsd representation of m to b, the global tags
+// are added after the tags of m.
+func appendMetric(b []byte, m metric, global tags, container string) []byte {
 	b = appendName(b, m.name)
 	b = append(b, ':')
 	b = strconv.AppendFloat(b, m.value, 'g', -1, 64)
 	b = append(b, '|')
 	b = append(b, byte(m.kind))
+	if m.kind == timer {
+		b = append(b, 's')
+	}
 
 	if m.rate != 0 && m.rate != 1 {
 		b = append(b, '|', '@')
 		b = strconv.AppendFloat(b, m.rate, 'g', -1, 64)
 	}
 
-	if len(m.tags) != 0 {
+	if len(m.tags) != 0 || len(global) != 0 {
 		b = append(b, '|', '#')
 		b = append(b, m.tags...)
+		if len(m.tags) != 0 && len(global) != 0 {
+			b = append(b, ',')
+		}
+		b = append(b, global...)
+	}
+
+	// The container ID lets the agent add the tags of the container the
+	// metric originates from.
+	if container != "" {
+		b = append(b, "|c:"...)
+		b = append(b, container...)
 	}
 
 	return append(b, '\n')
 }
 
+// truncateTags returns a copy of m with the values of its tags truncated so its
+// dogstatsd representation with the global tags and container fits in size bytes. Only the
+// longest values are truncated, to the same length, and all values keep at
+// least minTagValueLength characters. ok is false if m does not fit even with
+// all its tag values truncated.
+func truncateTags(m metric, global tags, container string, size int) (truncated metric, ok bool) {
+	excess := len(appendMetric(nil, m, global, container)) - size
+	if excess <= 0 {
+		return m, true
+	}
+
+	list := strings.Split(string(m.tags), ",")
+	values := make([]string, len(list))
+	maxLength := 0
+
+	for i, t := range list {
+		// Tags without a name are made of their value only.
+		values[i] = t[strings.IndexByte(t, ':')+1:]
+		if len(values[i]) > maxLength {
+			maxLength = len(values[i])
+		}
+	}
+
+	// The number of bytes removed by truncating the values to n characters.
+	removed := func(n int) (r int) {
+		for _, v := range values {
+			if len(v) > n {
+				r += len(v) - n
+			}
+		}
+		return
+	}
+
+	if removed(minTagValueLength) < excess {
+		return m, false
+	}
+
+	// Search the longest length that removes enough bytes.
+	n := minTagValueLength + sort.Search(maxLength-minTagValueLength, func(i int) bool {
+		return removed(minTagValueLength+i+1) < excess
+	})
+
+	for i, t := range list {
+		if v := values[i]; len(v) > n {
+			list[i] = t[:len(t)-len(v)+n]
+		}
+	}
+
+	m.tags = tags(strings.Join(list, ","))
+	return m, true
+}
+
 func appendName(b []byte, s string) []byte {
 	// Dogstatsd metric names must start with a letter. Here we are not checking
 	// for this condition because in the context of coredns all metric names are
@@ -203,7 +401,10 @@ func toLower(c rune) rune      { return c + ('a' - 'A') }
 
 type tags string
 
-func makeTags(m *dto.Metric) tags {
+// The minimum length of the tag values truncated by truncateTags.
+const minTagValueLength = 8
+
+func makeTags(m *dto.Metric, names map[string]string) tags {
 	if len(m.Label) == 0 {
 		return ""
 	}
@@ -214,7 +415,11 @@ func makeTags(m *dto.Metric) tags {
 		if i != 0 {
 			b = append(b, ',')
 		}
-		b = appendTagName(b, *p.Name)
+		name, ok := names[*p.Name]
+		if !ok {
+			name = *p.Name
+		}
+		b = appendTagName(b, name)
 		b = append(b, ':')
 		b = appendTagValue(b, *p.Value)
 	}
@@ -222,6 +427,41 @@ func makeTags(m *dto.Metric) tags {
 	return tags(b)
 }
 
+// makeGlobalTags returns the tags that are added to all metrics from a list of
+// datadog tags, each formatted as "name:value" or "value".
+func makeGlobalTags(list []string) tags {
+	b := make([]byte, 0, 20*len(list))
+
+	for _, t := range list {
+		if t == "" {
+			continue
+		}
+		if len(b) != 0 {
+			b = append(b, ',')
+		}
+		if i := strings.IndexByte(t, ':'); i >= 0 {
+			b = appendTagName(b, t[:i])
+			b = append(b, ':')
+			t = t[i+1:]
+		}
+		b = appendTagValue(b, t)
+	}
+
+	return tags(b)
+}
+
+func appendTag(t tags, name, value string) tags {
+	b := make([]byte, 0, len(t)+len(name)+len(value)+2)
+	b = append(b, t...)
+	if len(b) != 0 {
+		b = append(b, ',')
+	}
+	b = appendTagName(b, name)
+	b = append(b, ':')
+	b = appendTagValue(b, value)
+	return tags(b)
+}
+
 type state map[key]metric
 
 func (s state) observe(m metric) (metric, bool) {
@@ -252,9 +492,17 @@ func (s state) observe(m metric) (metric, bool) {
 		//
 		// Gauges are reported on every flush so the metric collection system
 		// does not "expire" them if it doesn't receive a value for a while.
-		v, ok = m, true
+		//
+		// The exception are the quantiles of summaries, which carry the count
+		// of observations of the summary as version. Like histogram buckets,
+		// they are only reported when the summary observed new values since
+		// the last flush, otherwise the same quantiles would be weighted more
+		// the longer a summary stays idle.
+		if ok = m.version == 0 || m.version != v.version; ok {
+			v = m
+		}
 
-	case histogram:
+	case histogram, distribution, timer:
 		// For histograms the appraoch is a bit more complex. Each bucket of a
 		// prometheus histogram is reported as an individual metric where the
 		// count is the number of changes that the bucket itself observed, and
@@ -270,6 +518,11 @@ func (s state) observe(m metric) (metric, bool) {
 		//
 		// Finally, we adjust the rate of the metric to represent the weight of
 		// each bucket.
+		//
+		// Distributions are reported the same way, the only difference is that
+		// the dogstatsd agent forwards their values instead of aggregating them
+		// locally, so percentiles are computed across all coredns instances.
+		// Timers are histograms of durations in milliseconds.
 		count := m.count - v.count
 		if ok = v.version != m.version && count != 0; ok {
 			m.rate = 1 / float64(count)
@@ -281,5 +534,75 @@ func (s state) observe(m metric) (metric, bool) {
 	return m, ok
 }
 
+// percentileMetrics returns gauges of the percentiles of the observations of a
+// histogram since the last flush, estimated by interpolating between the bounds
+// of its buckets like the histogram_quantile function of prometheus. buckets
+// are the metrics made of the histogram h, which must not have been observed
+// by s yet. Observations above the largest bound of the buckets are ignored.
+func (s state) percentileMetrics(h *dto.Histogram, buckets []metric, percentiles []float64) []metric {
+	if len(buckets) == 0 || len(buckets) != len(h.Bucket) {
+		return nil
+	}
+
+	counts := make([]uint64, len(buckets))
+	total := uint64(0)
+
+	for i, b := range buckets {
+		last := s[key{kind: b.kind, name: b.name, tags: b.tags, index: b.index}].count
+		if b.count >= last {
+			counts[i] = b.count - last
+		} else { // histogram reset
+			counts[i] = b.count
+		}
+		total += counts[i]
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	scale := 1.0
+	if buckets[0].kind == timer {
+		scale = 1000
+	}
+
+	metrics := make([]metric, 0, len(percentiles))
+
+	for _, p := range percentiles {
+		rank := p / 100 * float64(total)
+		acc, min := 0.0, 0.0
+		value := *h.Bucket[len(h.Bucket)-1].UpperBound
+
+		for i, b := range h.Bucket {
+			max := *b.UpperBound
+			count := float64(counts[i])
+			if count != 0 && acc+count >= rank {
+				value = min + (max-min)*(rank-acc)/count
+				break
+			}
+			acc, min = acc+count, max
+		}
+
+		metrics = append(metrics, metric{
+			kind:       gauge,
+			name:       buckets[0].name + percentileSuffix(p),
+			value:      value * scale,
+			tags:       buckets[0].tags,
+			percentile: true,
+		})
+	}
+
+	return metrics
+}
+
+// percentileSuffix returns the suffix of the names of the gauges of percentile
+// p, named after the metrics that the dogstatsd agent makes of histograms.
+func percentileSuffix(p float64) string {
+	if p == 50 {
+		return "_median"
+	}
+	return "_" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1) + "percentile"
+}
+
 func isGoMetric(name string) bool      { return strings.HasPrefix(name, "go_") }
 func isProcessMetric(name string) bool { return strings.HasPrefix(name, "process_") }
@@ -1,12 +1,15 @@
 package dogstatsd
 
 import (
+	"strings"
 	"testing"
 )
 
 var testMetrics = []struct {
 	s string
 	m metric
+	g tags
+	c string
 }{
 	{
 		s: "test.metric.small:0|c\n",
@@ -50,6 +53,26 @@ var testMetrics = []struct {
 		},
 	},
 
+	{
+		s: "request.latency:0.25|d|@0.5\n",
+		m: metric{
+			kind:  distribution,
+			name:  "request.latency",
+			value: 0.25,
+			rate:  0.5,
+		},
+	},
+
+	{
+		s: "request.duration:250|ms|@0.5\n",
+		m: metric{
+			kind:  timer,
+			name:  "request.duration",
+			value: 250,
+			rate:  0.5,
+		},
+	},
+
 	{
 		s: "fuel.level:0.5|g\n",
 		m: metric{
@@ -101,25 +124,165 @@ var testMetrics = []struct {
 			tags:  "country:china",
 		},
 	},
+
+	{
+		s: "users.online:1|c|#country:china,env:prod,service:coredns\n",
+		m: metric{
+			kind:  counter,
+			name:  "users.online",
+			value: 1,
+			rate:  1,
+			tags:  "country:china",
+		},
+		g: "env:prod,service:coredns",
+	},
+
+	{
+		s: "users.online:1|c|#env:prod\n",
+		m: metric{
+			kind:  counter,
+			name:  "users.online",
+			value: 1,
+			rate:  1,
+		},
+		g: "env:prod",
+	},
+
+	{
+		s: "users.online:1|c|#env:prod|c:83c1e1ee1b8ee2b1d7bb9f6e3a0e6d4c1b1d1e0a8f5e2c4d3b2a190807060504\n",
+		m: metric{
+			kind:  counter,
+			name:  "users.online",
+			value: 1,
+			rate:  1,
+		},
+		g: "env:prod",
+		c: "83c1e1ee1b8ee2b1d7bb9f6e3a0e6d4c1b1d1e0a8f5e2c4d3b2a190807060504",
+	},
 }
 
 func TestAppendMetric(t *testing.T) {
 	for _, test := range testMetrics {
 		t.Run(test.m.name, func(b *testing.T) {
-			if s := string(appendMetric(nil, test.m)); s != test.s {
+			if s := string(appendMetric(nil, test.m, test.g, test.c)); s != test.s {
 				t.Errorf("\n<<< %#v\n>>> %#v", test.s, s)
 			}
 		})
 	}
 }
 
+func TestTruncateTags(t *testing.T) {
+	tests := []struct {
+		m      metric
+		g      tags
+		size   int
+		tags   tags
+		failed bool
+	}{
+		{ // fits
+			m:    metric{kind: counter, name: "a", value: 1, tags: "zone:segment.com."},
+			g:    "env:prod",
+			size: 40,
+			tags: "zone:segment.com.",
+		},
+		{ // only the longest value is truncated
+			m:    metric{kind: counter, name: "a", value: 1, tags: "zone:segment.com.,name:" + tags(strings.Repeat("x", 40))},
+			size: 50,
+			tags: "zone:segment.com.,name:" + tags(strings.Repeat("x", 19)),
+		},
+		{ // values are truncated to the same length
+			m:    metric{kind: counter, name: "a", value: 1, tags: "zone:segment.com.,name:" + tags(strings.Repeat("x", 40))},
+			size: 40,
+			tags: "zone:segment.co,name:" + tags(strings.Repeat("x", 10)),
+		},
+		{ // tags without names and global tags
+			m:    metric{kind: counter, name: "a", value: 1, tags: tags(strings.Repeat("x", 40))},
+			g:    "env:prod",
+			size: 30,
+			tags: tags(strings.Repeat("x", 13)),
+		},
+		{ // values are not truncated below the minimum length
+			m:      metric{kind: counter, name: "a", value: 1, tags: "zone:segment.com.,name:" + tags(strings.Repeat("x", 40))},
+			size:   30,
+			failed: true,
+		},
+		{ // no tags
+			m:      metric{kind: counter, name: strings.Repeat("a", 40), value: 1},
+			size:   30,
+			failed: true,
+		},
+	}
+
+	for _, test := range tests {
+		m, ok := truncateTags(test.m, test.g, "", test.size)
+
+		if ok == test.failed {
+			t.Errorf("%q: expected the truncation to fail (%t) but found %t", test.m.tags, test.failed, !ok)
+			continue
+		}
+
+		if ok {
+			if m.tags != test.tags {
+				t.Errorf("%q: expected the tags to be %q but found: %q", test.m.tags, test.tags, m.tags)
+			}
+			if n := len(appendMetric(nil, m, test.g, "")); n > test.size {
+				t.Errorf("%q: expected the metric to fit in %d B but found: %d B", test.m.tags, test.size, n)
+			}
+		}
+	}
+}
+
+func TestBucketValueFunc(t *testing.T) {
+	random := func(min, max float64) float64 { return min + (max-min)/4 }
+
+	for s, expected := range map[string]float64{
+		"random":   1.5,
+		"midpoint": 2,
+		"upper":    3,
+		"lower":    1,
+	} {
+		f, ok := bucketValueFunc(s, random)
+		if !ok {
+			t.Errorf("%s: expected a bucket value function", s)
+			continue
+		}
+		if value := f(1, 3); value != expected {
+			t.Errorf("%s: expected the bucket value to be %g but found: %g", s, expected, value)
+		}
+	}
+
+	if _, ok := bucketValueFunc("median", random); ok {
+		t.Error("median: expected no bucket value function")
+	}
+}
+
+func TestPercentileSuffix(t *testing.T) {
+	for p, suffix := range map[float64]string{
+		50:   "_median",
+		95:   "_95percentile",
+		99.9: "_99_9percentile",
+	} {
+		if s := percentileSuffix(p); s != suffix {
+			t.Errorf("%g: expected the suffix to be %q but found: %q", p, suffix, s)
+		}
+	}
+}
+
+func TestMakeGlobalTags(t *testing.T) {
+	global := makeGlobalTags([]string{"env:Prod", "", "team:dns:core", "canary", "bad name:a b"})
+
+	if global != "env:prod,team:dns:core,canary,bad_name:a_b" {
+		t.Errorf("Unexpected global tags: %q", global)
+	}
+}
+
 func BenchmarkAppendMetric(b *testing.B) {
 	buffer := make([]byte, 4096)
 
 	for _, test := range testMetrics {
 		b.Run(test.m.name, func(b *testing.B) {
 			for i := 0; i != b.N; i++ {
-				appendMetric(buffer[:0], test.m)
+				appendMetric(buffer[:0], test.m, test.g, test.c)
 			}
 		})
 	}
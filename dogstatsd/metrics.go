@@ -0,0 +1,125 @@
+package dogstatsd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	metricsPlugin "github.com/coredns/coredns/plugin/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const subsystem = "dogstatsd"
+
+var (
+	once sync.Once
+
+	flushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: subsystem,
+		Name:      "flushes_total",
+		Help:      "The number of flushes of metrics to a dogstatsd agent.",
+	}, []string{"addr"})
+
+	flushErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: subsystem,
+		Name:      "flush_errors_total",
+		Help:      "The number of flushes of metrics to a dogstatsd agent which failed.",
+	}, []string{"addr"})
+
+	flushDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: subsystem,
+		Name:      "flush_duration_seconds",
+		Help:      "The distribution of durations of flushes of metrics to a dogstatsd agent.",
+		Buckets:   []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10},
+	}, []string{"addr"})
+
+	writtenBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: subsystem,
+		Name:      "written_bytes_total",
+		Help:      "The number of bytes of metrics written to a dogstatsd agent.",
+	}, []string{"addr"})
+
+	droppedMetrics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: subsystem,
+		Name:      "dropped_metrics_total",
+		Help:      "The number of metrics not sent to a dogstatsd agent because they exceeded the buffer size.",
+	}, []string{"addr"})
+
+	droppedFlushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: subsystem,
+		Name:      "dropped_flushes_total",
+		Help:      "The number of flushes of metrics dropped because the previous flushes to a dogstatsd agent were not done.",
+	}, []string{"addr"})
+
+	truncatedMetrics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: subsystem,
+		Name:      "truncated_metrics_total",
+		Help:      "The number of metrics sent to a dogstatsd agent with tag values truncated to fit in the buffer size.",
+	}, []string{"addr"})
+
+	droppedTagSets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: subsystem,
+		Name:      "dropped_tag_sets_total",
+		Help:      "The number of tag sets of metrics aggregated in an \"other\" series because they exceeded the maximum number of tag sets per metric.",
+	}, []string{"addr", "name"})
+)
+
+type agentMetrics struct {
+	addr string
+}
+
+func (m agentMetrics) flushesInc() {
+	flushes.WithLabelValues(m.addr).Inc()
+}
+
+func (m agentMetrics) flushErrorsInc() {
+	flushErrors.WithLabelValues(m.addr).Inc()
+}
+
+func (m agentMetrics) flushDurationsObserve(d time.Duration) {
+	flushDurations.WithLabelValues(m.addr).Observe(float64(d) / float64(time.Second))
+}
+
+func (m agentMetrics) writtenBytesAdd(n int) {
+	writtenBytes.WithLabelValues(m.addr).Add(float64(n))
+}
+
+func (m agentMetrics) droppedMetricsInc() {
+	droppedMetrics.WithLabelValues(m.addr).Inc()
+}
+
+func (m agentMetrics) droppedFlushesInc() {
+	droppedFlushes.WithLabelValues(m.addr).Inc()
+}
+
+func (m agentMetrics) truncatedMetricsInc() {
+	truncatedMetrics.WithLabelValues(m.addr).Inc()
+}
+
+func (m agentMetrics) droppedTagSetsAdd(name string, n int) {
+	droppedTagSets.WithLabelValues(m.addr, name).Add(float64(n))
+}
+
+// registerMetrics registers the metrics of the plugin to the registry of the
+// prometheus plugin, they are reported to the dogstatsd agent like the metrics
+// of other plugins.
+func registerMetrics(m *metricsPlugin.Metrics) {
+	once.Do(func() {
+		m.MustRegister(flushes)
+		m.MustRegister(flushErrors)
+		m.MustRegister(flushDurations)
+		m.MustRegister(writtenBytes)
+		m.MustRegister(droppedMetrics)
+		m.MustRegister(truncatedMetrics)
+		m.MustRegister(droppedFlushes)
+		m.MustRegister(droppedTagSets)
+	})
+}
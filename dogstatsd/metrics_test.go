@@ -0,0 +1,71 @@
+package dogstatsd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestAgentMetrics(t *testing.T) {
+	server, plugin, _ := setupTest()
+	defer server.Close()
+
+	metrics := []metric{
+		{kind: counter, name: "coredns.dns.requests", value: 1},
+		{kind: gauge, name: "coredns.dns.cache.size", value: 42, tags: tags("name:" + strings.Repeat("a", 100))},
+		{kind: gauge, name: "coredns.dns." + strings.Repeat("a", 100), value: 42},
+	}
+
+	if err := plugin.flushMetrics(metrics); err != nil {
+		t.Fatal(err)
+	}
+	assertRead(t, server,
+		"coredns.dns.requests:1|c",
+		"coredns.dns.cache.size:42|g|#name:"+strings.Repeat("a", 65),
+	)
+
+	addr := plugin.Addr
+	if n := metricValue(flushes.WithLabelValues(addr)); n != 1 {
+		t.Errorf("Expected 1 flush but found: %g", n)
+	}
+	if n := metricValue(flushErrors.WithLabelValues(addr)); n != 0 {
+		t.Errorf("Expected no flush errors but found: %g", n)
+	}
+	if n := metricValue(flushDurations.WithLabelValues(addr).(prometheus.Metric)); n != 1 {
+		t.Errorf("Expected 1 flush duration but found: %g", n)
+	}
+	if n := metricValue(writtenBytes.WithLabelValues(addr)); n != 125 {
+		t.Errorf("Expected 125 written bytes but found: %g", n)
+	}
+	if n := metricValue(truncatedMetrics.WithLabelValues(addr)); n != 1 {
+		t.Errorf("Expected 1 truncated metric but found: %g", n)
+	}
+	if n := metricValue(droppedMetrics.WithLabelValues(addr)); n != 1 {
+		t.Errorf("Expected 1 dropped metric but found: %g", n)
+	}
+
+	plugin.Addr = "tcp://127.0.0.1:1" // nothing listens on this port
+	errors := metricValue(flushErrors.WithLabelValues(plugin.Addr))
+	if err := plugin.flushMetrics(metrics); err == nil {
+		t.Error("Expected an error flushing to an agent which is not listening")
+	}
+	if n := metricValue(flushErrors.WithLabelValues(plugin.Addr)); n != errors+1 {
+		t.Errorf("Expected %g flush errors but found: %g", errors+1, n)
+	}
+}
+
+func metricValue(m prometheus.Metric) float64 {
+	var v dto.Metric
+	m.Write(&v)
+	switch {
+	case v.Counter != nil:
+		return v.Counter.GetValue()
+	case v.Gauge != nil:
+		return v.Gauge.GetValue()
+	case v.Histogram != nil:
+		return float64(v.Histogram.GetSampleCount())
+	}
+	return 0
+}
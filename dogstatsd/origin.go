@@ -0,0 +1,84 @@
+package dogstatsd
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+var (
+	// The path of a cgroup in the lines of /proc/self/cgroup, which are
+	// formatted as "hierarchy-ID:controllers:path".
+	cgroupPath = regexp.MustCompile(`^\d+:[^:]*:(.+)$`)
+
+	// The IDs of docker and containerd containers, of ECS tasks, and of the
+	// containers of kubernetes pods (in their UUID form), which end the path
+	// of the cgroups of containers.
+	cgroupContainerID = regexp.MustCompile(`([0-9a-f]{64}|[0-9a-f]{32}-\d+|[0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})(?:\.scope)?$`)
+
+	// The ID of the container in the mount point of its hostname file, which
+	// is used with cgroup v2 where the cgroup path of containers is "/".
+	mountinfoContainerID = regexp.MustCompile(`/([^\s/]+)/([0-9a-f]{64})/[\S]*hostname`)
+)
+
+// envContainerID returns the ID of the container the process runs in, detected
+// from its cgroups or its mount points, or an empty string if it is not in a
+// container or if origin detection is disabled by the DD_ORIGIN_DETECTION_ENABLED
+// environment variable of datadog.
+func envContainerID() string {
+	if enabled, err := strconv.ParseBool(os.Getenv("DD_ORIGIN_DETECTION_ENABLED")); err == nil && !enabled {
+		return ""
+	}
+
+	if id := readContainerID("/proc/self/cgroup", parseCgroupContainerID); id != "" {
+		return id
+	}
+
+	return readContainerID("/proc/self/mountinfo", parseMountinfoContainerID)
+}
+
+func readContainerID(path string, parse func(io.Reader) string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	return parse(f)
+}
+
+// parseCgroupContainerID returns the container ID found at the end of a cgroup
+// path in r, which has the format of /proc/self/cgroup.
+func parseCgroupContainerID(r io.Reader) string {
+	s := bufio.NewScanner(r)
+
+	for s.Scan() {
+		path := cgroupPath.FindStringSubmatch(s.Text())
+		if path == nil {
+			continue
+		}
+		if id := cgroupContainerID.FindStringSubmatch(path[1]); id != nil {
+			return id[1]
+		}
+	}
+
+	return ""
+}
+
+// parseMountinfoContainerID returns the container ID found in the mount point
+// of the hostname file in r, which has the format of /proc/self/mountinfo. The
+// IDs of the sandboxes of kubernetes pods are ignored.
+func parseMountinfoContainerID(r io.Reader) string {
+	s := bufio.NewScanner(r)
+
+	for s.Scan() {
+		for _, m := range mountinfoContainerID.FindAllStringSubmatch(s.Text(), -1) {
+			if m[1] != "sandboxes" {
+				return m[2]
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,76 @@
+package dogstatsd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCgroupContainerID(t *testing.T) {
+	tests := []struct {
+		cgroup string
+		id     string
+	}{
+		{
+			cgroup: "0::/\n",
+			id:     "",
+		},
+
+		{ // docker
+			cgroup: `12:memory:/docker/3726184226f5d3147c25fdeab5b60097e378e8a720503a5e19ecfdf29f869860
+11:cpu,cpuacct:/docker/3726184226f5d3147c25fdeab5b60097e378e8a720503a5e19ecfdf29f869860
+`,
+			id: "3726184226f5d3147c25fdeab5b60097e378e8a720503a5e19ecfdf29f869860",
+		},
+
+		{ // kubernetes with systemd
+			cgroup: "1:name=systemd:/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod2d3da189_6407_48e3_9ab6_78188d75e609.slice/cri-containerd-7b8952daecf4c0e44bbcefe1b5c5ebc7b4839d4eefeccefe694709d3809b6199.scope\n",
+			id:     "7b8952daecf4c0e44bbcefe1b5c5ebc7b4839d4eefeccefe694709d3809b6199",
+		},
+
+		{ // ECS fargate
+			cgroup: "1:name=systemd:/ecs/34dc0b5e626f2c5c4c5170e34b10e765-1234567890\n",
+			id:     "34dc0b5e626f2c5c4c5170e34b10e765-1234567890",
+		},
+
+		{ // not a container
+			cgroup: "4:memory:/user.slice/user-1000.slice/session-2.scope\n",
+			id:     "",
+		},
+	}
+
+	for _, test := range tests {
+		if id := parseCgroupContainerID(strings.NewReader(test.cgroup)); id != test.id {
+			t.Errorf("%q: expected the container ID to be %q but found: %q", test.cgroup, test.id, id)
+		}
+	}
+}
+
+func TestParseMountinfoContainerID(t *testing.T) {
+	tests := []struct {
+		mountinfo string
+		id        string
+	}{
+		{
+			mountinfo: "608 554 0:52 / / rw,relatime master:293 - overlay overlay rw\n",
+			id:        "",
+		},
+
+		{ // docker with cgroup v2
+			mountinfo: `608 554 0:52 / / rw,relatime master:293 - overlay overlay rw
+620 608 254:1 /docker/containers/0cfa82bf3ab29da271548d6a044e95c948c6fd2f7578fb41833a44ca23da425f/hostname /etc/hostname rw,relatime - ext4 /dev/vda1 rw
+`,
+			id: "0cfa82bf3ab29da271548d6a044e95c948c6fd2f7578fb41833a44ca23da425f",
+		},
+
+		{ // kubernetes pod sandbox, which is not the container
+			mountinfo: "620 608 254:1 /var/lib/containerd/io.containerd.grpc.v1.cri/sandboxes/fc7038bc73a8d3850c66ddbfb0b2901afa378bfcbb942cc384b051767e4ac6b0/hostname /etc/hostname rw - ext4 /dev/vda1 rw\n",
+			id:        "",
+		},
+	}
+
+	for _, test := range tests {
+		if id := parseMountinfoContainerID(strings.NewReader(test.mountinfo)); id != test.id {
+			t.Errorf("%q: expected the container ID to be %q but found: %q", test.mountinfo, test.id, id)
+		}
+	}
+}
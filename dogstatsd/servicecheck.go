@@ -0,0 +1,132 @@
+package dogstatsd
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Name of the service check reporting the health of CoreDNS.
+const serviceCheckName = "coredns.up"
+
+type serviceCheckStatus int
+
+const (
+	serviceCheckOK serviceCheckStatus = iota
+	serviceCheckWarning
+	serviceCheckCritical
+	serviceCheckUnknown
+)
+
+type serviceCheck struct {
+	name    string
+	status  serviceCheckStatus
+	message string
+	time    time.Time
+}
+
+// appendServiceCheck appends the dogstatsd representation of c to b, the
+// hostname is omitted when empty.
+func appendServiceCheck(b []byte, c serviceCheck, hostname string, global tags) []byte {
+	b = append(b, "_sc|"...)
+	b = append(b, c.name...)
+	b = append(b, '|')
+	b = strconv.AppendInt(b, int64(c.status), 10)
+
+	if !c.time.IsZero() {
+		b = append(b, "|d:"...)
+		b = strconv.AppendInt(b, c.time.Unix(), 10)
+	}
+
+	if hostname != "" {
+		b = append(b, "|h:"...)
+		b = append(b, hostname...)
+	}
+
+	if len(global) != 0 {
+		b = append(b, '|', '#')
+		b = append(b, global...)
+	}
+
+	// The message must be the last field.
+	if c.message != "" {
+		b = append(b, "|m:"...)
+		b = append(b, escapeEventText(c.message)...)
+	}
+
+	return append(b, '\n')
+}
+
+// healthCounters counts the queries and the failed queries, which were
+// answered with SERVFAIL or returned an error from a plugin, since the last
+// service check.
+type healthCounters struct {
+	mutex    sync.Mutex
+	queries  int64
+	failures int64
+}
+
+func (c *healthCounters) incr(failed bool) {
+	c.mutex.Lock()
+	c.queries++
+	if failed {
+		c.failures++
+	}
+	c.mutex.Unlock()
+}
+
+func (c *healthCounters) swap() (queries, failures int64) {
+	c.mutex.Lock()
+	queries, failures = c.queries, c.failures
+	c.queries, c.failures = 0, 0
+	c.mutex.Unlock()
+	return
+}
+
+// checkHealth queues a service check with the status derived from the rate of
+// failed queries since the last check, if service checks are enabled. Only the
+// last check is kept when the previous one was not written yet.
+func (d *Dogstatsd) checkHealth() {
+	if !d.EnableServiceCheck {
+		return
+	}
+
+	queries, failures := d.health.swap()
+	check := serviceCheck{
+		name:   serviceCheckName,
+		status: serviceCheckOK,
+		time:   time.Now(),
+	}
+
+	if queries == 0 {
+		check.message = "No queries since the last check."
+	} else {
+		rate := 100 * float64(failures) / float64(queries)
+		switch {
+		case failures != 0 && rate >= d.ServiceCheckCritical:
+			check.status = serviceCheckCritical
+		case failures != 0 && rate >= d.ServiceCheckWarning:
+			check.status = serviceCheckWarning
+		}
+		check.message = fmt.Sprintf("%d of %d queries (%.2f%%) failed since the last check.", failures, queries, rate)
+	}
+
+	d.pendingMutex.Lock()
+	d.serviceCheck = &check
+	d.pendingMutex.Unlock()
+}
+
+// takeServiceChecks returns the service check waiting to be written to the
+// agent, if any, and removes it.
+func (d *Dogstatsd) takeServiceChecks() []serviceCheck {
+	d.pendingMutex.Lock()
+	defer d.pendingMutex.Unlock()
+
+	if d.serviceCheck == nil {
+		return nil
+	}
+	checks := []serviceCheck{*d.serviceCheck}
+	d.serviceCheck = nil
+	return checks
+}
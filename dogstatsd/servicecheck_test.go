@@ -0,0 +1,77 @@
+package dogstatsd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAppendServiceCheck(t *testing.T) {
+	tests := []struct {
+		s        string
+		c        serviceCheck
+		hostname string
+		g        tags
+	}{
+		{
+			s: "_sc|coredns.up|0\n",
+			c: serviceCheck{name: "coredns.up"},
+		},
+
+		{
+			s: "_sc|coredns.up|2|d:1500000000|h:coredns-1|#env:prod,host:coredns-1|m:Hello\\nWorld\n",
+			c: serviceCheck{
+				name:    "coredns.up",
+				status:  serviceCheckCritical,
+				message: "Hello\nWorld",
+				time:    time.Unix(1500000000, 0),
+			},
+			hostname: "coredns-1",
+			g:        makeGlobalTags([]string{"env:prod", "host:coredns-1"}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.s, func(t *testing.T) {
+			if s := string(appendServiceCheck(nil, test.c, test.hostname, test.g)); s != test.s {
+				t.Errorf("\nexpected: %q\nfound:    %q", test.s, s)
+			}
+		})
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	tests := []struct {
+		queries  int
+		failures int
+		status   serviceCheckStatus
+	}{
+		{queries: 0, failures: 0, status: serviceCheckOK},
+		{queries: 1000, failures: 0, status: serviceCheckOK},
+		{queries: 1000, failures: 9, status: serviceCheckOK},
+		{queries: 1000, failures: 10, status: serviceCheckWarning},
+		{queries: 1000, failures: 49, status: serviceCheckWarning},
+		{queries: 1000, failures: 50, status: serviceCheckCritical},
+		{queries: 1000, failures: 1000, status: serviceCheckCritical},
+	}
+
+	d := New()
+	if d.checkHealth(); d.takeServiceChecks() != nil {
+		t.Error("Expected no service check when they are disabled")
+	}
+	d.EnableServiceCheck = true
+
+	for _, test := range tests {
+		for i := 0; i != test.queries; i++ {
+			d.health.incr(i < test.failures)
+		}
+		d.checkHealth()
+
+		checks := d.takeServiceChecks()
+		if len(checks) != 1 {
+			t.Fatalf("Expected a single service check but found: %+v", checks)
+		}
+		if checks[0].status != test.status {
+			t.Errorf("Expected status %d for %d failures out of %d queries but found: %d (%s)", test.status, test.failures, test.queries, checks[0].status, checks[0].message)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package dogstatsd
 
 import (
+	"crypto/tls"
 	"errors"
+	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -46,10 +49,16 @@ func setup(c *caddy.Controller) error {
 			return errors.New("the dogstatsd plugin requires the prometheus plugin to be loaded, add 'prometheus' to the zone configuration block where 'dogstatsd' is declared")
 		}
 		d.Reg = m.Reg
+		registerMetrics(m)
 		d.Start()
 		return nil
 	})
 
+	c.OnRestart(func() error {
+		d.Reload()
+		return nil
+	})
+
 	c.OnShutdown(func() error {
 		d.Stop()
 		return nil
@@ -76,7 +85,7 @@ func dogstatsdParse(c *caddy.Controller) (*Dogstatsd, error) {
 			d.Addr = "udp://" + d.Addr
 		} else {
 			switch d.Addr[:i] {
-			case "udp", "udp4", "udp6", "unixgram":
+			case "udp", "udp4", "udp6", "unixgram", "tcp", "tcp4", "tcp6", "unix":
 			default:
 				return nil, c.Errf("unsupported protocol: %s", d.Addr[:i])
 			}
@@ -94,12 +103,73 @@ func dogstatsdParse(c *caddy.Controller) (*Dogstatsd, error) {
 			}
 			d.BufferSize = bufferSize
 
+		case "format":
+			format, statsdTemplate, err := dogstatsdParseFormat(c)
+			if err != nil {
+				return nil, err
+			}
+			d.Format, d.StatsdTemplate = format, statsdTemplate
+
 		case "flush":
-			flushInterval, err := dogstatsdParseFlush(c)
+			flushInterval, flushJitter, err := dogstatsdParseFlush(c)
 			if err != nil {
 				return nil, err
 			}
-			d.FlushInterval = flushInterval
+			d.FlushInterval, d.FlushJitter = flushInterval, flushJitter
+
+		case "topn":
+			topN, topInterval, err := dogstatsdParseTopN(c)
+			if err != nil {
+				return nil, err
+			}
+			d.TopN, d.TopInterval = topN, topInterval
+
+		case "clients":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			switch args[0] {
+			case "docker", "kubernetes", "ecs", "ip", "subnet":
+			default:
+				return nil, c.Errf("clients must be identified by docker, kubernetes, ecs, ip, or subnet, got %s", args[0])
+			}
+			d.Clients = args[0]
+
+		case "docker":
+			dockerHost, dockerTLSConfig, err := dogstatsdParseDocker(c)
+			if err != nil {
+				return nil, err
+			}
+			d.DockerHost, d.DockerTLSConfig = dockerHost, dockerTLSConfig
+
+		case "docker_refresh":
+			dockerRefresh, err := dogstatsdParseRefresh(c, "docker")
+			if err != nil {
+				return nil, err
+			}
+			d.DockerRefresh = dockerRefresh
+
+		case "kubernetes_refresh":
+			kubernetesRefresh, err := dogstatsdParseRefresh(c, "kubernetes")
+			if err != nil {
+				return nil, err
+			}
+			d.KubernetesRefresh = kubernetesRefresh
+
+		case "ecs_refresh":
+			ecsRefresh, err := dogstatsdParseRefresh(c, "ecs")
+			if err != nil {
+				return nil, err
+			}
+			d.ECSRefresh = ecsRefresh
+
+		case "docker_labels":
+			labels := c.RemainingArgs()
+			if len(labels) == 0 {
+				return nil, c.ArgErr()
+			}
+			d.DockerLabels = append(d.DockerLabels, labels...)
 
 		case "go":
 			if len(c.RemainingArgs()) != 0 {
@@ -113,6 +183,112 @@ func dogstatsdParse(c *caddy.Controller) (*Dogstatsd, error) {
 			}
 			d.EnableProcessMetrics = true
 
+		case "distributions":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			d.EnableDistributions = true
+
+		case "timers":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			d.EnableTimers = true
+
+		case "events":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			d.EnableEvents = true
+
+		case "service_check":
+			warning, critical, err := dogstatsdParseServiceCheck(c)
+			if err != nil {
+				return nil, err
+			}
+			d.EnableServiceCheck = true
+			d.ServiceCheckWarning, d.ServiceCheckCritical = warning, critical
+
+		case "container_id":
+			containerID, err := dogstatsdParseContainerID(c)
+			if err != nil {
+				return nil, err
+			}
+			d.ContainerID = containerID
+
+		case "hostname":
+			hostname, err := dogstatsdParseHostname(c)
+			if err != nil {
+				return nil, err
+			}
+			d.Hostname = hostname
+
+		case "include":
+			patterns, err := dogstatsdParsePatterns(c)
+			if err != nil {
+				return nil, err
+			}
+			d.Include = append(d.Include, patterns...)
+
+		case "exclude":
+			patterns, err := dogstatsdParsePatterns(c)
+			if err != nil {
+				return nil, err
+			}
+			d.Exclude = append(d.Exclude, patterns...)
+
+		case "strip_tags":
+			pattern, labels, err := dogstatsdParseStripTags(c)
+			if err != nil {
+				return nil, err
+			}
+			if d.StripTags == nil {
+				d.StripTags = make(map[string][]string)
+			}
+			d.StripTags[pattern] = append(d.StripTags[pattern], labels...)
+
+		case "metric_name", "tag_name":
+			if err := d.addMapping(c.Val(), c.RemainingArgs()); err != nil {
+				return nil, c.Err(err.Error())
+			}
+
+		case "mappings":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			if err := d.loadMappings(args[0]); err != nil {
+				return nil, c.Err(err.Error())
+			}
+
+		case "untyped":
+			untyped, err := dogstatsdParseUntyped(c)
+			if err != nil {
+				return nil, err
+			}
+			d.Untyped = untyped
+
+		case "bucket_value":
+			bucketValue, err := dogstatsdParseBucketValue(c)
+			if err != nil {
+				return nil, err
+			}
+			d.BucketValue = bucketValue
+
+		case "max_tag_sets":
+			maxTagSets, err := dogstatsdParseMaxTagSets(c)
+			if err != nil {
+				return nil, err
+			}
+			d.MaxTagSets = maxTagSets
+
+		case "percentiles":
+			percentiles, err := dogstatsdParsePercentiles(c)
+			if err != nil {
+				return nil, err
+			}
+			d.Percentiles = append(d.Percentiles, percentiles...)
+
 		default:
 			return nil, c.ArgErr()
 		}
@@ -144,10 +320,39 @@ func dogstatsdParseBuffer(c *caddy.Controller) (bufferSize int, err error) {
 	return
 }
 
-func dogstatsdParseFlush(c *caddy.Controller) (flushInterval time.Duration, err error) {
+func dogstatsdParseFormat(c *caddy.Controller) (format, statsdTemplate string, err error) {
 	args := c.RemainingArgs()
 
-	if len(args) != 1 {
+	if len(args) != 1 && len(args) != 2 {
+		err = c.ArgErr()
+		return
+	}
+
+	format, statsdTemplate = args[0], defaultStatsdTemplate
+
+	switch format {
+	case "dogstatsd", "influx":
+		if len(args) != 1 {
+			err = c.Err("the name template is only supported by the statsd and graphite formats")
+		}
+	case "statsd", "graphite":
+		if len(args) == 2 {
+			statsdTemplate = args[1]
+			if _, err = parseNameTemplate(statsdTemplate); err != nil {
+				err = c.Err(err.Error())
+			}
+		}
+	default:
+		err = c.Errf("unsupported format: %s", format)
+	}
+
+	return
+}
+
+func dogstatsdParseFlush(c *caddy.Controller) (flushInterval, flushJitter time.Duration, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 && len(args) != 2 {
 		err = c.ArgErr()
 		return
 	}
@@ -158,7 +363,280 @@ func dogstatsdParseFlush(c *caddy.Controller) (flushInterval time.Duration, err
 
 	if flushInterval < (1 * time.Second) {
 		err = c.Errf("the flush interval must be at least 1s, got %s", flushInterval)
+		return
+	}
+
+	if len(args) == 2 {
+		if flushJitter, err = time.ParseDuration(args[1]); err != nil {
+			return
+		}
+
+		if flushJitter < 0 || flushJitter >= flushInterval {
+			err = c.Errf("the flush jitter must be between 0 and the flush interval of %s, got %s", flushInterval, flushJitter)
+		}
+	}
+
+	return
+}
+
+func dogstatsdParseDocker(c *caddy.Controller) (dockerHost string, dockerTLSConfig *tls.Config, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 && len(args) != 3 && len(args) != 4 {
+		err = c.ArgErr()
+		return
+	}
+
+	dockerHost = args[0]
+	network, _ := dockerNetworkAddress(dockerHost)
+
+	switch network {
+	case "unix", "tcp":
+	default:
+		err = c.Errf("unsupported docker protocol: %s", network)
+		return
+	}
+
+	if len(args) == 1 {
+		return
+	}
+
+	if network != "tcp" {
+		err = c.Errf("docker client certificates require a tcp address, got %s", dockerHost)
+		return
+	}
+
+	caFile := ""
+	if len(args) == 4 {
+		caFile = args[3]
+	}
+
+	if dockerTLSConfig, err = makeDockerTLSConfig(args[1], args[2], caFile); err != nil {
+		err = c.Errf("loading docker client certificates: %s", err)
+	}
+
+	return
+}
+
+func dogstatsdParseRefresh(c *caddy.Controller, clients string) (refresh time.Duration, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	if refresh, err = time.ParseDuration(args[0]); err != nil {
+		return
+	}
+
+	if refresh < (1 * time.Second) {
+		err = c.Errf("the %s refresh interval must be at least 1s, got %s", clients, refresh)
+	}
+
+	return
+}
+
+func dogstatsdParseTopN(c *caddy.Controller) (topN int, topInterval time.Duration, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 && len(args) != 2 {
+		err = c.ArgErr()
+		return
+	}
+
+	if topN, err = strconv.Atoi(args[0]); err != nil {
+		return
+	}
+
+	if topN < 1 || topN > 1000 {
+		err = c.Errf("the number of top counters must be between 1 and 1000, got %d", topN)
+		return
+	}
+
+	if len(args) == 2 {
+		if topInterval, err = time.ParseDuration(args[1]); err != nil {
+			return
+		}
+
+		if topInterval < (1 * time.Second) {
+			err = c.Errf("the top counters interval must be at least 1s, got %s", topInterval)
+		}
+	}
+
+	return
+}
+
+func dogstatsdParseUntyped(c *caddy.Controller) (untyped string, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	if _, ok := untypedKind(args[0]); !ok {
+		err = c.Errf("untyped metrics must be reported as gauge, counter, or none, got %s", args[0])
+		return
+	}
+
+	untyped = args[0]
+	return
+}
+
+func dogstatsdParseBucketValue(c *caddy.Controller) (bucketValue string, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	if _, ok := bucketValueFunc(args[0], randFloat64); !ok {
+		err = c.Errf("histogram buckets must be reported as random, midpoint, upper, or lower, got %s", args[0])
+		return
+	}
+
+	bucketValue = args[0]
+	return
+}
+
+func dogstatsdParseMaxTagSets(c *caddy.Controller) (maxTagSets int, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	if maxTagSets, err = strconv.Atoi(args[0]); err != nil {
+		return
+	}
+
+	if maxTagSets < 1 {
+		err = c.Errf("the maximum number of tag sets must be at least 1, got %d", maxTagSets)
+	}
+
+	return
+}
+
+func dogstatsdParsePercentiles(c *caddy.Controller) (percentiles []float64, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) == 0 {
+		err = c.ArgErr()
+		return
+	}
+
+	for _, arg := range args {
+		var p float64
+
+		if p, err = strconv.ParseFloat(arg, 64); err != nil {
+			return
+		}
+
+		if p <= 0 || p >= 100 {
+			err = c.Errf("percentiles must be between 0 and 100, got %s", arg)
+			return
+		}
+
+		percentiles = append(percentiles, p)
+	}
+
+	return
+}
+
+func dogstatsdParseServiceCheck(c *caddy.Controller) (warning, critical float64, err error) {
+	warning, critical = defaultServiceCheckWarning, defaultServiceCheckCritical
+	args := c.RemainingArgs()
+
+	if len(args) > 2 {
+		err = c.ArgErr()
+		return
+	}
+
+	if len(args) > 0 {
+		if warning, err = strconv.ParseFloat(args[0], 64); err != nil {
+			return
+		}
+	}
+
+	if len(args) > 1 {
+		if critical, err = strconv.ParseFloat(args[1], 64); err != nil {
+			return
+		}
+	}
+
+	if warning < 0 || critical > 100 || warning > critical {
+		err = c.Errf("the service check thresholds must be percentages with the warning threshold not above the critical threshold, got %g and %g", warning, critical)
+	}
+
+	return
+}
+
+func dogstatsdParseContainerID(c *caddy.Controller) (containerID string, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) != 1 {
+		err = c.ArgErr()
+		return
+	}
+
+	switch containerID = args[0]; {
+	case containerID == "none":
+		containerID = ""
+	case strings.ContainsAny(containerID, "|,#:"):
+		err = c.Errf("invalid container ID: %s", containerID)
+	}
+
+	return
+}
+
+func dogstatsdParseHostname(c *caddy.Controller) (hostname string, err error) {
+	switch args := c.RemainingArgs(); len(args) {
+	case 0:
+		if hostname, err = os.Hostname(); err != nil {
+			err = c.Errf("the hostname could not be determined, set it explicitly: %s", err)
+		}
+	case 1:
+		hostname = args[0]
+	default:
+		err = c.ArgErr()
+	}
+	return
+}
+
+func dogstatsdParsePatterns(c *caddy.Controller) (patterns []string, err error) {
+	patterns = c.RemainingArgs()
+
+	if len(patterns) == 0 {
+		err = c.ArgErr()
+		return
+	}
+
+	for _, pattern := range patterns {
+		if _, err = path.Match(pattern, ""); err != nil {
+			err = c.Errf("invalid metric name pattern: %s", pattern)
+			return
+		}
+	}
+
+	return
+}
+
+func dogstatsdParseStripTags(c *caddy.Controller) (pattern string, labels []string, err error) {
+	args := c.RemainingArgs()
+
+	if len(args) < 2 {
+		err = c.ArgErr()
+		return
+	}
+
+	if _, err = path.Match(args[0], ""); err != nil {
+		err = c.Errf("invalid metric name pattern: %s", args[0])
+		return
 	}
 
+	pattern, labels = args[0], args[1:]
 	return
 }
@@ -1,6 +1,8 @@
 package dogstatsd
 
 import (
+	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -8,51 +10,156 @@ import (
 )
 
 func TestSetupSuccess(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	tests := []struct {
 		input                string
 		addr                 string
 		bufferSize           int
+		format               string
+		statsdTemplate       string
 		flushInterval        time.Duration
+		flushJitter          time.Duration
+		topN                 int
+		topInterval          time.Duration
+		clients              string
+		dockerHost           string
+		dockerRefresh        time.Duration
+		kubernetesRefresh    time.Duration
+		ecsRefresh           time.Duration
+		dockerLabels         []string
 		enableGoMetrics      bool
 		enableProcessMetrics bool
+		enableDistributions  bool
+		enableTimers         bool
+		enableEvents         bool
+		enableServiceCheck   bool
+		serviceCheckWarning  float64
+		serviceCheckCritical float64
+		hostname             string
+		containerID          string
+		metricNames          map[string]string
+		tagNames             map[string]string
+		include              []string
+		exclude              []string
+		stripTags            map[string][]string
+		untyped              string
+		bucketValue          string
+		percentiles          []float64
+		maxTagSets           int
 	}{
 		{
-			input:         `dogstatsd`,
-			addr:          defaultAddr,
-			bufferSize:    defaultBufferSize,
-			flushInterval: defaultFlushInterval,
+			input:          `dogstatsd`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input:          `dogstatsd 10.50.0.2:8125`,
+			addr:           "udp://10.50.0.2:8125",
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
 		},
 
 		{
-			input:         `dogstatsd 10.50.0.2:8125`,
-			addr:          "udp://10.50.0.2:8125",
-			bufferSize:    defaultBufferSize,
-			flushInterval: defaultFlushInterval,
+			input:          `dogstatsd udp://10.50.0.2:8125`,
+			addr:           "udp://10.50.0.2:8125",
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
 		},
 
 		{
-			input:         `dogstatsd udp://10.50.0.2:8125`,
-			addr:          "udp://10.50.0.2:8125",
-			bufferSize:    defaultBufferSize,
-			flushInterval: defaultFlushInterval,
+			input:          `dogstatsd tcp://10.50.0.2:8125`,
+			addr:           "tcp://10.50.0.2:8125",
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input:          `dogstatsd unix:///var/run/datadog/dsd.socket`,
+			addr:           "unix:///var/run/datadog/dsd.socket",
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
 		},
 
 		{
 			input: `dogstatsd {
 				buffer 8192
 			}`,
-			addr:          defaultAddr,
-			bufferSize:    8192,
-			flushInterval: defaultFlushInterval,
+			addr:           defaultAddr,
+			bufferSize:     8192,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
 		},
 
 		{
 			input: `dogstatsd {
 				flush 10s
 			}`,
-			addr:          defaultAddr,
-			bufferSize:    defaultBufferSize,
-			flushInterval: 10 * time.Second,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  10 * time.Second,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				flush 10s 2s
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  10 * time.Second,
+			flushJitter:    2 * time.Second,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
 		},
 
 		{
@@ -60,9 +167,187 @@ func TestSetupSuccess(t *testing.T) {
 				buffer 8192
 				flush 10s
 			}`,
-			addr:          defaultAddr,
-			bufferSize:    8192,
-			flushInterval: 10 * time.Second,
+			addr:           defaultAddr,
+			bufferSize:     8192,
+			flushInterval:  10 * time.Second,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				topn 25
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           25,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				topn 25 5m
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           25,
+			clients:        defaultClients,
+			topInterval:    5 * time.Minute,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				clients kubernetes
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        "kubernetes",
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				clients ecs
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        "ecs",
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				clients subnet
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        "subnet",
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				docker_refresh 10s
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			dockerRefresh:  10 * time.Second,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				kubernetes_refresh 30s
+			}`,
+			addr:              defaultAddr,
+			bufferSize:        defaultBufferSize,
+			flushInterval:     defaultFlushInterval,
+			topN:              defaultTopN,
+			clients:           defaultClients,
+			kubernetesRefresh: 30 * time.Second,
+			untyped:           defaultUntyped,
+			bucketValue:       defaultBucketValue,
+			format:            defaultFormat,
+			statsdTemplate:    defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				ecs_refresh 30s
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			ecsRefresh:     30 * time.Second,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				docker_labels com.docker.compose.service team
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			dockerLabels:   []string{"com.docker.compose.service", "team"},
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				docker unix:///var/run/docker.sock
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			dockerHost:     "unix:///var/run/docker.sock",
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				docker tcp://10.0.0.1:2376
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			dockerHost:     "tcp://10.0.0.1:2376",
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
 		},
 
 		{
@@ -72,7 +357,13 @@ func TestSetupSuccess(t *testing.T) {
 			addr:            defaultAddr,
 			bufferSize:      defaultBufferSize,
 			flushInterval:   defaultFlushInterval,
+			topN:            defaultTopN,
+			clients:         defaultClients,
 			enableGoMetrics: true,
+			untyped:         defaultUntyped,
+			bucketValue:     defaultBucketValue,
+			format:          defaultFormat,
+			statsdTemplate:  defaultStatsdTemplate,
 		},
 
 		{
@@ -82,7 +373,395 @@ func TestSetupSuccess(t *testing.T) {
 			addr:                 defaultAddr,
 			bufferSize:           defaultBufferSize,
 			flushInterval:        defaultFlushInterval,
+			topN:                 defaultTopN,
+			clients:              defaultClients,
 			enableProcessMetrics: true,
+			untyped:              defaultUntyped,
+			bucketValue:          defaultBucketValue,
+			format:               defaultFormat,
+			statsdTemplate:       defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				distributions
+			}`,
+			addr:                defaultAddr,
+			bufferSize:          defaultBufferSize,
+			flushInterval:       defaultFlushInterval,
+			topN:                defaultTopN,
+			clients:             defaultClients,
+			enableDistributions: true,
+			untyped:             defaultUntyped,
+			bucketValue:         defaultBucketValue,
+			format:              defaultFormat,
+			statsdTemplate:      defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				timers
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			enableTimers:   true,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				events
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			enableEvents:   true,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				hostname coredns-1
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			hostname:       "coredns-1",
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				hostname
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			hostname:       hostname,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				container_id 83c1e1ee1b8e
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			containerID:    "83c1e1ee1b8e",
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				container_id none
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			containerID:    "none",
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				metric_name coredns_dns_request_duration_seconds coredns.request.latency
+				tag_name server srv
+				tag_name zone domain
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+			metricNames: map[string]string{
+				"coredns_dns_request_duration_seconds": "coredns.request.latency",
+			},
+			tagNames: map[string]string{
+				"server": "srv",
+				"zone":   "domain",
+			},
+		},
+
+		{
+			input: `dogstatsd {
+				include coredns_dns_* coredns_consul_*
+				exclude coredns_consul_cache_*
+				exclude coredns_dns_request_size_bytes
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+			include:        []string{"coredns_dns_*", "coredns_consul_*"},
+			exclude:        []string{"coredns_consul_cache_*", "coredns_dns_request_size_bytes"},
+		},
+
+		{
+			input: `dogstatsd {
+				strip_tags coredns_consul_cache_* name
+				strip_tags coredns_consul_cache_* dc
+				strip_tags coredns_dns_* server zone
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+			stripTags: map[string][]string{
+				"coredns_consul_cache_*": {"name", "dc"},
+				"coredns_dns_*":          {"server", "zone"},
+			},
+		},
+
+		{
+			input: `dogstatsd {
+				untyped counter
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        "counter",
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				untyped none
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        "none",
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				bucket_value midpoint
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    "midpoint",
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				percentiles 50 95 99.9
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+			percentiles:    []float64{50, 95, 99.9},
+		},
+
+		{
+			input: `dogstatsd {
+				max_tag_sets 100
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+			format:         defaultFormat,
+			statsdTemplate: defaultStatsdTemplate,
+			maxTagSets:     100,
+		},
+
+		{
+			input: `dogstatsd {
+				format dogstatsd
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			format:         "dogstatsd",
+			statsdTemplate: defaultStatsdTemplate,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+		},
+
+		{
+			input: `dogstatsd {
+				format statsd
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			format:         "statsd",
+			statsdTemplate: defaultStatsdTemplate,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+		},
+
+		{
+			input: `dogstatsd {
+				format statsd {metric}.{server}.{zone}
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			format:         "statsd",
+			statsdTemplate: "{metric}.{server}.{zone}",
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+		},
+
+		{
+			input: `dogstatsd {
+				format influx
+			}`,
+			addr:           defaultAddr,
+			bufferSize:     defaultBufferSize,
+			format:         "influx",
+			statsdTemplate: defaultStatsdTemplate,
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+		},
+
+		{
+			input: `dogstatsd tcp://10.0.0.1:2003 {
+				format graphite {metric}.{zone}
+			}`,
+			addr:           "tcp://10.0.0.1:2003",
+			bufferSize:     defaultBufferSize,
+			format:         "graphite",
+			statsdTemplate: "{metric}.{zone}",
+			flushInterval:  defaultFlushInterval,
+			topN:           defaultTopN,
+			clients:        defaultClients,
+			untyped:        defaultUntyped,
+			bucketValue:    defaultBucketValue,
+		},
+
+		{
+			input: `dogstatsd {
+				service_check
+			}`,
+			addr:                 defaultAddr,
+			bufferSize:           defaultBufferSize,
+			flushInterval:        defaultFlushInterval,
+			topN:                 defaultTopN,
+			clients:              defaultClients,
+			untyped:              defaultUntyped,
+			bucketValue:          defaultBucketValue,
+			enableServiceCheck:   true,
+			serviceCheckWarning:  defaultServiceCheckWarning,
+			serviceCheckCritical: defaultServiceCheckCritical,
+			format:               defaultFormat,
+			statsdTemplate:       defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				service_check 2
+			}`,
+			addr:                 defaultAddr,
+			bufferSize:           defaultBufferSize,
+			flushInterval:        defaultFlushInterval,
+			topN:                 defaultTopN,
+			clients:              defaultClients,
+			untyped:              defaultUntyped,
+			bucketValue:          defaultBucketValue,
+			enableServiceCheck:   true,
+			serviceCheckWarning:  2,
+			serviceCheckCritical: defaultServiceCheckCritical,
+			format:               defaultFormat,
+			statsdTemplate:       defaultStatsdTemplate,
+		},
+
+		{
+			input: `dogstatsd {
+				service_check 0.5 10
+			}`,
+			addr:                 defaultAddr,
+			bufferSize:           defaultBufferSize,
+			flushInterval:        defaultFlushInterval,
+			topN:                 defaultTopN,
+			clients:              defaultClients,
+			untyped:              defaultUntyped,
+			bucketValue:          defaultBucketValue,
+			enableServiceCheck:   true,
+			serviceCheckWarning:  0.5,
+			serviceCheckCritical: 10,
+			format:               defaultFormat,
+			statsdTemplate:       defaultStatsdTemplate,
 		},
 	}
 
@@ -106,10 +785,63 @@ func TestSetupSuccess(t *testing.T) {
 				t.Errorf("Expected buffer size to be %v%% but found: %v%%", test.bufferSize, d.BufferSize)
 			}
 
+			if d.Format != test.format {
+				t.Errorf("Expected format to be %q but found: %q", test.format, d.Format)
+			}
+
+			if d.StatsdTemplate != test.statsdTemplate {
+				t.Errorf("Expected statsd template to be %q but found: %q", test.statsdTemplate, d.StatsdTemplate)
+			}
+
 			if d.FlushInterval != test.flushInterval {
 				t.Errorf("Expected flush interval to be %v but found: %v", test.flushInterval, d.FlushInterval)
 			}
 
+			if d.FlushJitter != test.flushJitter {
+				t.Errorf("Expected flush jitter to be %v but found: %v", test.flushJitter, d.FlushJitter)
+			}
+
+			if d.TopN != test.topN {
+				t.Errorf("Expected top counters size to be %v but found: %v", test.topN, d.TopN)
+			}
+
+			if d.TopInterval != test.topInterval {
+				t.Errorf("Expected top counters interval to be %v but found: %v", test.topInterval, d.TopInterval)
+			}
+
+			if d.Clients != test.clients {
+				t.Errorf("Expected clients to be identified by %v but found: %v", test.clients, d.Clients)
+			}
+
+			dockerHost := test.dockerHost
+			if dockerHost == "" {
+				dockerHost = os.Getenv("DOCKER_HOST")
+			}
+
+			if d.DockerHost != dockerHost {
+				t.Errorf("Expected docker host to be %q but found: %q", dockerHost, d.DockerHost)
+			}
+
+			if d.DockerTLSConfig != nil {
+				t.Errorf("Expected no docker TLS configuration but found: %+v", d.DockerTLSConfig)
+			}
+
+			if d.DockerRefresh != test.dockerRefresh {
+				t.Errorf("Expected docker refresh interval to be %v but found: %v", test.dockerRefresh, d.DockerRefresh)
+			}
+
+			if d.KubernetesRefresh != test.kubernetesRefresh {
+				t.Errorf("Expected kubernetes refresh interval to be %v but found: %v", test.kubernetesRefresh, d.KubernetesRefresh)
+			}
+
+			if d.ECSRefresh != test.ecsRefresh {
+				t.Errorf("Expected ecs refresh interval to be %v but found: %v", test.ecsRefresh, d.ECSRefresh)
+			}
+
+			if !reflect.DeepEqual(d.DockerLabels, test.dockerLabels) {
+				t.Errorf("Expected docker labels to be %q but found: %q", test.dockerLabels, d.DockerLabels)
+			}
+
 			if d.EnableGoMetrics != test.enableGoMetrics {
 				t.Errorf("Expected go metrics to be %t but found: %t", test.enableGoMetrics, d.EnableGoMetrics)
 			}
@@ -117,6 +849,90 @@ func TestSetupSuccess(t *testing.T) {
 			if d.EnableProcessMetrics != test.enableProcessMetrics {
 				t.Errorf("Expected process metrics to be %t but found: %t", test.enableProcessMetrics, d.EnableProcessMetrics)
 			}
+
+			if d.EnableDistributions != test.enableDistributions {
+				t.Errorf("Expected distributions to be %t but found: %t", test.enableDistributions, d.EnableDistributions)
+			}
+
+			if d.EnableTimers != test.enableTimers {
+				t.Errorf("Expected timers to be %t but found: %t", test.enableTimers, d.EnableTimers)
+			}
+
+			if d.EnableEvents != test.enableEvents {
+				t.Errorf("Expected events to be %t but found: %t", test.enableEvents, d.EnableEvents)
+			}
+
+			if d.EnableServiceCheck != test.enableServiceCheck {
+				t.Errorf("Expected service check to be %t but found: %t", test.enableServiceCheck, d.EnableServiceCheck)
+			}
+
+			serviceCheckWarning := test.serviceCheckWarning
+			if serviceCheckWarning == 0 {
+				serviceCheckWarning = defaultServiceCheckWarning
+			}
+
+			serviceCheckCritical := test.serviceCheckCritical
+			if serviceCheckCritical == 0 {
+				serviceCheckCritical = defaultServiceCheckCritical
+			}
+
+			if d.ServiceCheckWarning != serviceCheckWarning || d.ServiceCheckCritical != serviceCheckCritical {
+				t.Errorf("Expected service check thresholds to be %g and %g but found: %g and %g", serviceCheckWarning, serviceCheckCritical, d.ServiceCheckWarning, d.ServiceCheckCritical)
+			}
+
+			if d.Hostname != test.hostname {
+				t.Errorf("Expected hostname to be %q but found: %q", test.hostname, d.Hostname)
+			}
+
+			// The container ID defaults to the container that the test runs
+			// in, "none" is expected to disable it.
+			containerID := test.containerID
+			switch containerID {
+			case "":
+				containerID = envContainerID()
+			case "none":
+				containerID = ""
+			}
+
+			if d.ContainerID != containerID {
+				t.Errorf("Expected container ID to be %q but found: %q", containerID, d.ContainerID)
+			}
+
+			if !reflect.DeepEqual(d.MetricNames, test.metricNames) {
+				t.Errorf("Expected metric names to be %v but found: %v", test.metricNames, d.MetricNames)
+			}
+
+			if !reflect.DeepEqual(d.TagNames, test.tagNames) {
+				t.Errorf("Expected tag names to be %v but found: %v", test.tagNames, d.TagNames)
+			}
+
+			if !reflect.DeepEqual(d.Include, test.include) {
+				t.Errorf("Expected included metrics to be %q but found: %q", test.include, d.Include)
+			}
+
+			if !reflect.DeepEqual(d.Exclude, test.exclude) {
+				t.Errorf("Expected excluded metrics to be %q but found: %q", test.exclude, d.Exclude)
+			}
+
+			if !reflect.DeepEqual(d.StripTags, test.stripTags) {
+				t.Errorf("Expected stripped tags to be %q but found: %q", test.stripTags, d.StripTags)
+			}
+
+			if d.Untyped != test.untyped {
+				t.Errorf("Expected untyped metrics to be reported as %s but found: %s", test.untyped, d.Untyped)
+			}
+
+			if d.BucketValue != test.bucketValue {
+				t.Errorf("Expected histogram buckets to be reported as %s but found: %s", test.bucketValue, d.BucketValue)
+			}
+
+			if d.MaxTagSets != test.maxTagSets {
+				t.Errorf("Expected maximum number of tag sets to be %d but found: %d", test.maxTagSets, d.MaxTagSets)
+			}
+
+			if !reflect.DeepEqual(d.Percentiles, test.percentiles) {
+				t.Errorf("Expected percentiles to be %v but found: %v", test.percentiles, d.Percentiles)
+			}
 		})
 	}
 }
@@ -152,6 +968,96 @@ func TestSetupFailure(t *testing.T) {
 		`dogstatsd { # too many arguments to 'flush'
 			flush 1m% whatever
 		}`,
+		`dogstatsd { # invalid second argument to 'flush'
+			flush 1m whatever
+		}`,
+		`dogstatsd { # 'flush' jitter is not shorter than the interval
+			flush 10s 10s
+		}`,
+		`dogstatsd { # negative second argument to 'flush'
+			flush 10s -1s
+		}`,
+		`dogstatsd { # too many arguments to 'flush'
+			flush 10s 1s whatever
+		}`,
+		`dogstatsd { # missing argument to 'topn'
+			topn
+		}`,
+		`dogstatsd { # invalid first argument to 'topn'
+			topn whatever
+		}`,
+		`dogstatsd { # 'topn' is too small
+			topn 0
+		}`,
+		`dogstatsd { # 'topn' is too large
+			topn 1001
+		}`,
+		`dogstatsd { # invalid second argument to 'topn'
+			topn 25 whatever
+		}`,
+		`dogstatsd { # 'topn' interval is too short
+			topn 25 100ms
+		}`,
+		`dogstatsd { # too many arguments to 'topn'
+			topn 25 5m whatever
+		}`,
+		`dogstatsd { # missing argument to 'clients'
+			clients
+		}`,
+		`dogstatsd { # invalid argument to 'clients'
+			clients hostname
+		}`,
+		`dogstatsd { # missing argument to 'docker_refresh'
+			docker_refresh
+		}`,
+		`dogstatsd { # missing argument to 'docker'
+			docker
+		}`,
+		`dogstatsd { # missing key to 'docker'
+			docker tcp://10.0.0.1:2376 cert.pem
+		}`,
+		`dogstatsd { # too many arguments to 'docker'
+			docker tcp://10.0.0.1:2376 cert.pem key.pem ca.pem whatever
+		}`,
+		`dogstatsd { # unsupported protocol of 'docker'
+			docker ssh://10.0.0.1
+		}`,
+		`dogstatsd { # client certificates of 'docker' on a unix socket
+			docker unix:///var/run/docker.sock cert.pem key.pem
+		}`,
+		`dogstatsd { # client certificates of 'docker' not found
+			docker tcp://10.0.0.1:2376 /no/such/cert.pem /no/such/key.pem
+		}`,
+		`dogstatsd { # invalid argument to 'docker_refresh'
+			docker_refresh whatever
+		}`,
+		`dogstatsd { # 'docker_refresh' is too short
+			docker_refresh 500ms
+		}`,
+		`dogstatsd { # too many arguments to 'docker_refresh'
+			docker_refresh 10s whatever
+		}`,
+		`dogstatsd { # missing argument to 'kubernetes_refresh'
+			kubernetes_refresh
+		}`,
+		`dogstatsd { # invalid argument to 'kubernetes_refresh'
+			kubernetes_refresh whatever
+		}`,
+		`dogstatsd { # 'kubernetes_refresh' is too short
+			kubernetes_refresh 500ms
+		}`,
+		`dogstatsd { # missing argument to 'ecs_refresh'
+			ecs_refresh
+		}`,
+		`dogstatsd { # invalid argument to 'ecs_refresh'
+			ecs_refresh whatever
+		}`,
+		`dogstatsd { # 'ecs_refresh' is too short
+			ecs_refresh 500ms
+		}`,
+		`dogstatsd { # missing argument to 'docker_labels'
+			docker_labels
+		}`,
 		`dogstatsd { # invalid plugin configuration entry
 			whatever
 		}`,
@@ -161,6 +1067,126 @@ func TestSetupFailure(t *testing.T) {
 		`dogstats { # too may arguments to 'process'
 			process hello
 		}`,
+		`dogstatsd { # too may arguments to 'distributions'
+			distributions hello
+		}`,
+		`dogstatsd { # too may arguments to 'timers'
+			timers hello
+		}`,
+		`dogstatsd { # too may arguments to 'events'
+			events hello
+		}`,
+		`dogstatsd { # too may arguments to 'service_check'
+			service_check 1 5 10
+		}`,
+		`dogstatsd { # invalid argument to 'service_check'
+			service_check 1%
+		}`,
+		`dogstatsd { # warning threshold above the default critical threshold of 'service_check'
+			service_check 10
+		}`,
+		`dogstatsd { # warning threshold above the critical threshold of 'service_check'
+			service_check 5 1
+		}`,
+		`dogstatsd { # out of range argument to 'service_check'
+			service_check 1 200
+		}`,
+		`dogstatsd { # too may arguments to 'hostname'
+			hostname coredns-1 coredns-2
+		}`,
+		`dogstatsd { # missing argument to 'container_id'
+			container_id
+		}`,
+		`dogstatsd { # too may arguments to 'container_id'
+			container_id 83c1e1ee1b8e 6d4c1b1d1e0a
+		}`,
+		`dogstatsd { # invalid argument to 'container_id'
+			container_id 83c1e1ee|1b8e
+		}`,
+		`dogstatsd { # missing argument to 'include'
+			include
+		}`,
+		`dogstatsd { # invalid pattern passed to 'exclude'
+			exclude coredns_[
+		}`,
+		`dogstatsd { # missing label passed to 'strip_tags'
+			strip_tags coredns_consul_cache_*
+		}`,
+		`dogstatsd { # invalid pattern passed to 'strip_tags'
+			strip_tags coredns_[ name
+		}`,
+		`dogstatsd { # missing argument to 'metric_name'
+			metric_name coredns_dns_request_count_total
+		}`,
+		`dogstatsd { # too many arguments to 'tag_name'
+			tag_name server srv whatever
+		}`,
+		`dogstatsd { # missing argument to 'mappings'
+			mappings
+		}`,
+		`dogstatsd { # missing file passed to 'mappings'
+			mappings /this/file/does/not/exist
+		}`,
+		`dogstatsd { # missing argument to 'untyped'
+			untyped
+		}`,
+		`dogstatsd { # invalid argument to 'untyped'
+			untyped histogram
+		}`,
+		`dogstatsd { # too many arguments to 'untyped'
+			untyped gauge counter
+		}`,
+		`dogstatsd { # missing argument to 'bucket_value'
+			bucket_value
+		}`,
+		`dogstatsd { # invalid argument to 'bucket_value'
+			bucket_value median
+		}`,
+		`dogstatsd { # too many arguments to 'bucket_value'
+			bucket_value upper lower
+		}`,
+		`dogstatsd { # missing argument to 'format'
+			format
+		}`,
+		`dogstatsd { # too many arguments to 'format'
+			format statsd {metric} {zone}
+		}`,
+		`dogstatsd { # unsupported argument to 'format'
+			format opentsdb
+		}`,
+		`dogstatsd { # name template with the dogstatsd format
+			format dogstatsd {metric}
+		}`,
+		`dogstatsd { # name template with the influx format
+			format influx {metric}
+		}`,
+		`dogstatsd { # graphite name template without the metric name
+			format graphite {zone}
+		}`,
+		`dogstatsd { # name template without the metric name
+			format statsd {zone}
+		}`,
+		`dogstatsd { # unclosed placeholder in the name template
+			format statsd {metric}.{zone
+		}`,
+		`dogstatsd { # missing argument to 'max_tag_sets'
+			max_tag_sets
+		}`,
+		`dogstatsd { # invalid argument to 'max_tag_sets'
+			max_tag_sets many
+		}`,
+		`dogstatsd { # out of range argument to 'max_tag_sets'
+			max_tag_sets 0
+		}`,
+		`dogstatsd { # missing argument to 'percentiles'
+			percentiles
+		}`,
+		`dogstatsd { # invalid argument to 'percentiles'
+			percentiles 50 p99
+		}`,
+		`dogstatsd { # out of range argument to 'percentiles'
+			percentiles 50 100
+		}`,
 	}
 
 	for _, test := range tests {
@@ -0,0 +1,161 @@
+package dogstatsd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Name of the template placeholder replaced with the name of metrics.
+const templateMetric = "metric"
+
+// nameTemplate is the template of the names of metrics in the statsd format,
+// made of literal parts and of placeholders replaced with the values of tags.
+type nameTemplate []templatePart
+
+type templatePart struct {
+	text        string
+	placeholder bool
+}
+
+// parseNameTemplate parses s, where "{metric}" is replaced with the name of
+// metrics and "{TAG}" with the value of their tag named TAG.
+func parseNameTemplate(s string) (nameTemplate, error) {
+	var t nameTemplate
+	var metric bool
+
+	for s != "" {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			t = append(t, templatePart{text: s})
+			break
+		}
+		if i != 0 {
+			t = append(t, templatePart{text: s[:i]})
+		}
+
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in name template: %q", s[i:])
+		}
+
+		name := s[i+1 : i+j]
+		if name == "" {
+			return nil, fmt.Errorf("empty placeholder in name template")
+		}
+		if name == templateMetric {
+			metric = true
+		}
+
+		t = append(t, templatePart{text: name, placeholder: true})
+		s = s[i+j+1:]
+	}
+
+	if !metric {
+		return nil, fmt.Errorf("the name template must contain the {%s} placeholder", templateMetric)
+	}
+
+	return t, nil
+}
+
+// appendName appends the name of m made from the template to b. The periods
+// left by placeholders of tags that m does not have are removed.
+func (t nameTemplate) appendName(b []byte, m metric, global tags) []byte {
+	start := len(b)
+
+	for _, p := range t {
+		switch {
+		case !p.placeholder:
+			b = append(b, p.text...)
+		case p.text == templateMetric:
+			b = appendName(b, m.name)
+		default:
+			value, ok := lookupTag(m.tags, p.text)
+			if !ok {
+				value, _ = lookupTag(global, p.text)
+			}
+			b = appendStatsdNamePart(b, value)
+		}
+	}
+
+	// Periods are the separators of the hierarchy of statsd names, there must
+	// be no empty parts.
+	name := b[start:]
+	n := 0
+	for _, c := range name {
+		if c == '.' && (n == 0 || name[n-1] == '.') {
+			continue
+		}
+		name[n] = c
+		n++
+	}
+	if n != 0 && name[n-1] == '.' {
+		n--
+	}
+
+	return b[:start+n]
+}
+
+// appendStatsdNamePart appends s to b with characters which are not allowed in
+// a part of a statsd name, including periods, replaced by underscores.
+func appendStatsdNamePart(b []byte, s string) []byte {
+	for _, c := range s {
+		switch {
+		case isAlphaNum(c), isMinus(c), isUnderscore(c):
+			b = append(b, byte(c))
+		default:
+			b = append(b, '_')
+		}
+	}
+	return b
+}
+
+// lookupTag returns the value of the tag of t named name. Tags without a name
+// are never found.
+func lookupTag(t tags, name string) (string, bool) {
+	for s := string(t); s != ""; {
+		tag := s
+		if i := strings.IndexByte(s, ','); i >= 0 {
+			tag, s = s[:i], s[i+1:]
+		} else {
+			s = ""
+		}
+		if i := strings.IndexByte(tag, ':'); i >= 0 && tag[:i] == name {
+			return tag[i+1:], true
+		}
+	}
+	return "", false
+}
+
+// appendStatsdMetric appends the plain statsd representation of m to b, its
+// name is made from the template and it has no tags. Histograms and
+// distributions are reported as timers, which is how statsd servers compute
+// percentiles.
+func appendStatsdMetric(b []byte, m metric, global tags, template nameTemplate) []byte {
+	// A gauge with a sign is an increment of the gauge in statsd, negative
+	// values are set by resetting the gauge to zero first.
+	if m.kind == gauge && m.value < 0 {
+		b = template.appendName(b, m, global)
+		b = append(b, ":0|g\n"...)
+	}
+
+	b = template.appendName(b, m, global)
+	b = append(b, ':')
+	b = strconv.AppendFloat(b, m.value, 'g', -1, 64)
+
+	switch m.kind {
+	case counter:
+		b = append(b, "|c"...)
+	case gauge:
+		b = append(b, "|g"...)
+	default:
+		b = append(b, "|ms"...)
+	}
+
+	if m.rate != 0 && m.rate != 1 {
+		b = append(b, '|', '@')
+		b = strconv.AppendFloat(b, m.rate, 'g', -1, 64)
+	}
+
+	return append(b, '\n')
+}
@@ -0,0 +1,106 @@
+package dogstatsd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNameTemplate(t *testing.T) {
+	tests := []struct {
+		s string
+		t nameTemplate
+	}{
+		{
+			s: "{metric}",
+			t: nameTemplate{{text: "metric", placeholder: true}},
+		},
+
+		{
+			s: "dns.{metric}.{server}.by_zone.{zone}",
+			t: nameTemplate{
+				{text: "dns."},
+				{text: "metric", placeholder: true},
+				{text: "."},
+				{text: "server", placeholder: true},
+				{text: ".by_zone."},
+				{text: "zone", placeholder: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		template, err := parseNameTemplate(test.s)
+		if err != nil {
+			t.Errorf("%q: %s", test.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(template, test.t) {
+			t.Errorf("%q:\nexpected: %+v\nfound:    %+v", test.s, test.t, template)
+		}
+	}
+
+	for _, s := range []string{"", "{zone}", "{metric}.{zone", "{metric}.{}"} {
+		if _, err := parseNameTemplate(s); err == nil {
+			t.Errorf("%q: expected an error parsing the template", s)
+		}
+	}
+}
+
+func TestAppendStatsdMetric(t *testing.T) {
+	template, err := parseNameTemplate("{metric}.{server}.{zone}.{env}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		s string
+		m metric
+	}{
+		{
+			s: "coredns.dns.requests.total.dns____53.example_org_.prod:1|c\n",
+			m: metric{
+				kind:  counter,
+				name:  "coredns_dns_requests_total",
+				value: 1,
+				tags:  "server:dns://:53,zone:example.org.",
+			},
+		},
+
+		{ // missing tags
+			s: "coredns.dns.cache.size.prod:42|g\n",
+			m: metric{
+				kind:  gauge,
+				name:  "coredns_dns_cache_size",
+				value: 42,
+			},
+		},
+
+		{ // negative gauge
+			s: "coredns.temperature.prod:0|g\ncoredns.temperature.prod:-1.5|g\n",
+			m: metric{
+				kind:  gauge,
+				name:  "coredns_temperature",
+				value: -1.5,
+			},
+		},
+
+		{ // histograms are timers, and keep their sample rate
+			s: "coredns.dns.request.duration.seconds.dns____53.prod:0.25|ms|@0.5\n",
+			m: metric{
+				kind:  histogram,
+				name:  "coredns_dns_request_duration_seconds",
+				value: 0.25,
+				rate:  0.5,
+				tags:  "server:dns://:53",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.m.name, func(t *testing.T) {
+			if s := string(appendStatsdMetric(nil, test.m, "env:prod,host:coredns-1", template)); s != test.s {
+				t.Errorf("\nexpected: %q\nfound:    %q", test.s, s)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package dogstatsd
+
+import (
+	"path"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// strippedLabels returns the labels that are removed from the metrics of the
+// family with the given name, which are the labels of all the patterns of
+// StripTags matching the name.
+func (d *Dogstatsd) strippedLabels(name string) map[string]struct{} {
+	var labels map[string]struct{}
+
+	for pattern, list := range d.StripTags {
+		if match, _ := path.Match(pattern, name); !match {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]struct{}, len(list))
+		}
+		for _, label := range list {
+			labels[label] = struct{}{}
+		}
+	}
+
+	return labels
+}
+
+// stripLabels removes the labels from metrics, and aggregates the metrics that
+// end up with the same labels by summing their values. The buckets of
+// histograms are summed as well, but quantiles of summaries cannot be merged so
+// only the count and sum of observations are kept on aggregated summaries.
+//
+// The metrics are returned in the order of the first metric of each group.
+func stripLabels(t dto.MetricType, metrics []*dto.Metric, labels map[string]struct{}) []*dto.Metric {
+	stripped := make([]*dto.Metric, 0, len(metrics))
+	groups := make(map[string]*dto.Metric, len(metrics))
+	b := &strings.Builder{}
+
+	for _, m := range metrics {
+		kept := make([]*dto.LabelPair, 0, len(m.Label))
+		b.Reset()
+
+		for _, p := range m.Label {
+			if _, strip := labels[p.GetName()]; !strip {
+				kept = append(kept, p)
+				b.WriteString(p.GetName())
+				b.WriteByte('=')
+				b.WriteString(p.GetValue())
+				b.WriteByte(0)
+			}
+		}
+
+		if g := groups[b.String()]; g != nil {
+			mergeMetric(t, g, m)
+			continue
+		}
+
+		g := copyMetric(t, m)
+		g.Label = kept
+		groups[b.String()] = g
+		stripped = append(stripped, g)
+	}
+
+	return stripped
+}
+
+// copyMetric returns a copy of the value of m, which the values of other
+// metrics can be merged into without modifying m.
+func copyMetric(t dto.MetricType, m *dto.Metric) *dto.Metric {
+	c := &dto.Metric{}
+
+	switch t {
+	case dto.MetricType_COUNTER:
+		c.Counter = &dto.Counter{Value: float64Ptr(m.GetCounter().GetValue())}
+
+	case dto.MetricType_GAUGE:
+		c.Gauge = &dto.Gauge{Value: float64Ptr(m.GetGauge().GetValue())}
+
+	case dto.MetricType_UNTYPED:
+		c.Untyped = &dto.Untyped{Value: float64Ptr(m.GetUntyped().GetValue())}
+
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		c.Histogram = &dto.Histogram{
+			SampleCount: uint64Ptr(h.GetSampleCount()),
+			SampleSum:   float64Ptr(h.GetSampleSum()),
+			Bucket:      make([]*dto.Bucket, len(h.Bucket)),
+		}
+		for i, b := range h.Bucket {
+			c.Histogram.Bucket[i] = &dto.Bucket{
+				CumulativeCount: uint64Ptr(b.GetCumulativeCount()),
+				UpperBound:      float64Ptr(b.GetUpperBound()),
+			}
+		}
+
+	case dto.MetricType_SUMMARY:
+		// The quantiles are kept until a metric is merged into the copy.
+		s := m.GetSummary()
+		c.Summary = &dto.Summary{
+			SampleCount: uint64Ptr(s.GetSampleCount()),
+			SampleSum:   float64Ptr(s.GetSampleSum()),
+			Quantile:    s.Quantile,
+		}
+	}
+
+	return c
+}
+
+// mergeMetric adds the value of m to the copy c.
+func mergeMetric(t dto.MetricType, c, m *dto.Metric) {
+	switch t {
+	case dto.MetricType_COUNTER:
+		*c.Counter.Value += m.GetCounter().GetValue()
+
+	case dto.MetricType_GAUGE:
+		*c.Gauge.Value += m.GetGauge().GetValue()
+
+	case dto.MetricType_UNTYPED:
+		*c.Untyped.Value += m.GetUntyped().GetValue()
+
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		*c.Histogram.SampleCount += h.GetSampleCount()
+		*c.Histogram.SampleSum += h.GetSampleSum()
+		// Metrics of the same family have the same buckets.
+		for i, b := range h.Bucket {
+			if i < len(c.Histogram.Bucket) {
+				*c.Histogram.Bucket[i].CumulativeCount += b.GetCumulativeCount()
+			}
+		}
+
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		*c.Summary.SampleCount += s.GetSampleCount()
+		*c.Summary.SampleSum += s.GetSampleSum()
+		c.Summary.Quantile = nil
+	}
+}
+
+func float64Ptr(v float64) *float64 { return &v }
+func uint64Ptr(v uint64) *uint64    { return &v }
@@ -0,0 +1,76 @@
+package dogstatsd
+
+import (
+	"reflect"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestStripLabels(t *testing.T) {
+	label := func(name, value string) *dto.LabelPair {
+		return &dto.LabelPair{Name: &name, Value: &value}
+	}
+
+	counter := func(value float64, labels ...*dto.LabelPair) *dto.Metric {
+		return &dto.Metric{Label: labels, Counter: &dto.Counter{Value: &value}}
+	}
+
+	metrics := []*dto.Metric{
+		counter(1, label("dc", "dc1"), label("name", "service-1")),
+		counter(2, label("dc", "dc2"), label("name", "service-1")),
+		counter(3, label("dc", "dc1"), label("name", "service-2")),
+	}
+
+	stripped := stripLabels(dto.MetricType_COUNTER, metrics, map[string]struct{}{"name": {}})
+	expected := []*dto.Metric{
+		counter(4, label("dc", "dc1")),
+		counter(2, label("dc", "dc2")),
+	}
+
+	if !reflect.DeepEqual(stripped, expected) {
+		t.Errorf("Unexpected stripped metrics:\n%v\n%v", expected, stripped)
+	}
+
+	// The metrics gathered from the registry are not modified.
+	if v := metrics[0].GetCounter().GetValue(); v != 1 {
+		t.Errorf("The value of the first metric was modified to %g", v)
+	}
+
+	histogram := func(count uint64, sum float64, buckets ...uint64) *dto.Metric {
+		h := &dto.Histogram{SampleCount: &count, SampleSum: &sum}
+		for i := range buckets {
+			h.Bucket = append(h.Bucket, &dto.Bucket{
+				CumulativeCount: &buckets[i],
+				UpperBound:      float64Ptr(float64(10 * (i + 1))),
+			})
+		}
+		return &dto.Metric{Label: []*dto.LabelPair{label("name", "service-1")}, Histogram: h}
+	}
+
+	stripped = stripLabels(dto.MetricType_HISTOGRAM, []*dto.Metric{
+		histogram(2, 15, 1, 2),
+		histogram(3, 40, 0, 3),
+	}, map[string]struct{}{"name": {}})
+	expected = []*dto.Metric{histogram(5, 55, 1, 5)}
+	expected[0].Label = []*dto.LabelPair{}
+
+	if !reflect.DeepEqual(stripped, expected) {
+		t.Errorf("Unexpected stripped histograms:\n%v\n%v", expected, stripped)
+	}
+
+	summary := func(count uint64, sum float64, quantiles ...*dto.Quantile) *dto.Metric {
+		return &dto.Metric{Summary: &dto.Summary{SampleCount: &count, SampleSum: &sum, Quantile: quantiles}}
+	}
+
+	stripped = stripLabels(dto.MetricType_SUMMARY, []*dto.Metric{
+		summary(1, 1, &dto.Quantile{Quantile: float64Ptr(0.5), Value: float64Ptr(1)}),
+		summary(2, 4, &dto.Quantile{Quantile: float64Ptr(0.5), Value: float64Ptr(2)}),
+	}, map[string]struct{}{"name": {}})
+	expected = []*dto.Metric{summary(3, 5)}
+	expected[0].Label = []*dto.LabelPair{}
+
+	if !reflect.DeepEqual(stripped, expected) {
+		t.Errorf("Unexpected stripped summaries:\n%v\n%v", expected, stripped)
+	}
+}